@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"os"
-	"strings"
 
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
 	"github.com/rogue-syntax/rs-goapiserver/authutil"
+	"github.com/rogue-syntax/rs-goapiserver/health"
+	"github.com/rogue-syntax/rs-goapiserver/logquery"
 	"github.com/rogue-syntax/rs-goapiserver/middleware"
 	"github.com/rogue-syntax/rs-goapiserver/observability"
 	"github.com/rogue-syntax/rs-goapiserver/routeroles"
@@ -24,62 +26,13 @@ func SetAdminRoutes() {
 		fmt.Fprint(w, pwHash)
 	}, &middleware.BlankMiddleware)
 
-	middleware.RouteHandler("/v1/errors/errLog", func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
-		data, _ := os.ReadFile("/var/logs/apiserver.log")
-		dstr := string(data)
-		dstrSli := strings.Split(dstr, "\n")
-		dStr := "["
-		for i, strs := range dstrSli {
-			if i != 0 || i != len(dstrSli)-1 {
-				dStr += strs + ","
-			}
+	middleware.RouteHandler("/v1/logs/query", logquery.Handler_QueryLogs, &middleware.RoleBaseReqVerifMiddleware)
 
-		}
-		dStr += "]"
+	middleware.RouteHandler("/v1/logs/timeline", logquery.Handler_GetTimeline, &middleware.RoleBaseReqVerifMiddleware)
 
-		//htmlStr := "<div>" + dStr + "</div>"
-		//htmlStr += "<script>let errorArray = " + dStr + "; console.log(errorArray[errorArray.length-2]);console.log(errorArray)</script>"
+	middleware.RouteHandler("/v1/errors/errLog", logquery.HandlerFor(logquery.ERROR_LOG), &middleware.RoleBaseReqVerifMiddleware)
 
-		htmlStr := "<div>" + dStr + "</div>"
-		htmlStr += "<script>let errorArray = " + dStr + ";"
-		htmlStr += "errorArray.forEach((err, i) => {"
-		htmlStr += "		try{ errorArray[i].context = JSON.parse(errorArray[i].error); }catch(e){};"
-		htmlStr += " }); console.log(errorArray[errorArray.length-2]);  console.log(errorArray)</script>"
-
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		fmt.Fprintf(w, htmlStr)
-
-	}, &middleware.BlankMiddleware)
-
-	middleware.RouteHandler("/v1/errors/reqLog", func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
-		data, _ := os.ReadFile("/var/logs/requestLogger.log")
-		fmt.Fprintf(w, string(data))
-		dstr := string(data)
-		dstrSli := strings.Split(dstr, "\n")
-		dStr := "["
-		for i, strs := range dstrSli {
-			if i != 0 || i != len(dstrSli)-1 {
-				dStr += strs + ","
-			}
-
-		}
-		dStr += "]"
-
-		//htmlStr := "<div>" + dStr + "</div>"
-		//htmlStr += "<script>let errorArray = " + dStr + "; console.log(errorArray[errorArray.length-2]);console.log(errorArray)</script>"
-
-		htmlStr := "<div>" + dStr + "</div>"
-		htmlStr += "<script>let logArray = " + dStr + ";"
-		//htmlStr += "function superParse( obj ){ Object.keys(obj).forEach( (key) =>{ success = false; try{ obj[key] = JSON.parse(obj[key]); success = true; }catch(e){}; if ( success === true ){ superParse(obj[key])}; })};"
-		//htmlStr += "logArray.forEach((err, i) => {"
-		//htmlStr += "		try{ logArray[i].context = JSON.parse(logArray[i].log); }catch(e){};"
-		//htmlStr += " }); console.log(logArray[logArray.length-2]);"
-		htmlStr += "console.log(logArray)</script>"
-
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		fmt.Fprintf(w, htmlStr)
-
-	}, &middleware.BlankMiddleware)
+	middleware.RouteHandler("/v1/errors/reqLog", logquery.HandlerFor(logquery.REQUEST_LOG), &middleware.RoleBaseReqVerifMiddleware)
 
 	middleware.RouteHandler("/v1/test/testPWVerificationEP", signup.TestPWVerifEP_handler, &middleware.BlankMiddleware)
 
@@ -89,4 +42,35 @@ func SetAdminRoutes() {
 
 	middleware.RouteHandler("/v1/observe/getUserSockets", observability.Handler_GetUserSockets, &middleware.RoleBaseReqVerifMiddleware)
 
+	observability.RegisterCollectors()
+	middleware.RouteHandler("/v1/observe/metrics", observability.Handler_Metrics, &middleware.RoleBaseReqVerifMiddleware)
+
+}
+
+// SetDiagnosticsRoutes
+//   - mounts the pprof, goroutine, heap, GC and runtime diagnostics, and the health check detail with errors,
+//     under observability.DIAGNOSTICS_PREFIX on mux
+//   - mux must be the Mux of the internal admin mainserver.Server, http.DefaultServeMux is refused since mainserver.Serve
+//     serves the public api from it
+//   - allow: checked before role permissions, nil to rely on role permissions alone
+func SetDiagnosticsRoutes(mux *http.ServeMux, allow *middleware.IPAllowList) error {
+	if mux == nil || mux == http.DefaultServeMux {
+		return errors.New(apierrorkeys.RouteDefError + ": diagnostics are only served on the admin listener's mux")
+	}
+	diagnostics := middleware.NewRouteGroup(observability.DIAGNOSTICS_PREFIX)
+	if allow != nil {
+		diagnostics.Use(allow)
+	}
+	diagnostics.UseList(&middleware.RoleBaseReqVerifMiddleware)
+	get := []string{http.MethodGet}
+	diagnostics.Route(
+		middleware.RouteDef{RouteStr: "/pprof", HandlerFunc: observability.Handler_PprofIndex, Methods: get},
+		middleware.RouteDef{RouteStr: "/pprof/{name}", HandlerFunc: observability.Handler_Pprof, Methods: get},
+		middleware.RouteDef{RouteStr: "/goroutines", HandlerFunc: observability.Handler_Goroutines, Methods: get},
+		middleware.RouteDef{RouteStr: "/heap", HandlerFunc: observability.Handler_HeapStats, Methods: get},
+		middleware.RouteDef{RouteStr: "/gc", HandlerFunc: observability.Handler_GCStats, Methods: get},
+		middleware.RouteDef{RouteStr: "/runtime", HandlerFunc: observability.Handler_RuntimeSummary, Methods: get},
+		middleware.RouteDef{RouteStr: "/health", HandlerFunc: health.Handler_HealthDetail, Methods: get},
+	)
+	return diagnostics.Register(mux, "diagnostics")
 }
@@ -43,6 +43,38 @@ func CtxGetUser(ctx context.Context) (*user.UserExternal, error) {
 	return user, nil
 }
 
+// path parameters extracted from a RouteDef path template like "/v1/users/{id}/sessions"
+type pathParamsKeyType string
+
+const pathParamsKey pathParamsKeyType = "pathParams"
+
+func CtxWithPathParams(ctx context.Context, params map[string]string) context.Context {
+	return context.WithValue(ctx, pathParamsKey, params)
+}
+func CtxGetPathParams(ctx context.Context) (map[string]string, error) {
+	params, ok := ctx.Value(pathParamsKey).(map[string]string)
+	if !ok {
+		err := errors.New(apierrorkeys.ContextError)
+		return nil, err
+	}
+	return params, nil
+}
+
+// CtxGetPathParam
+//   - get a single path parameter by name, i.e. id, err := apicontext.CtxGetPathParam(ctx, "id")
+func CtxGetPathParam(ctx context.Context, name string) (string, error) {
+	params, err := CtxGetPathParams(ctx)
+	if err != nil {
+		return "", err
+	}
+	val, ok := params[name]
+	if !ok {
+		err := errors.New(apierrorkeys.MapKeyNotFound)
+		return "", err
+	}
+	return val, nil
+}
+
 //MAKE THIS FOR ISSUER
 /*
 type issuerKeyType string
@@ -1,11 +1,13 @@
 package apierrors
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 
 	"github.com/pkg/errors"
 	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorcatalog"
 	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
 	"github.com/rogue-syntax/rs-goapiserver/rs_go_requestlogger"
 	"github.com/rogue-syntax/rs-goapiserver/zerologger"
@@ -75,10 +77,87 @@ reqError:ReqError is:
 	}
 }*/
 
+// ReturnError
+//   - what HandleError returns to the client, Status overrides the status apireturn.StatusRegistry gives Msg
 type ReturnError struct {
-	Msg  string
+	Msg    string
+	Data   interface{}
+	Status int
+	W      *http.ResponseWriter
+}
+
+// LocalizeErrors
+//   - when true HandleError adds the apierrorcatalog message for Msg in the locale of the request's Accept-Language
+//   - off by default so existing responses are unchanged
+var LocalizeErrors = false
+
+// KeyedError
+//   - an error that carries the apierrorkeys key and data to return to the client
+//   - i.e. return out, apierrors.NewKeyedError(apierrorkeys.EmailTaken, nil, err) from a middleware.Typed handler
+type KeyedError struct {
+	Key  string
 	Data interface{}
-	W    *http.ResponseWriter
+	Err  error
+}
+
+func NewKeyedError(key string, data interface{}, err error) *KeyedError {
+	return &KeyedError{Key: key, Data: data, Err: err}
+}
+
+func (ke *KeyedError) Error() string {
+	if ke.Err == nil {
+		return ke.Key
+	}
+	return ke.Key + ": " + ke.Err.Error()
+}
+
+func (ke *KeyedError) Unwrap() error {
+	return ke.Err
+}
+
+// ReqIder
+//   - an error that carries the Req_id of the request it happened under, see WithReqId
+//   - rs_ev_src action errors implement it, so HandleError logs them with the Req_id of their event
+type ReqIder interface {
+	ReqId() string
+}
+
+// reqIdError attaches a Req_id to an error
+type reqIdError struct {
+	err    error
+	req_id string
+}
+
+func (re *reqIdError) Error() string { return re.err.Error() }
+func (re *reqIdError) Unwrap() error { return re.err }
+func (re *reqIdError) ReqId() string { return re.req_id }
+
+// WithReqId attaches req_id to err for HandleError callers without the *http.Request, nil err or empty req_id return err
+func WithReqId(err error, req_id string) error {
+	if err == nil || req_id == "" {
+		return err
+	}
+	return &reqIdError{err: err, req_id: req_id}
+}
+
+// WithCtxReqId is WithReqId with the Req_id of a request context, i.e. the ctx handed to a handler
+func WithCtxReqId(ctx context.Context, err error) error {
+	req_id, _ := rs_go_requestlogger.CtxGetReqId(ctx)
+	return WithReqId(err, req_id)
+}
+
+// ReqIdOf is the Req_id of r's context, else the first Req_id in err's chain, else empty
+func ReqIdOf(r *http.Request, err error) string {
+	if r != nil {
+		if req_id, _ := rs_go_requestlogger.CtxGetReqId(r.Context()); req_id != "" {
+			return req_id
+		}
+	}
+	var rid ReqIder
+	if errors.As(err, &rid) {
+		return rid.ReqId()
+	}
+	return ""
 }
 
 type LogError struct {
@@ -193,8 +272,9 @@ func (rlh *ErrorLogHandler) Stream(err error, msg string, jsonError string, r *h
 }
 
 func (rlh *ErrorLogHandler) Write(err error, msg string, r *http.Request) string {
+	req_id := ReqIdOf(r, err)
 	err = errors.WithStack(err)
-	return zerologger.LogError(&err, msg, nil)
+	return zerologger.LogErrorReqId(&err, msg, req_id)
 }
 
 type RequestLogImpl struct {
@@ -246,14 +326,19 @@ func HandleError(r *http.Request, err error, msg string, returnError *ReturnErro
 	ErrorLogCallbacks.ErrorHandlerImpl.Stream(err, msg, errorStr, r)
 
 	if r != nil {
-		rsLog, _ := rs_go_requestlogger.CtxGetRSLogger(r.Context())
-		rsLog.ErrorLogs = append(rsLog.ErrorLogs, err.Error())
-		ctx := rs_go_requestlogger.CtxWithRSLogger(r.Context(), rsLog)
-		r.WithContext(ctx)
+		if rsLog, _ := rs_go_requestlogger.CtxGetRSLogger(r.Context()); rsLog != nil {
+			rsLog.ErrorLogs = append(rsLog.ErrorLogs, err.Error())
+			ctx := rs_go_requestlogger.CtxWithRSLogger(r.Context(), rsLog)
+			r.WithContext(ctx)
+		}
 	}
 
 	if returnError != nil {
-		apireturn.ApiJSONReturn(returnError.Data, returnError.Msg, returnError.W)
+		opts := apireturn.ReturnOptions{Status: returnError.Status}
+		if LocalizeErrors && r != nil {
+			opts.Message, _ = apierrorcatalog.Message(returnError.Msg, r.Header.Get("Accept-Language"))
+		}
+		apireturn.ApiJSONReturnWith(returnError.Data, returnError.Msg, opts, returnError.W)
 	}
 }
 
@@ -0,0 +1,512 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/apivalidate"
+	"github.com/rogue-syntax/rs-goapiserver/authutil"
+	"github.com/rogue-syntax/rs-goapiserver/database"
+)
+
+// Named api keys
+/*
+
+	A user may hold several api keys, one per integration, each with a Label, Scopes, an optional expiry and a
+	last used time. A key is sent in the kbxa header with auth-mode=a as
+
+	  kbxk_<Key_id>.<secret>
+
+	The Key_id finds the key, so no user-id header is needed. Only the sha512 of the secret is stored, the whole
+	key is returned once by Create and Rotate and can not be read back. So is the key's signing secret for signed
+	requests, which is stored encrypted, see signing.go.
+
+	Scopes narrow the routes a key may call, a key needs at least one:
+	  - "*": every route the user may call
+	  - a route template i.e. "/v1/app/testReqVerif", or a prefix ending in /* i.e. "/v1/reports/*"
+	  - a permission name from Permissions i.e. "apikeys", a named list of route scopes
+	Scopes never widen what the user may do, RoleBaseReqVerif still checks the user's role.
+
+	Rotate issues a new key with the Label, Scopes and expiry of the old one and expires the old one after a grace
+	period, so an integration can switch over without downtime. Revoke stops a key at once.
+
+	A kbxa key without the kbxk_ prefix is the legacy user_api_tok from /v1/test/genApiKey, sent with the user-id header.
+
+	The table is in apikeys.sql, the endpoints in handlers.go.
+
+*/
+
+const (
+	KEY_PREFIX = "kbxk_"
+	SCOPE_ALL  = "*"
+
+	MAX_ACTIVE_KEYS    = 50
+	MAX_LABEL_LENGTH   = 100
+	MAX_ROTATION_GRACE = 7 * 24 * time.Hour
+
+	keyIdBytes = 8
+)
+
+// LastUsedResolution: Last_used_at is only written when it is older than this, so a busy key is not an UPDATE per request
+var LastUsedResolution = time.Minute
+
+// Permissions maps permission scopes to the route scopes they grant, see the top of this file
+var Permissions = map[string][]string{
+	"apikeys": {ROUTE_PREFIX + "/*"},
+}
+
+func SetPermissions(permissions map[string][]string) {
+	Permissions = permissions
+}
+
+// Scopes: stored as a JSON array
+type Scopes []string
+
+func (s Scopes) Value() (driver.Value, error) {
+	if s == nil {
+		s = Scopes{}
+	}
+	return json.Marshal(s)
+}
+
+func (s *Scopes) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, s)
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	}
+	return errors.Errorf("apikeys: can not scan %T into Scopes", src)
+}
+
+// ApiKey
+//   - a row of user_api_key, Secret_hash and Signing_secret_enc are never returned to the client
+//   - Signing_secret_enc: the sealed signing secret, nil for a key made while request signing was off
+//   - Rotated_from: the Key_id this key replaced with Rotate
+type ApiKey struct {
+	Key_id             string
+	User_id            int
+	Label              string
+	Secret_hash        string  `json:"-"`
+	Signing_secret_enc *string `json:"-"`
+	Scopes             Scopes
+	Created_at         time.Time
+	Last_used_at       *time.Time
+	Expires_at         *time.Time
+	Revoked_at         *time.Time
+	Rotated_from       *string
+}
+
+// Active reports whether k is neither revoked nor expired at now
+func (k *ApiKey) Active(now time.Time) bool {
+	if k.Revoked_at != nil {
+		return false
+	}
+	return k.Expires_at == nil || now.Before(*k.Expires_at)
+}
+
+// Allows reports whether one of k's Scopes covers routeString, the RouteStr the request matched
+func (k *ApiKey) Allows(routeString string) bool {
+	for _, scope := range k.Scopes {
+		if scope == SCOPE_ALL {
+			return true
+		}
+		if strings.HasPrefix(scope, "/") {
+			if routeMatches(scope, routeString) {
+				return true
+			}
+			continue
+		}
+		for _, route := range Permissions[scope] {
+			if routeMatches(route, routeString) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// covers reports whether a caller holding k may hand out scopes, a key can not mint a key wider than itself
+func (k *ApiKey) covers(scopes []string) bool {
+	held := make(map[string]bool, len(k.Scopes))
+	for _, scope := range k.Scopes {
+		if scope == SCOPE_ALL {
+			return true
+		}
+		held[scope] = true
+	}
+	for _, scope := range scopes {
+		if !held[scope] {
+			return false
+		}
+	}
+	return true
+}
+
+// routeMatches: scope is a route template, or a prefix ending in /* that also matches the prefix itself
+func routeMatches(scope string, routeString string) bool {
+	if prefix, ok := strings.CutSuffix(scope, "/*"); ok {
+		return routeString == prefix || strings.HasPrefix(routeString, prefix+"/")
+	}
+	return scope == routeString
+}
+
+// NormalizeScopes trims and dedupes scopes, and checks each is SCOPE_ALL, a route or a permission in Permissions
+func NormalizeScopes(scopes []string) ([]string, error) {
+	var out []string
+	var violations []apivalidate.FieldViolation
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		if scope == "" || seen[scope] {
+			continue
+		}
+		seen[scope] = true
+		_, isPermission := Permissions[scope]
+		if scope != SCOPE_ALL && !strings.HasPrefix(scope, "/") && !isPermission {
+			violations = append(violations, apivalidate.FieldViolation{Field: "scopes", Rule: "scope", Msg: "unknown scope " + scope})
+			continue
+		}
+		out = append(out, scope)
+	}
+	if len(out) == 0 && len(violations) == 0 {
+		violations = append(violations, apivalidate.FieldViolation{Field: "scopes", Rule: "required", Msg: "at least one scope is required"})
+	}
+	if len(violations) > 0 {
+		return nil, &apivalidate.ValidationError{Violations: violations}
+	}
+	return out, nil
+}
+
+// FormatKey is the kbxa value for a key id and hex secret
+func FormatKey(key_id string, secret string) string {
+	return KEY_PREFIX + key_id + "." + secret
+}
+
+// ParseKey splits a kbxa value made by FormatKey, ok is false for anything else i.e. a legacy user_api_tok
+func ParseKey(raw string) (key_id string, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(raw, KEY_PREFIX)
+	if !ok {
+		return "", "", false
+	}
+	key_id, secret, ok = strings.Cut(rest, ".")
+	if !ok || len(key_id) != 2*keyIdBytes || secret == "" {
+		return "", "", false
+	}
+	return key_id, secret, true
+}
+
+// IsKey reports whether raw has the named key prefix
+func IsKey(raw string) bool {
+	return strings.HasPrefix(raw, KEY_PREFIX)
+}
+
+// a verified key context object, set by authentication.VerifyWithApi
+type keyCtxType string
+
+const keyCtxKey keyCtxType = "apiKey"
+
+func CtxWithKey(ctx context.Context, k *ApiKey) context.Context {
+	return context.WithValue(ctx, keyCtxKey, k)
+}
+
+// CtxGetKey is the key the request was authenticated with, an error if it was not authenticated with a named key
+func CtxGetKey(ctx context.Context) (*ApiKey, error) {
+	k, ok := ctx.Value(keyCtxKey).(*ApiKey)
+	if !ok || k == nil {
+		return nil, errors.New(apierrorkeys.ContextError)
+	}
+	return k, nil
+}
+
+// Verify
+//   - checks a kbxa value made by FormatKey against its stored hash, then its revocation, expiry and Scopes for routeString
+//   - the secret is checked first so a wrong secret can not learn whether a key id expired
+//   - errors start with APIKeyNotFound, AuthorizationError, APIKeyExpired or APIKeyScopeDenied
+func Verify(ctx context.Context, raw string, routeString string) (*ApiKey, error) {
+	key_id, secret, ok := ParseKey(raw)
+	if !ok {
+		return nil, errors.New(apierrorkeys.APIKeyNotFound)
+	}
+	k, err := lookup(ctx, key_id)
+	if err != nil {
+		return nil, err
+	}
+	secretBytes, err := hex.DecodeString(secret)
+	if err != nil {
+		return nil, errors.New(apierrorkeys.AuthorizationError)
+	}
+	hash := authutil.HashTokenBytes(secretBytes)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(k.Secret_hash)) != 1 {
+		return nil, errors.New(apierrorkeys.AuthorizationError)
+	}
+	if err := authorize(ctx, k, routeString); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// findKey is FindByKey_idContext, a var so tests can look keys up without a database
+var findKey = FindByKey_idContext
+
+// lookup finds key_id for Verify and VerifySignature, a missing key is APIKeyNotFound
+func lookup(ctx context.Context, key_id string) (*ApiKey, error) {
+	k, err := findKey(ctx, key_id)
+	if err == sql.ErrNoRows {
+		return nil, errors.New(apierrorkeys.APIKeyNotFound)
+	}
+	return k, err
+}
+
+// authorize checks an authenticated k's revocation, expiry and Scopes for routeString, and touches it
+func authorize(ctx context.Context, k *ApiKey, routeString string) error {
+	now := time.Now().UTC()
+	if !k.Active(now) {
+		return errors.New(apierrorkeys.APIKeyExpired + ": " + k.Key_id)
+	}
+	if !k.Allows(routeString) {
+		return errors.New(apierrorkeys.APIKeyScopeDenied + ": " + k.Key_id + " may not call " + routeString)
+	}
+	touch(ctx, k, now)
+	return nil
+}
+
+// touch sets Last_used_at at most once per LastUsedResolution, a failed write does not fail the request
+func touch(ctx context.Context, k *ApiKey, now time.Time) {
+	if k.Last_used_at != nil && now.Sub(*k.Last_used_at) < LastUsedResolution {
+		return
+	}
+	_, err := database.DB.ExecContext(ctx,
+		"UPDATE user_api_key SET last_used_at = ? WHERE key_id = ? AND (last_used_at IS NULL OR last_used_at < ?)",
+		now, k.Key_id, now.Add(-LastUsedResolution))
+	if err == nil {
+		k.Last_used_at = &now
+	}
+}
+
+func FindByKey_id(key_id string) (*ApiKey, error) {
+	return FindByKey_idContext(context.Background(), key_id)
+}
+
+func FindByKey_idContext(ctx context.Context, key_id string) (*ApiKey, error) {
+	var k ApiKey
+	err := database.DB.GetContext(ctx, &k, "SELECT * FROM user_api_key WHERE key_id = ?", key_id)
+	return &k, err
+}
+
+// ListByUser_idContext lists a user's keys newest first, revoked and expired ones included
+func ListByUser_idContext(ctx context.Context, user_id int) ([]ApiKey, error) {
+	keys := []ApiKey{}
+	err := database.DB.SelectContext(ctx, &keys, "SELECT * FROM user_api_key WHERE user_id = ? ORDER BY created_at DESC", user_id)
+	return keys, err
+}
+
+// NewKey
+//   - what Create and Rotate store, Expires_at nil for a key that does not expire
+type NewKey struct {
+	Label      string
+	Scopes     []string
+	Expires_at *time.Time
+}
+
+// Secrets: the kbxa value and the signing secret of a new key, Signing_secret is empty while request signing is off
+type Secrets struct {
+	ApiKey         string
+	Signing_secret string
+}
+
+// Create stores a new key for user_id and returns it with its Secrets, the only time they are available
+func Create(ctx context.Context, user_id int, nk NewKey) (*ApiKey, Secrets, error) {
+	tx, err := database.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	defer tx.Rollback()
+	var active int
+	err = tx.GetContext(ctx, &active,
+		"SELECT COUNT(*) FROM user_api_key WHERE user_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?) FOR UPDATE",
+		user_id, time.Now().UTC())
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	if active >= MAX_ACTIVE_KEYS {
+		return nil, Secrets{}, apierrors.NewKeyedError(apierrorkeys.InvalidAPIInput,
+			"a user may hold at most "+strconv.Itoa(MAX_ACTIVE_KEYS)+" active api keys, revoke one first", nil)
+	}
+	k, secrets, err := insert(ctx, tx, user_id, nk, nil)
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	return k, secrets, tx.Commit()
+}
+
+// insert validates nk and stores it as a new key
+func insert(ctx context.Context, tx *sqlx.Tx, user_id int, nk NewKey, rotated_from *string) (*ApiKey, Secrets, error) {
+	scopes, err := NormalizeScopes(nk.Scopes)
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	label := strings.TrimSpace(nk.Label)
+	now := time.Now().UTC()
+	var violations []apivalidate.FieldViolation
+	if label == "" || utf8.RuneCountInString(label) > MAX_LABEL_LENGTH {
+		violations = append(violations, apivalidate.FieldViolation{Field: "label", Rule: "max", Msg: "label must be 1 to 100 characters"})
+	}
+	if nk.Expires_at != nil && !nk.Expires_at.After(now) {
+		violations = append(violations, apivalidate.FieldViolation{Field: "expires_at", Rule: "future", Msg: "expires_at must be in the future"})
+	}
+	if len(violations) > 0 {
+		return nil, Secrets{}, &apivalidate.ValidationError{Violations: violations}
+	}
+
+	idBytes := make([]byte, keyIdBytes)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, Secrets{}, err
+	}
+	secret, secretBytes, err := authutil.MakeAuthToken()
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	key_id := hex.EncodeToString(idBytes)
+	signingSecret, signingSecretEnc, err := newSigningSecret(key_id)
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	k := &ApiKey{
+		Key_id:             key_id,
+		User_id:            user_id,
+		Label:              label,
+		Secret_hash:        authutil.HashTokenBytes(secretBytes),
+		Signing_secret_enc: signingSecretEnc,
+		Scopes:             scopes,
+		Created_at:         now,
+		Rotated_from:       rotated_from,
+	}
+	if nk.Expires_at != nil {
+		expires := nk.Expires_at.UTC()
+		k.Expires_at = &expires
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_api_key (key_id, user_id, label, secret_hash, signing_secret_enc, scopes, created_at, expires_at, rotated_from)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.Key_id, k.User_id, k.Label, k.Secret_hash, k.Signing_secret_enc, k.Scopes, k.Created_at, k.Expires_at, k.Rotated_from)
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	secrets := Secrets{ApiKey: FormatKey(k.Key_id, secret)}
+	if signingSecret != nil {
+		secrets.Signing_secret = *signingSecret
+	}
+	return k, secrets, nil
+}
+
+// findOwned locks and returns key_id if user_id owns it, a missing key and another user's key are the same error
+func findOwned(ctx context.Context, tx *sqlx.Tx, user_id int, key_id string) (*ApiKey, error) {
+	var k ApiKey
+	err := tx.GetContext(ctx, &k, "SELECT * FROM user_api_key WHERE key_id = ? FOR UPDATE", key_id)
+	if err == sql.ErrNoRows || (err == nil && k.User_id != user_id) {
+		return nil, apierrors.NewKeyedError(apierrorkeys.ResourceOwnershipMismatch, nil, errors.New("api key "+key_id))
+	}
+	return &k, err
+}
+
+// Revoke stops user_id's key at once, revoking a revoked key keeps its first Revoked_at
+func Revoke(ctx context.Context, user_id int, key_id string) (*ApiKey, error) {
+	tx, err := database.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	k, err := findOwned(ctx, tx, user_id, key_id)
+	if err != nil {
+		return nil, err
+	}
+	if k.Revoked_at == nil {
+		now := time.Now().UTC()
+		_, err = tx.ExecContext(ctx, "UPDATE user_api_key SET revoked_at = ? WHERE key_id = ?", now, key_id)
+		if err != nil {
+			return nil, err
+		}
+		k.Revoked_at = &now
+	}
+	return k, tx.Commit()
+}
+
+// Rotate
+//   - issues a new key with the Label, Scopes and Expires_at of user_id's key_id, and returns it with its Secrets
+//   - the old key stops after grace, at once if grace is 0, and never later than its own Expires_at
+//   - a revoked or expired key can not be rotated, Create a new one
+func Rotate(ctx context.Context, user_id int, key_id string, grace time.Duration) (*ApiKey, Secrets, error) {
+	if grace < 0 || grace > MAX_ROTATION_GRACE {
+		return nil, Secrets{}, &apivalidate.ValidationError{Violations: []apivalidate.FieldViolation{
+			{Field: "grace_seconds", Rule: "max", Msg: "grace must be between 0 and " + MAX_ROTATION_GRACE.String()},
+		}}
+	}
+	tx, err := database.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	defer tx.Rollback()
+	old, err := findOwned(ctx, tx, user_id, key_id)
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	now := time.Now().UTC()
+	if !old.Active(now) {
+		return nil, Secrets{}, apierrors.NewKeyedError(apierrorkeys.APIKeyExpired, nil, errors.New("api key "+key_id))
+	}
+	k, secrets, err := insert(ctx, tx, user_id, NewKey{Label: old.Label, Scopes: old.Scopes, Expires_at: old.Expires_at}, &old.Key_id)
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	if grace == 0 {
+		_, err = tx.ExecContext(ctx, "UPDATE user_api_key SET revoked_at = ? WHERE key_id = ?", now, key_id)
+	} else {
+		stop := now.Add(grace)
+		if old.Expires_at != nil && old.Expires_at.Before(stop) {
+			stop = *old.Expires_at
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE user_api_key SET expires_at = ? WHERE key_id = ?", stop, key_id)
+	}
+	if err != nil {
+		return nil, Secrets{}, err
+	}
+	return k, secrets, tx.Commit()
+}
+
+var SQL string = `
+CREATE TABLE user_api_key (
+	key_id CHAR(16) NOT NULL,
+	user_id INT NOT NULL,
+	label VARCHAR(100) NOT NULL,
+	secret_hash CHAR(128) NOT NULL,
+	signing_secret_enc VARCHAR(255) NULL,
+	scopes JSON NOT NULL,
+	created_at DATETIME(6) NOT NULL,
+	last_used_at DATETIME(6) NULL,
+	expires_at DATETIME(6) NULL,
+	revoked_at DATETIME(6) NULL,
+	rotated_from CHAR(16) NULL,
+  PRIMARY KEY (key_id),
+  KEY user_id (user_id)
+) ENGINE = INNODB,
+  CHARACTER SET utf8mb4,
+  COLLATE utf8mb4_general_ci;
+`
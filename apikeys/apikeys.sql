@@ -0,0 +1,17 @@
+CREATE TABLE user_api_key (
+	key_id CHAR(16) NOT NULL,
+	user_id INT NOT NULL,
+	label VARCHAR(100) NOT NULL,
+	secret_hash CHAR(128) NOT NULL,
+	signing_secret_enc VARCHAR(255) NULL,
+	scopes JSON NOT NULL,
+	created_at DATETIME(6) NOT NULL,
+	last_used_at DATETIME(6) NULL,
+	expires_at DATETIME(6) NULL,
+	revoked_at DATETIME(6) NULL,
+	rotated_from CHAR(16) NULL,
+  PRIMARY KEY (key_id),
+  KEY user_id (user_id)
+) ENGINE = INNODB,
+  CHARACTER SET utf8mb4,
+  COLLATE utf8mb4_general_ci;
@@ -0,0 +1,257 @@
+package apikeys
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogue-syntax/rs-goapiserver/apicontext"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/apivalidate"
+	"github.com/rogue-syntax/rs-goapiserver/authutil"
+	"github.com/rogue-syntax/rs-goapiserver/entities/user"
+)
+
+func TestAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes []string
+		route  string
+		want   bool
+	}{
+		{"all", []string{SCOPE_ALL}, "/v1/anything", true},
+		{"exact route", []string{"/v1/app/testReqVerif"}, "/v1/app/testReqVerif", true},
+		{"other route", []string{"/v1/app/testReqVerif"}, "/v1/app/signOut", false},
+		{"prefix matches itself", []string{"/v1/reports/*"}, "/v1/reports", true},
+		{"prefix matches below", []string{"/v1/reports/*"}, "/v1/reports/{id}/pdf", true},
+		{"prefix is not a string prefix", []string{"/v1/reports/*"}, "/v1/reportsx", false},
+		{"permission", []string{"apikeys"}, ROUTE_REVOKE, true},
+		{"permission root", []string{"apikeys"}, ROUTE_PREFIX, true},
+		{"permission other route", []string{"apikeys"}, "/v1/app/signOut", false},
+		{"unknown permission", []string{"nope"}, ROUTE_PREFIX, false},
+		{"no scopes", nil, ROUTE_PREFIX, false},
+		{"second scope", []string{"/v1/a", "/v1/b"}, "/v1/b", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &ApiKey{Scopes: tt.scopes}
+			if got := k.Allows(tt.route); got != tt.want {
+				t.Errorf("Allows(%q) with %v = %v, want %v", tt.route, tt.scopes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		name   string
+		held   []string
+		issued []string
+		want   bool
+	}{
+		{"all covers anything", []string{SCOPE_ALL}, []string{"/v1/a", "apikeys"}, true},
+		{"same scopes", []string{"/v1/a", "apikeys"}, []string{"apikeys"}, true},
+		{"nothing issued", []string{"/v1/a"}, nil, true},
+		{"wider scope", []string{"/v1/a"}, []string{"/v1/a", "/v1/b"}, false},
+		{"all is wider", []string{"/v1/a"}, []string{SCOPE_ALL}, false},
+		{"prefix does not cover a route under it", []string{"/v1/reports/*"}, []string{"/v1/reports/x"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &ApiKey{Scopes: tt.held}
+			if got := k.covers(tt.issued); got != tt.want {
+				t.Errorf("covers(%v) with %v = %v, want %v", tt.issued, tt.held, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []string
+		want    []string
+		wantErr bool
+	}{
+		{"trims and dedupes", []string{" /v1/a ", "/v1/a", "apikeys"}, []string{"/v1/a", "apikeys"}, false},
+		{"all", []string{SCOPE_ALL}, []string{SCOPE_ALL}, false},
+		{"unknown permission", []string{"/v1/a", "nope"}, nil, true},
+		{"empty", []string{" ", ""}, nil, true},
+		{"none", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeScopes(tt.scopes)
+			if tt.wantErr {
+				if _, ok := err.(*apivalidate.ValidationError); !ok {
+					t.Fatalf("NormalizeScopes(%v) error = %v, want a ValidationError", tt.scopes, err)
+				}
+				return
+			}
+			if err != nil || strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("NormalizeScopes(%v) = %v, %v, want %v", tt.scopes, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key_id := strings.Repeat("a", 2*keyIdBytes)
+	tests := []struct {
+		name       string
+		raw        string
+		wantKey_id string
+		wantSecret string
+		wantOk     bool
+	}{
+		{"formatted", FormatKey(key_id, "beef"), key_id, "beef", true},
+		{"legacy key", "beef", "", "", false},
+		{"no secret", KEY_PREFIX + key_id + ".", "", "", false},
+		{"no dot", KEY_PREFIX + key_id, "", "", false},
+		{"short key id", KEY_PREFIX + "abc.beef", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key_id, secret, ok := ParseKey(tt.raw)
+			if key_id != tt.wantKey_id || secret != tt.wantSecret || ok != tt.wantOk {
+				t.Errorf("ParseKey(%q) = %q, %q, %v", tt.raw, key_id, secret, ok)
+			}
+		})
+	}
+}
+
+func TestActive(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+	tests := []struct {
+		name string
+		k    ApiKey
+		want bool
+	}{
+		{"no expiry", ApiKey{}, true},
+		{"expires later", ApiKey{Expires_at: &future}, true},
+		{"expired", ApiKey{Expires_at: &past}, false},
+		{"expires now", ApiKey{Expires_at: &now}, false},
+		{"revoked", ApiKey{Revoked_at: &past, Expires_at: &future}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.k.Active(now); got != tt.want {
+				t.Errorf("Active = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeKeys swaps findKey for a lookup in keys until the test ends
+func fakeKeys(t *testing.T, keys ...*ApiKey) {
+	byId := make(map[string]*ApiKey)
+	for _, k := range keys {
+		// a fresh Last_used_at keeps touch from writing to the database
+		now := time.Now().UTC()
+		k.Last_used_at = &now
+		byId[k.Key_id] = k
+	}
+	prev := findKey
+	findKey = func(ctx context.Context, key_id string) (*ApiKey, error) {
+		if k, ok := byId[key_id]; ok {
+			copied := *k
+			return &copied, nil
+		}
+		return &ApiKey{}, sql.ErrNoRows
+	}
+	t.Cleanup(func() { findKey = prev })
+}
+
+func TestVerify(t *testing.T) {
+	secret, secretBytes, err := authutil.MakeAuthToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	active := &ApiKey{Key_id: strings.Repeat("1", 2*keyIdBytes), Secret_hash: authutil.HashTokenBytes(secretBytes), Scopes: Scopes{"/v1/a"}}
+	expired := &ApiKey{Key_id: strings.Repeat("2", 2*keyIdBytes), Secret_hash: authutil.HashTokenBytes(secretBytes), Scopes: Scopes{"/v1/a"}, Expires_at: &past}
+	fakeKeys(t, active, expired)
+
+	tests := []struct {
+		name    string
+		raw     string
+		route   string
+		wantErr string
+	}{
+		{"valid", FormatKey(active.Key_id, secret), "/v1/a", ""},
+		{"out of scope", FormatKey(active.Key_id, secret), "/v1/b", apierrorkeys.APIKeyScopeDenied},
+		{"wrong secret", FormatKey(active.Key_id, strings.Repeat("0", len(secret))), "/v1/a", apierrorkeys.AuthorizationError},
+		{"secret not hex", FormatKey(active.Key_id, "zz"), "/v1/a", apierrorkeys.AuthorizationError},
+		{"expired", FormatKey(expired.Key_id, secret), "/v1/a", apierrorkeys.APIKeyExpired},
+		{"unknown key", FormatKey(strings.Repeat("3", 2*keyIdBytes), secret), "/v1/a", apierrorkeys.APIKeyNotFound},
+		{"not a named key", secret, "/v1/a", apierrorkeys.APIKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := Verify(context.Background(), tt.raw, tt.route)
+			if tt.wantErr == "" {
+				if err != nil || k == nil || k.Key_id != active.Key_id {
+					t.Fatalf("Verify = %v, %v", k, err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Fatalf("Verify error = %v, want %s", err, tt.wantErr)
+			}
+			if k != nil {
+				t.Errorf("Verify returned a key with an error")
+			}
+		})
+	}
+}
+
+func TestCallerMayManage(t *testing.T) {
+	narrow := &ApiKey{Key_id: strings.Repeat("1", 2*keyIdBytes), User_id: 7, Scopes: Scopes{ROUTE_REVOKE}}
+	wide := &ApiKey{Key_id: strings.Repeat("2", 2*keyIdBytes), User_id: 7, Scopes: Scopes{SCOPE_ALL}}
+	other := &ApiKey{Key_id: strings.Repeat("3", 2*keyIdBytes), User_id: 8, Scopes: Scopes{SCOPE_ALL}}
+	fakeKeys(t, narrow, wide, other)
+
+	tests := []struct {
+		name    string
+		caller  *ApiKey
+		target  string
+		wantErr bool
+	}{
+		{"session caller", nil, wide.Key_id, false},
+		{"narrow key on itself", narrow, narrow.Key_id, false},
+		{"narrow key on a wider key", narrow, wide.Key_id, true},
+		{"wide key on a narrow key", wide, narrow.Key_id, false},
+		// another user's key is not found by Revoke and Rotate, it is not a scope error
+		{"key of another user", narrow, other.Key_id, false},
+		{"unknown key", narrow, strings.Repeat("4", 2*keyIdBytes), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.caller != nil {
+				ctx = CtxWithKey(ctx, tt.caller)
+			}
+			err := callerMayManage(ctx, 7, tt.target, "revoke")
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("callerMayManage error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.HasPrefix(err.Error(), apierrorkeys.APIKeyScopeDenied) {
+				t.Errorf("callerMayManage error = %v, want %s", err, apierrorkeys.APIKeyScopeDenied)
+			}
+		})
+	}
+}
+
+func TestRevokeKeyScope(t *testing.T) {
+	narrow := &ApiKey{Key_id: strings.Repeat("1", 2*keyIdBytes), User_id: 7, Scopes: Scopes{ROUTE_REVOKE}}
+	wide := &ApiKey{Key_id: strings.Repeat("2", 2*keyIdBytes), User_id: 7, Scopes: Scopes{SCOPE_ALL}}
+	fakeKeys(t, narrow, wide)
+	ctx := apicontext.CtxWithUser(CtxWithKey(context.Background(), narrow), &user.UserExternal{User_id: 7})
+	_, err := RevokeKey(ctx, KeyIdInput{Key_id: wide.Key_id})
+	if err == nil || !strings.HasPrefix(err.Error(), apierrorkeys.APIKeyScopeDenied) {
+		t.Fatalf("RevokeKey of a wider key error = %v, want %s", err, apierrorkeys.APIKeyScopeDenied)
+	}
+}
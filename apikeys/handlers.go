@@ -0,0 +1,134 @@
+package apikeys
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rogue-syntax/rs-goapiserver/apicontext"
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apimaster"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+// Api key endpoints, middleware.Typed handlers for ReqVerifMiddleware routes
+//   - GET  /v1/apikeys: List
+//   - POST /v1/apikeys: CreateKey
+//   - POST /v1/apikeys/{key_id}/revoke: RevokeKey
+//   - POST /v1/apikeys/{key_id}/rotate: RotateKey
+//   - called with a named key, the key needs a scope for the route, and can only create or rotate keys within its own Scopes
+const (
+	ROUTE_PREFIX = "/v1/apikeys"
+	ROUTE_REVOKE = ROUTE_PREFIX + "/{key_id}/revoke"
+	ROUTE_ROTATE = ROUTE_PREFIX + "/{key_id}/rotate"
+
+	SECRET_MESSAGE = "Api key attached. It is shown once, store it now. You are responsible for any action taken on your behalf with this key. Do not share it."
+)
+
+type CreateInput struct {
+	Label      string     `json:"label" validate:"required,max=100"`
+	Scopes     []string   `json:"scopes" validate:"required"`
+	Expires_at *time.Time `json:"expires_at"`
+}
+
+type KeyIdInput struct {
+	Key_id string `json:"key_id" validate:"required"`
+}
+
+type RotateInput struct {
+	Key_id        string `json:"key_id" validate:"required"`
+	Grace_seconds int    `json:"grace_seconds" validate:"min=0,max=604800"`
+}
+
+// SecretReturn
+//   - a new key with its kbxa value and, when request signing is on, its signing secret
+//   - the only response that holds them
+type SecretReturn struct {
+	Key            *ApiKey
+	ApiKey         string
+	Signing_secret string
+	Message        string
+}
+
+// callerMayIssue refuses a caller authenticated with a named key that does not hold every scope in scopes
+func callerMayIssue(ctx context.Context, scopes []string) error {
+	caller, err := CtxGetKey(ctx)
+	if err != nil {
+		return nil
+	}
+	if !caller.covers(scopes) {
+		return apierrors.NewKeyedError(apierrorkeys.APIKeyScopeDenied, nil, errors.New("api key "+caller.Key_id+" can not issue wider scopes"))
+	}
+	return nil
+}
+
+// callerMayManage refuses a caller authenticated with a named key revoking or rotating a key of the user it does not cover
+func callerMayManage(ctx context.Context, user_id int, key_id string, action string) error {
+	caller, err := CtxGetKey(ctx)
+	if err != nil {
+		return nil
+	}
+	target, err := findKey(ctx, key_id)
+	if err == nil && target.User_id == user_id && !caller.covers(target.Scopes) {
+		return apierrors.NewKeyedError(apierrorkeys.APIKeyScopeDenied, nil, errors.New("api key "+caller.Key_id+" can not "+action+" wider scopes"))
+	}
+	return nil
+}
+
+// List: the user's api keys, newest first, without secrets
+func List(ctx context.Context, in apimaster.ApiNilDescriptor) ([]ApiKey, error) {
+	usr, err := apicontext.CtxGetUser(ctx)
+	if err != nil {
+		return nil, apierrors.NewKeyedError(apierrorkeys.AuthorizationError, nil, err)
+	}
+	return ListByUser_idContext(ctx, usr.User_id)
+}
+
+// CreateKey: a new api key for the user, the kbxa value and signing secret are only in this response
+func CreateKey(ctx context.Context, in CreateInput) (SecretReturn, error) {
+	usr, err := apicontext.CtxGetUser(ctx)
+	if err != nil {
+		return SecretReturn{}, apierrors.NewKeyedError(apierrorkeys.AuthorizationError, nil, err)
+	}
+	scopes, err := NormalizeScopes(in.Scopes)
+	if err != nil {
+		return SecretReturn{}, err
+	}
+	if err := callerMayIssue(ctx, scopes); err != nil {
+		return SecretReturn{}, err
+	}
+	k, secrets, err := Create(ctx, usr.User_id, NewKey{Label: in.Label, Scopes: scopes, Expires_at: in.Expires_at})
+	if err != nil {
+		return SecretReturn{}, err
+	}
+	return SecretReturn{Key: k, ApiKey: secrets.ApiKey, Signing_secret: secrets.Signing_secret, Message: SECRET_MESSAGE}, nil
+}
+
+// RevokeKey: stops one of the user's keys at once
+func RevokeKey(ctx context.Context, in KeyIdInput) (*ApiKey, error) {
+	usr, err := apicontext.CtxGetUser(ctx)
+	if err != nil {
+		return nil, apierrors.NewKeyedError(apierrorkeys.AuthorizationError, nil, err)
+	}
+	if err := callerMayManage(ctx, usr.User_id, in.Key_id, "revoke"); err != nil {
+		return nil, err
+	}
+	return Revoke(ctx, usr.User_id, in.Key_id)
+}
+
+// RotateKey: replaces one of the user's keys, the old one keeps working for grace_seconds
+func RotateKey(ctx context.Context, in RotateInput) (SecretReturn, error) {
+	usr, err := apicontext.CtxGetUser(ctx)
+	if err != nil {
+		return SecretReturn{}, apierrors.NewKeyedError(apierrorkeys.AuthorizationError, nil, err)
+	}
+	if err := callerMayManage(ctx, usr.User_id, in.Key_id, "rotate"); err != nil {
+		return SecretReturn{}, err
+	}
+	k, secrets, err := Rotate(ctx, usr.User_id, in.Key_id, time.Duration(in.Grace_seconds)*time.Second)
+	if err != nil {
+		return SecretReturn{}, err
+	}
+	return SecretReturn{Key: k, ApiKey: secrets.ApiKey, Signing_secret: secrets.Signing_secret, Message: SECRET_MESSAGE}, nil
+}
@@ -0,0 +1,221 @@
+package apikeys
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/global"
+)
+
+// Signed requests
+/*
+
+	A named key can sign requests instead of sending its secret, see authentication.VerifyWithSignature.
+
+	Create and Rotate give every key a signing secret of its own, returned once next to the kbxa value. It is not
+	the kbxa secret and is not derived from anything stored in the clear: user_api_key keeps it in
+	signing_secret_enc, encrypted with the server held SigningSecretCipher and bound to its key id, so a copy of
+	the table can neither sign requests nor be moved to another key.
+
+	Clients derive the HMAC key from the signing secret and sign with it, see SigningKey and Sign:
+
+	  signing key = HMAC-SHA256(key: hex decoded signing secret, message: "kbx-request-signing-v1")
+	  signature   = hex(HMAC-SHA256(key: signing key, message: the string to sign))
+
+	Request signing is off, and keys are created without a signing secret, until SetSigningSecretCipher or
+	InitFromEnv sets a cipher. Keys created before then have to be rotated to get one.
+
+*/
+
+const (
+	// SIGNING_KEY_INFO: the message the signing secret is HMACed over to derive the signing key
+	SIGNING_KEY_INFO = "kbx-request-signing-v1"
+
+	signingSecretBytes = 32
+)
+
+// SigningSecretCipher
+//   - encrypts signing secrets at rest, implement to keep the key in a KMS
+//   - aad is the key id, Open must fail if it is not the aad the secret was sealed with
+type SigningSecretCipher interface {
+	Seal(plaintext []byte, aad []byte) ([]byte, error)
+	Open(ciphertext []byte, aad []byte) ([]byte, error)
+}
+
+// AESGCMCipher: a SigningSecretCipher with a local AES-256-GCM key, the nonce is stored before the ciphertext
+type AESGCMCipher struct {
+	aead cipher.AEAD
+}
+
+func NewAESGCMCipher(key []byte) (*AESGCMCipher, error) {
+	if len(key) != 32 {
+		return nil, errors.New(apierrorkeys.AppInitErr + ": api key signing secret cipher needs a 32 byte key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &AESGCMCipher{aead: aead}, nil
+}
+
+func (c *AESGCMCipher) Seal(plaintext []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func (c *AESGCMCipher) Open(ciphertext []byte, aad []byte) ([]byte, error) {
+	if len(ciphertext) < c.aead.NonceSize() {
+		return nil, errors.New("apikeys: short ciphertext")
+	}
+	n := c.aead.NonceSize()
+	return c.aead.Open(nil, ciphertext[:n], ciphertext[n:], aad)
+}
+
+var signingCipher struct {
+	mu sync.RWMutex
+	c  SigningSecretCipher
+}
+
+// SetSigningSecretCipher turns request signing on, nil turns it off
+func SetSigningSecretCipher(c SigningSecretCipher) {
+	signingCipher.mu.Lock()
+	signingCipher.c = c
+	signingCipher.mu.Unlock()
+}
+
+func getSigningCipher() SigningSecretCipher {
+	signingCipher.mu.RLock()
+	defer signingCipher.mu.RUnlock()
+	return signingCipher.c
+}
+
+// InitFromEnv
+//   - sets an AESGCMCipher from global.EnvVars.ApiKeySigningEncKey, a hex 32 byte key
+//   - leaves request signing off if ApiKeySigningEncKey is empty
+func InitFromEnv() error {
+	if global.EnvVars.ApiKeySigningEncKey == "" {
+		return nil
+	}
+	key, err := hex.DecodeString(global.EnvVars.ApiKeySigningEncKey)
+	if err != nil {
+		return errors.Wrap(err, apierrorkeys.AppInitErr+": ApiKeySigningEncKey is not hex")
+	}
+	c, err := NewAESGCMCipher(key)
+	if err != nil {
+		return err
+	}
+	SetSigningSecretCipher(c)
+	return nil
+}
+
+// newSigningSecret makes a signing secret for key_id, returns it hex encoded and sealed for signing_secret_enc
+//   - both are nil when request signing is off
+func newSigningSecret(key_id string) (*string, *string, error) {
+	c := getSigningCipher()
+	if c == nil {
+		return nil, nil, nil
+	}
+	secretBytes := make([]byte, signingSecretBytes)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, nil, err
+	}
+	sealed, err := c.Seal(secretBytes, []byte(key_id))
+	if err != nil {
+		return nil, nil, err
+	}
+	secret := hex.EncodeToString(secretBytes)
+	enc := hex.EncodeToString(sealed)
+	return &secret, &enc, nil
+}
+
+// signingSecretOf opens k's signing secret
+func signingSecretOf(k *ApiKey) ([]byte, error) {
+	c := getSigningCipher()
+	if c == nil {
+		return nil, errors.New(apierrorkeys.SignatureInvalid + ": request signing is off")
+	}
+	if k.Signing_secret_enc == nil {
+		return nil, errors.New(apierrorkeys.SignatureInvalid + ": api key " + k.Key_id + " has no signing secret, rotate it")
+	}
+	sealed, err := hex.DecodeString(*k.Signing_secret_enc)
+	if err != nil {
+		return nil, errors.Wrap(err, apierrorkeys.SystemError)
+	}
+	secret, err := c.Open(sealed, []byte(k.Key_id))
+	if err != nil {
+		return nil, errors.Wrap(err, apierrorkeys.SystemError)
+	}
+	return secret, nil
+}
+
+// SigningKey derives the HMAC key from a hex signing secret, see the top of this file
+func SigningKey(signingSecret string) ([]byte, error) {
+	secretBytes, err := hex.DecodeString(signingSecret)
+	if err != nil || len(secretBytes) != signingSecretBytes {
+		return nil, errors.New(apierrorkeys.SignatureInvalid + ": malformed signing secret")
+	}
+	return deriveSigningKey(secretBytes), nil
+}
+
+func deriveSigningKey(secretBytes []byte) []byte {
+	mac := hmac.New(sha256.New, secretBytes)
+	mac.Write([]byte(SIGNING_KEY_INFO))
+	return mac.Sum(nil)
+}
+
+// Sign is the hex HMAC-SHA256 of stringToSign under signingKey
+func Sign(signingKey []byte, stringToSign string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignature compares signature over stringToSign with the one k's signing secret makes
+func checkSignature(k *ApiKey, stringToSign string, signature string) error {
+	secret, err := signingSecretOf(k)
+	if err != nil {
+		return err
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New(apierrorkeys.SignatureInvalid)
+	}
+	want, _ := hex.DecodeString(Sign(deriveSigningKey(secret), stringToSign))
+	if !hmac.Equal(got, want) {
+		return errors.New(apierrorkeys.SignatureInvalid)
+	}
+	return nil
+}
+
+// VerifySignature
+//   - checks signature over stringToSign with key_id's signing secret, then the key's revocation, expiry and Scopes for routeString
+//   - errors start with APIKeyNotFound, SignatureInvalid, SystemError, APIKeyExpired or APIKeyScopeDenied
+func VerifySignature(ctx context.Context, key_id string, stringToSign string, signature string, routeString string) (*ApiKey, error) {
+	k, err := lookup(ctx, key_id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSignature(k, stringToSign, signature); err != nil {
+		return nil, err
+	}
+	if err := authorize(ctx, k, routeString); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
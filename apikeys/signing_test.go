@@ -0,0 +1,150 @@
+package apikeys
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+// testCipher sets an AESGCMCipher until the test ends
+func testCipher(t *testing.T) {
+	c, err := NewAESGCMCipher(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := getSigningCipher()
+	SetSigningSecretCipher(c)
+	t.Cleanup(func() { SetSigningSecretCipher(prev) })
+}
+
+func TestAESGCMCipher(t *testing.T) {
+	if _, err := NewAESGCMCipher(make([]byte, 16)); err == nil {
+		t.Fatal("NewAESGCMCipher took a 16 byte key")
+	}
+	c, err := NewAESGCMCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := c.Seal([]byte("secret"), []byte("key a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("sealed value holds the plaintext")
+	}
+	if got, err := c.Open(sealed, []byte("key a")); err != nil || string(got) != "secret" {
+		t.Fatalf("Open = %q, %v", got, err)
+	}
+	if _, err := c.Open(sealed, []byte("key b")); err == nil {
+		t.Fatal("Open took another key id as aad")
+	}
+	if _, err := c.Open(sealed[:4], []byte("key a")); err == nil {
+		t.Fatal("Open took a short ciphertext")
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	// the documented derivation, HMAC-SHA256(hex decoded signing secret, SIGNING_KEY_INFO)
+	signingKey, err := SigningKey(strings.Repeat("00", signingSecretBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(signingKey); got != "ae38aa7eb61f4fc3666e22e3f7b85875db08764c333d57fdc011b206b55fab16" {
+		t.Errorf("SigningKey = %s", got)
+	}
+	if got := Sign(signingKey, "KBX-HMAC-SHA256\nGET"); got != "99b823eb1f573067ae81fb1e7c71de71f9eaed77becc32978506564f7b804f1f" {
+		t.Errorf("Sign = %s", got)
+	}
+	for _, bad := range []string{"", "zz", strings.Repeat("00", signingSecretBytes-1)} {
+		if _, err := SigningKey(bad); err == nil {
+			t.Errorf("SigningKey(%q) took a malformed secret", bad)
+		}
+	}
+}
+
+func TestNewSigningSecretOff(t *testing.T) {
+	prev := getSigningCipher()
+	SetSigningSecretCipher(nil)
+	defer SetSigningSecretCipher(prev)
+	secret, enc, err := newSigningSecret("k")
+	if secret != nil || enc != nil || err != nil {
+		t.Fatalf("newSigningSecret with signing off = %v, %v, %v", secret, enc, err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	testCipher(t)
+	newKey := func(key_id string, scopes ...string) (*ApiKey, string) {
+		secret, enc, err := newSigningSecret(key_id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &ApiKey{Key_id: key_id, Secret_hash: "stored hash", Signing_secret_enc: enc, Scopes: scopes}, *secret
+	}
+	active, secret := newKey("aaaaaaaaaaaaaaaa", "/v1/a")
+	past := time.Now().Add(-time.Minute)
+	expired, expiredSecret := newKey("bbbbbbbbbbbbbbbb", "/v1/a")
+	expired.Expires_at = &past
+	legacy := &ApiKey{Key_id: "cccccccccccccccc", Secret_hash: "stored hash", Scopes: Scopes{"/v1/a"}}
+	// a sealed secret copied onto another row does not open under that row's key id
+	swapped := &ApiKey{Key_id: "dddddddddddddddd", Signing_secret_enc: active.Signing_secret_enc, Scopes: Scopes{"/v1/a"}}
+	fakeKeys(t, active, expired, legacy, swapped)
+
+	sign := func(signingSecret string, sts string) string {
+		signingKey, err := SigningKey(signingSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Sign(signingKey, sts)
+	}
+	const sts = "KBX-HMAC-SHA256\nGET\n/v1/a\n\n1700000000\nnonce\nhash"
+	// the stored secret hash is not the signing key, the attack the signing secret closes
+	hashSigningKey := Sign([]byte("stored hash"), sts)
+
+	tests := []struct {
+		name      string
+		key_id    string
+		signature string
+		route     string
+		wantErr   string
+	}{
+		{"valid", active.Key_id, sign(secret, sts), "/v1/a", ""},
+		{"tampered string to sign", active.Key_id, sign(secret, sts+"x"), "/v1/a", apierrorkeys.SignatureInvalid},
+		{"signed with the secret hash", active.Key_id, hashSigningKey, "/v1/a", apierrorkeys.SignatureInvalid},
+		{"signature not hex", active.Key_id, "zz", "/v1/a", apierrorkeys.SignatureInvalid},
+		{"out of scope", active.Key_id, sign(secret, sts), "/v1/b", apierrorkeys.APIKeyScopeDenied},
+		{"expired", expired.Key_id, sign(expiredSecret, sts), "/v1/a", apierrorkeys.APIKeyExpired},
+		{"no signing secret", legacy.Key_id, sign(secret, sts), "/v1/a", apierrorkeys.SignatureInvalid},
+		{"sealed for another key", swapped.Key_id, sign(secret, sts), "/v1/a", apierrorkeys.SystemError},
+		{"unknown key", "eeeeeeeeeeeeeeee", sign(secret, sts), "/v1/a", apierrorkeys.APIKeyNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := VerifySignature(context.Background(), tt.key_id, sts, tt.signature, tt.route)
+			if tt.wantErr == "" {
+				if err != nil || k == nil || k.Key_id != tt.key_id {
+					t.Fatalf("VerifySignature = %v, %v", k, err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Fatalf("VerifySignature error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	t.Run("signing off", func(t *testing.T) {
+		prev := getSigningCipher()
+		SetSigningSecretCipher(nil)
+		defer SetSigningSecretCipher(prev)
+		_, err := VerifySignature(context.Background(), active.Key_id, sts, sign(secret, sts), "/v1/a")
+		if err == nil || !strings.HasPrefix(err.Error(), apierrorkeys.SignatureInvalid) {
+			t.Fatalf("VerifySignature error = %v, want %s", err, apierrorkeys.SignatureInvalid)
+		}
+	})
+}
@@ -2,10 +2,11 @@ package apimaster
 
 import (
 	"context"
+	_ "embed"
 	"encoding/json"
-	"html/template"
 	"net/http"
 	"reflect"
+	"strings"
 
 	"github.com/rogue-syntax/rs-goapiserver/apireturn"
 	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
@@ -23,6 +24,9 @@ var builtInTypes = []string{
 	"uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
 }
 
+//go:embed explorer.html
+var explorerPage []byte
+
 type StructDescriptorMap map[string]map[string]interface{}
 
 func MakeStructDescriptorJSON(s interface{}) string {
@@ -59,6 +63,24 @@ func MakeStructDescriptorMap[T any](s *T) StructDescriptorMap {
 	return nameMap
 }
 
+// MakeTypeDescriptorMap
+//   - MakeStructDescriptorMap for a reflect.Type, a non struct type is described by its name only
+//   - used by middleware.Typed to describe a route's In and Out
+func MakeTypeDescriptorMap(t reflect.Type) StructDescriptorMap {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	fields := make(map[string]interface{})
+	if t.Kind() != reflect.Struct {
+		return StructDescriptorMap{t.String(): fields}
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fields[field.Name] = field.Type.String()
+	}
+	return StructDescriptorMap{t.Name(): fields}
+}
+
 type TypeNameString string
 type RouteParamSource string
 
@@ -69,16 +91,75 @@ const (
 	MULTIPART_FORM RouteParamSource = "MULTIPART-FORM"
 )
 
+// auth schemes a route accepts, see authentication.VerifyRequest
+const (
+	AUTH_SCHEME_COOKIE  = "kbxs"
+	AUTH_SCHEME_HEADER  = "kbxb"
+	AUTH_SCHEME_API_KEY = "kbxa"
+	AUTH_SCHEME_SIGNED  = "kbxsig"
+	AUTH_SCHEME_TOKEN   = "kbxt"
+)
+
 type RouteParam struct {
 	Source RouteParamSource
 }
+
+/*
+ApiReqDef: the description of a route in ApiReqMap
+  - Route: the RouteStr it was registered for, the OpenAPI path, set by middleware when registering
+  - InputType, OutputType: the Go types of the input and of the Data returned, used for the OpenAPI document,
+    set with TypeOf i.e. InputType: apimaster.TypeOf[PWSubmission](), set automatically for middleware.Typed routes
+  - Security: the AUTH_SCHEME_* the route accepts, empty for public routes, set from the route's middleware
+  - ErrorStatuses: http statuses the route's middleware may reject a request with, set from the route's middleware
+*/
 type ApiReqDef struct {
 	API           string
+	Route         string
 	Method        RouteParamSource
+	HTTPMethods   []string
+	PathParams    []string
 	Desc          string
 	Input         StructDescriptorMap
 	OutputData    StructDescriptorMap
 	OutputWrapper StructDescriptorMap
+	InputType     reflect.Type `json:"-"`
+	OutputType    reflect.Type `json:"-"`
+	Security      []string
+	ErrorStatuses []int
+}
+
+// ReqMapKey
+//   - the key of a route in an ApiReqMap list, its RouteStr, prefixed with its methods if it declares any
+//   - i.e. "GET /v1/apikeys" and "POST /v1/apikeys", so routes sharing a path keep their own ApiReqDef
+func ReqMapKey(routeStr string, methods []string) string {
+	if len(methods) == 0 {
+		return routeStr
+	}
+	return strings.Join(methods, ",") + " " + routeStr
+}
+
+// TypeOf returns the reflect.Type of T, for ApiReqDef.InputType and OutputType
+func TypeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// MethodFromHTTPMethods
+//   - derives an ApiReqDef Method from the http methods a RouteDef declares
+//   - GET only routes are GETREQ, anything with a body is POSTREQ unless declared as MULTIPART_FORM
+//   - no declared methods keeps the current value
+func MethodFromHTTPMethods(methods []string, current RouteParamSource) RouteParamSource {
+	if len(methods) == 0 {
+		return current
+	}
+	for _, m := range methods {
+		if m != http.MethodGet && m != http.MethodHead {
+			if current == MULTIPART_FORM {
+				return MULTIPART_FORM
+			}
+			return POSTREQ
+		}
+	}
+	return GETREQ
 }
 
 type ExampleInput struct {
@@ -99,6 +180,8 @@ var ApiReqMap map[string]map[string]ApiReqDef = map[string]map[string]ApiReqDef{
 			Input:         MakeStructDescriptorMap(new(ExampleInput)),
 			OutputData:    MakeStructDescriptorMap(new(ExampleOutput)),
 			OutputWrapper: MakeStructDescriptorMap(new(apireturn.JsonReturn)),
+			InputType:     TypeOf[ExampleInput](),
+			OutputType:    TypeOf[ExampleOutput](),
 		},
 	},
 }
@@ -109,132 +192,11 @@ func Handler_GetApiReqMap(w http.ResponseWriter, r *http.Request, ctx context.Co
 
 }
 
+// Handler_GetApiReqMapPage
+//   - serves the embedded API explorer, it loads the OpenAPI document from OPENAPI_ROUTE
+//   - routes can be searched, schemas expanded, and requests sent with the kbxs cookie, a kbxb token or a kbxa api key
 func Handler_GetApiReqMapPage(w http.ResponseWriter, r *http.Request, ctx context.Context) {
-	templateStr := `
-	<h1>API</h1>
-		<ul>
-		{{ range $key, $value := .}}
-			<li>
-				<div> 
-					{{$key}}
-				</div>
-				<div>
-					<ul>
-					{{ range $key2, $value2 := $value}}
-						<li>
-							<div>
-								{{$key2}}
-							</div>
-							<div>
-								<table>
-								
-									<tr>	
-										<td>
-											Route:
-										</td>
-										<td>
-											{{$value2.API}}
-										</td>
-									</tr>
-									<tr>	
-										<td>
-											Request Method:
-										</td>
-										<td>
-											{{$value2.Method}}
-										</td>
-									</tr>
-									<tr>	
-										<td>
-											Description:
-										</td>
-										<td>
-											{{$value2.Desc}}
-										</td>
-									</tr>
-									<tr>
-										<td>
-											Input:
-										</td>
-										<td>
-										{{ range $key3, $value3 := $value2.Input}}
-											<div>
-												{{$key3}}
-											</div>
-											<div>
-												<table>
-												{{ range $key4, $value4 := $value3}}
-													<tr>
-														<td>
-															{{$key4}}
-														</td>
-														<td>
-															{{$value4}}
-														</td>
-													</tr>
-												{{ end }}
-												</table>
-											</div>
-										{{ end }}	
-										</td>
-									</tr>
-									<tr>
-										<td>
-											Output Data:
-										</td>
-										<td>
-											<table>
-											{{ range $key3, $value3 := $value2.OutputData}}
-
-												<tr>
-													<td>
-
-														{{$key3}}	
-													</td>
-													<td>
-														{{$value3}}
-													</td>
-												</tr>
-
-											{{ end }}
-											</table>
-										</td>
-									</tr>
-									<tr>
-										<td>
-											Output Wrapper:
-										</td>
-										<td>
-											<table>
-											{{ range $key3, $value3 := $value2.OutputWrapper}}
-
-												<tr>
-													<td>
-
-														{{$key3}}	
-													</td>
-													<td>
-														{{$value3}}
-													</td>
-												</tr>
-
-											{{ end }}
-											</table>
-										</td>
-									</tr>
-								
-								</table>
-							</div>
-						</li>
-					{{ end }}
-					</ul>
-				</div>
-			</li>
-		{{ end }}
-		</ul>
-	`
-	tmplt := template.Must(template.New("api-page").Parse(templateStr))
-	tmplt.Execute(w, ApiReqMap)
-	//apireturn.ApiJSONReturn(ApiReqMap, apierrorkeys.NOError, &w)
-
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(explorerPage)
 }
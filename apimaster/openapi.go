@@ -0,0 +1,606 @@
+package apimaster
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/apivalidate"
+)
+
+// OpenAPI 3.1 document generation
+/*
+
+	BuildOpenAPI turns every ApiReqDef in ApiReqMap into an OpenAPI 3.1 document, served at OPENAPI_ROUTE by Handler_GetOpenAPI.
+
+	Schemas come from ApiReqDef.InputType and OutputType, walked with reflection:
+	  - properties are named like encoding/json names them, embedded structs are flattened
+	  - named structs go in components/schemas as "package.Type" and are referenced, so recursive types are fine
+	  - pointers are nullable, time.Time and encoding.TextMarshaler types are strings, *multipart.FileHeader is a binary string
+	  - `validate` tags (see apivalidate) give required, minLength / minimum / minItems, maxLength / maximum / maxItems, enum, pattern and email
+	A ReqDef without InputType or OutputType falls back to its flat StructDescriptorMap.
+
+	Every response is the apireturn.JsonReturn envelope, Data holds the output on success and Error holds an apierrorkeys key otherwise.
+	Routes whose middleware authenticates list the kbxs cookie, kbxb header and kbxa header schemes, see ApiReqDef.Security.
+
+	Set OpenAPIDocInfo and OpenAPIServers before serving to describe the deployment.
+
+*/
+
+const (
+	OPENAPI_VERSION = "3.1.0"
+	OPENAPI_ROUTE   = "/v1/openapi.json"
+)
+
+type OpenAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type OpenAPIServer struct {
+	URL         string `json:"url"`
+	Description string `json:"description,omitempty"`
+}
+
+var OpenAPIDocInfo = OpenAPIInfo{Title: "rs-goapiserver", Version: "1"}
+
+var OpenAPIServers []OpenAPIServer
+
+type OpenAPIDoc struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       OpenAPIInfo                             `json:"info"`
+	Servers    []OpenAPIServer                         `json:"servers,omitempty"`
+	Paths      map[string]map[string]*OpenAPIOperation `json:"paths"`
+	Components OpenAPIComponents                       `json:"components"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]*Schema                `json:"schemas"`
+	Responses       map[string]*OpenAPIResponse       `json:"responses"`
+	SecuritySchemes map[string]*OpenAPISecurityScheme `json:"securitySchemes"`
+}
+
+type OpenAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Summary     string                      `json:"summary,omitempty"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Parameters  []*OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+}
+
+type OpenAPIParameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                         `json:"required,omitempty"`
+	Content  map[string]*OpenAPIMediaType `json:"content"`
+}
+
+type OpenAPIMediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type OpenAPIResponse struct {
+	Ref         string                       `json:"$ref,omitempty"`
+	Description string                       `json:"description,omitempty"`
+	Content     map[string]*OpenAPIMediaType `json:"content,omitempty"`
+}
+
+type OpenAPISecurityScheme struct {
+	Type         string `json:"type"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// Schema
+//   - a JSON Schema as used by OpenAPI 3.1, Type is a string or, for nullable values, []string{type, "null"}
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 interface{}        `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+}
+
+// BuildOpenAPI builds the document for every route in ApiReqMap, see the top of this file
+func BuildOpenAPI() *OpenAPIDoc {
+	doc := &OpenAPIDoc{
+		OpenAPI: OPENAPI_VERSION,
+		Info:    OpenAPIDocInfo,
+		Servers: OpenAPIServers,
+		Paths:   make(map[string]map[string]*OpenAPIOperation),
+		Components: OpenAPIComponents{
+			Responses:       map[string]*OpenAPIResponse{"Error": errorResponse()},
+			SecuritySchemes: securitySchemes(),
+		},
+	}
+	b := newSchemaBuilder()
+
+	listNames := make([]string, 0, len(ApiReqMap))
+	for listName := range ApiReqMap {
+		listNames = append(listNames, listName)
+	}
+	sort.Strings(listNames)
+	for _, listName := range listNames {
+		keys := make([]string, 0, len(ApiReqMap[listName]))
+		for key := range ApiReqMap[listName] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			reqDef := ApiReqMap[listName][key]
+			// entries not registered through middleware are keyed by their path
+			route := reqDef.Route
+			if route == "" {
+				route = key
+			}
+			if _, ok := doc.Paths[route]; !ok {
+				doc.Paths[route] = make(map[string]*OpenAPIOperation)
+			}
+			for _, method := range operationMethods(reqDef) {
+				doc.Paths[route][strings.ToLower(method)] = b.operation(listName, route, method, reqDef)
+			}
+		}
+	}
+	doc.Components.Schemas = b.schemas
+	return doc
+}
+
+// Handler_GetOpenAPI serves BuildOpenAPI as plain OpenAPI JSON, not wrapped in a JsonReturn
+func Handler_GetOpenAPI(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	jb, err := json.Marshal(BuildOpenAPI())
+	if err != nil {
+		http.Error(w, apierrorkeys.JSONMarshalError, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(jb)
+}
+
+func securitySchemes() map[string]*OpenAPISecurityScheme {
+	return map[string]*OpenAPISecurityScheme{
+		AUTH_SCHEME_COOKIE: {Type: "apiKey", In: "cookie", Name: "kbxs",
+			Description: "Browser session cookie issued by /v1/app/signIn, sent with the kbxu user id cookie. State changing requests also need the X-CSRF-Token header set to the kbxc cookie."},
+		AUTH_SCHEME_HEADER: {Type: "apiKey", In: "header", Name: "kbxb",
+			Description: "Session token returned by /v1/app/signIn when kbxb is posted, sent with auth-mode=b and the user-id."},
+		AUTH_SCHEME_API_KEY: {Type: "apiKey", In: "header", Name: "kbxa",
+			Description: "Named api key kbxk_<key id>.<secret> from /v1/apikeys sent with auth-mode=a, limited to the key's scopes. The legacy key from /v1/test/genApiKey also needs the user-id header."},
+		AUTH_SCHEME_SIGNED: {Type: "apiKey", In: "header", Name: "X-Kbx-Signature",
+			Description: "Request signed with a named api key, sent with auth-mode=s and the X-Kbx-Key-Id, X-Kbx-Timestamp and X-Kbx-Nonce headers. The signature is the hex HMAC-SHA256, under a key derived from the Signing_secret returned with the key, of the method, path, query, timestamp, nonce and body hash, see authentication.StringToSign."},
+		AUTH_SCHEME_TOKEN: {Type: "http", Scheme: "bearer", BearerFormat: "JWT",
+			Description: "Access token returned by /v1/app/signIn when kbxt is posted, sent with auth-mode=t. It expires after minutes, post the refresh token to /v1/app/token/refresh for a new pair."},
+	}
+}
+
+func errorResponse() *OpenAPIResponse {
+	return &OpenAPIResponse{
+		Description: "Error, Error holds an apierrorkeys key and Data may hold details. Sent as application/problem+json when the request accepts it, see apireturn.ResponseMode",
+		Content: map[string]*OpenAPIMediaType{
+			"application/json": {Schema: &Schema{
+				Type:     "object",
+				Required: []string{"Error", "Data"},
+				Properties: map[string]*Schema{
+					"Error":   {Type: "string"},
+					"Data":    {},
+					"Message": {Type: "string", Description: "user facing message from the error catalog, when apierrors.LocalizeErrors is set"},
+				},
+			}},
+			apireturn.PROBLEM_CONTENT_TYPE: {Schema: &Schema{
+				Type:     "object",
+				Required: []string{"type", "title", "status", "key"},
+				Properties: map[string]*Schema{
+					"type":    {Type: "string"},
+					"title":   {Type: "string"},
+					"status":  {Type: "integer"},
+					"detail":  {Type: "string"},
+					"key":     {Type: "string"},
+					"data":    {},
+					"message": {Type: "string", Description: "user facing message from the error catalog, when apierrors.LocalizeErrors is set"},
+				},
+			}},
+		},
+	}
+}
+
+// operationMethods is the http methods a ReqDef is documented under
+func operationMethods(reqDef ApiReqDef) []string {
+	var methods []string
+	for _, m := range reqDef.HTTPMethods {
+		// HEAD is implied by GET
+		if m != http.MethodHead {
+			methods = append(methods, m)
+		}
+	}
+	if len(methods) > 0 {
+		return methods
+	}
+	switch reqDef.Method {
+	case GETREQ, URIREQ:
+		return []string{http.MethodGet}
+	}
+	return []string{http.MethodPost}
+}
+
+var operationIDReplacer = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+func (b *schemaBuilder) operation(listName string, route string, method string, reqDef ApiReqDef) *OpenAPIOperation {
+	op := &OpenAPIOperation{
+		OperationID: strings.Trim(operationIDReplacer.ReplaceAllString(listName+"_"+strings.ToLower(method)+"_"+route, "_"), "_"),
+		Summary:     reqDef.Desc,
+		Tags:        []string{listName},
+		Responses:   make(map[string]*OpenAPIResponse),
+	}
+
+	inSchema := b.inputSchema(reqDef)
+	pathParams := make(map[string]bool)
+	for _, name := range reqDef.PathParams {
+		pathParams[strings.ToLower(name)] = true
+		op.Parameters = append(op.Parameters, &OpenAPIParameter{Name: name, In: "path", Required: true, Schema: propertyFold(inSchema, name, &Schema{Type: "string"})})
+	}
+
+	if inSchema != nil {
+		inQuery := reqDef.Method == GETREQ || reqDef.Method == URIREQ || method == http.MethodGet || method == http.MethodDelete
+		if inQuery {
+			for _, name := range sortedKeys(inSchema.Properties) {
+				if pathParams[strings.ToLower(name)] {
+					continue
+				}
+				op.Parameters = append(op.Parameters, &OpenAPIParameter{Name: name, In: "query", Required: containsFold(inSchema.Required, name), Schema: inSchema.Properties[name]})
+			}
+		} else {
+			ref := b.inputRef(reqDef, inSchema)
+			content := map[string]*OpenAPIMediaType{}
+			if reqDef.Method == MULTIPART_FORM {
+				content["multipart/form-data"] = &OpenAPIMediaType{Schema: ref}
+			} else {
+				content["application/json"] = &OpenAPIMediaType{Schema: ref}
+				content["application/x-www-form-urlencoded"] = &OpenAPIMediaType{Schema: ref}
+			}
+			op.RequestBody = &OpenAPIRequestBody{Required: len(inSchema.Required) > 0, Content: content}
+		}
+	}
+
+	op.Responses["200"] = &OpenAPIResponse{
+		Description: "Success, Error is " + apierrorkeys.NOError + " and Data holds the output",
+		Content: map[string]*OpenAPIMediaType{"application/json": {Schema: &Schema{
+			Type:     "object",
+			Required: []string{"Error", "Data"},
+			Properties: map[string]*Schema{
+				"Error": {Type: "string"},
+				"Data":  b.outputSchema(reqDef),
+			},
+		}}},
+	}
+	op.Responses["default"] = &OpenAPIResponse{Ref: "#/components/responses/Error"}
+	for _, status := range reqDef.ErrorStatuses {
+		op.Responses[strconv.Itoa(status)] = &OpenAPIResponse{Ref: "#/components/responses/Error"}
+	}
+
+	for _, scheme := range reqDef.Security {
+		op.Security = append(op.Security, map[string][]string{scheme: {}})
+	}
+	return op
+}
+
+// inputSchema is the resolved object schema of the input, nil if the route takes none
+func (b *schemaBuilder) inputSchema(reqDef ApiReqDef) *Schema {
+	var s *Schema
+	if reqDef.InputType != nil {
+		if reqDef.InputType == reflect.TypeOf(ApiNilDescriptor{}) {
+			return nil
+		}
+		s = b.resolve(b.schemaFor(reqDef.InputType))
+	} else {
+		s = descriptorSchema(reqDef.Input)
+	}
+	if s == nil || len(s.Properties) == 0 {
+		return nil
+	}
+	return s
+}
+
+// inputRef references the input's component schema if it has one
+func (b *schemaBuilder) inputRef(reqDef ApiReqDef, inSchema *Schema) *Schema {
+	if reqDef.InputType != nil {
+		return b.schemaFor(reqDef.InputType)
+	}
+	return inSchema
+}
+
+func (b *schemaBuilder) outputSchema(reqDef ApiReqDef) *Schema {
+	if reqDef.OutputType != nil {
+		return b.schemaFor(reqDef.OutputType)
+	}
+	if s := descriptorSchema(reqDef.OutputData); s != nil {
+		return s
+	}
+	return &Schema{}
+}
+
+// schemaBuilder collects named struct schemas into components/schemas
+type schemaBuilder struct {
+	schemas map[string]*Schema
+	names   map[reflect.Type]string
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{schemas: make(map[string]*Schema), names: make(map[reflect.Type]string)}
+}
+
+// resolve follows a component $ref
+func (b *schemaBuilder) resolve(s *Schema) *Schema {
+	if s != nil && strings.HasPrefix(s.Ref, "#/components/schemas/") {
+		return b.schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	fileHeaderType    = reflect.TypeOf(multipart.FileHeader{})
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+func (b *schemaBuilder) schemaFor(t reflect.Type) *Schema {
+	nullable := false
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+		nullable = true
+	}
+	var s *Schema
+	switch {
+	case t == timeType:
+		s = &Schema{Type: "string", Format: "date-time"}
+	case t == fileHeaderType:
+		return &Schema{Type: "string", Format: "binary"}
+	case t == rawMessageType:
+		return &Schema{}
+	case t.Kind() != reflect.Struct && reflect.PointerTo(t).Implements(textMarshalerType):
+		s = &Schema{Type: "string"}
+	default:
+		switch t.Kind() {
+		case reflect.Bool:
+			s = &Schema{Type: "boolean"}
+		case reflect.Int8, reflect.Int16, reflect.Int32:
+			s = &Schema{Type: "integer", Format: "int32"}
+		case reflect.Int, reflect.Int64:
+			s = &Schema{Type: "integer", Format: "int64"}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			zero := 0.0
+			s = &Schema{Type: "integer", Minimum: &zero}
+		case reflect.Float32:
+			s = &Schema{Type: "number", Format: "float"}
+		case reflect.Float64:
+			s = &Schema{Type: "number", Format: "double"}
+		case reflect.String:
+			s = &Schema{Type: "string"}
+		case reflect.Slice, reflect.Array:
+			if t.Elem().Kind() == reflect.Uint8 {
+				s = &Schema{Type: "string", Format: "byte"}
+			} else {
+				s = &Schema{Type: "array", Items: b.schemaFor(t.Elem())}
+			}
+		case reflect.Map:
+			s = &Schema{Type: "object", AdditionalProperties: b.schemaFor(t.Elem())}
+		case reflect.Struct:
+			if t.Name() == "" {
+				s = b.structSchema(t)
+			} else {
+				// references are left as is, OpenAPI 3.1 allows null alongside a $ref only through anyOf
+				return &Schema{Ref: "#/components/schemas/" + b.component(t)}
+			}
+		default:
+			return &Schema{}
+		}
+	}
+	if nullable {
+		if typ, ok := s.Type.(string); ok {
+			s.Type = []string{typ, "null"}
+		}
+	}
+	return s
+}
+
+var componentNameReplacer = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// component registers a named struct in components/schemas and returns its name
+func (b *schemaBuilder) component(t reflect.Type) string {
+	if name, ok := b.names[t]; ok {
+		return name
+	}
+	pkg := t.PkgPath()
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		pkg = pkg[i+1:]
+	}
+	base := componentNameReplacer.ReplaceAllString(pkg+"."+t.Name(), "_")
+	name := base
+	for i := 2; b.schemas[name] != nil; i++ {
+		name = base + "_" + strconv.Itoa(i)
+	}
+	// registered before its fields are walked so recursive types end in a $ref
+	b.names[t] = name
+	b.schemas[name] = &Schema{Type: "object"}
+	*b.schemas[name] = *b.structSchema(t)
+	return name
+}
+
+func (b *schemaBuilder) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	b.addFields(s, t)
+	return s
+}
+
+// addFields adds the json fields of t to s, flattening embedded structs like encoding/json
+func (b *schemaBuilder) addFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		jsonTag := field.Tag.Get("json")
+		if field.Anonymous && (jsonTag == "" || strings.HasPrefix(jsonTag, ",")) {
+			ft := field.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				b.addFields(s, ft)
+				continue
+			}
+		}
+		name := apivalidate.JSONName(field)
+		if name == "" {
+			continue
+		}
+		prop := b.schemaFor(field.Type)
+		rules, err := apivalidate.ParseTag(field.Tag.Get(apivalidate.TAG_NAME))
+		if err == nil {
+			applyRules(prop, rules, field.Type)
+			if rules.Required && !containsFold(s.Required, name) {
+				s.Required = append(s.Required, name)
+			}
+		}
+		s.Properties[name] = prop
+	}
+}
+
+// applyRules adds apivalidate rules to a property schema
+func applyRules(s *Schema, rules apivalidate.Rules, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	toInt := func(f *float64) *int {
+		if f == nil {
+			return nil
+		}
+		n := int(*f)
+		return &n
+	}
+	switch t.Kind() {
+	case reflect.String:
+		s.MinLength, s.MaxLength = toInt(rules.Min), toInt(rules.Max)
+	case reflect.Slice, reflect.Array, reflect.Map:
+		s.MinItems, s.MaxItems = toInt(rules.Min), toInt(rules.Max)
+	default:
+		if rules.Min != nil {
+			s.Minimum = rules.Min
+		}
+		if rules.Max != nil {
+			s.Maximum = rules.Max
+		}
+	}
+	for _, option := range rules.OneOf {
+		if n, err := strconv.ParseFloat(option, 64); err == nil && t.Kind() != reflect.String {
+			s.Enum = append(s.Enum, n)
+		} else {
+			s.Enum = append(s.Enum, option)
+		}
+	}
+	if rules.Email {
+		s.Format = "email"
+	}
+	if rules.Pattern != nil {
+		s.Pattern = rules.Pattern.String()
+	}
+}
+
+// descriptorSchema builds a schema from a flat StructDescriptorMap, for ReqDefs without InputType or OutputType
+func descriptorSchema(m StructDescriptorMap) *Schema {
+	for _, fields := range m {
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		for name, typ := range fields {
+			typStr, _ := typ.(string)
+			s.Properties[name] = schemaFromTypeString(typStr)
+		}
+		return s
+	}
+	return nil
+}
+
+func schemaFromTypeString(typ string) *Schema {
+	switch {
+	case strings.HasPrefix(typ, "*"):
+		s := schemaFromTypeString(typ[1:])
+		if t, ok := s.Type.(string); ok {
+			s.Type = []string{t, "null"}
+		}
+		return s
+	case typ == "[]uint8" || typ == "[]byte":
+		return &Schema{Type: "string", Format: "byte"}
+	case strings.HasPrefix(typ, "[]"):
+		return &Schema{Type: "array", Items: schemaFromTypeString(typ[2:])}
+	case strings.HasPrefix(typ, "map["):
+		return &Schema{Type: "object"}
+	case typ == "string":
+		return &Schema{Type: "string"}
+	case typ == "bool":
+		return &Schema{Type: "boolean"}
+	case typ == "time.Time":
+		return &Schema{Type: "string", Format: "date-time"}
+	case strings.HasPrefix(typ, "int") || strings.HasPrefix(typ, "uint"):
+		return &Schema{Type: "integer"}
+	case strings.HasPrefix(typ, "float"):
+		return &Schema{Type: "number"}
+	}
+	return &Schema{Description: typ}
+}
+
+// propertyFold finds a property case insensitively, or returns fallback
+func propertyFold(s *Schema, name string, fallback *Schema) *Schema {
+	if s == nil {
+		return fallback
+	}
+	for key, prop := range s.Properties {
+		if strings.EqualFold(key, name) {
+			return prop
+		}
+	}
+	return fallback
+}
+
+func sortedKeys(m map[string]*Schema) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
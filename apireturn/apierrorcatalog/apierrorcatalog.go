@@ -0,0 +1,435 @@
+package apierrorcatalog
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rogue-syntax/rs-goapiserver/apimaster"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+// Error catalog
+/*
+
+	Every apierrorkeys key with a description for developers, a suggested client Action, and user facing Messages
+	by locale. The status comes from apireturn.StatusRegistry when the catalog is served.
+
+	Handler_GetErrorCatalog serves it at CATALOG_ROUTE with an ETag, so clients can cache it and revalidate.
+
+	Message picks the best locale from an Accept-Language header, falling back to DEFAULT_LOCALE.
+	apierrors.HandleError adds it to error responses when apierrors.LocalizeErrors is set.
+
+	Add application keys, or more locales for existing keys, with Register before serving.
+
+*/
+
+const (
+	CATALOG_ROUTE  = "/v1/errors/catalog"
+	DEFAULT_LOCALE = "en"
+)
+
+// suggested client actions
+const (
+	ACTION_NONE            = "none"
+	ACTION_RETRY           = "retry"
+	ACTION_RETRY_LATER     = "retry_later"
+	ACTION_SIGN_IN         = "sign_in"
+	ACTION_REFRESH         = "refresh"
+	ACTION_FIX_INPUT       = "fix_input"
+	ACTION_CONTACT_SUPPORT = "contact_support"
+)
+
+// Messages are user facing messages by locale i.e. "en", "es", "fr"
+type Messages map[string]string
+
+/*
+CatalogEntry: one error key
+  - Status: the http status of the key, filled in from apireturn.StatusFor when served
+  - Description: what the key means, for developers
+  - Action: one of the ACTION_* constants
+  - Messages: text to show users, by locale
+*/
+type CatalogEntry struct {
+	Key         string
+	Status      int
+	Description string
+	Action      string
+	Messages    Messages
+}
+
+var (
+	msgServer = Messages{
+		"en": "Something went wrong on our side. Please try again later.",
+		"es": "Algo salió mal de nuestro lado. Inténtalo de nuevo más tarde.",
+		"fr": "Une erreur s'est produite de notre côté. Veuillez réessayer plus tard.",
+	}
+	msgUpstream = Messages{
+		"en": "A service we depend on is not responding. Please try again in a few minutes.",
+		"es": "Un servicio del que dependemos no responde. Inténtalo de nuevo en unos minutos.",
+		"fr": "Un service dont nous dépendons ne répond pas. Veuillez réessayer dans quelques minutes.",
+	}
+	msgSignIn = Messages{
+		"en": "Please sign in to continue.",
+		"es": "Inicia sesión para continuar.",
+		"fr": "Veuillez vous connecter pour continuer.",
+	}
+	msgBadRequest = Messages{
+		"en": "The request could not be read. Please check what was sent and try again.",
+		"es": "No se pudo leer la solicitud. Revisa lo que enviaste e inténtalo de nuevo.",
+		"fr": "La requête n'a pas pu être lue. Vérifiez les données envoyées et réessayez.",
+	}
+	msgInvalid = Messages{
+		"en": "Some fields are missing or invalid. Please correct them and try again.",
+		"es": "Faltan algunos campos o no son válidos. Corrígelos e inténtalo de nuevo.",
+		"fr": "Certains champs sont manquants ou invalides. Corrigez-les puis réessayez.",
+	}
+	msgForbidden = Messages{
+		"en": "You do not have access to this.",
+		"es": "No tienes acceso a esto.",
+		"fr": "Vous n'avez pas accès à cette ressource.",
+	}
+	msgFile = Messages{
+		"en": "The file could not be processed. Please check it and try again.",
+		"es": "No se pudo procesar el archivo. Revísalo e inténtalo de nuevo.",
+		"fr": "Le fichier n'a pas pu être traité. Vérifiez-le puis réessayez.",
+	}
+)
+
+func entry(key string, description string, action string, messages Messages) CatalogEntry {
+	return CatalogEntry{Key: key, Description: description, Action: action, Messages: messages}
+}
+
+var defaultEntries = []CatalogEntry{
+	// General
+	entry(apierrorkeys.NOError, "The request succeeded.", ACTION_NONE, Messages{"en": "Done.", "es": "Listo.", "fr": "Terminé."}),
+	entry(apierrorkeys.SystemError, "An unexpected server error.", ACTION_RETRY_LATER, msgServer),
+
+	// APP
+	entry(apierrorkeys.AppInitErr, "The server failed to start.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.AppInitErr_DB, "The server could not connect to its database at start up.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.AppInitErr_ENV, "The server could not read its environment config at start up.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.AppInitErr_S3, "The server could not connect to file storage at start up.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.DBInitErr, "The database connection could not be opened.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.PanicError, "A handler panicked, the panic was recovered and logged.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.ServeHttpError, "The http server stopped with an error.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.SendMailError, "An email could not be sent.", ACTION_RETRY_LATER, Messages{
+		"en": "We could not send the email. Please try again in a few minutes.",
+		"es": "No pudimos enviar el correo. Inténtalo de nuevo en unos minutos.",
+		"fr": "Nous n'avons pas pu envoyer l'e-mail. Veuillez réessayer dans quelques minutes.",
+	}),
+	entry(apierrorkeys.LogGenError, "A log entry could not be built.", ACTION_NONE, msgServer),
+	entry(apierrorkeys.ShutdownError, "The server did not shut down cleanly.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.HealthCheckErr, "A health or readiness check failed, the server is not ready for traffic.", ACTION_RETRY_LATER, msgServer),
+
+	// Authentication
+	entry(apierrorkeys.AuthorizationError, "The request is not authenticated, or the user may not use this route.", ACTION_SIGN_IN, msgSignIn),
+	entry(apierrorkeys.MiddlewareError, "A route was registered without its middleware list set.", ACTION_CONTACT_SUPPORT, msgServer),
+	entry(apierrorkeys.SessionExpired, "The session behind the kbxs cookie or kbxb token has expired.", ACTION_SIGN_IN, Messages{
+		"en": "Your session has expired. Please sign in again.",
+		"es": "Tu sesión ha caducado. Inicia sesión de nuevo.",
+		"fr": "Votre session a expiré. Veuillez vous reconnecter.",
+	}),
+	entry(apierrorkeys.APIKeyNotFound, "No kbxa api key or kbxb token was sent for the auth mode.", ACTION_SIGN_IN, msgSignIn),
+	entry(apierrorkeys.AuthHeaderNotFound, "A required auth header is missing.", ACTION_SIGN_IN, msgSignIn),
+	entry(apierrorkeys.CSRFError, "The X-CSRF-Token header is missing or does not match the kbxc cookie.", ACTION_REFRESH, Messages{
+		"en": "This page has expired. Please reload it and try again.",
+		"es": "Esta página ha caducado. Recárgala e inténtalo de nuevo.",
+		"fr": "Cette page a expiré. Veuillez la recharger et réessayer.",
+	}),
+	entry(apierrorkeys.IPNotAllowed, "The client address is not in the route's IPAllowList.", ACTION_NONE, msgForbidden),
+	entry(apierrorkeys.APIKeyExpired, "The kbxa api key has expired or was revoked, create a new one at /v1/apikeys.", ACTION_SIGN_IN, msgSignIn),
+	entry(apierrorkeys.APIKeyScopeDenied, "The kbxa api key's scopes do not include this route.", ACTION_NONE, msgForbidden),
+	entry(apierrorkeys.SignatureInvalid, "The signed request's headers are missing, or its X-Kbx-Signature does not match the request.", ACTION_NONE, msgSignIn),
+	entry(apierrorkeys.SignatureExpired, "The signed request's X-Kbx-Timestamp is outside the allowed clock skew, check the client clock.", ACTION_RETRY, msgSignIn),
+	entry(apierrorkeys.NonceReplayed, "The signed request's X-Kbx-Nonce was already used, sign each request with a new nonce.", ACTION_NONE, msgSignIn),
+	entry(apierrorkeys.AccessTokenInvalid, "The bearer access token is malformed, has a bad signature or an unknown key id, or its session was revoked.", ACTION_SIGN_IN, msgSignIn),
+	entry(apierrorkeys.AccessTokenExpired, "The bearer access token has expired, get a new one from /v1/app/token/refresh.", ACTION_REFRESH, msgSignIn),
+	entry(apierrorkeys.RefreshTokenError, "The refresh token is unknown, expired or revoked, or token mode is not configured.", ACTION_SIGN_IN, msgSignIn),
+	entry(apierrorkeys.RefreshTokenReused, "An already used refresh token was sent again, every token of its session was revoked.", ACTION_SIGN_IN, msgSignIn),
+
+	// Account
+	entry(apierrorkeys.AccountError, "The account could not be loaded or changed.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.NonexistentAccount, "No account matches the request.", ACTION_FIX_INPUT, Messages{
+		"en": "We could not find that account.",
+		"es": "No encontramos esa cuenta.",
+		"fr": "Nous n'avons pas trouvé ce compte.",
+	}),
+	entry(apierrorkeys.DefunctCompanyMemeberships, "The user's company memberships are no longer active.", ACTION_CONTACT_SUPPORT, msgForbidden),
+	entry(apierrorkeys.NoCompanyMemeberships, "The user is not a member of any company.", ACTION_CONTACT_SUPPORT, msgForbidden),
+	entry(apierrorkeys.CompanyAuthenicationMismatch, "The user is not a member of the company in the request.", ACTION_NONE, msgForbidden),
+	entry(apierrorkeys.ResourceOwnershipMismatch, "The resource belongs to another user or company.", ACTION_NONE, msgForbidden),
+
+	// Password
+	entry(apierrorkeys.PWIncorrect, "The password does not match.", ACTION_FIX_INPUT, Messages{
+		"en": "The password is incorrect.",
+		"es": "La contraseña es incorrecta.",
+		"fr": "Le mot de passe est incorrect.",
+	}),
+	entry(apierrorkeys.PWReqNotMet, "The new password does not meet the password requirements.", ACTION_FIX_INPUT, Messages{
+		"en": "The password does not meet the requirements.",
+		"es": "La contraseña no cumple los requisitos.",
+		"fr": "Le mot de passe ne respecte pas les exigences.",
+	}),
+	entry(apierrorkeys.PWReqNotFound, "The password reset token is unknown or expired.", ACTION_FIX_INPUT, Messages{
+		"en": "This password reset link is invalid or has expired. Please request a new one.",
+		"es": "Este enlace para restablecer la contraseña no es válido o ha caducado. Solicita uno nuevo.",
+		"fr": "Ce lien de réinitialisation est invalide ou a expiré. Veuillez en demander un nouveau.",
+	}),
+	entry(apierrorkeys.CantDecode, "The request body or form could not be decoded.", ACTION_FIX_INPUT, msgBadRequest),
+	entry(apierrorkeys.LoginFailed, "The email and password do not match an account.", ACTION_FIX_INPUT, Messages{
+		"en": "The email or password is incorrect.",
+		"es": "El correo o la contraseña son incorrectos.",
+		"fr": "L'e-mail ou le mot de passe est incorrect.",
+	}),
+	entry(apierrorkeys.LoggedOut, "The session was signed out.", ACTION_NONE, Messages{
+		"en": "You have been signed out.",
+		"es": "Has cerrado sesión.",
+		"fr": "Vous avez été déconnecté.",
+	}),
+	entry(apierrorkeys.SignupError, "The account could not be created.", ACTION_RETRY_LATER, Messages{
+		"en": "We could not create your account. Please try again later.",
+		"es": "No pudimos crear tu cuenta. Inténtalo de nuevo más tarde.",
+		"fr": "Nous n'avons pas pu créer votre compte. Veuillez réessayer plus tard.",
+	}),
+	entry(apierrorkeys.EmailTaken, "An account already uses the email.", ACTION_FIX_INPUT, Messages{
+		"en": "An account with this email already exists.",
+		"es": "Ya existe una cuenta con este correo.",
+		"fr": "Un compte existe déjà avec cet e-mail.",
+	}),
+
+	// Data
+	entry(apierrorkeys.JSONMarshalError, "The response could not be encoded as JSON.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.JSONDecodeError, "The request body is not valid JSON.", ACTION_FIX_INPUT, msgBadRequest),
+	entry(apierrorkeys.ContextError, "A value expected in the request context is missing.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.DataConversionError, "A value could not be converted to the type needed.", ACTION_FIX_INPUT, msgInvalid),
+	entry(apierrorkeys.NullDataError, "A value needed to complete the request is null.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.InvalidType, "A value has the wrong type.", ACTION_FIX_INPUT, msgInvalid),
+	entry(apierrorkeys.InvalidCast, "A value could not be cast on the server.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.AutoIdOnNewRecord, "A new record was sent with an id, ids are assigned by the server.", ACTION_FIX_INPUT, msgBadRequest),
+	entry(apierrorkeys.RequiredDataMissing, "A required value is missing.", ACTION_FIX_INPUT, msgInvalid),
+
+	// API Requests
+	entry(apierrorkeys.APIReqError, "The handler could not complete the request.", ACTION_RETRY, msgServer),
+	entry(apierrorkeys.MethodNotAllowed, "The route does not accept the http method, see the Allow header.", ACTION_NONE, msgBadRequest),
+	entry(apierrorkeys.RouteDefError, "A route definition is invalid, reported at registration.", ACTION_CONTACT_SUPPORT, msgServer),
+	entry(apierrorkeys.RateLimited, "Too many requests, wait for the Retry-After header seconds.", ACTION_RETRY_LATER, Messages{
+		"en": "Too many attempts. Please wait a moment and try again.",
+		"es": "Demasiados intentos. Espera un momento e inténtalo de nuevo.",
+		"fr": "Trop de tentatives. Veuillez patienter un instant puis réessayer.",
+	}),
+	entry(apierrorkeys.RateLimitError, "The rate limit store failed, the request was let through.", ACTION_NONE, msgServer),
+	entry(apierrorkeys.RequestError, "The request is malformed.", ACTION_FIX_INPUT, msgBadRequest),
+	entry(apierrorkeys.InvalidAPIInput, "The input failed validation, Data lists every field violation.", ACTION_FIX_INPUT, msgInvalid),
+	entry(apierrorkeys.FormFieldValidationError, "A form field failed validation.", ACTION_FIX_INPUT, msgInvalid),
+	entry(apierrorkeys.FormFieldUserError, "A form field holds a value the user must change.", ACTION_FIX_INPUT, msgInvalid),
+
+	// Database
+	entry(apierrorkeys.DBExecError, "A database statement failed.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.DBQueryError, "A database query failed.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.RowScanError, "A database row could not be read.", ACTION_RETRY_LATER, msgServer),
+
+	// File Operations
+	entry(apierrorkeys.FileUploadError, "The file could not be uploaded.", ACTION_RETRY, msgFile),
+	entry(apierrorkeys.FileDownloadError, "The file could not be downloaded.", ACTION_RETRY, msgFile),
+	entry(apierrorkeys.FileEmpty, "The uploaded file is empty.", ACTION_FIX_INPUT, Messages{
+		"en": "The file is empty.",
+		"es": "El archivo está vacío.",
+		"fr": "Le fichier est vide.",
+	}),
+	entry(apierrorkeys.MapKeyNotFound, "A key expected in a map is missing.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.UnauthorizedFileType, "The file type is not allowed.", ACTION_FIX_INPUT, Messages{
+		"en": "This type of file is not allowed.",
+		"es": "Este tipo de archivo no está permitido.",
+		"fr": "Ce type de fichier n'est pas autorisé.",
+	}),
+	entry(apierrorkeys.MismatchedFileType, "The file content does not match its extension or declared type.", ACTION_FIX_INPUT, msgFile),
+	entry(apierrorkeys.ExcelPipelineError, "A spreadsheet could not be processed.", ACTION_FIX_INPUT, msgFile),
+
+	// SMS
+	entry(apierrorkeys.SMSSendError, "A text message could not be sent.", ACTION_RETRY_LATER, Messages{
+		"en": "We could not send the text message. Please try again in a few minutes.",
+		"es": "No pudimos enviar el mensaje de texto. Inténtalo de nuevo en unos minutos.",
+		"fr": "Nous n'avons pas pu envoyer le SMS. Veuillez réessayer dans quelques minutes.",
+	}),
+	entry(apierrorkeys.SMSMsgSent, "The text message was sent.", ACTION_NONE, Messages{
+		"en": "Message sent.",
+		"es": "Mensaje enviado.",
+		"fr": "Message envoyé.",
+	}),
+	entry(apierrorkeys.SMSCodeNotFound, "The sms code is unknown or expired.", ACTION_FIX_INPUT, Messages{
+		"en": "The code is invalid or has expired.",
+		"es": "El código no es válido o ha caducado.",
+		"fr": "Le code est invalide ou a expiré.",
+	}),
+
+	// Upstream services
+	entry(apierrorkeys.HTTPPostReqError, "A request to another service failed.", ACTION_RETRY_LATER, msgUpstream),
+	entry(apierrorkeys.S3ReadError, "A file could not be read from storage.", ACTION_RETRY_LATER, msgUpstream),
+	entry(apierrorkeys.S3WriteError, "A file could not be written to storage.", ACTION_RETRY_LATER, msgUpstream),
+
+	// Internal
+	entry(apierrorkeys.WebSocketError, "The websocket connection failed.", ACTION_RETRY, msgServer),
+	entry(apierrorkeys.UtilityProcessError, "A utility process failed.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.EventError, "An event could not be processed.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.EventSubscriptionError, "An event subscription failed.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.UDFMarshalError, "A user defined field could not be encoded.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.UDFBrokerError, "The user defined field broker failed.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.UDFADDError, "A user defined field could not be added.", ACTION_RETRY_LATER, msgServer),
+	entry(apierrorkeys.GoRoutineRecovery, "A background goroutine panicked and was recovered.", ACTION_NONE, msgServer),
+}
+
+var (
+	catalogMu sync.RWMutex
+	catalog   = make(map[string]CatalogEntry)
+)
+
+func init() {
+	for _, e := range defaultEntries {
+		Register(e)
+	}
+}
+
+// Register adds an entry, or merges into the entry for its key: a non empty Description or Action replaces, Messages add locales
+func Register(e CatalogEntry) {
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	existing, ok := catalog[e.Key]
+	if !ok {
+		existing = CatalogEntry{Key: e.Key, Messages: Messages{}}
+	}
+	if e.Description != "" {
+		existing.Description = e.Description
+	}
+	if e.Action != "" {
+		existing.Action = e.Action
+	}
+	merged := make(Messages, len(existing.Messages)+len(e.Messages))
+	for locale, msg := range existing.Messages {
+		merged[locale] = msg
+	}
+	for locale, msg := range e.Messages {
+		merged[strings.ToLower(locale)] = msg
+	}
+	existing.Messages = merged
+	catalog[e.Key] = existing
+}
+
+// Lookup finds the entry for an Error, the key before the first colon is used, see apireturn.ErrorKeyOf
+func Lookup(errMsg string) (CatalogEntry, bool) {
+	catalogMu.RLock()
+	e, ok := catalog[apireturn.ErrorKeyOf(errMsg)]
+	catalogMu.RUnlock()
+	if ok {
+		e.Status = apireturn.StatusFor(e.Key)
+	}
+	return e, ok
+}
+
+// Entries returns every entry sorted by key
+func Entries() []CatalogEntry {
+	catalogMu.RLock()
+	entries := make([]CatalogEntry, 0, len(catalog))
+	for _, e := range catalog {
+		e.Status = apireturn.StatusFor(e.Key)
+		entries = append(entries, e)
+	}
+	catalogMu.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// Message
+//   - the user facing message for an Error in the best locale of an Accept-Language header
+//   - unknown keys get the SYSTEM_ERROR message, returns the locale used
+func Message(errMsg string, acceptLanguage string) (string, string) {
+	e, ok := Lookup(errMsg)
+	if !ok {
+		e, _ = Lookup(apierrorkeys.SystemError)
+	}
+	locales := make([]string, 0, len(e.Messages))
+	for locale := range e.Messages {
+		locales = append(locales, locale)
+	}
+	locale := MatchLocale(acceptLanguage, locales)
+	return e.Messages[locale], locale
+}
+
+// MatchLocale picks the available locale the Accept-Language header prefers most, "fr-CA" matches "fr",
+// DEFAULT_LOCALE if none match
+func MatchLocale(acceptLanguage string, available []string) string {
+	type wanted struct {
+		tag string
+		q   float64
+	}
+	var prefs []wanted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, wanted{tag: strings.ToLower(tag), q: q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	has := func(locale string) bool {
+		for _, a := range available {
+			if a == locale {
+				return true
+			}
+		}
+		return false
+	}
+	for _, pref := range prefs {
+		if has(pref.tag) {
+			return pref.tag
+		}
+		if base, _, found := strings.Cut(pref.tag, "-"); found && has(base) {
+			return base
+		}
+	}
+	return DEFAULT_LOCALE
+}
+
+var ErrorCatalog_ApiReq apimaster.ApiReqDef = apimaster.ApiReqDef{
+	API:           CATALOG_ROUTE,
+	Method:        apimaster.GETREQ,
+	Desc:          "Error catalog: every error key with its status, description, suggested action and localized messages",
+	OutputData:    apimaster.MakeStructDescriptorMap(new(CatalogEntry)),
+	OutputWrapper: apimaster.MakeStructDescriptorMap(new(apireturn.JsonReturn)),
+	OutputType:    apimaster.TypeOf[[]CatalogEntry](),
+}
+
+// Handler_GetErrorCatalog
+//   - serves Entries in a JsonReturn, cacheable with an ETag so clients revalidate with If-None-Match
+func Handler_GetErrorCatalog(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	entries := Entries()
+	jb, err := json.Marshal(entries)
+	if err != nil {
+		apireturn.ApiJSONReturn(nil, apierrorkeys.JSONMarshalError, &w)
+		return
+	}
+	sum := sha256.Sum256(jb)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	apireturn.ApiJSONReturn(entries, apierrorkeys.NOError, &w)
+}
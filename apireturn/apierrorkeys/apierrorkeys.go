@@ -11,6 +11,8 @@ const (
 	ServeHttpError = "SERVE_HTTP_ERROR"
 	SendMailError  = "SEND_MAIL_ERROR"
 	LogGenError    = "LOG_GEN_ERROR"
+	ShutdownError  = "SHUTDOWN_ERROR"
+	HealthCheckErr = "HEALTH_CHECK_ERROR"
 
 	// Authentication
 	AuthorizationError = "AUTH_ERROR"
@@ -18,6 +20,17 @@ const (
 	SessionExpired     = "SESSION_EXPIRED"
 	APIKeyNotFound     = "API_KEY_NOT_FOUND"
 	AuthHeaderNotFound = "AUTH_HEADER_NOT_FOUND"
+	CSRFError          = "CSRF_ERROR"
+	IPNotAllowed       = "IP_NOT_ALLOWED"
+	APIKeyExpired      = "API_KEY_EXPIRED"
+	APIKeyScopeDenied  = "API_KEY_SCOPE_DENIED"
+	SignatureInvalid   = "SIGNATURE_INVALID"
+	SignatureExpired   = "SIGNATURE_EXPIRED"
+	NonceReplayed      = "NONCE_REPLAYED"
+	AccessTokenInvalid = "ACCESS_TOKEN_INVALID"
+	AccessTokenExpired = "ACCESS_TOKEN_EXPIRED"
+	RefreshTokenError  = "REFRESH_TOKEN_ERROR"
+	RefreshTokenReused = "REFRESH_TOKEN_REUSED"
 
 	//Account
 	AccountError                 = "ACCOUNT_ERROR"
@@ -43,7 +56,11 @@ const (
 	DataConversionError = "DATA_CONVERSION_ERROR"
 
 	// API Requests
-	APIReqError = "API_REQ_ERROR"
+	APIReqError      = "API_REQ_ERROR"
+	MethodNotAllowed = "METHOD_NOT_ALLOWED"
+	RouteDefError    = "ROUTE_DEF_ERROR"
+	RateLimited      = "RATE_LIMITED"
+	RateLimitError   = "RATE_LIMIT_ERROR"
 
 	// Database
 	DBExecError  = "DB_EXEC_ERROR"
@@ -2,12 +2,9 @@ package apireturn
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 
-	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
 	"github.com/rogue-syntax/rs-goapiserver/entities/user"
-	"github.com/rogue-syntax/rs-goapiserver/zerologger"
 )
 
 const (
@@ -27,8 +24,9 @@ type ApiDefinition struct {
 }
 
 type JsonReturn struct {
-	Error string
-	Data  interface{}
+	Error   string
+	Data    interface{}
+	Message string `json:",omitempty"`
 }
 
 type JsonResponse struct {
@@ -46,16 +44,11 @@ type AuthenicatedJsonReturn struct {
 API JSON Return
   - jsonRet : Data to be returned. Can be Interface object, string, int, or nil
   - errMsg : Const string error code from apireturn.AUTH_ERROR
+  - the status and shape of the response follow the request's ResponseMode, see status.go
 */
 
 func ApiJSONReturn(jsonRet interface{}, errMsg string, w *http.ResponseWriter) {
 	if w != nil {
-		jr := JsonReturn{Error: errMsg, Data: jsonRet}
-		jrStr, err := json.Marshal(jr)
-		if err != nil {
-			zerologger.LogError(&err, apierrorkeys.JSONMarshalError, nil)
-			fmt.Fprint(*w, `{ "Error":"`+apierrorkeys.JSONMarshalError+`", Data:"`+err.Error()+`"}`)
-		}
-		fmt.Fprint(*w, string(jrStr))
+		writeReturn(jsonRet, errMsg, ReturnOptions{}, *w)
 	}
 }
@@ -0,0 +1,278 @@
+package apireturn
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/zerologger"
+)
+
+// HTTP statuses and problem responses
+/*
+
+	StatusRegistry maps apierrorkeys to HTTP statuses, how a response uses them depends on its ResponseMode:
+	  - RESPONSE_ENVELOPE: the legacy JsonReturn, always 200 unless a status was written before, the default
+	  - RESPONSE_ENVELOPE_STATUS: the JsonReturn with the status of its Error key
+	  - RESPONSE_PROBLEM: errors as an RFC 7807 application/problem+json ProblemDetails with the status of the key,
+	    successes as the JsonReturn
+
+	DefaultResponseMode is the server wide mode. A request whose Accept header lists application/problem+json gets
+	RESPONSE_PROBLEM whatever the default, so existing clients keep the envelope while new ones opt in.
+	The middleware's ResponseRecorder carries the mode of its request, see ResponseModer.
+
+	An Error like "AUTH_ERROR: session not found" is looked up by the key before the first colon. Keys not in the
+	registry are 500, add application keys with RegisterStatus.
+
+*/
+
+type ResponseMode int
+
+const (
+	RESPONSE_ENVELOPE ResponseMode = iota
+	RESPONSE_ENVELOPE_STATUS
+	RESPONSE_PROBLEM
+)
+
+const (
+	PROBLEM_CONTENT_TYPE = "application/problem+json"
+	JSON_CONTENT_TYPE    = "application/json"
+	DEFAULT_ERROR_STATUS = http.StatusInternalServerError
+)
+
+// DefaultResponseMode is used by requests that do not ask for problem responses, set it before serving
+var DefaultResponseMode = RESPONSE_ENVELOPE
+
+// ProblemTypeBase prefixes the key to make a ProblemDetails Type i.e. "https://docs.example.com/errors/", about:blank if empty
+var ProblemTypeBase = ""
+
+// StatusRegistry maps apierrorkeys to HTTP statuses, see the top of this file
+var StatusRegistry = map[string]int{
+	apierrorkeys.NOError: http.StatusOK,
+
+	// Authentication
+	apierrorkeys.AuthorizationError: http.StatusUnauthorized,
+	apierrorkeys.SessionExpired:     http.StatusUnauthorized,
+	apierrorkeys.APIKeyNotFound:     http.StatusUnauthorized,
+	apierrorkeys.AuthHeaderNotFound: http.StatusUnauthorized,
+	apierrorkeys.LoginFailed:        http.StatusUnauthorized,
+	apierrorkeys.PWIncorrect:        http.StatusUnauthorized,
+	apierrorkeys.CSRFError:          http.StatusForbidden,
+	apierrorkeys.IPNotAllowed:       http.StatusForbidden,
+	apierrorkeys.APIKeyExpired:      http.StatusUnauthorized,
+	apierrorkeys.APIKeyScopeDenied:  http.StatusForbidden,
+	apierrorkeys.SignatureInvalid:   http.StatusUnauthorized,
+	apierrorkeys.SignatureExpired:   http.StatusUnauthorized,
+	apierrorkeys.NonceReplayed:      http.StatusUnauthorized,
+	apierrorkeys.AccessTokenInvalid: http.StatusUnauthorized,
+	apierrorkeys.AccessTokenExpired: http.StatusUnauthorized,
+	apierrorkeys.RefreshTokenError:  http.StatusUnauthorized,
+	apierrorkeys.RefreshTokenReused: http.StatusUnauthorized,
+	apierrorkeys.MiddlewareError:    http.StatusInternalServerError,
+
+	// Account
+	apierrorkeys.NonexistentAccount:           http.StatusNotFound,
+	apierrorkeys.CompanyAuthenicationMismatch: http.StatusForbidden,
+	apierrorkeys.NoCompanyMemeberships:        http.StatusForbidden,
+	apierrorkeys.DefunctCompanyMemeberships:   http.StatusForbidden,
+	apierrorkeys.EmailTaken:                   http.StatusConflict,
+	apierrorkeys.ResourceOwnershipMismatch:    http.StatusForbidden,
+
+	// Input
+	apierrorkeys.InvalidAPIInput:          http.StatusUnprocessableEntity,
+	apierrorkeys.PWReqNotMet:              http.StatusUnprocessableEntity,
+	apierrorkeys.FormFieldValidationError: http.StatusUnprocessableEntity,
+	apierrorkeys.FormFieldUserError:       http.StatusUnprocessableEntity,
+	apierrorkeys.RequiredDataMissing:      http.StatusUnprocessableEntity,
+	apierrorkeys.CantDecode:               http.StatusBadRequest,
+	apierrorkeys.JSONDecodeError:          http.StatusBadRequest,
+	apierrorkeys.InvalidType:              http.StatusBadRequest,
+	apierrorkeys.RequestError:             http.StatusBadRequest,
+	apierrorkeys.PWReqNotFound:            http.StatusNotFound,
+	apierrorkeys.SMSCodeNotFound:          http.StatusNotFound,
+
+	// Requests
+	apierrorkeys.MethodNotAllowed: http.StatusMethodNotAllowed,
+	apierrorkeys.RateLimited:      http.StatusTooManyRequests,
+
+	// Files
+	apierrorkeys.FileEmpty:            http.StatusBadRequest,
+	apierrorkeys.MismatchedFileType:   http.StatusBadRequest,
+	apierrorkeys.UnauthorizedFileType: http.StatusUnsupportedMediaType,
+
+	// Upstream services
+	apierrorkeys.HTTPPostReqError: http.StatusBadGateway,
+	apierrorkeys.SendMailError:    http.StatusBadGateway,
+	apierrorkeys.SMSSendError:     http.StatusBadGateway,
+	apierrorkeys.S3ReadError:      http.StatusBadGateway,
+	apierrorkeys.S3WriteError:     http.StatusBadGateway,
+
+	// Server
+	apierrorkeys.SystemError:  http.StatusInternalServerError,
+	apierrorkeys.APIReqError:  http.StatusInternalServerError,
+	apierrorkeys.DBExecError:  http.StatusInternalServerError,
+	apierrorkeys.DBQueryError: http.StatusInternalServerError,
+	apierrorkeys.PanicError:   http.StatusInternalServerError,
+
+	// Health
+	apierrorkeys.HealthCheckErr: http.StatusServiceUnavailable,
+}
+
+// RegisterStatus maps an application error key to a status
+func RegisterStatus(key string, status int) {
+	StatusRegistry[key] = status
+}
+
+// ErrorKeyOf is the key of an Error, the part before the first colon
+func ErrorKeyOf(errMsg string) string {
+	key, _, _ := strings.Cut(errMsg, ":")
+	return strings.TrimSpace(key)
+}
+
+// StatusFor is the status of an Error, DEFAULT_ERROR_STATUS for unknown keys
+func StatusFor(errMsg string) int {
+	if status, ok := StatusRegistry[ErrorKeyOf(errMsg)]; ok {
+		return status
+	}
+	return DEFAULT_ERROR_STATUS
+}
+
+// ResponseModer
+//   - an http.ResponseWriter that knows the ResponseMode of its request, i.e. middleware.ResponseRecorder
+type ResponseModer interface {
+	ResponseMode() ResponseMode
+}
+
+// headerWriter reports whether a status was already sent, i.e. middleware.ResponseRecorder
+type headerWriter interface {
+	WroteHeader() bool
+}
+
+// ModeForRequest is RESPONSE_PROBLEM if the Accept header lists application/problem+json, else DefaultResponseMode
+func ModeForRequest(r *http.Request) ResponseMode {
+	if r != nil {
+		for _, accept := range r.Header.Values("Accept") {
+			for _, part := range strings.Split(accept, ",") {
+				mediaType, _, _ := strings.Cut(part, ";")
+				if strings.EqualFold(strings.TrimSpace(mediaType), PROBLEM_CONTENT_TYPE) {
+					return RESPONSE_PROBLEM
+				}
+			}
+		}
+	}
+	return DefaultResponseMode
+}
+
+// ResponseModeOf is the mode of w's request, DefaultResponseMode if w does not know it
+func ResponseModeOf(w http.ResponseWriter) ResponseMode {
+	if rm, ok := w.(ResponseModer); ok {
+		return rm.ResponseMode()
+	}
+	return DefaultResponseMode
+}
+
+/*
+ProblemDetails: an RFC 7807 problem response
+  - Type: ProblemTypeBase + key, or about:blank
+  - Title: the text of Status
+  - Detail: the whole Error when it says more than the key
+  - Key: the apierrorkeys key, Data: the Data the envelope would have held
+  - Message: a user facing message, see ReturnOptions
+*/
+type ProblemDetails struct {
+	Type    string      `json:"type"`
+	Title   string      `json:"title"`
+	Status  int         `json:"status"`
+	Detail  string      `json:"detail,omitempty"`
+	Key     string      `json:"key"`
+	Data    interface{} `json:"data,omitempty"`
+	Message string      `json:"message,omitempty"`
+}
+
+// NewProblemDetails builds the problem for an Error
+func NewProblemDetails(data interface{}, errMsg string, status int) ProblemDetails {
+	key := ErrorKeyOf(errMsg)
+	problem := ProblemDetails{Type: "about:blank", Title: http.StatusText(status), Status: status, Key: key, Data: data}
+	if ProblemTypeBase != "" {
+		problem.Type = ProblemTypeBase + key
+	}
+	if errMsg != key {
+		problem.Detail = errMsg
+	}
+	return problem
+}
+
+/*
+API JSON Return with a status
+  - same as ApiJSONReturn, but status is sent in every ResponseMode, i.e. 405 from the router or 429 from RateLimit
+*/
+func ApiJSONReturnStatus(jsonRet interface{}, errMsg string, status int, w *http.ResponseWriter) {
+	ApiJSONReturnWith(jsonRet, errMsg, ReturnOptions{Status: status}, w)
+}
+
+// ReturnOptions
+//   - Status: sent in every ResponseMode when non zero, see ApiJSONReturnStatus
+//   - Message: a user facing message added to the envelope or problem, i.e. from apierrorcatalog.Message
+type ReturnOptions struct {
+	Status  int
+	Message string
+}
+
+// ApiJSONReturnWith is ApiJSONReturn with ReturnOptions
+func ApiJSONReturnWith(jsonRet interface{}, errMsg string, opts ReturnOptions, w *http.ResponseWriter) {
+	if w != nil {
+		writeReturn(jsonRet, errMsg, opts, *w)
+	}
+}
+
+// writeReturn writes the envelope or problem for w's ResponseMode, a zero opts.Status takes the status from the mode
+func writeReturn(jsonRet interface{}, errMsg string, opts ReturnOptions, w http.ResponseWriter) {
+	status := opts.Status
+	mode := ResponseModeOf(w)
+	if status == 0 && mode != RESPONSE_ENVELOPE {
+		status = StatusFor(errMsg)
+	}
+	if mode == RESPONSE_PROBLEM && ErrorKeyOf(errMsg) != apierrorkeys.NOError {
+		if status == 0 {
+			status = StatusFor(errMsg)
+		}
+		problem := NewProblemDetails(jsonRet, errMsg, status)
+		problem.Message = opts.Message
+		jb, err := json.Marshal(problem)
+		if err != nil {
+			zerologger.LogError(&err, apierrorkeys.JSONMarshalError, nil)
+			jb, _ = json.Marshal(NewProblemDetails(nil, apierrorkeys.JSONMarshalError, http.StatusInternalServerError))
+		}
+		writeStatus(w, status, PROBLEM_CONTENT_TYPE)
+		w.Write(jb)
+		return
+	}
+	if mode != RESPONSE_ENVELOPE {
+		writeStatus(w, status, JSON_CONTENT_TYPE)
+	} else {
+		writeStatus(w, status, "")
+	}
+	jr := JsonReturn{Error: errMsg, Data: jsonRet, Message: opts.Message}
+	jrStr, err := json.Marshal(jr)
+	if err != nil {
+		zerologger.LogError(&err, apierrorkeys.JSONMarshalError, nil)
+		fmt.Fprint(w, `{ "Error":"`+apierrorkeys.JSONMarshalError+`", Data:"`+err.Error()+`"}`)
+		return
+	}
+	fmt.Fprint(w, string(jrStr))
+}
+
+// writeStatus sends the status and content type unless a status was already sent
+func writeStatus(w http.ResponseWriter, status int, contentType string) {
+	if hw, ok := w.(headerWriter); ok && hw.WroteHeader() {
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+	}
+}
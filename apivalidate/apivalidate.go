@@ -0,0 +1,318 @@
+package apivalidate
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+// Struct tag validation for api inputs
+/*
+
+	Fields are validated with a `validate` struct tag, rules separated by commas, i.e.
+
+	type SignUpInput struct {
+		Email    string `json:"email" validate:"required,email,max=254"`
+		Plan     string `validate:"oneof=free pro"`
+		Age      *int   `validate:"min=13,max=130"`
+		Username string `validate:"required,min=3,pattern=^[a-z0-9_]+$"`
+	}
+
+	  - required: the field must not be its zero value, a slice or map must not be empty, a pointer must not be nil
+	  - min=n, max=n: numbers by value, strings by character count, slices and maps by length
+	  - oneof=a b c: the value must be one of the space separated options
+	  - email: the value must be an email address
+	  - pattern=regexp: the string must match, pattern must be the last rule since the regexp may contain commas
+
+	A field that is not required and holds its zero value is not checked further, the fields of a zero struct value still are.
+	Nested structs, pointers to structs and slices of structs are validated too, violations name the field by
+	its json path i.e. "items.2.name".
+
+*/
+
+const TAG_NAME = "validate"
+
+var emailRegexp = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
+
+/*
+Rules: the parsed `validate` tag of one field
+*/
+type Rules struct {
+	Required bool
+	Min      *float64
+	Max      *float64
+	OneOf    []string
+	Email    bool
+	Pattern  *regexp.Regexp
+}
+
+// ParseTag parses a `validate` tag, see the top of this file
+func ParseTag(tag string) (Rules, error) {
+	var rules Rules
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "pattern=") {
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+		name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch name {
+		case "":
+		case "required":
+			rules.Required = true
+		case "email":
+			rules.Email = true
+		case "min", "max":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return rules, errors.Wrap(err, apierrorkeys.RouteDefError+": bad "+name+" in validate tag")
+			}
+			if name == "min" {
+				rules.Min = &n
+			} else {
+				rules.Max = &n
+			}
+		case "oneof":
+			rules.OneOf = strings.Fields(arg)
+		case "pattern":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return rules, errors.Wrap(err, apierrorkeys.RouteDefError+": bad pattern in validate tag")
+			}
+			rules.Pattern = re
+		default:
+			return rules, errors.New(apierrorkeys.RouteDefError + ": unknown validate rule " + name)
+		}
+	}
+	return rules, nil
+}
+
+/*
+FieldViolation: one field that failed a rule
+  - Field: the json path of the field i.e. "items.2.name"
+  - Rule: the rule that failed i.e. "required", "min=3", "type"
+  - Msg: a readable reason
+*/
+type FieldViolation struct {
+	Field string
+	Rule  string
+	Msg   string
+}
+
+// ValidationError
+//   - every violation found in an input, return Violations to the client with apierrorkeys.InvalidAPIInput
+type ValidationError struct {
+	Violations []FieldViolation
+}
+
+func (ve *ValidationError) Error() string {
+	parts := make([]string, 0, len(ve.Violations))
+	for _, v := range ve.Violations {
+		parts = append(parts, v.Field+": "+v.Msg)
+	}
+	return apierrorkeys.InvalidAPIInput + ": " + strings.Join(parts, "; ")
+}
+
+// JSONName is the name encoding/json uses for a field, "" if the field is skipped
+func JSONName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+type fieldRules struct {
+	index int
+	name  string
+	rules Rules
+}
+
+var rulesCache sync.Map
+
+// rulesFor parses and caches the rules of every exported field of a struct type
+func rulesFor(t reflect.Type) ([]fieldRules, error) {
+	if cached, ok := rulesCache.Load(t); ok {
+		return cached.([]fieldRules), nil
+	}
+	var out []fieldRules
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := JSONName(field)
+		if name == "" {
+			continue
+		}
+		rules, err := ParseTag(field.Tag.Get(TAG_NAME))
+		if err != nil {
+			return nil, errors.Wrap(err, t.String()+"."+field.Name)
+		}
+		out = append(out, fieldRules{index: i, name: name, rules: rules})
+	}
+	rulesCache.Store(t, out)
+	return out, nil
+}
+
+// Struct
+//   - validates v, a struct or pointer to a struct, against its `validate` tags
+//   - returns a *ValidationError listing every violation, or another error if a tag is malformed
+func Struct(v interface{}) error {
+	var violations []FieldViolation
+	err := walk(reflect.ValueOf(v), "", &violations)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return &ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+func walk(v reflect.Value, path string, violations *[]FieldViolation) error {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			return nil
+		}
+		fields, err := rulesFor(v.Type())
+		if err != nil {
+			return err
+		}
+		for _, f := range fields {
+			fieldPath := joinPath(path, f.name)
+			fv := v.Field(f.index)
+			if !check(fv, fieldPath, f.rules, violations) {
+				continue
+			}
+			err = walk(fv, fieldPath, violations)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			err := walk(v.Index(i), joinPath(path, strconv.Itoa(i)), violations)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// check applies rules to one field, returns false if nested values should not be walked
+func check(v reflect.Value, path string, rules Rules, violations *[]FieldViolation) bool {
+	add := func(rule string, msg string) {
+		*violations = append(*violations, FieldViolation{Field: path, Rule: rule, Msg: msg})
+	}
+	if isEmpty(v) {
+		if rules.Required {
+			add("required", "is required")
+		}
+		// a zero struct value still has its own required fields
+		return v.Kind() == reflect.Struct
+	}
+	for v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+
+	size, sized := measure(v)
+	if rules.Min != nil && sized && size < *rules.Min {
+		add("min="+formatNum(*rules.Min), "must be at least "+formatNum(*rules.Min)+unitOf(v))
+	}
+	if rules.Max != nil && sized && size > *rules.Max {
+		add("max="+formatNum(*rules.Max), "must be at most "+formatNum(*rules.Max)+unitOf(v))
+	}
+	if len(rules.OneOf) > 0 {
+		str := fmt.Sprint(v.Interface())
+		found := false
+		for _, option := range rules.OneOf {
+			if option == str {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("oneof="+strings.Join(rules.OneOf, " "), "must be one of "+strings.Join(rules.OneOf, ", "))
+		}
+	}
+	if v.Kind() == reflect.String {
+		if rules.Email && !emailRegexp.MatchString(v.String()) {
+			add("email", "must be an email address")
+		}
+		if rules.Pattern != nil && !rules.Pattern.MatchString(v.String()) {
+			add("pattern="+rules.Pattern.String(), "must match "+rules.Pattern.String())
+		}
+	}
+	return true
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Invalid:
+		return true
+	}
+	return v.IsZero()
+}
+
+// measure is the value min and max compare against
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), true
+	}
+	return 0, false
+}
+
+func unitOf(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.String:
+		return " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return " items"
+	}
+	return ""
+}
+
+func formatNum(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
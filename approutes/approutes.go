@@ -1,8 +1,14 @@
 package approutes
 
 import (
+	"net/http"
+
+	"github.com/rogue-syntax/rs-goapiserver/apikeys"
 	"github.com/rogue-syntax/rs-goapiserver/apimaster"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorcatalog"
 	"github.com/rogue-syntax/rs-goapiserver/authentication"
+	"github.com/rogue-syntax/rs-goapiserver/authtokens"
+	"github.com/rogue-syntax/rs-goapiserver/health"
 	"github.com/rogue-syntax/rs-goapiserver/mail"
 	"github.com/rogue-syntax/rs-goapiserver/middleware"
 	"github.com/rogue-syntax/rs-goapiserver/signup"
@@ -12,15 +18,24 @@ import (
 var BaseAppRoutes = []middleware.RouteDef{
 	{RouteStr: "/v1/api", HandlerFunc: apimaster.Handler_GetApiReqMapPage, MiddlewareSli: &middleware.RoleBaseReqVerifMiddleware},
 	{RouteStr: "/v1/api-data", HandlerFunc: apimaster.Handler_GetApiReqMap, MiddlewareSli: &middleware.RoleBaseReqVerifMiddleware},
-	{RouteStr: "/v1/app/signIn", HandlerFunc: authentication.Handler_AppSignIn, MiddlewareSli: &middleware.BlankMiddleware},
-	{RouteStr: "/v1/app/signup", HandlerFunc: signup.Handler_AppSignUp, MiddlewareSli: &middleware.BlankMiddleware},
+	{RouteStr: apimaster.OPENAPI_ROUTE, HandlerFunc: apimaster.Handler_GetOpenAPI, MiddlewareSli: &middleware.RoleBaseReqVerifMiddleware, Methods: []string{http.MethodGet}},
+	{RouteStr: health.HEALTHZ_ROUTE, HandlerFunc: health.Handler_Healthz, MiddlewareSli: &middleware.BlankMiddleware, Methods: []string{http.MethodGet}},
+	{RouteStr: health.READYZ_ROUTE, HandlerFunc: health.Handler_Readyz, MiddlewareSli: &middleware.BlankMiddleware, Methods: []string{http.MethodGet}},
+	{RouteStr: apierrorcatalog.CATALOG_ROUTE, HandlerFunc: apierrorcatalog.Handler_GetErrorCatalog, MiddlewareSli: &middleware.BlankMiddleware, ReqDef: &apierrorcatalog.ErrorCatalog_ApiReq, Methods: []string{http.MethodGet}},
+	{RouteStr: "/v1/app/signIn", HandlerFunc: authentication.Handler_AppSignIn, MiddlewareSli: &middleware.BlankMiddleware, Use: []middleware.RequestMiddleware{&middleware.SignInRateLimit}},
+	{RouteStr: authtokens.REFRESH_ROUTE, Typed: middleware.Typed(authtokens.RefreshTokens).Describe("Use up a refresh token for a new access and refresh token pair"), MiddlewareSli: &middleware.BlankMiddleware, Methods: []string{http.MethodPost}, Use: []middleware.RequestMiddleware{&middleware.TokenRefreshRateLimit}},
+	{RouteStr: "/v1/app/signup", HandlerFunc: signup.Handler_AppSignUp, MiddlewareSli: &middleware.BlankMiddleware, Use: []middleware.RequestMiddleware{&middleware.EmailRateLimit}},
 	{RouteStr: "/v1/app/signOut", HandlerFunc: authentication.Handler_AppSignOut, MiddlewareSli: &middleware.ReqVerifMiddleware},
 	{RouteStr: "/v1/app/testReqVerif", HandlerFunc: authentication.Handler_TestReqVerif, MiddlewareSli: &middleware.ReqVerifMiddleware},
 	{RouteStr: "/v1/app/testEmail", HandlerFunc: mail.SendTestEmail_handler, MiddlewareSli: &middleware.BlankMiddleware},
 	{RouteStr: "/v1/app/emailVerificationEP", HandlerFunc: signup.EmailVerifEP_handler, MiddlewareSli: &middleware.BlankMiddleware},
-	{RouteStr: "/v1/app/requestPasswordReset", HandlerFunc: signup.Handler_RequestPasswordReset, MiddlewareSli: &middleware.BlankMiddleware},
-	{RouteStr: "/v1/app/newPWVerificationEP", HandlerFunc: signup.PWVerifEP_handler, MiddlewareSli: &middleware.BlankMiddleware, ReqDef: &signup.PWVerifEP_handler_ApiReq},
+	{RouteStr: "/v1/app/requestPasswordReset", HandlerFunc: signup.Handler_RequestPasswordReset, MiddlewareSli: &middleware.BlankMiddleware, Use: []middleware.RequestMiddleware{&middleware.EmailRateLimit}},
+	{RouteStr: "/v1/app/newPWVerificationEP", HandlerFunc: signup.PWVerifEP_handler, MiddlewareSli: &middleware.BlankMiddleware, ReqDef: &signup.PWVerifEP_handler_ApiReq, Methods: []string{http.MethodPost}, Validate: true},
 	{RouteStr: "/v1/testWS/", HandlerFunc: websockets.TestWS, MiddlewareSli: &middleware.ReqVerifMiddleware},
 	{RouteStr: "/ws/wss/", HandlerFunc: websockets.WsEndpoint, MiddlewareSli: &middleware.ReqVerifMiddleware},
 	{RouteStr: "/v1/test/genApiKey", HandlerFunc: authentication.Handler_GenApiKey, MiddlewareSli: &middleware.ReqVerifMiddleware},
+	{RouteStr: apikeys.ROUTE_PREFIX, Typed: middleware.Typed(apikeys.List).Describe("List the user's api keys"), MiddlewareSli: &middleware.ReqVerifMiddleware, Methods: []string{http.MethodGet}},
+	{RouteStr: apikeys.ROUTE_PREFIX, Typed: middleware.Typed(apikeys.CreateKey).Describe("Create a named api key with scopes and an optional expiry, the key is only returned once"), MiddlewareSli: &middleware.ReqVerifMiddleware, Methods: []string{http.MethodPost}},
+	{RouteStr: apikeys.ROUTE_REVOKE, Typed: middleware.Typed(apikeys.RevokeKey).Describe("Revoke an api key"), MiddlewareSli: &middleware.ReqVerifMiddleware, Methods: []string{http.MethodPost}},
+	{RouteStr: apikeys.ROUTE_ROTATE, Typed: middleware.Typed(apikeys.RotateKey).Describe("Replace an api key, the old key keeps working for grace_seconds"), MiddlewareSli: &middleware.ReqVerifMiddleware, Methods: []string{http.MethodPost}},
 }
@@ -3,29 +3,38 @@ package authentication
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"fmt"
 
 	"encoding/hex"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 
 	"github.com/rogue-syntax/rs-goapiserver/apicontext"
 	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apikeys"
 	"github.com/rogue-syntax/rs-goapiserver/apireturn"
 	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/authtokens"
 	"github.com/rogue-syntax/rs-goapiserver/authutil"
 	"github.com/rogue-syntax/rs-goapiserver/database"
 	"github.com/rogue-syntax/rs-goapiserver/entities/user"
 	"github.com/rogue-syntax/rs-goapiserver/global"
+	"github.com/rogue-syntax/rs-goapiserver/metrics"
 	"github.com/rogue-syntax/rs-goapiserver/routeroles"
+	"github.com/rogue-syntax/rs-goapiserver/tracing"
 	"golang.org/x/crypto/bcrypt"
 )
 
 const (
 	USER_ID_HEADER_KEY = "user-id"
+	AUTH_MODE_TOKEN    = "t"
+	CSRF_COOKIE_KEY    = "kbxc"
+	CSRF_HEADER_KEY    = "X-CSRF-Token"
 )
 
 /*
@@ -38,9 +47,10 @@ user_auth_session issue token should be comapre encrypted:
 
 Authenticate session with kbxs cookie , compare to user_auth_session.token
 Authenticate session with kbxb , compare to user_auth_session.token
-Authenticate one off request with api key in header kbxa , compare to user_api_tok
+Authenticate one off request with api key in header kbxa , compare to user_api_key.secret_hash for a named kbxk_ key, or user_api_tok
 
 browser: user id cookie is kbxu, access token string is kbxs
+browser: csrf token cookie is kbxc, readable by the app and sent back in the X-CSRF-Token header on state changing requests
 non browser app: requests must be sent with kbxb header with token string. token string is returned to client at sign on and per validated request
 
 */
@@ -68,7 +78,7 @@ type UserSession struct {
 func AuthenticateUser(w *http.ResponseWriter, ctx context.Context) (*user.UserExternal, error) {
 	usr, err := apicontext.CtxGetUser(ctx)
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: w})
+		apierrors.HandleError(nil, apierrors.WithCtxReqId(ctx, err), err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: w})
 		return nil, err
 	}
 	return usr, nil
@@ -82,13 +92,18 @@ func Handler_AppSignOut(w http.ResponseWriter, r *http.Request, ctx context.Cont
 
 	if err != nil {
 
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
 		return
 	}
 
-	err = killUserSessionForID_x_Agent(r, true, (*usr).User_id)
+	//a token mode sign out ends the refresh token family
+	if claims, claimsErr := authtokens.CtxGetClaims(ctx); claimsErr == nil {
+		err = authtokens.RevokeFamily(ctx, claims.Sid)
+	} else {
+		err = killUserSessionForID_x_Agent(ctx, r, true, (*usr).User_id)
+	}
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
 		return
 	}
 
@@ -96,7 +111,7 @@ func Handler_AppSignOut(w http.ResponseWriter, r *http.Request, ctx context.Cont
 
 }
 
-func killUserSessionForID_x_Agent(r *http.Request, useCookie bool, user_id_in int) error {
+func killUserSessionForID_x_Agent(ctx context.Context, r *http.Request, useCookie bool, user_id_in int) error {
 
 	// lookup session based on user id and user agent
 	// if request comes from non browser application this may ned to be set by application
@@ -119,7 +134,7 @@ func killUserSessionForID_x_Agent(r *http.Request, useCookie bool, user_id_in in
 	//kbxu user_id cookie must match (*usr)
 	if user_id == user_id_in {
 		user_agent := authutil.Sha1Hash(r.Header.Get("User-Agent"))
-		_, err = database.DB.DB.Exec("call killUserSession(?,?)", user_id, user_agent)
+		_, err = database.DB.DB.ExecContext(ctx, "call killUserSession(?,?)", user_id, user_agent)
 		if err != nil {
 			return err
 		}
@@ -135,18 +150,29 @@ func killUserSessionForID_x_Agent(r *http.Request, useCookie bool, user_id_in in
 //   - - an empty value will result in a samesite cookie being issued to the browser for browser app session authenication
 //   - - conventipon for 'kbxb' will be the strings 'true', or the post body variable should be left unset
 //   - - i.e. "kbxb: false" will result in a header token being retuned, just like "kbxb: true"
+//   - kbxt: a non empty value returns an authtokens.TokenPair for auth mode "t" instead of a session, see authtokens
 func Handler_AppSignIn(w http.ResponseWriter, r *http.Request, ctx context.Context) {
-	usr, err := verifyUser(r.FormValue("pw"), r.FormValue("em"))
+	usr, err := verifyUser(ctx, r.FormValue("pw"), r.FormValue("em"))
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
 		return
 	}
 	// password is authrnticated
+	//issue stateless access and refresh tokens
+	if r.FormValue("kbxt") != "" {
+		pair, err := authtokens.IssuePair(ctx, (*usr).User_id, (*usr).User_role_id)
+		if err != nil {
+			apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+			return
+		}
+		apireturn.ApiJSONReturn(pair, apierrorkeys.NOError, &w)
+		return
+	}
 	//issue token to cookie, or to header token
 	isKbxb := r.FormValue("kbxb")
-	userToken, err := issueToken((*usr).User_id, isKbxb, w, r)
+	userToken, err := issueToken(ctx, (*usr).User_id, isKbxb, w, r)
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
 		return
 	}
 
@@ -165,14 +191,14 @@ func Handler_AppSignIn(w http.ResponseWriter, r *http.Request, ctx context.Conte
 
 func HandleAppBrowserSignIn(pw string, em string, w http.ResponseWriter, r *http.Request) (*user.UserExternal, error) {
 	var userExternal user.UserExternal
-	usr, err := verifyUser(pw, em)
+	usr, err := verifyUser(r.Context(), pw, em)
 	if err != nil {
 		return &userExternal, err
 	}
 	// password is authrnticated
 	//issue token to cookie, or to header token
 	isKbxb := r.FormValue("kbxb")
-	_, err = issueToken((*usr).User_id, isKbxb, w, r)
+	_, err = issueToken(r.Context(), (*usr).User_id, isKbxb, w, r)
 	if err != nil {
 		return &userExternal, err
 	}
@@ -181,7 +207,7 @@ func HandleAppBrowserSignIn(pw string, em string, w http.ResponseWriter, r *http
 	return &userExternal, nil
 }
 
-func issueToken(user_id int, isKbxb string, w http.ResponseWriter, r *http.Request) (string, error) {
+func issueToken(ctx context.Context, user_id int, isKbxb string, w http.ResponseWriter, r *http.Request) (string, error) {
 	var uSession UserSession
 
 	bytesR := make([]byte, 16)
@@ -202,7 +228,7 @@ func issueToken(user_id int, isKbxb string, w http.ResponseWriter, r *http.Reque
 		//isKbxb value of 'kbxb' from request body not present so issue kookie
 		issueSessionCookie(uSession.User_id, userToken, sExpiration, w)
 	}
-	err := UpdateUserSession(uSession)
+	err := UpdateUserSessionContext(ctx, uSession)
 	if err != nil {
 		return userToken, err
 	}
@@ -251,14 +277,68 @@ func issueSessionCookie(user_id int, userToken string, sExpiration time.Time, w
 		SameSite: http.SameSiteStrictMode,
 	}
 
+	//csrf token, not HttpOnly so the app can copy it to the X-CSRF-Token header
+	csrfToken := authutil.CSRFTokenFor(userToken)
+	cookie5 := http.Cookie{Name: CSRF_COOKIE_KEY,
+		Value:    csrfToken,
+		Expires:  sExpiration,
+		Domain:   global.EnvVars.Apiserver,
+		Path:     "/",
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	cookie6 := http.Cookie{Name: CSRF_COOKIE_KEY,
+		Value:    csrfToken,
+		Expires:  sExpiration,
+		Domain:   "www." + global.EnvVars.Apiserver,
+		Path:     "/",
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
 	http.SetCookie(w, &cookie)
 	http.SetCookie(w, &cookie2)
 	http.SetCookie(w, &cookie3)
 	http.SetCookie(w, &cookie4)
+	http.SetCookie(w, &cookie5)
+	http.SetCookie(w, &cookie6)
+}
+
+// VerifyCSRF
+//   - for cookie authenticated, state changing requests, the X-CSRF-Token header must match the kbxc cookie issued at sign in
+//   - the token is derived from the kbxs session token, so it is checked against the session cookie, not just the kbxc cookie
+//   - GET, HEAD, OPTIONS and TRACE are not checked
+//   - requests carrying a kbxa, kbxb, X-Kbx-Signature or Authorization header are not checked, a cross site page can not set those headers
+//   - requests without a kbxs cookie are not checked, there is no cookie session to ride on
+func VerifyCSRF(r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return nil
+	}
+	if r.Header.Get("kbxa") != "" || r.Header.Get("kbxb") != "" || r.Header.Get(SIGNATURE_HEADER_KEY) != "" || r.Header.Get("Authorization") != "" {
+		return nil
+	}
+	cookie, err := r.Cookie("kbxs")
+	if err != nil {
+		return nil
+	}
+	headerToken := r.Header.Get(CSRF_HEADER_KEY)
+	if headerToken == "" {
+		return errors.New(apierrorkeys.CSRFError + ": missing " + CSRF_HEADER_KEY + " header")
+	}
+	if subtle.ConstantTimeCompare([]byte(headerToken), []byte(authutil.CSRFTokenFor(cookie.Value))) != 1 {
+		return errors.New(apierrorkeys.CSRFError + ": " + CSRF_HEADER_KEY + " header does not match the session")
+	}
+	return nil
 }
 
 func UpdateUserSession(uSession UserSession) error {
-	_, err := database.DB.Exec("call UpdateUserSession(?,?,?,?,?,?,?)",
+	return UpdateUserSessionContext(context.Background(), uSession)
+}
+
+func UpdateUserSessionContext(ctx context.Context, uSession UserSession) error {
+	_, err := database.DB.ExecContext(ctx, "call UpdateUserSession(?,?,?,?,?,?,?)",
 		uSession.User_id,
 		uSession.Token,
 		uSession.Updated_at,
@@ -293,12 +373,14 @@ func pwVerif(hString *string, pwIn *string) (bool, error) {
 //   - Attempts to find user by email using user.FindUserInternalByEmail
 //   - Attempts to get positive comparision between submitted pw and hashed pw from database user record
 //   - Will either return a non nil error, or a user.UserInternal object
-func verifyUser(pw string, em string) (*user.UserInternal, error) {
-	usr, err := user.FindUserInternalByEmail(em)
+func verifyUser(ctx context.Context, pw string, em string) (*user.UserInternal, error) {
+	usr, err := user.FindUserInternalByEmailContext(ctx, em)
 	if err != nil {
 		return usr, err
 	}
+	_, span := tracing.StartChild(ctx, "bcrypt compare", tracing.KIND_INTERNAL)
 	isAuthentic, err := pwVerif(&usr.User_pw, &pw)
+	span.End()
 	if err != nil {
 		return usr, err
 	}
@@ -309,27 +391,29 @@ func verifyUser(pw string, em string) (*user.UserInternal, error) {
 	return usr, err
 }
 
+// Handler_GenApiKey
+//   - Deprecated: replaces the user's single legacy user_api_tok, use the named keys at /v1/apikeys, see apikeys
 func Handler_GenApiKey(w http.ResponseWriter, r *http.Request, ctx context.Context) {
 
 	usr, err := apicontext.CtxGetUser(ctx)
 
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
 		return
 	}
 
 	hexStrForClient, bytesForDB, err := authutil.MakeAuthToken()
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
 		return
 	}
 	//return hex string to user
 	//save sha256 hashed -> hex string to database
 
 	hashForStorage := authutil.HashTokenBytes(bytesForDB)
-	_, err = database.DB.Exec("call UpdateUserApiTok(?,?)", (*usr).User_id, hashForStorage)
+	_, err = database.DB.ExecContext(ctx, "call UpdateUserApiTok(?,?)", (*usr).User_id, hashForStorage)
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
 		return
 	}
 	apiKeyReturn := ApiKeyReturn{ApiSecret: hexStrForClient,
@@ -353,7 +437,7 @@ func Handler_TestReqVerif(w http.ResponseWriter, r *http.Request, ctx context.Co
 	usr, err := apicontext.CtxGetUser(ctx)
 
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
 		return
 	}
 
@@ -366,7 +450,7 @@ func compareAndVerify(user_id int, userToken string, hasedToken string, ctx cont
 		return ctx, err
 	}
 
-	usr, err := user.FindUserExternalByUser_id(user_id)
+	usr, err := user.FindUserExternalByUser_idContext(ctx, user_id)
 	if err != nil {
 		return ctx, err
 	}
@@ -377,15 +461,30 @@ func compareAndVerify(user_id int, userToken string, hasedToken string, ctx cont
 
 // Verify with api
 //   - Branched from VerifyRequest
+//   - a named key, kbxk_<key id>.<secret>, is found by its key id and must have a scope for routeString, see apikeys
+//   - the key is put in the context with apikeys.CtxWithKey
+//   - any other kbxa value is the legacy user_api_tok of the user in the user-id header
 func VerifyWithApi(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	apiKey := r.Header.Get("kbxa")
-	if apiKey != "" {
+	if apikeys.IsKey(apiKey) {
+		k, err := apikeys.Verify(ctx, apiKey, routeString)
+		if err != nil {
+			return ctx, err
+		}
+		usr, err := user.FindUserExternalByUser_idContext(ctx, k.User_id)
+		if err != nil {
+			return ctx, err
+		}
+		ctx = apicontext.CtxWithUser(ctx, usr)
+		ctx = apikeys.CtxWithKey(ctx, k)
+		return ctx, nil
+	} else if apiKey != "" {
 		//user_id, err := strconv.Atoi(r.FormValue(USER_ID_HEADER_KEY))
 		user_id, err := strconv.Atoi(r.Header.Get(USER_ID_HEADER_KEY))
 		if err != nil {
 			return ctx, err
 		}
-		apiKeyHash, err := user.FindApiKeyByUser_id(user_id)
+		apiKeyHash, err := user.FindApiKeyByUser_idContext(ctx, user_id)
 		if err != nil {
 			return ctx, err
 		}
@@ -397,12 +496,35 @@ func VerifyWithApi(ctx context.Context, routeString string, w http.ResponseWrite
 	}
 }
 
+// Verify with token
+//   - Branched from VerifyRequest
+//   - checks the access token in the Authorization header without a database call, see authtokens
+//   - the context user only has User_id and User_role_id set, from the token, and the claims are put in the context
+//     with authtokens.CtxWithClaims
+func VerifyWithToken(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), authtokens.TOKEN_TYPE+" ")
+	if !ok || token == "" {
+		return ctx, errors.New(apierrorkeys.AuthHeaderNotFound)
+	}
+	claims, err := authtokens.Verify(token, time.Now())
+	if err != nil {
+		return ctx, err
+	}
+	user_id, err := claims.User_id()
+	if err != nil {
+		return ctx, errors.New(apierrorkeys.AccessTokenInvalid)
+	}
+	ctx = apicontext.CtxWithUser(ctx, &user.UserExternal{User_id: user_id, User_role_id: claims.Role})
+	ctx = authtokens.CtxWithClaims(ctx, claims)
+	return ctx, nil
+}
+
 // Verify with header
 //   - Branched from VerifyRequest
 func VerifyWithHeader(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	apiKey := r.Header.Get("kbxb")
 	if apiKey != "" {
-		uSession, err := getUserSessionForID_x_Agent(r, false)
+		uSession, err := getUserSessionForID_x_Agent(ctx, r, false)
 		if err != nil {
 			return ctx, err
 		}
@@ -426,7 +548,7 @@ func VerifyWithCookie(ctx context.Context, routeString string, w http.ResponseWr
 		//cookie found
 		apiKey = cookie.Value
 	}
-	uSession, err := getUserSessionForID_x_Agent(r, true)
+	uSession, err := getUserSessionForID_x_Agent(ctx, r, true)
 	if err != nil {
 		return ctx, err
 	}
@@ -438,7 +560,7 @@ func VerifyWithCookie(ctx context.Context, routeString string, w http.ResponseWr
 
 	//dont reissue on every request to avoid sync issues
 	/*
-		_, err = issueToken(uSession.User_id, "", w, r)
+		_, err = issueToken(ctx, uSession.User_id, "", w, r)
 	*/
 	return ctx, nil
 
@@ -456,22 +578,49 @@ func VerifyWithCookie(ctx context.Context, routeString string, w http.ResponseWr
 //   - Authenticate one off request with api key in header kbxa , compare to user_api_tok
 //   - - Purpose of VerifyWithAPI with authBode a : kbxa header isto provide per prequest API authentication for third parties accessing data via API RPC calls
 //   - - requires post body : authMode "a"
+//   - - a named kbxk_ key from /v1/apikeys is limited to its scopes, the legacy user_api_tok requires header: user-id
+//   - Authenticate a request signed with a named api key, compare the X-Kbx-Signature HMAC to user_api_key.secret_hash
+//   - - Purpose of VerifyWithSignature with authMode s : the kbxa secret is never sent, and a captured request can not be replayed, see signature.go
+//   - - requires post body : authMode "s"
+//   - Authenticate a stateless access token from sign in with kbxt, in the header Authorization: Bearer <token>
+//   - - Purpose of VerifyWithToken with authMode t : no session lookup or user load per request, see authtokens
+//   - - requires post body : authMode "t"
 func VerifyRequest(ctx context.Context, routeString string, authMode string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	if authMode == "a" {
 		ctx, err := VerifyWithApi(ctx, routeString, w, r)
+		countAuthFailure(err, "api_key")
+		errx := errors.Wrap(err, apierrorkeys.AuthorizationError)
+		return ctx, errx
+	} else if authMode == AUTH_MODE_SIGNED {
+		ctx, err := VerifyWithSignature(ctx, routeString, w, r)
+		countAuthFailure(err, "signature")
+		errx := errors.Wrap(err, apierrorkeys.AuthorizationError)
+		return ctx, errx
+	} else if authMode == AUTH_MODE_TOKEN {
+		ctx, err := VerifyWithToken(ctx, routeString, w, r)
+		countAuthFailure(err, "token")
 		errx := errors.Wrap(err, apierrorkeys.AuthorizationError)
 		return ctx, errx
 	} else if authMode == "b" {
 		ctx, err := VerifyWithHeader(ctx, routeString, w, r)
+		countAuthFailure(err, "header")
 		errx := errors.Wrap(err, apierrorkeys.AuthorizationError)
 		return ctx, errx
 	} else {
 		ctx, err := VerifyWithCookie(ctx, routeString, w, r)
+		countAuthFailure(err, "cookie")
 		errx := errors.Wrap(err, apierrorkeys.AuthorizationError)
 		return ctx, errx
 	}
 }
 
+// countAuthFailure records a failed VerifyRequest in metrics.AuthFailuresTotal
+func countAuthFailure(err error, mode string) {
+	if err != nil {
+		metrics.AuthFailuresTotal.Inc(mode)
+	}
+}
+
 func tokenCompare(userToken string, sessionToken string) error {
 
 	tBytes, err := hex.DecodeString(userToken)
@@ -505,7 +654,7 @@ func GetUserAgentHashFromRequest(r *http.Request) string {
 	return user_agent
 }
 
-func getUserSessionForID_x_Agent(r *http.Request, useCookie bool) (UserSession, error) {
+func getUserSessionForID_x_Agent(ctx context.Context, r *http.Request, useCookie bool) (UserSession, error) {
 	var uSession UserSession
 	// lookup session based on user id and user agent
 	// if request comes from non browser application this may ned to be set by application
@@ -527,7 +676,7 @@ func getUserSessionForID_x_Agent(r *http.Request, useCookie bool) (UserSession,
 
 	user_agent := authutil.Sha1Hash(r.Header.Get("User-Agent"))
 
-	err = database.DB.Get(&uSession, "call getUserSession(?,?)", user_id, user_agent)
+	err = database.DB.GetContext(ctx, &uSession, "call getUserSession(?,?)", user_id, user_agent)
 	if err != nil {
 		return uSession, err
 	}
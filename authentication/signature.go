@@ -0,0 +1,278 @@
+package authentication
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rogue-syntax/rs-goapiserver/apicontext"
+	"github.com/rogue-syntax/rs-goapiserver/apikeys"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/entities/user"
+)
+
+// Signed requests, auth mode "s"
+/*
+
+	A named api key from /v1/apikeys can sign each request with its signing secret instead of sending its secret in
+	kbxa, so a logged header or a leaking proxy never exposes the key. A signed request is sent with auth-mode=s and
+	the headers
+
+	  X-Kbx-Key-Id:    the key id, the part of kbxk_<key id>.<secret> before the dot
+	  X-Kbx-Timestamp: unix seconds when the request was signed
+	  X-Kbx-Nonce:     16 to 128 random characters of [A-Za-z0-9_-], never reused
+	  X-Kbx-Signature: the hex HMAC-SHA256 of the string to sign under apikeys.SigningKey(signing secret)
+
+	The string to sign is these lines joined by "\n", see StringToSign:
+
+	  KBX-HMAC-SHA256
+	  POST                   the method
+	  /v1/apikeys            the escaped path
+	  auth-mode=s&page=2     the query, sorted by key as url.Values.Encode does
+	  1700000000             X-Kbx-Timestamp
+	  4f1c...                X-Kbx-Nonce
+	  e3b0c442...            the hex SHA-256 of the body, of "" without a body
+
+	A request is refused if its timestamp is more than SignatureClockSkew from the server clock, or if the key
+	already used its nonce within twice that window. Go clients can sign with SignRequest. The signing secret and
+	how the signing key is derived from it are described in apikeys/signing.go.
+
+	Nonces are kept in DefaultNonceStore, an in-memory store, implement NonceStore to share them between
+	instances. If the store errors the request is refused. Bodies over MaxSignedBodyBytes can not be signed.
+
+*/
+
+const (
+	AUTH_MODE_SIGNED    = "s"
+	SIGNATURE_ALGORITHM = "KBX-HMAC-SHA256"
+
+	KEY_ID_HEADER_KEY    = "X-Kbx-Key-Id"
+	TIMESTAMP_HEADER_KEY = "X-Kbx-Timestamp"
+	NONCE_HEADER_KEY     = "X-Kbx-Nonce"
+	SIGNATURE_HEADER_KEY = "X-Kbx-Signature"
+)
+
+// SignatureClockSkew: how far a signed request's timestamp may be from the server clock, either way
+var SignatureClockSkew = 5 * time.Minute
+
+// MaxSignedBodyBytes: the largest body a signed request may have
+var MaxSignedBodyBytes int64 = 10 << 20
+
+// ErrSignedBodyTooLarge: the body of a signed request is over MaxSignedBodyBytes, the router refuses it with 413
+var ErrSignedBodyTooLarge = errors.New(apierrorkeys.SignatureInvalid + ": signed body is too large")
+
+var nonceRegexp = regexp.MustCompile("^[A-Za-z0-9_-]{16,128}$")
+
+// NonceStore
+//   - remembers the nonces of signed requests, implement for a shared backend
+//   - Use records key until now+ttl and reports false if key was already recorded, it must be safe for concurrent use
+type NonceStore interface {
+	Use(ctx context.Context, key string, ttl time.Duration, now time.Time) (bool, error)
+}
+
+// MemoryNonceStore
+//   - an in-memory NonceStore for a single instance, expired nonces are swept as it is used
+type MemoryNonceStore struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+	uses    int
+}
+
+// how many Uses between sweeps of expired nonces
+const nonceSweepEvery = 1024
+
+func NewMemoryNonceStore() *MemoryNonceStore {
+	return &MemoryNonceStore{expires: make(map[string]time.Time)}
+}
+
+// DefaultNonceStore is where VerifyWithSignature records nonces
+var DefaultNonceStore NonceStore = NewMemoryNonceStore()
+
+func (s *MemoryNonceStore) Use(ctx context.Context, key string, ttl time.Duration, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uses++
+	if s.uses%nonceSweepEvery == 0 {
+		for k, exp := range s.expires {
+			if now.After(exp) {
+				delete(s.expires, k)
+			}
+		}
+	}
+	if exp, ok := s.expires[key]; ok && !now.After(exp) {
+		return false, nil
+	}
+	s.expires[key] = now.Add(ttl)
+	return true, nil
+}
+
+// StringToSign is what a signed request's X-Kbx-Signature covers, see the top of this file
+func StringToSign(method string, u *url.URL, timestamp string, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		SIGNATURE_ALGORITHM,
+		strings.ToUpper(method),
+		u.EscapedPath(),
+		u.Query().Encode(),
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+// signedBodyCloser keeps the original body's Closer when a body is handed back partly read
+type signedBodyCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// BufferSignedBody
+//   - keeps the body of a request with an X-Kbx-Signature for VerifyWithSignature, in r.Body and r.GetBody
+//   - called by the router before ParseForm consumes form bodies
+//   - a body over MaxSignedBodyBytes is handed back unread and is ErrSignedBodyTooLarge, r.GetBody then
+//     keeps failing so a later VerifyWithSignature refuses the request instead of buffering what is left
+func BufferSignedBody(r *http.Request) error {
+	if r.Header.Get(SIGNATURE_HEADER_KEY) == "" || r.GetBody != nil || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxSignedBodyBytes+1))
+	if err != nil {
+		err = errors.Wrap(err, apierrorkeys.SignatureInvalid)
+		r.GetBody = func() (io.ReadCloser, error) { return nil, err }
+		return err
+	}
+	if int64(len(body)) > MaxSignedBodyBytes {
+		r.Body = signedBodyCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+		r.GetBody = func() (io.ReadCloser, error) { return nil, ErrSignedBodyTooLarge }
+		return ErrSignedBodyTooLarge
+	}
+	r.Body = signedBodyCloser{Reader: bytes.NewReader(body), Closer: r.Body}
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+// signedBody is the whole body of a signed request, without consuming r.Body
+func signedBody(r *http.Request) ([]byte, error) {
+	err := BufferSignedBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.GetBody == nil {
+		return nil, nil
+	}
+	rc, err := r.GetBody()
+	if err != nil {
+		return nil, errors.Wrap(err, apierrorkeys.SignatureInvalid)
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Verify with signature
+//   - Branched from VerifyRequest
+//   - checks a request signed with a named api key, see the top of this file
+//   - the key is put in the context with apikeys.CtxWithKey
+func VerifyWithSignature(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	key_id := r.Header.Get(KEY_ID_HEADER_KEY)
+	timestamp := r.Header.Get(TIMESTAMP_HEADER_KEY)
+	nonce := r.Header.Get(NONCE_HEADER_KEY)
+	signature := r.Header.Get(SIGNATURE_HEADER_KEY)
+	if key_id == "" || timestamp == "" || nonce == "" || signature == "" {
+		return ctx, errors.New(apierrorkeys.SignatureInvalid + ": missing signature headers")
+	}
+	if !nonceRegexp.MatchString(nonce) {
+		return ctx, errors.New(apierrorkeys.SignatureInvalid + ": bad nonce")
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ctx, errors.New(apierrorkeys.SignatureInvalid + ": bad timestamp")
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(unix, 0))
+	if skew > SignatureClockSkew || skew < -SignatureClockSkew {
+		return ctx, errors.New(apierrorkeys.SignatureExpired + ": timestamp is " + skew.Round(time.Second).String() + " from the server clock")
+	}
+	body, err := signedBody(r)
+	if err != nil {
+		return ctx, err
+	}
+
+	k, err := apikeys.VerifySignature(ctx, key_id, StringToSign(r.Method, r.URL, timestamp, nonce, body), signature, routeString)
+	if err != nil {
+		return ctx, err
+	}
+	// only a valid signature uses up its nonce, so forged requests can not fill the store
+	fresh, err := DefaultNonceStore.Use(ctx, key_id+":"+nonce, 2*SignatureClockSkew, now)
+	if err != nil {
+		return ctx, errors.Wrap(err, apierrorkeys.SystemError)
+	}
+	if !fresh {
+		return ctx, errors.New(apierrorkeys.NonceReplayed)
+	}
+
+	usr, err := user.FindUserExternalByUser_idContext(ctx, k.User_id)
+	if err != nil {
+		return ctx, err
+	}
+	ctx = apicontext.CtxWithUser(ctx, usr)
+	ctx = apikeys.CtxWithKey(ctx, k)
+	return ctx, nil
+}
+
+// SignRequest
+//   - signs r for auth mode "s" with the Key_id and Signing_secret of a key from /v1/apikeys, for Go clients
+//   - add auth-mode=s to r.URL before signing, the query is signed
+//   - reads the body through r.GetBody, or buffers it into r.Body and r.GetBody
+func SignRequest(r *http.Request, key_id string, signingSecret string, now time.Time) error {
+	signingKey, err := apikeys.SigningKey(signingSecret)
+	if err != nil {
+		return err
+	}
+	var body []byte
+	if r.GetBody != nil {
+		rc, err := r.GetBody()
+		if err != nil {
+			return err
+		}
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	} else if r.Body != nil && r.Body != http.NoBody {
+		body, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	r.Header.Set(KEY_ID_HEADER_KEY, key_id)
+	r.Header.Set(TIMESTAMP_HEADER_KEY, timestamp)
+	r.Header.Set(NONCE_HEADER_KEY, nonce)
+	r.Header.Set(SIGNATURE_HEADER_KEY, apikeys.Sign(signingKey, StringToSign(r.Method, r.URL, timestamp, nonce, body)))
+	return nil
+}
@@ -0,0 +1,185 @@
+package authentication
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogue-syntax/rs-goapiserver/apikeys"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+func TestStringToSign(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		want   string
+	}{
+		{
+			"no body", "get", "/v1/apikeys?page=2&auth-mode=s", "",
+			"KBX-HMAC-SHA256\nGET\n/v1/apikeys\nauth-mode=s&page=2\n1700000000\nnonce\n" +
+				"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+		{
+			"body and escaped path", "POST", "/v1/a%20b?auth-mode=s", "x=1",
+			"KBX-HMAC-SHA256\nPOST\n/v1/a%20b\nauth-mode=s\n1700000000\nnonce\n" +
+				"1f206b11c23e28cc250ded7fc0098d3823a8467a54340f1ac4e535cb8544493f",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := StringToSign(tt.method, u, "1700000000", "nonce", []byte(tt.body))
+			if got != tt.want {
+				t.Errorf("StringToSign = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	ttl := time.Minute
+	s := NewMemoryNonceStore()
+	steps := []struct {
+		name string
+		key  string
+		at   time.Time
+		want bool
+	}{
+		{"first use", "k1:n1", now, true},
+		{"replay", "k1:n1", now.Add(time.Second), false},
+		{"replay at ttl", "k1:n1", now.Add(ttl), false},
+		{"other nonce", "k1:n2", now, true},
+		{"same nonce other key", "k2:n1", now, true},
+		{"after ttl", "k1:n1", now.Add(ttl + time.Second), true},
+		{"replay of the renewed nonce", "k1:n1", now.Add(ttl + 2*time.Second), false},
+	}
+	for _, step := range steps {
+		fresh, err := s.Use(ctx, step.key, ttl, step.at)
+		if err != nil || fresh != step.want {
+			t.Errorf("%s: Use = %v, %v, want %v", step.name, fresh, err, step.want)
+		}
+	}
+}
+
+func TestMemoryNonceStoreSweep(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	s := NewMemoryNonceStore()
+	for i := 0; i < nonceSweepEvery-1; i++ {
+		s.Use(ctx, "k:"+strconv.Itoa(i), time.Second, now)
+	}
+	// the sweep runs on this Use, after every earlier nonce expired
+	s.Use(ctx, "k:last", time.Second, now.Add(time.Minute))
+	if len(s.expires) != 1 {
+		t.Errorf("%d nonces kept after the sweep, want 1", len(s.expires))
+	}
+}
+
+func TestVerifyWithSignatureRejects(t *testing.T) {
+	now := time.Now()
+	ts := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+	tests := []struct {
+		name      string
+		key_id    string
+		timestamp string
+		nonce     string
+		signature string
+		wantErr   string
+	}{
+		{"missing key id", "", ts(0), "0123456789abcdef", "ab", apierrorkeys.SignatureInvalid},
+		{"missing signature", "k", ts(0), "0123456789abcdef", "", apierrorkeys.SignatureInvalid},
+		{"short nonce", "k", ts(0), "0123", "ab", apierrorkeys.SignatureInvalid},
+		{"nonce with bad characters", "k", ts(0), "0123456789abcdef/", "ab", apierrorkeys.SignatureInvalid},
+		{"timestamp not a number", "k", "soon", "0123456789abcdef", "ab", apierrorkeys.SignatureInvalid},
+		{"too old", "k", ts(-SignatureClockSkew - time.Minute), "0123456789abcdef", "ab", apierrorkeys.SignatureExpired},
+		{"too far ahead", "k", ts(SignatureClockSkew + time.Minute), "0123456789abcdef", "ab", apierrorkeys.SignatureExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/a?auth-mode=s", nil)
+			r.Header.Set(KEY_ID_HEADER_KEY, tt.key_id)
+			r.Header.Set(TIMESTAMP_HEADER_KEY, tt.timestamp)
+			r.Header.Set(NONCE_HEADER_KEY, tt.nonce)
+			r.Header.Set(SIGNATURE_HEADER_KEY, tt.signature)
+			_, err := VerifyWithSignature(context.Background(), "/v1/a", httptest.NewRecorder(), r)
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Fatalf("VerifyWithSignature error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBufferSignedBody(t *testing.T) {
+	prev := MaxSignedBodyBytes
+	MaxSignedBodyBytes = 8
+	defer func() { MaxSignedBodyBytes = prev }()
+
+	r := httptest.NewRequest("POST", "/v1/a", strings.NewReader("x=1&y=2"))
+	r.Header.Set(SIGNATURE_HEADER_KEY, "ab")
+	body, err := signedBody(r)
+	if err != nil || string(body) != "x=1&y=2" {
+		t.Fatalf("signedBody = %q, %v", body, err)
+	}
+	// the body is still there for ParseForm and the handler
+	rest, _ := io.ReadAll(r.Body)
+	if string(rest) != "x=1&y=2" {
+		t.Errorf("r.Body after buffering = %q", rest)
+	}
+
+	r = httptest.NewRequest("POST", "/v1/a", strings.NewReader("0123456789"))
+	r.Header.Set(SIGNATURE_HEADER_KEY, "ab")
+	if err := BufferSignedBody(r); err == nil || !strings.HasPrefix(err.Error(), apierrorkeys.SignatureInvalid) {
+		t.Fatalf("BufferSignedBody over the limit error = %v", err)
+	}
+	rest, _ = io.ReadAll(r.Body)
+	if string(rest) != "0123456789" {
+		t.Errorf("r.Body after a refused body = %q", rest)
+	}
+	// the drained body is not buffered again, VerifyWithSignature fails closed
+	if body, err := signedBody(r); err == nil {
+		t.Errorf("signedBody after a refused body = %q, want an error", body)
+	}
+}
+
+func TestSignRequest(t *testing.T) {
+	signingSecret := strings.Repeat("ab", 32)
+	now := time.Unix(1700000000, 0)
+	r := httptest.NewRequest("POST", "/v1/a?auth-mode=s", strings.NewReader(`{"x":1}`))
+	if err := SignRequest(r, "aaaaaaaaaaaaaaaa", signingSecret, now); err != nil {
+		t.Fatal(err)
+	}
+	if r.Header.Get(KEY_ID_HEADER_KEY) != "aaaaaaaaaaaaaaaa" || r.Header.Get(TIMESTAMP_HEADER_KEY) != "1700000000" {
+		t.Fatalf("headers = %v", r.Header)
+	}
+	nonce := r.Header.Get(NONCE_HEADER_KEY)
+	if !nonceRegexp.MatchString(nonce) {
+		t.Fatalf("nonce %q does not pass VerifyWithSignature's check", nonce)
+	}
+	signingKey, err := apikeys.SigningKey(signingSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := apikeys.Sign(signingKey, StringToSign("POST", r.URL, "1700000000", nonce, []byte(`{"x":1}`)))
+	if got := r.Header.Get(SIGNATURE_HEADER_KEY); got != want {
+		t.Errorf("signature = %s, want %s", got, want)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != `{"x":1}` {
+		t.Errorf("body after signing = %q", body)
+	}
+	if err := SignRequest(r, "aaaaaaaaaaaaaaaa", "not hex", now); err == nil {
+		t.Error("SignRequest took a malformed signing secret")
+	}
+}
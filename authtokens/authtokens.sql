@@ -0,0 +1,15 @@
+CREATE TABLE user_refresh_token (
+	token_hash CHAR(128) NOT NULL,
+	family_id CHAR(32) NOT NULL,
+	user_id INT NOT NULL,
+	created_at DATETIME(6) NOT NULL,
+	expires_at DATETIME(6) NOT NULL,
+	family_expires_at DATETIME(6) NOT NULL,
+	used_at DATETIME(6) NULL,
+	revoked_at DATETIME(6) NULL,
+  PRIMARY KEY (token_hash),
+  KEY family_id (family_id),
+  KEY user_id (user_id)
+) ENGINE = INNODB,
+  CHARACTER SET utf8mb4,
+  COLLATE utf8mb4_general_ci;
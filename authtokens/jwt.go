@@ -0,0 +1,298 @@
+package authtokens
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/global"
+)
+
+// Stateless access tokens with rotating refresh tokens, auth mode "t"
+/*
+
+	Sign in with kbxt posted to /v1/app/signIn returns a TokenPair instead of a session:
+
+	  - Access_token: a JWT signed with HS256 or EdDSA, good for AccessTokenTTL, carrying the user id (sub), role
+	    and session id (sid). Sent as "Authorization: Bearer <token>" with auth-mode=t, it is checked without a
+	    database call, so the context user only has User_id and User_role_id set, load the user if more is needed.
+	  - Refresh_token: opaque, good for RefreshTokenTTL and at most RefreshFamilyMaxAge after sign in, only its
+	    sha512 is stored. Post it to /v1/app/token/refresh for a new TokenPair.
+
+	Every refresh token is used once, refreshing returns a new one of the same family, the sid. A used refresh token
+	sent again means it was copied, so its whole family is revoked and the access tokens of the family are refused
+	by this instance until they would have expired anyway, other instances refuse them once they expire.
+	Sign out revokes the family the same way.
+
+	Tokens are signed with the current Key of SetKeys, and checked with any Key by its kid, so a key can be rotated
+	by making the new key current and keeping the old one until AccessTokenTTL has passed. InitFromEnv sets the key
+	from EnvVars.TokenSigningAlg, TokenSigningKid and TokenSigningKey, token mode is off until a key is set.
+
+	The refresh token table is in authtokens.sql.
+
+*/
+
+const (
+	ALG_HS256 = "HS256"
+	ALG_EDDSA = "EdDSA"
+
+	TOKEN_TYPE = "Bearer"
+
+	// HS256 secrets shorter than this are refused
+	MIN_HS256_SECRET_BYTES = 32
+)
+
+var (
+	AccessTokenTTL      = 10 * time.Minute
+	RefreshTokenTTL     = 14 * 24 * time.Hour
+	RefreshFamilyMaxAge = 90 * 24 * time.Hour
+
+	// Leeway: clock difference allowed between the instance that signed a token and the one checking it
+	Leeway = 30 * time.Second
+
+	// Issuer: the iss claim of new tokens, and the iss required of checked tokens when not empty
+	Issuer = ""
+)
+
+/*
+Key: a token signing key
+  - Kid: the key id put in the token header, unique among the keys of SetKeys
+  - Alg: ALG_HS256 with Secret, or ALG_EDDSA with PublicKey and, to sign, PrivateKey
+*/
+type Key struct {
+	Kid        string
+	Alg        string
+	Secret     []byte
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+}
+
+func (k *Key) validate(signing bool) error {
+	if k.Kid == "" {
+		return errors.New(apierrorkeys.AppInitErr + ": token key without a kid")
+	}
+	switch k.Alg {
+	case ALG_HS256:
+		if len(k.Secret) < MIN_HS256_SECRET_BYTES {
+			return errors.New(apierrorkeys.AppInitErr + ": HS256 token key " + k.Kid + " is shorter than " + strconv.Itoa(MIN_HS256_SECRET_BYTES) + " bytes")
+		}
+	case ALG_EDDSA:
+		if k.PublicKey == nil && k.PrivateKey != nil {
+			k.PublicKey = k.PrivateKey.Public().(ed25519.PublicKey)
+		}
+		if len(k.PublicKey) != ed25519.PublicKeySize || (signing && len(k.PrivateKey) != ed25519.PrivateKeySize) {
+			return errors.New(apierrorkeys.AppInitErr + ": bad EdDSA token key " + k.Kid)
+		}
+	default:
+		return errors.New(apierrorkeys.AppInitErr + ": unknown token key alg " + k.Alg)
+	}
+	return nil
+}
+
+func (k *Key) sign(signingInput []byte) []byte {
+	if k.Alg == ALG_EDDSA {
+		return ed25519.Sign(k.PrivateKey, signingInput)
+	}
+	mac := hmac.New(sha256.New, k.Secret)
+	mac.Write(signingInput)
+	return mac.Sum(nil)
+}
+
+func (k *Key) verify(signingInput []byte, sig []byte) bool {
+	if k.Alg == ALG_EDDSA {
+		return ed25519.Verify(k.PublicKey, signingInput, sig)
+	}
+	return hmac.Equal(k.sign(signingInput), sig)
+}
+
+var keys struct {
+	mu      sync.RWMutex
+	current *Key
+	byKid   map[string]*Key
+}
+
+// SetKeys
+//   - signs new tokens with current, and checks tokens signed with current or any of previous
+//   - previous EdDSA keys only need a PublicKey
+func SetKeys(current Key, previous ...Key) error {
+	if err := current.validate(true); err != nil {
+		return err
+	}
+	byKid := map[string]*Key{current.Kid: &current}
+	for i := range previous {
+		k := previous[i]
+		if err := k.validate(false); err != nil {
+			return err
+		}
+		if _, ok := byKid[k.Kid]; ok {
+			return errors.New(apierrorkeys.AppInitErr + ": duplicate token key kid " + k.Kid)
+		}
+		byKid[k.Kid] = &k
+	}
+	keys.mu.Lock()
+	keys.current = &current
+	keys.byKid = byKid
+	keys.mu.Unlock()
+	return nil
+}
+
+// InitFromEnv
+//   - sets the signing key from global.EnvVars, TokenSigningKey is a hex HS256 secret or a hex 32 byte ed25519 seed
+//   - leaves token mode off if TokenSigningKey is empty
+func InitFromEnv() error {
+	env := global.EnvVars
+	if env.TokenSigningKey == "" {
+		return nil
+	}
+	raw, err := hex.DecodeString(env.TokenSigningKey)
+	if err != nil {
+		return errors.Wrap(err, apierrorkeys.AppInitErr+": TokenSigningKey is not hex")
+	}
+	k := Key{Kid: env.TokenSigningKid, Alg: env.TokenSigningAlg}
+	if k.Kid == "" {
+		k.Kid = "default"
+	}
+	if k.Alg == ALG_EDDSA {
+		if len(raw) != ed25519.SeedSize {
+			return errors.New(apierrorkeys.AppInitErr + ": EdDSA TokenSigningKey must be a 32 byte seed")
+		}
+		k.PrivateKey = ed25519.NewKeyFromSeed(raw)
+	} else {
+		k.Secret = raw
+	}
+	return SetKeys(k)
+}
+
+// Enabled reports whether a signing key is set
+func Enabled() bool {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+	return keys.current != nil
+}
+
+/*
+Claims: the payload of an access token
+  - Sub: the user id, see User_id
+  - Sid: the session, the refresh token family the token was issued from
+  - Role: the user's User_role_id when the token was issued
+*/
+type Claims struct {
+	Iss  string `json:"iss,omitempty"`
+	Sub  string `json:"sub"`
+	Sid  string `json:"sid"`
+	Role *int   `json:"role,omitempty"`
+	Iat  int64  `json:"iat"`
+	Exp  int64  `json:"exp"`
+	Jti  string `json:"jti"`
+}
+
+func (c *Claims) User_id() (int, error) {
+	return strconv.Atoi(c.Sub)
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// Sign makes an access token of claims with the current key
+func Sign(claims Claims) (string, error) {
+	keys.mu.RLock()
+	k := keys.current
+	keys.mu.RUnlock()
+	if k == nil {
+		return "", errors.New(apierrorkeys.AccessTokenInvalid + ": token mode has no signing key")
+	}
+	hb, err := json.Marshal(header{Alg: k.Alg, Typ: "JWT", Kid: k.Kid})
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := b64.EncodeToString(hb) + "." + b64.EncodeToString(cb)
+	return signingInput + "." + b64.EncodeToString(k.sign([]byte(signingInput))), nil
+}
+
+// Verify
+//   - checks an access token's signature with the key of its kid, the alg must be that key's, then its expiry, issuer and session
+//   - errors start with AccessTokenInvalid or AccessTokenExpired
+func Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New(apierrorkeys.AccessTokenInvalid + ": malformed")
+	}
+	hb, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New(apierrorkeys.AccessTokenInvalid + ": malformed header")
+	}
+	var h header
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return nil, errors.New(apierrorkeys.AccessTokenInvalid + ": malformed header")
+	}
+	keys.mu.RLock()
+	k := keys.byKid[h.Kid]
+	keys.mu.RUnlock()
+	// the alg must be the key's own, so a token can not pick a weaker check i.e. "none"
+	if k == nil || h.Alg != k.Alg {
+		return nil, errors.New(apierrorkeys.AccessTokenInvalid + ": unknown kid or alg")
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil || !k.verify([]byte(parts[0]+"."+parts[1]), sig) {
+		return nil, errors.New(apierrorkeys.AccessTokenInvalid + ": bad signature")
+	}
+	cb, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New(apierrorkeys.AccessTokenInvalid + ": malformed claims")
+	}
+	var claims Claims
+	if err := json.Unmarshal(cb, &claims); err != nil {
+		return nil, errors.New(apierrorkeys.AccessTokenInvalid + ": malformed claims")
+	}
+	if Issuer != "" && claims.Iss != Issuer {
+		return nil, errors.New(apierrorkeys.AccessTokenInvalid + ": wrong issuer")
+	}
+	if claims.Sid == "" || claims.Iat > now.Add(Leeway).Unix() {
+		return nil, errors.New(apierrorkeys.AccessTokenInvalid + ": bad claims")
+	}
+	if now.Add(-Leeway).Unix() >= claims.Exp {
+		return nil, errors.New(apierrorkeys.AccessTokenExpired)
+	}
+	if sessionRevoked(claims.Sid, now) {
+		return nil, errors.New(apierrorkeys.AccessTokenInvalid + ": session revoked")
+	}
+	return &claims, nil
+}
+
+// a verified access token context object, set by authentication.VerifyWithToken
+type claimsCtxType string
+
+const claimsCtxKey claimsCtxType = "tokenClaims"
+
+func CtxWithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsCtxKey, claims)
+}
+
+// CtxGetClaims is the access token the request was authenticated with, an error if it was not authenticated with one
+func CtxGetClaims(ctx context.Context) (*Claims, error) {
+	claims, ok := ctx.Value(claimsCtxKey).(*Claims)
+	if !ok || claims == nil {
+		return nil, errors.New(apierrorkeys.ContextError)
+	}
+	return claims, nil
+}
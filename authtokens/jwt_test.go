@@ -0,0 +1,147 @@
+package authtokens
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+var (
+	hsKey  = Key{Kid: "k1", Alg: ALG_HS256, Secret: bytes.Repeat([]byte{1}, MIN_HS256_SECRET_BYTES)}
+	oldKey = Key{Kid: "k0", Alg: ALG_HS256, Secret: bytes.Repeat([]byte{2}, MIN_HS256_SECRET_BYTES)}
+	edKey  = Key{Kid: "k2", Alg: ALG_EDDSA, PrivateKey: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{3}, ed25519.SeedSize))}
+)
+
+// keepKeys puts back the keys of SetKeys when the test ends
+func keepKeys(t *testing.T) {
+	keys.mu.RLock()
+	prevCurrent, prevByKid := keys.current, keys.byKid
+	keys.mu.RUnlock()
+	t.Cleanup(func() {
+		keys.mu.Lock()
+		keys.current, keys.byKid = prevCurrent, prevByKid
+		keys.mu.Unlock()
+	})
+}
+
+// testKeys sets the keys of SetKeys until the test ends
+func testKeys(t *testing.T, current Key, previous ...Key) {
+	keepKeys(t)
+	if err := SetKeys(current, previous...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testClaims(now time.Time) Claims {
+	return Claims{Sub: "7", Sid: "family", Iat: now.Unix(), Exp: now.Add(AccessTokenTTL).Unix(), Jti: "jti"}
+}
+
+func signWith(t *testing.T, k Key, claims Claims) string {
+	testKeys(t, k)
+	token, err := Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestSetKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  Key
+		previous []Key
+		wantErr  bool
+	}{
+		{"hs256", hsKey, nil, false},
+		{"eddsa", edKey, []Key{hsKey}, false},
+		{"previous eddsa with only a public key", hsKey, []Key{{Kid: "p", Alg: ALG_EDDSA, PublicKey: edKey.PrivateKey.Public().(ed25519.PublicKey)}}, false},
+		{"short secret", Key{Kid: "s", Alg: ALG_HS256, Secret: []byte("short")}, nil, true},
+		{"no kid", Key{Alg: ALG_HS256, Secret: hsKey.Secret}, nil, true},
+		{"unknown alg", Key{Kid: "n", Alg: "none"}, nil, true},
+		{"eddsa current without a private key", Key{Kid: "p", Alg: ALG_EDDSA, PublicKey: edKey.PrivateKey.Public().(ed25519.PublicKey)}, nil, true},
+		{"duplicate kid", hsKey, []Key{{Kid: hsKey.Kid, Alg: ALG_HS256, Secret: oldKey.Secret}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepKeys(t)
+			err := SetKeys(tt.current, tt.previous...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetKeys error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	revokeSession("revoked family", now)
+
+	withClaims := func(f func(c *Claims)) Claims {
+		c := testClaims(now)
+		f(&c)
+		return c
+	}
+	hsToken := signWith(t, hsKey, testClaims(now))
+	edToken := signWith(t, edKey, testClaims(now))
+	oldToken := signWith(t, oldKey, testClaims(now))
+	retiredToken := signWith(t, Key{Kid: "gone", Alg: ALG_HS256, Secret: oldKey.Secret}, testClaims(now))
+	expired := signWith(t, hsKey, withClaims(func(c *Claims) { c.Exp = now.Add(-Leeway).Unix() }))
+	inLeeway := signWith(t, hsKey, withClaims(func(c *Claims) { c.Exp = now.Add(-Leeway + time.Second).Unix() }))
+	future := signWith(t, hsKey, withClaims(func(c *Claims) { c.Iat = now.Add(Leeway + time.Second).Unix() }))
+	noSid := signWith(t, hsKey, withClaims(func(c *Claims) { c.Sid = "" }))
+	revoked := signWith(t, hsKey, withClaims(func(c *Claims) { c.Sid = "revoked family" }))
+	otherIssuer := signWith(t, hsKey, withClaims(func(c *Claims) { c.Iss = "other" }))
+
+	parts := strings.Split(hsToken, ".")
+	tampered := parts[0] + "." + b64.EncodeToString([]byte(`{"sub":"1","sid":"family","iat":1700000000,"exp":1800000000}`)) + "." + parts[2]
+	// an HS256 header naming the EdDSA key, so the public key would be the HMAC secret
+	hsForEd := b64.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT","kid":"k2"}`)) + "." + parts[1]
+	edPub := edKey.PrivateKey.Public().(ed25519.PublicKey)
+	hsForEd += "." + b64.EncodeToString((&Key{Alg: ALG_HS256, Secret: edPub}).sign([]byte(hsForEd)))
+	none := b64.EncodeToString([]byte(`{"alg":"none","typ":"JWT","kid":"k1"}`)) + "." + parts[1] + "."
+
+	testKeys(t, hsKey, oldKey, edKey)
+	tests := []struct {
+		name    string
+		token   string
+		issuer  string
+		wantErr string
+	}{
+		{"hs256", hsToken, "", ""},
+		{"eddsa", edToken, "", ""},
+		{"previous key", oldToken, "", ""},
+		{"within leeway", inLeeway, "", ""},
+		{"issuer required", otherIssuer, "other", ""},
+		{"expired", expired, "", apierrorkeys.AccessTokenExpired},
+		{"iat in the future", future, "", apierrorkeys.AccessTokenInvalid},
+		{"no sid", noSid, "", apierrorkeys.AccessTokenInvalid},
+		{"revoked session", revoked, "", apierrorkeys.AccessTokenInvalid},
+		{"wrong issuer", hsToken, "other", apierrorkeys.AccessTokenInvalid},
+		{"unknown kid", retiredToken, "", apierrorkeys.AccessTokenInvalid},
+		{"tampered claims", tampered, "", apierrorkeys.AccessTokenInvalid},
+		{"alg other than the kid's", hsForEd, "", apierrorkeys.AccessTokenInvalid},
+		{"alg none", none, "", apierrorkeys.AccessTokenInvalid},
+		{"not a jwt", "abc", "", apierrorkeys.AccessTokenInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev := Issuer
+			Issuer = tt.issuer
+			defer func() { Issuer = prev }()
+			claims, err := Verify(tt.token, now)
+			if tt.wantErr == "" {
+				if err != nil || claims == nil || claims.Sub != "7" {
+					t.Fatalf("Verify = %v, %v", claims, err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Fatalf("Verify error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package authtokens
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/authutil"
+	"github.com/rogue-syntax/rs-goapiserver/database"
+	"github.com/rogue-syntax/rs-goapiserver/entities/user"
+)
+
+const (
+	REFRESH_ROUTE = "/v1/app/token/refresh"
+
+	refreshTokenBytes = 32
+	familyIdBytes     = 16
+)
+
+// TokenPair: what sign in with kbxt and /v1/app/token/refresh return, Expires_in values are seconds
+type TokenPair struct {
+	Access_token       string
+	Token_type         string
+	Expires_in         int64
+	Refresh_token      string
+	Refresh_expires_in int64
+}
+
+// RefreshToken: a row of user_refresh_token, Family_id is the sid of the access tokens issued with it
+type RefreshToken struct {
+	Token_hash        string
+	Family_id         string
+	User_id           int
+	Created_at        time.Time
+	Expires_at        time.Time
+	Family_expires_at time.Time
+	Used_at           *time.Time
+	Revoked_at        *time.Time
+}
+
+// revokedSessions: families revoked on this instance, refused by Verify until their access tokens expire
+var revokedSessions = struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}{until: make(map[string]time.Time)}
+
+func revokeSession(sid string, now time.Time) {
+	revokedSessions.mu.Lock()
+	defer revokedSessions.mu.Unlock()
+	for s, until := range revokedSessions.until {
+		if now.After(until) {
+			delete(revokedSessions.until, s)
+		}
+	}
+	revokedSessions.until[sid] = now.Add(AccessTokenTTL + Leeway)
+}
+
+func sessionRevoked(sid string, now time.Time) bool {
+	revokedSessions.mu.Lock()
+	defer revokedSessions.mu.Unlock()
+	until, ok := revokedSessions.until[sid]
+	return ok && !now.After(until)
+}
+
+func randomHex(n int) (string, []byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return hex.EncodeToString(b), b, err
+}
+
+func refreshErr(msg string) error {
+	return apierrors.NewKeyedError(apierrorkeys.RefreshTokenError, nil, errors.New(msg))
+}
+
+// IssuePair starts a new session, a refresh token family, for user_id and returns its first TokenPair
+func IssuePair(ctx context.Context, user_id int, role *int) (*TokenPair, error) {
+	if !Enabled() {
+		return nil, refreshErr("token mode is off")
+	}
+	family_id, _, err := randomHex(familyIdBytes)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	tx, err := database.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	pair, err := issue(ctx, tx, user_id, role, family_id, now.Add(RefreshFamilyMaxAge), now)
+	if err != nil {
+		return nil, err
+	}
+	return pair, tx.Commit()
+}
+
+// issue stores a new refresh token of family_id and signs an access token for it
+func issue(ctx context.Context, tx *sqlx.Tx, user_id int, role *int, family_id string, family_expires_at time.Time, now time.Time) (*TokenPair, error) {
+	raw, rawBytes, err := randomHex(refreshTokenBytes)
+	if err != nil {
+		return nil, err
+	}
+	expires_at := now.Add(RefreshTokenTTL)
+	if expires_at.After(family_expires_at) {
+		expires_at = family_expires_at
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO user_refresh_token (token_hash, family_id, user_id, created_at, expires_at, family_expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		authutil.HashTokenBytes(rawBytes), family_id, user_id, now, expires_at, family_expires_at)
+	if err != nil {
+		return nil, err
+	}
+	jti, _, err := randomHex(familyIdBytes)
+	if err != nil {
+		return nil, err
+	}
+	access, err := Sign(Claims{
+		Iss:  Issuer,
+		Sub:  strconv.Itoa(user_id),
+		Sid:  family_id,
+		Role: role,
+		Iat:  now.Unix(),
+		Exp:  now.Add(AccessTokenTTL).Unix(),
+		Jti:  jti,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		Access_token:       access,
+		Token_type:         TOKEN_TYPE,
+		Expires_in:         int64(AccessTokenTTL / time.Second),
+		Refresh_token:      raw,
+		Refresh_expires_in: int64(expires_at.Sub(now) / time.Second),
+	}, nil
+}
+
+// Refresh
+//   - uses up a refresh token and returns a new TokenPair of its family, with the user's current role
+//   - a refresh token used before revokes its whole family and is RefreshTokenReused
+//   - unknown, expired and revoked tokens are RefreshTokenError
+func Refresh(ctx context.Context, raw string) (*TokenPair, error) {
+	if !Enabled() {
+		return nil, refreshErr("token mode is off")
+	}
+	rawBytes, err := hex.DecodeString(raw)
+	if err != nil || len(rawBytes) != refreshTokenBytes {
+		return nil, refreshErr("malformed")
+	}
+	now := time.Now().UTC()
+	tx, err := database.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var rt RefreshToken
+	err = tx.GetContext(ctx, &rt, "SELECT * FROM user_refresh_token WHERE token_hash = ? FOR UPDATE", authutil.HashTokenBytes(rawBytes))
+	if err == sql.ErrNoRows {
+		return nil, refreshErr("unknown")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rt.Revoked_at != nil {
+		return nil, refreshErr("revoked")
+	}
+	if rt.Used_at != nil {
+		// a used token came back, whoever holds the family now is not known, end it
+		err = revokeFamily(ctx, tx, rt.Family_id, now)
+		if err != nil {
+			return nil, err
+		}
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, apierrors.NewKeyedError(apierrorkeys.RefreshTokenReused, nil, errors.New("family "+rt.Family_id))
+	}
+	if !now.Before(rt.Expires_at) {
+		return nil, refreshErr("expired")
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE user_refresh_token SET used_at = ? WHERE token_hash = ?", now, rt.Token_hash)
+	if err != nil {
+		return nil, err
+	}
+	usr, err := user.FindUserExternalByUser_idContext(ctx, rt.User_id)
+	if err == sql.ErrNoRows {
+		return nil, refreshErr("unknown user")
+	}
+	if err != nil {
+		return nil, err
+	}
+	pair, err := issue(ctx, tx, rt.User_id, usr.User_role_id, rt.Family_id, rt.Family_expires_at, now)
+	if err != nil {
+		return nil, err
+	}
+	return pair, tx.Commit()
+}
+
+func revokeFamily(ctx context.Context, tx *sqlx.Tx, family_id string, now time.Time) error {
+	_, err := tx.ExecContext(ctx, "UPDATE user_refresh_token SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL", now, family_id)
+	if err == nil {
+		revokeSession(family_id, now)
+	}
+	return err
+}
+
+// RevokeFamily ends a session, its refresh tokens stop at once and its access tokens on this instance
+func RevokeFamily(ctx context.Context, family_id string) error {
+	tx, err := database.DB.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err = revokeFamily(ctx, tx, family_id, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RefreshInput: the refresh token to use up
+type RefreshInput struct {
+	Refresh_token string `json:"refresh_token" validate:"required"`
+}
+
+// RefreshTokens: a middleware.Typed handler for REFRESH_ROUTE
+func RefreshTokens(ctx context.Context, in RefreshInput) (*TokenPair, error) {
+	return Refresh(ctx, in.Refresh_token)
+}
+
+var SQL string = `
+CREATE TABLE user_refresh_token (
+	token_hash CHAR(128) NOT NULL,
+	family_id CHAR(32) NOT NULL,
+	user_id INT NOT NULL,
+	created_at DATETIME(6) NOT NULL,
+	expires_at DATETIME(6) NOT NULL,
+	family_expires_at DATETIME(6) NOT NULL,
+	used_at DATETIME(6) NULL,
+	revoked_at DATETIME(6) NULL,
+  PRIMARY KEY (token_hash),
+  KEY family_id (family_id),
+  KEY user_id (user_id)
+) ENGINE = INNODB,
+  CHARACTER SET utf8mb4,
+  COLLATE utf8mb4_general_ci;
+`
@@ -0,0 +1,202 @@
+package authtokens
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/authutil"
+	"github.com/rogue-syntax/rs-goapiserver/database"
+)
+
+// fakeStore: user_refresh_token rows for the queries of refresh.go, and a UserExternal row for every user
+type fakeStore struct {
+	mu   sync.Mutex
+	rows map[string][]driver.Value
+}
+
+var refreshColumns = []string{"token_hash", "family_id", "user_id", "created_at", "expires_at", "family_expires_at", "used_at", "revoked_at"}
+
+func (s *fakeStore) exec(query string, args []driver.Value) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.Contains(query, "INSERT INTO user_refresh_token"):
+		s.rows[args[0].(string)] = append(append([]driver.Value{}, args...), nil, nil)
+	case strings.Contains(query, "SET used_at"):
+		s.rows[args[1].(string)][6] = args[0]
+	case strings.Contains(query, "SET revoked_at"):
+		for _, row := range s.rows {
+			if row[1] == args[1] && row[7] == nil {
+				row[7] = args[0]
+			}
+		}
+	default:
+		return driver.ErrSkip
+	}
+	return nil
+}
+
+func (s *fakeStore) query(query string, args []driver.Value) (driver.Rows, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case strings.Contains(query, "FROM user_refresh_token WHERE token_hash"):
+		rows := &fakeRows{columns: refreshColumns}
+		if row, ok := s.rows[args[0].(string)]; ok {
+			rows.values = append(rows.values, append([]driver.Value{}, row...))
+		}
+		return rows, nil
+	case strings.Contains(query, "FROM UserExternal"):
+		return &fakeRows{columns: []string{"user_id", "user_role_id"}, values: [][]driver.Value{{args[0], int64(2)}}}, nil
+	}
+	return nil, driver.ErrSkip
+}
+
+type fakeConnector struct{ s *fakeStore }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn{c.s}, nil }
+func (c fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ s *fakeStore }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.s, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	s     *fakeStore
+	query string
+}
+
+func (st fakeStmt) Close() error  { return nil }
+func (st fakeStmt) NumInput() int { return -1 }
+func (st fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), st.s.exec(st.query, args)
+}
+func (st fakeStmt) Query(args []driver.Value) (driver.Rows, error) { return st.s.query(st.query, args) }
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// fakeDB swaps database.DB for a fakeStore until the test ends
+func fakeDB(t *testing.T) *fakeStore {
+	s := &fakeStore{rows: make(map[string][]driver.Value)}
+	prev := database.DB
+	database.DB = sqlx.NewDb(sql.OpenDB(fakeConnector{s}), "mysql")
+	t.Cleanup(func() { database.DB = prev })
+	return s
+}
+
+func TestRefreshRotation(t *testing.T) {
+	fakeDB(t)
+	testKeys(t, hsKey)
+	ctx := context.Background()
+
+	first, err := IssuePair(ctx, 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Refresh(ctx, first.Refresh_token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Refresh_token == first.Refresh_token {
+		t.Fatal("Refresh returned the refresh token it used up")
+	}
+	firstClaims, err := Verify(first.Access_token, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := Verify(second.Access_token, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Sid != firstClaims.Sid || claims.Sub != "7" || claims.Role == nil || *claims.Role != 2 {
+		t.Errorf("refreshed claims = %+v, want sid %s, sub 7 and the user's current role 2", claims, firstClaims.Sid)
+	}
+
+	// the used first token comes back, the family ends for both holders
+	_, err = Refresh(ctx, first.Refresh_token)
+	if err == nil || !strings.HasPrefix(err.Error(), apierrorkeys.RefreshTokenReused) {
+		t.Fatalf("Refresh of a used token error = %v, want %s", err, apierrorkeys.RefreshTokenReused)
+	}
+	_, err = Refresh(ctx, second.Refresh_token)
+	if err == nil || !strings.HasPrefix(err.Error(), apierrorkeys.RefreshTokenError) {
+		t.Fatalf("Refresh in a revoked family error = %v, want %s", err, apierrorkeys.RefreshTokenError)
+	}
+	if _, err = Verify(second.Access_token, time.Now()); err == nil {
+		t.Error("Verify took an access token of a revoked family")
+	}
+}
+
+func TestRefreshRejects(t *testing.T) {
+	s := fakeDB(t)
+	testKeys(t, hsKey)
+	ctx := context.Background()
+
+	expired, err := IssuePair(ctx, 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawBytes, _ := hex.DecodeString(expired.Refresh_token)
+	s.rows[authutil.HashTokenBytes(rawBytes)][4] = time.Now().Add(-time.Minute)
+	revoked, err := IssuePair(ctx, 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedClaims, err := Verify(revoked.Access_token, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = RevokeFamily(ctx, revokedClaims.Sid); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{"malformed", "zz", apierrorkeys.RefreshTokenError + ": malformed"},
+		{"short", expired.Refresh_token[:10], apierrorkeys.RefreshTokenError + ": malformed"},
+		{"unknown", strings.Repeat("0", 2*refreshTokenBytes), apierrorkeys.RefreshTokenError + ": unknown"},
+		{"expired", expired.Refresh_token, apierrorkeys.RefreshTokenError + ": expired"},
+		{"revoked family", revoked.Refresh_token, apierrorkeys.RefreshTokenError + ": revoked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Refresh(ctx, tt.raw)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Fatalf("Refresh error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
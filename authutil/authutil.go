@@ -43,6 +43,11 @@ func HashTokenBytes(bytesR []byte) string {
 	return hex.EncodeToString(hashedTokenBytes)
 }
 
+// CSRFTokenFor derives the csrf token for a session token, it is not the hash stored for the session
+func CSRFTokenFor(userToken string) string {
+	return HashTokenBytes([]byte("kbxc:" + userToken))
+}
+
 func Sha1Hash(s string) string {
 	h := sha1.New()
 	h.Write([]byte(s))
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// readErrorKeys returns the value of every exported string constant in the apierrorkeys package source
+func readErrorKeys(dir string) ([]string, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading apierrorkeys from "+dir)
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.CONST {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					valueSpec := spec.(*ast.ValueSpec)
+					for i, name := range valueSpec.Names {
+						if !name.IsExported() || i >= len(valueSpec.Values) {
+							continue
+						}
+						lit, ok := valueSpec.Values[i].(*ast.BasicLit)
+						if !ok || lit.Kind != token.STRING {
+							continue
+						}
+						key, err := strconv.Unquote(lit.Value)
+						if err == nil && !seen[key] {
+							seen[key] = true
+							keys = append(keys, key)
+						}
+					}
+				}
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no error keys found in " + dir)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
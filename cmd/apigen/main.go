@@ -0,0 +1,100 @@
+// Command apigen writes a TypeScript client for the routes in approutes.BaseAppRoutes
+/*
+
+	go run ./cmd/apigen -out ../frontend/src/api.ts
+
+	The routes are registered on a scratch mux, exactly as the server registers them, and the OpenAPI document
+	apimaster.BuildOpenAPI makes from their ApiReqDefs is turned into TypeScript:
+	  - an interface for every input and output type, see apimaster/openapi.go for how Go types map to schemas
+	  - ErrorKey, a string union of every key in apireturn/apierrorkeys, and JsonReturn<T>, the response envelope
+	  - an ApiClient with one method per route and method, and cookieAuth, sessionTokenAuth and apiKeyAuth for the
+	    kbxs cookie, kbxb header and kbxa api key auth modes
+	Routes without a ReqDef are included with an untyped input and output. Routes that do not answer with a JsonReturn,
+	the explorer page, the OpenAPI document and the websockets, are left out, see -skip.
+
+	Nothing is served and no database or env config is needed.
+
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/rogue-syntax/rs-goapiserver/apimaster"
+	"github.com/rogue-syntax/rs-goapiserver/approutes"
+	"github.com/rogue-syntax/rs-goapiserver/middleware"
+)
+
+func main() {
+	out := flag.String("out", "api.ts", "file to write, - for stdout")
+	listName := flag.String("list", "app", "ApiReqMap list name the routes are registered under")
+	errorKeysDir := flag.String("errorkeys", defaultErrorKeysDir(), "directory of the apierrorkeys package source")
+	skip := flag.String("skip", "/v1/api,"+apimaster.OPENAPI_ROUTE+",/v1/testWS/,/ws/wss/", "comma separated routes to leave out")
+	flag.Parse()
+
+	errorKeys, err := readErrorKeys(*errorKeysDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "apigen:", err)
+		os.Exit(1)
+	}
+
+	registerRoutes(*listName, approutes.BaseAppRoutes, strings.Split(*skip, ","))
+	ts := generateTypeScript(apimaster.BuildOpenAPI(), errorKeys)
+
+	if *out == "-" {
+		fmt.Print(ts)
+		return
+	}
+	err = os.WriteFile(*out, []byte(ts), 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "apigen:", err)
+		os.Exit(1)
+	}
+}
+
+// registerRoutes registers defs on a scratch mux so their ApiReqDefs land in apimaster.ApiReqMap
+func registerRoutes(listName string, defs []middleware.RouteDef, skip []string) {
+	middleware.SetBlankMiddleware()
+	middleware.SetReqVerifMiddleware()
+	middleware.SetRoleBaseReqVerifMiddleware()
+	middleware.SetWebhookMiddleware()
+
+	// only the generated routes are documented, not the examples
+	apimaster.ApiReqMap = map[string]map[string]apimaster.ApiReqDef{}
+
+	var documented []middleware.RouteDef
+	for _, def := range defs {
+		if containsString(skip, def.RouteStr) {
+			continue
+		}
+		if def.ReqDef == nil && def.Typed == nil {
+			def.ReqDef = &apimaster.ApiReqDef{API: def.RouteStr}
+		}
+		documented = append(documented, def)
+	}
+	middleware.SetRouteDefsOnMux(http.NewServeMux(), &documented, listName)
+}
+
+// defaultErrorKeysDir is apireturn/apierrorkeys next to this source file
+func defaultErrorKeysDir() string {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		return filepath.Join("apireturn", "apierrorkeys")
+	}
+	return filepath.Join(filepath.Dir(file), "..", "..", "apireturn", "apierrorkeys")
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if strings.TrimSpace(v) == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,517 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rogue-syntax/rs-goapiserver/apimaster"
+)
+
+// generateTypeScript renders the client, see the top of main.go
+func generateTypeScript(doc *apimaster.OpenAPIDoc, errorKeys []string) string {
+	g := &tsGen{doc: doc}
+	g.line("// Code generated by apigen from the registered routes. DO NOT EDIT.")
+	g.line("// " + doc.Info.Title + " " + doc.Info.Version)
+	g.line("")
+	g.errorKeys(errorKeys)
+	g.line(tsEnvelope)
+	g.interfaces()
+	g.line(tsRuntime)
+	g.client()
+	return g.b.String()
+}
+
+type tsGen struct {
+	doc *apimaster.OpenAPIDoc
+	b   strings.Builder
+}
+
+func (g *tsGen) line(s string) {
+	g.b.WriteString(s)
+	g.b.WriteString("\n")
+}
+
+func (g *tsGen) errorKeys(keys []string) {
+	g.line("/** ErrorKey is every key in apireturn/apierrorkeys */")
+	g.line("export type ErrorKey =")
+	for i, key := range keys {
+		end := ""
+		if i == len(keys)-1 {
+			end = ";"
+		}
+		g.line("\t| " + tsLiteral(key) + end)
+	}
+	g.line("")
+}
+
+func (g *tsGen) interfaces() {
+	names := make([]string, 0, len(g.doc.Components.Schemas))
+	for name := range g.doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		schema := g.doc.Components.Schemas[name]
+		g.line("/** " + name + " */")
+		if len(schema.Properties) > 0 {
+			g.line("export interface " + tsName(name) + " " + g.objectType(schema, ""))
+		} else {
+			g.line("export type " + tsName(name) + " = " + g.tsType(schema, "") + ";")
+		}
+		g.line("")
+	}
+}
+
+var identRegexp = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+var nameSplitter = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// tsName turns a component name like "signup.PWSubmission" into "SignupPWSubmission"
+func tsName(component string) string {
+	return pascal(component)
+}
+
+func pascal(s string) string {
+	var out strings.Builder
+	for _, part := range nameSplitter.Split(s, -1) {
+		if part != "" {
+			out.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return out.String()
+}
+
+func tsLiteral(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func tsPropName(name string) string {
+	if identRegexp.MatchString(name) {
+		return name
+	}
+	return tsLiteral(name)
+}
+
+// tsType renders a schema as a TypeScript type, indent is the indent of the line it starts on
+func (g *tsGen) tsType(s *apimaster.Schema, indent string) string {
+	if s == nil {
+		return "unknown"
+	}
+	if s.Ref != "" {
+		return tsName(strings.TrimPrefix(s.Ref, "#/components/schemas/"))
+	}
+	if len(s.Enum) > 0 {
+		literals := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			literals[i] = tsLiteral(v)
+		}
+		return strings.Join(literals, " | ")
+	}
+	var types []string
+	switch t := s.Type.(type) {
+	case string:
+		types = []string{t}
+	case []string:
+		types = t
+	}
+	if len(types) == 0 {
+		return "unknown"
+	}
+	out := make([]string, 0, len(types))
+	for _, t := range types {
+		out = append(out, g.baseType(t, s, indent))
+	}
+	return strings.Join(out, " | ")
+}
+
+func (g *tsGen) baseType(t string, s *apimaster.Schema, indent string) string {
+	switch t {
+	case "null":
+		return "null"
+	case "string":
+		if s.Format == "binary" {
+			return "Blob"
+		}
+		return "string"
+	case "integer", "number":
+		return "number"
+	case "boolean":
+		return "boolean"
+	case "array":
+		item := g.tsType(s.Items, indent)
+		if strings.Contains(item, " ") {
+			item = "(" + item + ")"
+		}
+		return item + "[]"
+	case "object":
+		if len(s.Properties) > 0 {
+			return g.objectType(s, indent)
+		}
+		if s.AdditionalProperties != nil {
+			return "Record<string, " + g.tsType(s.AdditionalProperties, indent) + ">"
+		}
+		return "Record<string, unknown>"
+	}
+	return "unknown"
+}
+
+// objectType renders an object literal type, properties that are not required are optional
+func (g *tsGen) objectType(s *apimaster.Schema, indent string) string {
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out strings.Builder
+	out.WriteString("{\n")
+	for _, name := range names {
+		optional := "?"
+		for _, req := range s.Required {
+			if req == name {
+				optional = ""
+			}
+		}
+		out.WriteString(indent + "\t" + tsPropName(name) + optional + ": " + g.tsType(s.Properties[name], indent+"\t") + ";\n")
+	}
+	out.WriteString(indent + "}")
+	return out.String()
+}
+
+// resolve follows a component $ref
+func (g *tsGen) resolve(s *apimaster.Schema) *apimaster.Schema {
+	if s != nil && s.Ref != "" {
+		return g.doc.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+	}
+	return s
+}
+
+// tsOperation is one generated client method
+type tsOperation struct {
+	name       string
+	httpMethod string
+	path       string
+	summary    string
+	security   []string
+	inType     string
+	optional   bool
+	encoding   string
+	pathParams map[string]string
+	outType    string
+}
+
+func (g *tsGen) client() {
+	var ops []tsOperation
+	used := make(map[string]bool)
+	paths := make([]string, 0, len(g.doc.Paths))
+	for path := range g.doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		methods := make([]string, 0, len(g.doc.Paths[path]))
+		for method := range g.doc.Paths[path] {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		for _, method := range methods {
+			op := g.operation(method, path, g.doc.Paths[path][method])
+			base := op.name
+			for i := 2; used[op.name]; i++ {
+				op.name = base + strconv.Itoa(i)
+			}
+			used[op.name] = true
+			ops = append(ops, op)
+		}
+	}
+
+	g.line("/** ApiClient has a method per route, see ApiClientBase for auth and encoding */")
+	g.line("export class ApiClient extends ApiClientBase {")
+	for i, op := range ops {
+		if i > 0 {
+			g.line("")
+		}
+		g.line("\t/**")
+		if op.summary != "" {
+			g.line("\t * " + op.summary)
+		}
+		auth := "public"
+		if len(op.security) > 0 {
+			auth = "auth: " + strings.Join(op.security, ", ")
+		}
+		g.line("\t * " + op.httpMethod + " " + op.path + " (" + auth + ")")
+		g.line("\t */")
+		param := "input: " + op.inType
+		if op.optional {
+			param += " = {}"
+		}
+		g.line("\t" + op.name + "(" + param + ", init?: RequestInit): Promise<JsonReturn<" + op.outType + ">> {")
+		spec := "{ encoding: " + tsLiteral(op.encoding)
+		if len(op.pathParams) > 0 {
+			spec += ", pathParams: " + tsLiteral(op.pathParams)
+		}
+		spec += " }"
+		g.line("\t\treturn this.request(" + tsLiteral(op.httpMethod) + ", " + tsLiteral(op.path) + ", input, " + spec + ", init);")
+		g.line("\t}")
+	}
+	g.line("}")
+}
+
+func (g *tsGen) operation(method string, path string, op *apimaster.OpenAPIOperation) tsOperation {
+	out := tsOperation{
+		name:       method + pascal(path),
+		httpMethod: strings.ToUpper(method),
+		path:       path,
+		summary:    op.Summary,
+		pathParams: make(map[string]string),
+		outType:    "unknown",
+	}
+	for _, security := range op.Security {
+		for scheme := range security {
+			out.security = append(out.security, scheme)
+		}
+	}
+
+	var inSchema *apimaster.Schema
+	var query []*apimaster.OpenAPIParameter
+	var pathParams []*apimaster.OpenAPIParameter
+	for _, param := range op.Parameters {
+		if param.In == "path" {
+			pathParams = append(pathParams, param)
+		} else {
+			query = append(query, param)
+		}
+	}
+	switch {
+	case op.RequestBody != nil:
+		if media, ok := op.RequestBody.Content["multipart/form-data"]; ok {
+			out.encoding = "multipart"
+			inSchema = media.Schema
+		} else {
+			out.encoding = "json"
+			inSchema = op.RequestBody.Content["application/json"].Schema
+		}
+		out.inType = g.tsType(inSchema, "\t")
+	case len(query) > 0:
+		out.encoding = "query"
+		inSchema = &apimaster.Schema{Type: "object", Properties: map[string]*apimaster.Schema{}}
+		for _, param := range query {
+			inSchema.Properties[param.Name] = param.Schema
+			if param.Required {
+				inSchema.Required = append(inSchema.Required, param.Name)
+			}
+		}
+		out.inType = g.objectType(inSchema, "\t")
+	default:
+		// no declared input, legacy handlers read form values
+		out.encoding = "form"
+		if out.httpMethod == "GET" {
+			out.encoding = "query"
+		}
+		out.inType = "Record<string, unknown>"
+	}
+	resolved := g.resolve(inSchema)
+	out.optional = resolved == nil || len(resolved.Required) == 0
+
+	var extra []string
+	for _, param := range pathParams {
+		out.optional = false
+		key := ""
+		if resolved != nil {
+			for name := range resolved.Properties {
+				if strings.EqualFold(name, param.Name) {
+					key = name
+				}
+			}
+		}
+		if key == "" {
+			key = param.Name
+			extra = append(extra, tsPropName(param.Name)+": string | number")
+		}
+		out.pathParams[param.Name] = key
+	}
+	if len(extra) > 0 {
+		out.inType += " & { " + strings.Join(extra, "; ") + " }"
+	}
+
+	if ok := op.Responses["200"]; ok != nil && ok.Content["application/json"] != nil {
+		envelope := ok.Content["application/json"].Schema
+		if data := envelope.Properties["Data"]; data != nil {
+			out.outType = g.tsType(data, "\t")
+		}
+	}
+	return out
+}
+
+const tsEnvelope = `/** JsonReturn is the envelope of every response, Error is NO_ERROR on success */
+export interface JsonReturn<T> {
+	Error: ErrorKey | (string & {});
+	Data: T;
+	Message?: string;
+}
+`
+
+const tsRuntime = `/**
+ * AuthMode is how requests are authenticated:
+ * cookie sends the kbxs session cookie set by /v1/app/signIn, and the kbxc cookie as X-CSRF-Token on state changing requests,
+ * b sends the kbxb session token /v1/app/signIn returns when kbxb is posted,
+ * a sends a kbxa api key, a named kbxk_ key from /v1/apikeys needs no userId, the legacy key from /v1/test/genApiKey does,
+ * t sends the Access_token /v1/app/signIn returns when kbxt is posted, as a Bearer token
+ */
+export type AuthMode =
+	| { mode: "cookie" }
+	| { mode: "b"; token: string; userId: string | number }
+	| { mode: "a"; apiKey: string; userId?: string | number }
+	| { mode: "t"; accessToken: string };
+
+export function cookieAuth(): AuthMode {
+	return { mode: "cookie" };
+}
+
+export function sessionTokenAuth(token: string, userId: string | number): AuthMode {
+	return { mode: "b", token, userId };
+}
+
+export function apiKeyAuth(apiKey: string, userId?: string | number): AuthMode {
+	return { mode: "a", apiKey, userId };
+}
+
+export function accessTokenAuth(accessToken: string): AuthMode {
+	return { mode: "t", accessToken };
+}
+
+export interface ApiClientOptions {
+	baseUrl?: string;
+	auth?: AuthMode;
+	fetch?: typeof fetch;
+}
+
+/** ApiHttpError is thrown when a response is not a JsonReturn, i.e. a proxy error page */
+export class ApiHttpError extends Error {
+	status: number;
+	body: string;
+
+	constructor(status: number, body: string) {
+		super("HTTP " + status + ": " + body.slice(0, 200));
+		this.status = status;
+		this.body = body;
+	}
+}
+
+type Encoding = "query" | "json" | "form" | "multipart";
+
+interface RouteSpec {
+	encoding: Encoding;
+	pathParams?: Record<string, string>;
+}
+
+function readCookie(name: string): string {
+	if (typeof document === "undefined") {
+		return "";
+	}
+	for (const part of document.cookie.split("; ")) {
+		if (part.startsWith(name + "=")) {
+			return decodeURIComponent(part.substring(name.length + 1));
+		}
+	}
+	return "";
+}
+
+function appendValue(target: URLSearchParams | FormData, key: string, value: unknown): void {
+	if (value === undefined || value === null) {
+		return;
+	}
+	if (Array.isArray(value)) {
+		value.forEach((v) => appendValue(target, key, v));
+		return;
+	}
+	if (target instanceof FormData && typeof Blob !== "undefined" && value instanceof Blob) {
+		target.append(key, value);
+		return;
+	}
+	target.append(key, typeof value === "object" ? JSON.stringify(value) : String(value));
+}
+
+export class ApiClientBase {
+	protected options: ApiClientOptions;
+
+	constructor(options: ApiClientOptions = {}) {
+		this.options = { ...options };
+	}
+
+	setAuth(auth: AuthMode | undefined): void {
+		this.options.auth = auth;
+	}
+
+	protected async request<T>(method: string, route: string, input: object, spec: RouteSpec, init?: RequestInit): Promise<JsonReturn<T>> {
+		const values: Record<string, unknown> = { ...(input as Record<string, unknown>) };
+		let path = route;
+		for (const [param, key] of Object.entries(spec.pathParams || {})) {
+			path = path.replace("{" + param + "}", encodeURIComponent(String(values[key])));
+			delete values[key];
+		}
+
+		const query = new URLSearchParams();
+		const headers = new Headers(init?.headers);
+		let body: BodyInit | undefined;
+		switch (spec.encoding) {
+			case "query":
+				Object.entries(values).forEach(([key, value]) => appendValue(query, key, value));
+				break;
+			case "json":
+				headers.set("Content-Type", "application/json");
+				body = JSON.stringify(values);
+				break;
+			case "form": {
+				const form = new URLSearchParams();
+				Object.entries(values).forEach(([key, value]) => appendValue(form, key, value));
+				body = form;
+				break;
+			}
+			case "multipart": {
+				const data = new FormData();
+				Object.entries(values).forEach(([key, value]) => appendValue(data, key, value));
+				body = data;
+				break;
+			}
+		}
+
+		let credentials: RequestCredentials = "include";
+		const auth = this.options.auth || cookieAuth();
+		if (auth.mode === "cookie") {
+			const csrf = readCookie("kbxc");
+			if (csrf && method !== "GET" && method !== "HEAD") {
+				headers.set("X-CSRF-Token", csrf);
+			}
+		} else {
+			credentials = "omit";
+			query.set("auth-mode", auth.mode);
+			if (auth.mode === "a") {
+				headers.set("kbxa", auth.apiKey);
+				if (auth.userId !== undefined) {
+					headers.set("user-id", String(auth.userId));
+				}
+			} else if (auth.mode === "t") {
+				headers.set("Authorization", "Bearer " + auth.accessToken);
+			} else {
+				headers.set("kbxb", auth.token);
+				query.set("user-id", String(auth.userId));
+			}
+		}
+
+		const qs = query.toString();
+		const url = (this.options.baseUrl || "") + path + (qs ? "?" + qs : "");
+		const doFetch = this.options.fetch || globalThis.fetch.bind(globalThis);
+		const res = await doFetch(url, { credentials, ...init, method, headers, body });
+		const text = await res.text();
+		try {
+			return JSON.parse(text) as JsonReturn<T>;
+		} catch {
+			throw new ApiHttpError(res.status, text);
+		}
+	}
+}
+`
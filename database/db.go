@@ -1,6 +1,8 @@
 package database
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -9,9 +11,12 @@ import (
 	"github.com/go-sql-driver/mysql"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
 	"github.com/rogue-syntax/goqb-rs"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
 	"github.com/rogue-syntax/rs-goapiserver/global"
 	"github.com/rogue-syntax/rs-goapiserver/tls"
+	"github.com/rogue-syntax/rs-goapiserver/tracing"
 )
 
 // query struct for simple where conditions
@@ -54,6 +59,24 @@ func StartDB() error {
 	return nil
 }
 
+// CloseDB
+//   - closes database.DB, called last during shutdown
+func CloseDB() error {
+	if DB == nil {
+		return nil
+	}
+	return DB.Close()
+}
+
+// Ping
+//   - checks database.DB answers before ctx is done, for the health checks
+func Ping(ctx context.Context) error {
+	if DB == nil {
+		return errors.New(apierrorkeys.DBInitErr)
+	}
+	return DB.PingContext(ctx)
+}
+
 func connectGDBTLS() error {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?tls=custom&parseTime=true",
 		global.EnvVars.DbserverUser,
@@ -62,16 +85,7 @@ func connectGDBTLS() error {
 		global.EnvVars.DbserverPort,
 		global.EnvVars.DbserverDefaultDB)
 
-	db, dbconnerr := sqlx.Open("mysql", dsn)
-	if dbconnerr != nil {
-		return dbconnerr
-	}
-	db.SetMaxIdleConns(50)
-	db.SetMaxOpenConns(100)
-	db.SetConnMaxLifetime(1 * time.Minute)
-	DB = db
-	//defer db.Close()
-	return nil
+	return openDB(dsn)
 }
 
 func connectGDB() error {
@@ -82,10 +96,20 @@ func connectGDB() error {
 		global.EnvVars.DbserverPort,
 		global.EnvVars.DbserverDefaultDB)
 
-	db, dbconnerr := sqlx.Open("mysql", dsn)
+	return openDB(dsn)
+}
+
+// openDB opens DB with queries traced, see tracing.WrapConnector
+func openDB(dsn string) error {
+	cfg, dbconnerr := mysql.ParseDSN(dsn)
+	if dbconnerr != nil {
+		return dbconnerr
+	}
+	connector, dbconnerr := mysql.NewConnector(cfg)
 	if dbconnerr != nil {
 		return dbconnerr
 	}
+	db := sqlx.NewDb(sql.OpenDB(tracing.WrapConnector(connector, "mysql")), "mysql")
 	db.SetMaxIdleConns(50)
 	db.SetMaxOpenConns(100)
 	db.SetConnMaxLifetime(1 * time.Minute)
@@ -1,6 +1,8 @@
 package user
 
 import (
+	"context"
+
 	"github.com/rogue-syntax/rs-goapiserver/database"
 )
 
@@ -36,30 +38,46 @@ type UserExternal struct {
 }
 
 func FindUserInternalByEmail(email_value string) (*UserInternal, error) {
+	return FindUserInternalByEmailContext(context.Background(), email_value)
+}
+
+func FindUserInternalByEmailContext(ctx context.Context, email_value string) (*UserInternal, error) {
 	var err error
 	var usr UserInternal
-	err = database.DB.Get(&usr, "SELECT * FROM UserInternal WHERE email_value = ?", email_value)
+	err = database.DB.GetContext(ctx, &usr, "SELECT * FROM UserInternal WHERE email_value = ?", email_value)
 	return &usr, err
 }
 
 func FindUserInternalByUser_id(user_id int) (*UserInternal, error) {
+	return FindUserInternalByUser_idContext(context.Background(), user_id)
+}
+
+func FindUserInternalByUser_idContext(ctx context.Context, user_id int) (*UserInternal, error) {
 	var err error
 	var usr UserInternal
-	err = database.DB.Get(&usr, "SELECT * FROM UserInternal WHERE user_id = ?", user_id)
+	err = database.DB.GetContext(ctx, &usr, "SELECT * FROM UserInternal WHERE user_id = ?", user_id)
 	return &usr, err
 }
 
 func FindUserExternalByUser_id(user_id int) (*UserExternal, error) {
+	return FindUserExternalByUser_idContext(context.Background(), user_id)
+}
+
+func FindUserExternalByUser_idContext(ctx context.Context, user_id int) (*UserExternal, error) {
 	var err error
 	var usr UserExternal
-	err = database.DB.Get(&usr, "SELECT * FROM UserExternal WHERE user_id = ?", user_id)
+	err = database.DB.GetContext(ctx, &usr, "SELECT * FROM UserExternal WHERE user_id = ?", user_id)
 	return &usr, err
 }
 
 func FindApiKeyByUser_id(user_id int) (string, error) {
+	return FindApiKeyByUser_idContext(context.Background(), user_id)
+}
+
+func FindApiKeyByUser_idContext(ctx context.Context, user_id int) (string, error) {
 	var err error
 	var apiKeyHash string
-	err = database.DB.Get(&apiKeyHash, "SELECT user_api_tok FROM user_auth WHERE user_id = ?", user_id)
+	err = database.DB.GetContext(ctx, &apiKeyHash, "SELECT user_api_tok FROM user_auth WHERE user_id = ?", user_id)
 	return apiKeyHash, err
 }
 
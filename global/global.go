@@ -47,6 +47,10 @@ type EnvVarsType struct {
 	MinioUseSSL          bool
 	MinioSSLKey          string
 	MinioSSLCert         string
+	TokenSigningAlg      string
+	TokenSigningKid      string
+	TokenSigningKey      string
+	ApiKeySigningEncKey  string
 }
 
 var Reference_YYYY_MM_DD = "2006-01-02"
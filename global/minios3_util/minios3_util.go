@@ -7,6 +7,7 @@ import (
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
 	"github.com/rogue-syntax/rs-goapiserver/global"
 )
 
@@ -88,6 +89,17 @@ func Makes3Bucket(namer string) error {
 	return nil
 }
 
+// PingBucket
+//   - checks MinIO answers before ctx is done by probing bucket, for the health checks
+//   - a bucket that does not exist still counts as an answer
+func PingBucket(ctx context.Context, bucket string) error {
+	if minioClient == nil {
+		return errors.New(apierrorkeys.AppInitErr_S3)
+	}
+	_, err := minioClient.BucketExists(ctx, bucket)
+	return errors.Wrap(err, "PingBucket")
+}
+
 func CheckS3BucketExists(namer string) (bool, error) {
 	found, err := minioClient.BucketExists(context.Background(), namer)
 	err = errors.Wrap(err, "CheckS3BucketExists")
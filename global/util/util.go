@@ -2,6 +2,7 @@ package util
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -11,6 +12,7 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/tracing"
 )
 
 func Marshal(i interface{}) ([]byte, error) {
@@ -31,7 +33,14 @@ type ReqHeader struct {
 	HeaderValue string
 }
 
+// HttpPostReq is HttpPostReqContext without a caller, its span starts a new trace, use HttpPostReqContext from a handler
 func HttpPostReq(method string, payload interface{}, url string, reqHeaders []ReqHeader, addHeaders []ReqHeader) (error, []byte) {
+	return HttpPostReqContext(context.Background(), method, payload, url, reqHeaders, addHeaders)
+}
+
+// HttpPostReqContext
+//   - HttpPostReq bound to ctx, the outgoing request is cancelled when ctx is i.e. the client of the inbound request went away
+func HttpPostReqContext(ctx context.Context, method string, payload interface{}, url string, reqHeaders []ReqHeader, addHeaders []ReqHeader) (error, []byte) {
 	if reqHeaders == nil {
 		defaultHeader := []ReqHeader{
 			{HeaderName: "Content-Type", HeaderValue: "application/json; charset=utf-8"},
@@ -52,16 +61,33 @@ func HttpPostReq(method string, payload interface{}, url string, reqHeaders []Re
 		}
 	}
 
-	request, err := http.NewRequest(method, url, bytes.NewBuffer(reqBytes))
+	request, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(reqBytes))
+	if err != nil {
+		return err, returnByes
+	}
 
 	for i := 0; i < len(reqHeaders); i++ {
 		request.Header.Set(reqHeaders[i].HeaderName, reqHeaders[i].HeaderValue)
 	}
+
+	//TRACE SPAN: the callee continues the trace from the traceparent header
+	ctx, span := tracing.Start(ctx, "HTTP "+method, tracing.KIND_CLIENT)
+	defer span.End()
+	span.SetAttribute("http.request.method", method)
+	span.SetAttribute("server.address", request.URL.Host)
+	span.SetAttribute("url.path", request.URL.Path)
+	tracing.Inject(ctx, request.Header)
+
 	client := &http.Client{}
 	response, err := client.Do(request)
 	if err != nil {
+		span.RecordError(err)
 		return err, returnByes
 	}
+	span.SetAttribute("http.response.status_code", response.StatusCode)
+	if response.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(tracing.STATUS_ERROR, http.StatusText(response.StatusCode))
+	}
 	defer response.Body.Close()
 	rBody, err := ioutil.ReadAll(response.Body)
 	if err != nil {
@@ -0,0 +1,53 @@
+package health
+
+import (
+	"context"
+	"time"
+
+	"github.com/rogue-syntax/rs-goapiserver/database"
+	"github.com/rogue-syntax/rs-goapiserver/global/minios3_util"
+	"github.com/rogue-syntax/rs-goapiserver/mail"
+	"github.com/rogue-syntax/rs-goapiserver/websockets"
+)
+
+// names of the built in checks
+const (
+	CHECK_DATABASE   = "database"
+	CHECK_MINIO      = "minio"
+	CHECK_SMTP       = "smtp"
+	CHECK_WEBSOCKETS = "websockets"
+)
+
+// DatabaseCheck pings database.DB
+func DatabaseCheck() Check {
+	return Check{Name: CHECK_DATABASE, Func: database.Ping}
+}
+
+// MinioCheck probes bucket with the minios3_util client
+func MinioCheck(bucket string) Check {
+	return Check{Name: CHECK_MINIO, Func: func(ctx context.Context) error {
+		return minios3_util.PingBucket(ctx, bucket)
+	}}
+}
+
+// SMTPCheck dials the SMTP server, optional since the server can serve without mail, cached longer to not look like a scan
+func SMTPCheck() Check {
+	return Check{Name: CHECK_SMTP, Func: mail.Ping, Timeout: 5 * time.Second, CacheTTL: time.Minute, Optional: true}
+}
+
+// WebSocketCheck asks ManageWebSockets for a heartbeat, a liveness check since a stuck manager blocks every socket
+func WebSocketCheck() Check {
+	return Check{Name: CHECK_WEBSOCKETS, Func: websockets.Channel_Heartbeat, Liveness: true}
+}
+
+// RegisterBuiltins
+//   - registers the database, SMTP and websocket checks with Default, and the MinIO check if bucket is not empty
+//   - call after database.StartDB, minios3_util.IntiMinioClient and websockets.IntiWebsockets
+func RegisterBuiltins(bucket string) {
+	Register(DatabaseCheck())
+	Register(SMTPCheck())
+	Register(WebSocketCheck())
+	if bucket != "" {
+		Register(MinioCheck(bucket))
+	}
+}
@@ -0,0 +1,267 @@
+package health
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+// Health and readiness checks
+/*
+
+	A Registry of named Checks, each run with its own timeout and its result cached for a while so frequent
+	probes do not load the database or SMTP server.
+
+	/healthz (liveness) runs only the Checks marked Liveness, a failure means the process should be restarted,
+	i.e. the websocket manager goroutine is stuck. /readyz (readiness) runs every Check, a failure means the
+	process is up but should not get traffic, i.e. MySQL is unreachable.
+
+	Both answer 200 with a PublicReport, or 503 with HEALTH_CHECK_ERROR and the PublicReport as Data if a required
+	Check failed. A failed Optional Check makes the Report degraded but still 200. They are served without
+	authentication, so they only show each Check's name and status. A failed run of a Check is logged with its
+	error, and Handler_HealthDetail serves the whole Report, register it behind the admin listener, see
+	adminroutes.SetDiagnosticsRoutes.
+
+	The built in checks are in checks.go, register them once the database, MinIO and websockets are started:
+	  health.RegisterBuiltins("some-bucket")
+	Register application checks with Register.
+
+*/
+
+const (
+	HEALTHZ_ROUTE = "/healthz"
+	READYZ_ROUTE  = "/readyz"
+
+	DEFAULT_TIMEOUT   = 2 * time.Second
+	DEFAULT_CACHE_TTL = 5 * time.Second
+)
+
+type Status string
+
+const (
+	STATUS_OK       Status = "ok"
+	STATUS_DEGRADED Status = "degraded"
+	STATUS_FAIL     Status = "fail"
+)
+
+/*
+Check: a named dependency check
+  - Name: unique, registering a Check with the same name replaces it
+  - Func: nil when healthy, its ctx is done after Timeout and Func is abandoned if it does not return by then
+  - Timeout: DEFAULT_TIMEOUT when zero
+  - CacheTTL: how long a result is served before Func runs again, DEFAULT_CACHE_TTL when zero, negative never caches
+  - Liveness: also run by /healthz
+  - Optional: a failure makes the Report degraded instead of failed, i.e. SMTP
+*/
+type Check struct {
+	Name     string
+	Func     func(ctx context.Context) error
+	Timeout  time.Duration
+	CacheTTL time.Duration
+	Liveness bool
+	Optional bool
+}
+
+// Result: the outcome of one Check, Cached is true when it was served from the cache
+type Result struct {
+	Name        string
+	Status      Status
+	Error       string `json:",omitempty"`
+	Optional    bool
+	Duration_ms float64
+	Checked_at  time.Time
+	Cached      bool
+}
+
+// Report: the Results of a run sorted by name, Status is the worst of them
+type Report struct {
+	Status Status
+	Checks []Result
+}
+
+// PublicResult: the name and status of a Result, without its error
+type PublicResult struct {
+	Name   string
+	Status Status
+}
+
+// PublicReport: a Report as the unauthenticated /healthz and /readyz show it
+type PublicReport struct {
+	Status Status
+	Checks []PublicResult
+}
+
+// Public drops everything but the status and the name and status of each Check
+func (report Report) Public() PublicReport {
+	public := PublicReport{Status: report.Status, Checks: make([]PublicResult, len(report.Checks))}
+	for i, res := range report.Checks {
+		public.Checks[i] = PublicResult{Name: res.Name, Status: res.Status}
+	}
+	return public
+}
+
+// Registry: Checks run together, see Default
+type Registry struct {
+	mu     sync.RWMutex
+	checks map[string]*entry
+}
+
+// entry holds a Check and its last result, mu makes concurrent probes wait on one run of Func
+type entry struct {
+	check Check
+	mu    sync.Mutex
+	last  Result
+	ran   bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{checks: make(map[string]*entry)}
+}
+
+// Default is the registry Register adds to and the handlers run
+var Default = NewRegistry()
+
+// Register adds c to Default
+func Register(c Check) {
+	Default.Register(c)
+}
+
+// Register adds c, replacing a Check of the same name and its cached result
+func (reg *Registry) Register(c Check) {
+	if c.Timeout == 0 {
+		c.Timeout = DEFAULT_TIMEOUT
+	}
+	if c.CacheTTL == 0 {
+		c.CacheTTL = DEFAULT_CACHE_TTL
+	}
+	reg.mu.Lock()
+	reg.checks[c.Name] = &entry{check: c}
+	reg.mu.Unlock()
+}
+
+func (reg *Registry) Unregister(name string) {
+	reg.mu.Lock()
+	delete(reg.checks, name)
+	reg.mu.Unlock()
+}
+
+// Run runs the Checks in parallel, only the Liveness ones if liveness is true
+func (reg *Registry) Run(ctx context.Context, liveness bool) Report {
+	reg.mu.RLock()
+	entries := make([]*entry, 0, len(reg.checks))
+	for _, e := range reg.checks {
+		if !liveness || e.check.Liveness {
+			entries = append(entries, e)
+		}
+	}
+	reg.mu.RUnlock()
+
+	report := Report{Status: STATUS_OK, Checks: make([]Result, len(entries))}
+	var wg sync.WaitGroup
+	for i, e := range entries {
+		wg.Add(1)
+		go func(i int, e *entry) {
+			defer wg.Done()
+			report.Checks[i] = e.result(ctx)
+		}(i, e)
+	}
+	wg.Wait()
+
+	sort.Slice(report.Checks, func(i, j int) bool { return report.Checks[i].Name < report.Checks[j].Name })
+	for _, res := range report.Checks {
+		if res.Status != STATUS_FAIL {
+			continue
+		}
+		if !res.Optional {
+			report.Status = STATUS_FAIL
+		} else if report.Status == STATUS_OK {
+			report.Status = STATUS_DEGRADED
+		}
+	}
+	return report
+}
+
+// result is the cached result of e if still fresh, else runs e.check.Func
+func (e *entry) result(ctx context.Context) Result {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ran && e.check.CacheTTL > 0 && time.Since(e.last.Checked_at) < e.check.CacheTTL {
+		res := e.last
+		res.Cached = true
+		return res
+	}
+	start := time.Now()
+	err := runCheck(ctx, e.check)
+	res := Result{Name: e.check.Name, Status: STATUS_OK, Optional: e.check.Optional, Checked_at: start}
+	res.Duration_ms = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		res.Status = STATUS_FAIL
+		res.Error = err.Error()
+		apierrors.HandleError(nil, errors.Wrap(err, apierrorkeys.HealthCheckErr+": "+e.check.Name), apierrorkeys.HealthCheckErr, nil)
+	}
+	// a probe that gave up is not the check's result, do not cache it
+	if ctx.Err() == nil {
+		e.last = res
+		e.ran = true
+	}
+	return res
+}
+
+// runCheck runs c.Func within c.Timeout, a Func that ignores its ctx is left to finish on its own
+func runCheck(ctx context.Context, c Check) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- errors.Errorf("check panicked: %v", r)
+			}
+		}()
+		done <- c.Func(ctx)
+	}()
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "check timed out after "+c.Timeout.String())
+	}
+}
+
+// Handler_Healthz
+//   - liveness, runs the Liveness checks of Default, answers with the PublicReport
+func Handler_Healthz(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	report := Default.Run(ctx, true)
+	writeReport(report.Status, report.Public(), &w)
+}
+
+// Handler_Readyz
+//   - readiness, runs every check of Default, answers with the PublicReport
+func Handler_Readyz(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	report := Default.Run(ctx, false)
+	writeReport(report.Status, report.Public(), &w)
+}
+
+// Handler_HealthDetail
+//   - runs every check of Default and answers with the whole Report, errors included
+//   - register it behind authentication on the admin listener only
+func Handler_HealthDetail(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	report := Default.Run(ctx, false)
+	writeReport(report.Status, report, &w)
+}
+
+func writeReport(status Status, data interface{}, w *http.ResponseWriter) {
+	(*w).Header().Set("Cache-Control", "no-store")
+	if status == STATUS_FAIL {
+		apireturn.ApiJSONReturnStatus(data, apierrorkeys.HealthCheckErr, http.StatusServiceUnavailable, w)
+		return
+	}
+	apireturn.ApiJSONReturnStatus(data, apierrorkeys.NOError, http.StatusOK, w)
+}
@@ -0,0 +1,461 @@
+package logquery
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/zerologger"
+)
+
+// Log query
+/*
+
+	Reads the lumberjack error and request logs, the current file and its rotated backups, gzipped or not,
+	a line at a time so only a page of entries is held in memory.
+
+	Query filters by time range, level, Req_id, endpoint, user id and free text, and pages with Limit and Offset.
+	Order ORDER_DESC (the default) pages from the newest entry back. Offset is at most MAX_OFFSET, so a page never
+	holds more than MAX_OFFSET+MAX_LIMIT entries, page further back by moving To before the oldest entry seen.
+
+	Request log entries have no level, they get LEVEL_ERROR for a 5xx status or error logs, LEVEL_WARN for a
+	4xx status, LEVEL_INFO otherwise.
+
+	Handler_QueryLogs serves Query from url parameters, see QueryFromRequest, register it behind
+	RoleBaseReqVerifMiddleware.
+
+*/
+
+type Source string
+
+const (
+	ERROR_LOG   Source = "error"
+	REQUEST_LOG Source = "request"
+)
+
+const (
+	LEVEL_INFO  = "info"
+	LEVEL_WARN  = "warn"
+	LEVEL_ERROR = "error"
+)
+
+const (
+	ORDER_ASC  = "asc"
+	ORDER_DESC = "desc"
+)
+
+const (
+	DEFAULT_LIMIT = 100
+	MAX_LIMIT     = 1000
+	MAX_OFFSET    = 10000
+)
+
+// lumberjack names a backup <name>-<time><ext>, and <name>-<time><ext>.gz once compressed
+const (
+	backupTimeFormat = "2006-01-02T15-04-05.000"
+	compressSuffix   = ".gz"
+)
+
+// LogFiles is the current file of each Source, set before serving if the loggers write elsewhere
+var LogFiles = map[Source]string{
+	ERROR_LOG:   zerologger.ERROR_LOG_FILE,
+	REQUEST_LOG: zerologger.REQUEST_LOG_FILE,
+}
+
+/*
+Query: what to read
+  - Source: ERROR_LOG or REQUEST_LOG
+  - From, To: the time range, zero for open ended
+  - Level: one of the LEVEL_* constants, or a zerolog level for the error log
+  - Req_id, Endpoint, User_id: exact matches, 0 User_id for any
+  - Text: case insensitive match anywhere in the raw entry
+  - Limit, Offset: the page, Offset at most MAX_OFFSET, Order: ORDER_ASC or ORDER_DESC
+*/
+type Query struct {
+	Source   Source
+	From     time.Time
+	To       time.Time
+	Level    string
+	Req_id   string
+	Endpoint string
+	User_id  int
+	Text     string
+	Limit    int
+	Offset   int
+	Order    string
+}
+
+// Entry: one log entry, the fields used to filter it and the entry as logged
+type Entry struct {
+	Source   Source
+	Time     time.Time
+	Level    string
+	Req_id   string
+	Endpoint string
+	User_id  int
+	Message  string
+	Status   int
+	Raw      json.RawMessage
+}
+
+// Page: the entries of a page, Total counts every match, NextOffset is 0 on the last page and past MAX_OFFSET
+type Page struct {
+	Entries    []Entry
+	Total      int
+	NextOffset int
+}
+
+var offsetMsg = "offset can be at most " + strconv.Itoa(MAX_OFFSET) + ", page further back with an earlier to"
+
+// logFile is a current file or backup, rotated is the time lumberjack renamed it
+type logFile struct {
+	path    string
+	rotated time.Time
+	gzipped bool
+}
+
+// Run reads the files of q.Source and returns the page of matching entries
+func Run(q Query) (Page, error) {
+	q = normalize(q)
+	if q.Offset > MAX_OFFSET {
+		return Page{}, errors.New(apierrorkeys.RequestError + ": " + offsetMsg)
+	}
+	files, err := filesFor(q.Source)
+	if err != nil {
+		return Page{}, err
+	}
+	page := Page{Entries: []Entry{}}
+	// desc keeps the last Offset+Limit matches, asc stops collecting once the page is full
+	window := q.Offset + q.Limit
+	var ring []Entry
+	next := 0
+	for _, f := range files {
+		// every entry in a backup is older than its rotation time
+		if !q.From.IsZero() && !f.rotated.IsZero() && f.rotated.Before(q.From) {
+			continue
+		}
+		err := scanFile(f, q.Source, func(e Entry) {
+			if !q.matches(e) {
+				return
+			}
+			if q.Order == ORDER_ASC {
+				if page.Total >= q.Offset && page.Total < window {
+					page.Entries = append(page.Entries, e)
+				}
+			} else {
+				if len(ring) < window {
+					ring = append(ring, e)
+				} else {
+					ring[next] = e
+					next = (next + 1) % window
+				}
+			}
+			page.Total++
+		})
+		if err != nil {
+			return Page{}, err
+		}
+	}
+	if q.Order != ORDER_ASC {
+		// ring is the newest window of matches, oldest at next, the page is the newest after skipping Offset
+		ring = append(append(make([]Entry, 0, len(ring)), ring[next:]...), ring[:next]...)
+		end := len(ring) - q.Offset
+		for i := end - 1; i >= 0 && len(page.Entries) < q.Limit; i-- {
+			page.Entries = append(page.Entries, ring[i])
+		}
+	}
+	if window < page.Total && window <= MAX_OFFSET {
+		page.NextOffset = window
+	}
+	return page, nil
+}
+
+func normalize(q Query) Query {
+	if q.Source == "" {
+		q.Source = ERROR_LOG
+	}
+	if q.Limit <= 0 {
+		q.Limit = DEFAULT_LIMIT
+	}
+	if q.Limit > MAX_LIMIT {
+		q.Limit = MAX_LIMIT
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	if q.Order != ORDER_ASC {
+		q.Order = ORDER_DESC
+	}
+	q.Level = strings.ToLower(q.Level)
+	q.Text = strings.ToLower(q.Text)
+	return q
+}
+
+func (q Query) matches(e Entry) bool {
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && e.Time.After(q.To) {
+		return false
+	}
+	if q.Level != "" && e.Level != q.Level {
+		return false
+	}
+	if q.Req_id != "" && e.Req_id != q.Req_id {
+		return false
+	}
+	if q.Endpoint != "" && e.Endpoint != q.Endpoint {
+		return false
+	}
+	if q.User_id != 0 && e.User_id != q.User_id {
+		return false
+	}
+	if q.Text != "" && !bytes.Contains(bytes.ToLower(e.Raw), []byte(q.Text)) {
+		return false
+	}
+	return true
+}
+
+// filesFor lists the backups of a source oldest first, then the current file
+func filesFor(source Source) ([]logFile, error) {
+	current, ok := LogFiles[source]
+	if !ok {
+		return nil, errors.New(apierrorkeys.RequestError + ": unknown log source " + string(source))
+	}
+	dir := filepath.Dir(current)
+	ext := filepath.Ext(current)
+	prefix := strings.TrimSuffix(filepath.Base(current), ext) + "-"
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.WithStack(err)
+	}
+	var files []logFile
+	for _, de := range dirEntries {
+		name := de.Name()
+		if de.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		f := logFile{path: filepath.Join(dir, name)}
+		if strings.HasSuffix(name, compressSuffix) {
+			f.gzipped = true
+			name = strings.TrimSuffix(name, compressSuffix)
+		}
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		rotated, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext))
+		if err != nil {
+			continue
+		}
+		f.rotated = rotated
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].rotated.Before(files[j].rotated) })
+	if _, err := os.Stat(current); err == nil {
+		files = append(files, logFile{path: current})
+	}
+	return files, nil
+}
+
+// scanFile calls fn for each entry of f, lines that are not JSON are skipped
+func scanFile(f logFile, source Source, fn func(Entry)) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// rotated away since it was listed
+			return nil
+		}
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if f.gzipped {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	br := bufio.NewReader(reader)
+	for {
+		line, readErr := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			// request logs written before entries were newline separated hold many entries on a line
+			dec := json.NewDecoder(bytes.NewReader(line))
+			for {
+				var raw json.RawMessage
+				if err := dec.Decode(&raw); err != nil {
+					break
+				}
+				if e, ok := parseEntry(source, raw); ok {
+					fn(e)
+				}
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return errors.WithStack(readErr)
+		}
+	}
+}
+
+// errorLogLine is the zerolog error log entry
+type errorLogLine struct {
+	Level   string `json:"level"`
+	Time    string `json:"time"`
+	Message string `json:"message"`
+	Error   string `json:"error"`
+	Req_id  string `json:"Req_id"`
+}
+
+// requestLogLine is the part of rs_go_requestlogger.RSRequestLogger used to filter
+type requestLogLine struct {
+	Time         time.Time
+	User_id      int
+	Endpoint     string
+	Req_id       string
+	ErrorLogs    []string
+	ResponseVars struct {
+		Status int
+	}
+}
+
+func parseEntry(source Source, raw json.RawMessage) (Entry, bool) {
+	e := Entry{Source: source, Raw: raw}
+	if source == REQUEST_LOG {
+		var line requestLogLine
+		if err := json.Unmarshal(raw, &line); err != nil {
+			return e, false
+		}
+		e.Time = line.Time
+		e.User_id = line.User_id
+		e.Endpoint = line.Endpoint
+		e.Req_id = line.Req_id
+		e.Status = line.ResponseVars.Status
+		e.Level = LEVEL_INFO
+		if e.Status >= 400 {
+			e.Level = LEVEL_WARN
+		}
+		if e.Status >= 500 || len(line.ErrorLogs) > 0 {
+			e.Level = LEVEL_ERROR
+		}
+		if len(line.ErrorLogs) > 0 {
+			e.Message = line.ErrorLogs[0]
+		}
+		return e, true
+	}
+	var line errorLogLine
+	if err := json.Unmarshal(raw, &line); err != nil {
+		return e, false
+	}
+	e.Time, _ = time.Parse(time.RFC3339Nano, line.Time)
+	e.Level = strings.ToLower(line.Level)
+	e.Req_id = line.Req_id
+	e.Message = line.Message
+	if line.Error != "" {
+		e.Message += ": " + line.Error
+	}
+	return e, true
+}
+
+/*
+QueryFromRequest: a Query from url parameters
+  - source: error or request, from, to: RFC 3339 times, level, req_id, endpoint, user_id, q: free text,
+    limit, offset, order: asc or desc
+*/
+func QueryFromRequest(r *http.Request) (Query, error) {
+	v := r.URL.Query()
+	q := Query{
+		Source:   Source(v.Get("source")),
+		Level:    v.Get("level"),
+		Req_id:   v.Get("req_id"),
+		Endpoint: v.Get("endpoint"),
+		Text:     v.Get("q"),
+		Order:    v.Get("order"),
+	}
+	var err error
+	for _, tp := range []struct {
+		key string
+		t   *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if s := v.Get(tp.key); s != "" {
+			if *tp.t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+				return q, errors.Wrap(err, tp.key)
+			}
+		}
+	}
+	for _, ip := range []struct {
+		key string
+		n   *int
+	}{{"user_id", &q.User_id}, {"limit", &q.Limit}, {"offset", &q.Offset}} {
+		if s := v.Get(ip.key); s != "" {
+			if *ip.n, err = strconv.Atoi(s); err != nil {
+				return q, errors.Wrap(err, ip.key)
+			}
+		}
+	}
+	if q.Order != "" && q.Order != ORDER_ASC && q.Order != ORDER_DESC {
+		return q, errors.New("order must be " + ORDER_ASC + " or " + ORDER_DESC)
+	}
+	if q.Offset > MAX_OFFSET {
+		return q, errors.New(offsetMsg)
+	}
+	return q, nil
+}
+
+// Handler_QueryLogs
+//   - returns a Page for the Query in the url parameters, see QueryFromRequest
+func Handler_QueryLogs(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	serveQuery(w, r, "")
+}
+
+// HandlerFor is Handler_QueryLogs with the source fixed, the source parameter is ignored
+func HandlerFor(source Source) func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	return func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+		serveQuery(w, r, source)
+	}
+}
+
+func serveQuery(w http.ResponseWriter, r *http.Request, source Source) {
+	q, err := QueryFromRequest(r)
+	if err != nil {
+		apierrors.HandleError(r, err, apierrorkeys.RequestError, &apierrors.ReturnError{Msg: apierrorkeys.RequestError, Data: err.Error(), W: &w})
+		return
+	}
+	if source != "" {
+		q.Source = source
+	}
+	if q.Source != "" {
+		if _, ok := LogFiles[q.Source]; !ok {
+			apierrors.HandleError(r, errors.New("unknown log source "+string(q.Source)), apierrorkeys.RequestError, &apierrors.ReturnError{Msg: apierrorkeys.RequestError, Data: "source must be " + string(ERROR_LOG) + " or " + string(REQUEST_LOG), W: &w})
+			return
+		}
+	}
+	page, err := Run(q)
+	if err != nil {
+		apierrors.HandleError(r, err, apierrorkeys.SystemError, &apierrors.ReturnError{Msg: apierrorkeys.SystemError, W: &w})
+		return
+	}
+	apireturn.ApiJSONReturn(page, apierrorkeys.NOError, &w)
+}
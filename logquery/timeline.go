@@ -0,0 +1,108 @@
+package logquery
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/rs_ev_src"
+)
+
+// Request timeline
+/*
+
+	Everything logged under one Req_id: the request log entry, the error log entries and the rs_ev_src events
+	it produced, merged in time order.
+
+	Errors carry the Req_id when apierrors.HandleError gets the request, or an error from apierrors.WithReqId or
+	an rs_ev_src action. Events carry it when run with the handler's ctx, see rs_ev_src.DoEVEventActionContext.
+	Websocket callbacks carry the Req_id of the request that opened the socket.
+
+*/
+
+const (
+	TIMELINE_REQUEST = "request"
+	TIMELINE_ERROR   = "error"
+	TIMELINE_EVENT   = "event"
+)
+
+/*
+TimelineItem: one thing that happened under the Req_id
+  - Kind: TIMELINE_REQUEST, TIMELINE_ERROR or TIMELINE_EVENT
+  - Summary: a one line description, Data: the log Entry or rs_ev_src.EVEventSerial
+*/
+type TimelineItem struct {
+	Time    time.Time
+	Kind    string
+	Summary string
+	Data    interface{}
+}
+
+type Timeline struct {
+	Req_id string
+	Items  []TimelineItem
+}
+
+// BuildTimeline collects the log entries and events of req_id
+func BuildTimeline(ctx context.Context, req_id string) (Timeline, error) {
+	tl := Timeline{Req_id: req_id, Items: []TimelineItem{}}
+	for _, source := range []Source{REQUEST_LOG, ERROR_LOG} {
+		files, err := filesFor(source)
+		if err != nil {
+			return tl, err
+		}
+		for _, f := range files {
+			err := scanFile(f, source, func(e Entry) {
+				if e.Req_id == req_id {
+					tl.Items = append(tl.Items, timelineEntry(e))
+				}
+			})
+			if err != nil {
+				return tl, err
+			}
+		}
+	}
+	events, err := rs_ev_src.LoadByReqIdContext(ctx, req_id)
+	if err != nil {
+		return tl, err
+	}
+	for _, ev := range events {
+		summary := ev.Action_name + " succeeded"
+		if !ev.Success {
+			summary = ev.Action_name + " failed: " + ev.ErrMsg
+		}
+		tl.Items = append(tl.Items, TimelineItem{Time: ev.Timestamp, Kind: TIMELINE_EVENT, Summary: summary, Data: ev})
+	}
+	sort.SliceStable(tl.Items, func(i, j int) bool { return tl.Items[i].Time.Before(tl.Items[j].Time) })
+	return tl, nil
+}
+
+func timelineEntry(e Entry) TimelineItem {
+	if e.Source == REQUEST_LOG {
+		return TimelineItem{Time: e.Time, Kind: TIMELINE_REQUEST, Summary: e.Endpoint + " " + strconv.Itoa(e.Status), Data: e}
+	}
+	return TimelineItem{Time: e.Time, Kind: TIMELINE_ERROR, Summary: e.Message, Data: e}
+}
+
+// Handler_GetTimeline
+//   - returns the Timeline of the req_id url parameter
+func Handler_GetTimeline(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	req_id := r.URL.Query().Get("req_id")
+	if req_id == "" {
+		err := errors.New("req_id is required")
+		apierrors.HandleError(r, err, apierrorkeys.RequiredDataMissing, &apierrors.ReturnError{Msg: apierrorkeys.RequiredDataMissing, Data: err.Error(), W: &w})
+		return
+	}
+	tl, err := BuildTimeline(ctx, req_id)
+	if err != nil {
+		apierrors.HandleError(r, err, apierrorkeys.SystemError, &apierrors.ReturnError{Msg: apierrorkeys.SystemError, W: &w})
+		return
+	}
+	apireturn.ApiJSONReturn(tl, apierrorkeys.NOError, &w)
+}
@@ -3,12 +3,15 @@ package mail
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/smtp"
 
 	"github.com/rogue-syntax/rs-goapiserver/apierrors"
 	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
 	"github.com/rogue-syntax/rs-goapiserver/global"
+	"github.com/rogue-syntax/rs-goapiserver/metrics"
+	"github.com/rogue-syntax/rs-goapiserver/tracing"
 )
 
 type Mail struct {
@@ -33,6 +36,11 @@ type MailMulti struct {
 // mail creds are hard coded here in mailer func
 // single addr mail
 func Mailer(m Mail) error {
+	return MailerContext(context.Background(), m)
+}
+
+// MailerContext is Mailer traced as a child of the span in ctx
+func MailerContext(ctx context.Context, m Mail) error {
 	//ionos mail
 	/*
 		smtp_user := "support@port-trak.net"
@@ -52,12 +60,16 @@ func Mailer(m Mail) error {
 		"MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n" +
 		m.Body + "\r\n")
 	auth := smtp.PlainAuth("", smtp_user, smtp_pwd, mailer)
-	err := smtp.SendMail(mailer+smtpPort, auth, m.FromAddr, []string{m.ToAddr}, msg)
-	return err
+	return sendSMTP(ctx, mailer+smtpPort, auth, m.FromAddr, []string{m.ToAddr}, msg)
 }
 
 // multi addr mail
 func MailerMulti(m MailMulti) error {
+	return MailerMultiContext(context.Background(), m)
+}
+
+// MailerMultiContext is MailerMulti traced as a child of the span in ctx
+func MailerMultiContext(ctx context.Context, m MailMulti) error {
 	smtp_user := global.EnvVars.SMTPSupportUserName
 	smtp_pwd := global.EnvVars.SMTPSupportUserPW
 	mailer := global.EnvVars.SMTPEndpoint
@@ -68,12 +80,49 @@ func MailerMulti(m MailMulti) error {
 		"MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\n\n" +
 		m.Body + "\r\n")
 	auth := smtp.PlainAuth("", smtp_user, smtp_pwd, mailer)
-	err := smtp.SendMail(mailer+smtpPort, auth, m.FromAddr, m.ToArray, msg)
+	return sendSMTP(ctx, mailer+smtpPort, auth, m.FromAddr, m.ToArray, msg)
+}
+
+// sendSMTP sends msg in a client span and counts the result
+func sendSMTP(ctx context.Context, addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	_, span := tracing.Start(ctx, "smtp send", tracing.KIND_CLIENT)
+	span.SetAttribute("server.address", addr)
+	span.SetAttribute("messaging.batch.message_count", len(to))
+	err := smtp.SendMail(addr, auth, from, to, msg)
+	span.RecordError(err)
+	span.End()
+	metrics.MailSendsTotal.Inc("smtp", metrics.Result(err))
 	return err
 }
 
+// Ping
+//   - dials the SMTP server and reads its greeting before ctx is done, for the health checks
+//   - does not authenticate or send
+func Ping(ctx context.Context) error {
+	mailer := global.EnvVars.SMTPEndpoint
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", mailer+":"+global.EnvVars.SMTPPort)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, mailer)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return c.Quit()
+}
+
 // send mail with this
 func SendMail(toEmail string, fromName string, fromAddr string, subj string, msgHtml string) error {
+	return SendMailContext(context.Background(), toEmail, fromName, fromAddr, subj, msgHtml)
+}
+
+// SendMailContext is SendMail traced as a child of the span in ctx
+func SendMailContext(ctx context.Context, toEmail string, fromName string, fromAddr string, subj string, msgHtml string) error {
 
 	m := Mail{ToAddr: toEmail,
 		FromName: fromName,
@@ -81,7 +130,7 @@ func SendMail(toEmail string, fromName string, fromAddr string, subj string, msg
 		Subject:  subj,
 		Body:     msgHtml}
 
-	err := Mailer(m)
+	err := MailerContext(ctx, m)
 	if err != nil {
 		//log.Print(err.Error())
 		return err
@@ -277,8 +326,13 @@ Generate the email using CraftEmail( messageHTML ) template where messageHTML wi
   - subject : string | the subject field to use
 */
 func SendMailSingle(addr string, emailBody string, fromName string, fromAddr string, subject string) error {
+	return SendMailSingleContext(context.Background(), addr, emailBody, fromName, fromAddr, subject)
+}
+
+// SendMailSingleContext is SendMailSingle traced as a child of the span in ctx
+func SendMailSingleContext(ctx context.Context, addr string, emailBody string, fromName string, fromAddr string, subject string) error {
 	email := addr
-	sendErr := SendMail(email, fromName, fromAddr, subject, emailBody)
+	sendErr := SendMailContext(ctx, email, fromName, fromAddr, subject, emailBody)
 	if sendErr != nil {
 		return sendErr
 	}
@@ -288,9 +342,9 @@ func SendMailSingle(addr string, emailBody string, fromName string, fromAddr str
 func SendTestEmail_handler(w http.ResponseWriter, r *http.Request, ctx context.Context) {
 	email := "someRecipient@gmail.com"
 	welcomeEmailStr, _ := CraftTestEmail("HI THERE!")
-	err := SendMail(email, "Test Support", "support@test.com", "Test Email from Support", welcomeEmailStr)
+	err := SendMailContext(ctx, email, "Test Support", "support@test.com", "Test Email from Support", welcomeEmailStr)
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.SendMailError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.SendMailError, W: &w})
 		return
 	}
 	fmt.Fprintf(w, `mail sent`)
@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/mailgun/mailgun-go/v4"
+	"github.com/rogue-syntax/rs-goapiserver/metrics"
+	"github.com/rogue-syntax/rs-goapiserver/tracing"
 )
 
 type MailGunReq struct {
@@ -19,6 +21,11 @@ type MailGunReq struct {
 }
 
 func SendMailGunTemplate(req *MailGunReq) (string, error) {
+	return SendMailGunTemplateContext(context.Background(), req)
+}
+
+// SendMailGunTemplateContext is SendMailGunTemplate traced as a child of the span in ctx
+func SendMailGunTemplateContext(ctx context.Context, req *MailGunReq) (string, error) {
 	// Create an instance of the Mailgun Client
 	mg := mailgun.NewMailgun(req.Domain, req.APIKey)
 
@@ -38,11 +45,18 @@ func SendMailGunTemplate(req *MailGunReq) (string, error) {
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, span := tracing.Start(ctx, "mailgun send", tracing.KIND_CLIENT)
+	span.SetAttribute("mailgun.domain", req.Domain)
+	span.SetAttribute("mailgun.template", req.TemplateName)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
 
 	// Send the message with a 10 second timeout
 	_, id, err := mg.Send(ctx, message)
+	metrics.MailSendsTotal.Inc("mailgun", metrics.Result(err))
+	span.RecordError(err)
 
 	if err != nil {
 		return "", err
@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/pkg/errors"
@@ -20,6 +21,12 @@ import (
 	"github.com/rogue-syntax/rs-goapiserver/global/httpconfig"
 )
 
+const (
+	NETWORK_TCP4 = "tcp4"
+	NETWORK_TCP6 = "tcp6"
+	NETWORK_UNIX = "unix"
+)
+
 // handler is a typical HTTP request-response handler in Go; details later
 func handler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Greetings!")
@@ -54,6 +61,160 @@ func PanicRecovery(handler http.Handler) http.Handler {
 	})
 }
 
+/*
+ServerOptions: options for building a Server with NewServer
+  - Addr: host:port to listen on for tcp4 / tcp6, or the socket file path for unix
+  - Network: one of NETWORK_TCP4, NETWORK_TCP6, NETWORK_UNIX
+  - ReadTimeout, ReadHeaderTimeout, WriteTimeout, IdleTimeout: passed through to http.Server
+  - MaxHeaderBytes: passed through to http.Server
+  - Mux: the mux routes for this server are registered on, i.e. middleware.SetRouteDefsOnMux(opts.Mux, ...)
+
+Zero valued fields are filled from DefaultServerOptions, except Mux which gets a new http.ServeMux
+*/
+type ServerOptions struct {
+	Addr              string
+	Network           string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	Mux               *http.ServeMux
+}
+
+// DefaultServerOptions
+//   - the options the legacy Serve function has always used
+//   - Mux is http.DefaultServeMux so routes registered with middleware.RouteHandler are served
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{
+		Addr:              "0.0.0.0:9990",
+		Network:           NETWORK_TCP4,
+		ReadTimeout:       9600 * time.Second,
+		ReadHeaderTimeout: 9600 * time.Second,
+		WriteTimeout:      9600 * time.Second,
+		IdleTimeout:       9600 * time.Second,
+		MaxHeaderBytes:    http.DefaultMaxHeaderBytes,
+		Mux:               http.DefaultServeMux,
+	}
+}
+
+// Server
+//   - an http.Server and its listener, built from ServerOptions
+//   - several Servers can run in one process, i.e. a public api and an internal admin port, each on its own Mux
+type Server struct {
+	Opts       ServerOptions
+	Mux        *http.ServeMux
+	httpServer *http.Server
+	listener   net.Listener
+}
+
+// NewServer
+//   - builds a Server from opts, filling zero valued options from DefaultServerOptions
+//   - does not listen, call Listen or ListenAndServe
+func NewServer(opts ServerOptions) (*Server, error) {
+	defaults := DefaultServerOptions()
+	if opts.Network == "" {
+		opts.Network = defaults.Network
+	}
+	if opts.Network != NETWORK_TCP4 && opts.Network != NETWORK_TCP6 && opts.Network != NETWORK_UNIX {
+		return nil, errors.New(apierrorkeys.ServeHttpError + ": unsupported network " + opts.Network)
+	}
+	if opts.Addr == "" {
+		if opts.Network == NETWORK_UNIX {
+			return nil, errors.New(apierrorkeys.ServeHttpError + ": unix socket requires an Addr path")
+		}
+		opts.Addr = defaults.Addr
+	}
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = defaults.ReadTimeout
+	}
+	if opts.ReadHeaderTimeout == 0 {
+		opts.ReadHeaderTimeout = defaults.ReadHeaderTimeout
+	}
+	if opts.WriteTimeout == 0 {
+		opts.WriteTimeout = defaults.WriteTimeout
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = defaults.IdleTimeout
+	}
+	if opts.MaxHeaderBytes == 0 {
+		opts.MaxHeaderBytes = defaults.MaxHeaderBytes
+	}
+	if opts.Mux == nil {
+		opts.Mux = http.NewServeMux()
+	}
+
+	s := &Server{Opts: opts, Mux: opts.Mux}
+	s.httpServer = &http.Server{
+		Addr:              opts.Addr,
+		Handler:           PanicRecovery(opts.Mux),
+		ReadTimeout:       opts.ReadTimeout,
+		ReadHeaderTimeout: opts.ReadHeaderTimeout,
+		WriteTimeout:      opts.WriteTimeout,
+		IdleTimeout:       opts.IdleTimeout,
+		MaxHeaderBytes:    opts.MaxHeaderBytes,
+	}
+	return s, nil
+}
+
+// Listen
+//   - opens the listener for the server's Network and Addr
+//   - a stale unix socket file at Addr is removed first
+func (s *Server) Listen() error {
+	if s.listener != nil {
+		return nil
+	}
+	if s.Opts.Network == NETWORK_UNIX {
+		if err := os.Remove(s.Opts.Addr); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, apierrorkeys.ServeHttpError)
+		}
+	}
+	l, err := net.Listen(s.Opts.Network, s.Opts.Addr)
+	if err != nil {
+		return errors.Wrap(err, apierrorkeys.ServeHttpError)
+	}
+	s.listener = l
+	return nil
+}
+
+// Addr
+//   - the address the server is listening on, nil before Listen
+//   - useful when Addr was given with port 0
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// HttpServer returns the underlying http.Server
+func (s *Server) HttpServer() *http.Server {
+	return s.httpServer
+}
+
+// ListenAndServe
+//   - listens if Listen has not been called yet, then serves until the server is closed
+//   - http.ErrServerClosed is not returned as an error
+func (s *Server) ListenAndServe() error {
+	err := s.Listen()
+	if err != nil {
+		return err
+	}
+	err = s.httpServer.Serve(s.listener)
+	if err != nil && err != http.ErrServerClosed {
+		return errors.Wrap(err, apierrorkeys.ServeHttpError)
+	}
+	return nil
+}
+
+// Close immediately closes the listener and all connections
+func (s *Server) Close() error {
+	return s.httpServer.Close()
+}
+
+// Serve
+//   - legacy entry point: serves http.DefaultServeMux on 0.0.0.0:9990 with DefaultServerOptions
+//   - returns after SIGINT / SIGTERM once Shutdown has drained the server, see RunUntilSignal
 func Serve() {
 	fmt.Println("SERVING")
 
@@ -64,11 +225,13 @@ func Serve() {
 	httpconfig.SetHttpReqTimeout()
 	http.HandleFunc("/v1/", handler)
 
-	s := &http.Server{Addr: "0.0.0.0:9990", Handler: PanicRecovery(http.DefaultServeMux), ReadTimeout: 9600 * time.Second,
-		WriteTimeout: 9600 * time.Second, IdleTimeout: 9600 * time.Second}
-	l, err := net.Listen("tcp4", "0.0.0.0:9990")
+	s, err := NewServer(DefaultServerOptions())
+	if err != nil {
+		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.ServeHttpError, W: nil})
+		return
+	}
+	err = RunUntilSignal(DefaultShutdownOptions(), s)
 	if err != nil {
 		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.ServeHttpError, W: nil})
 	}
-	s.Serve(l)
 }
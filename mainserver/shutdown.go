@@ -0,0 +1,132 @@
+package mainserver
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/database"
+	"github.com/rogue-syntax/rs-goapiserver/rs_ev_src"
+	"github.com/rogue-syntax/rs-goapiserver/tracing"
+	"github.com/rogue-syntax/rs-goapiserver/websockets"
+	"github.com/rogue-syntax/rs-goapiserver/zerologger"
+)
+
+/*
+ShutdownOptions: options for a coordinated shutdown
+  - DrainTimeout: how long in-flight RouteHandler calls get to finish before connections are force closed
+  - CloseTimeout: how long websockets, event streamers and the database each get to close
+  - Signals: the signals that start the shutdown, SIGINT and SIGTERM if empty
+*/
+type ShutdownOptions struct {
+	DrainTimeout time.Duration
+	CloseTimeout time.Duration
+	Signals      []os.Signal
+}
+
+func DefaultShutdownOptions() ShutdownOptions {
+	return ShutdownOptions{
+		DrainTimeout: 30 * time.Second,
+		CloseTimeout: 10 * time.Second,
+		Signals:      []os.Signal{syscall.SIGINT, syscall.SIGTERM},
+	}
+}
+
+// Shutdown
+//   - stops accepting connections and waits for in-flight requests on the server until ctx is done
+//   - connections still open when ctx is done are force closed
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		s.httpServer.Close()
+	}
+	return err
+}
+
+// RunUntilSignal
+//   - serves every server until one of opts.Signals arrives, or a server fails
+//   - then runs Shutdown with opts
+//   - returns the first serve or shutdown error
+func RunUntilSignal(opts ShutdownOptions, servers ...*Server) error {
+	if len(opts.Signals) == 0 {
+		opts.Signals = DefaultShutdownOptions().Signals
+	}
+	sigCtx, stop := signal.NotifyContext(context.Background(), opts.Signals...)
+	defer stop()
+
+	serveErrs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *Server) {
+			serveErrs <- srv.ListenAndServe()
+		}(srv)
+	}
+
+	var serveErr error
+	select {
+	case <-sigCtx.Done():
+		zerologger.LogEvent("shutdown signal received, shutting down")
+	case serveErr = <-serveErrs:
+	}
+
+	shutdownErr := Shutdown(opts, servers...)
+	if serveErr != nil {
+		return serveErr
+	}
+	return shutdownErr
+}
+
+// Shutdown
+// Coordinated shutdown, in this order:
+//   - stop accepting connections on every server and let in-flight RouteHandler calls finish within opts.DrainTimeout
+//   - send close frames to every socket held by ManageWebSockets
+//   - stop new rs_ev_src events, wait for in-flight events and close the injected streamer
+//   - turn tracing off and close its exporter
+//   - close database.DB
+//
+// Every step runs even if an earlier one failed. Errors are logged, the first is returned
+func Shutdown(opts ShutdownOptions, servers ...*Server) error {
+	defaults := DefaultShutdownOptions()
+	if opts.DrainTimeout == 0 {
+		opts.DrainTimeout = defaults.DrainTimeout
+	}
+	if opts.CloseTimeout == 0 {
+		opts.CloseTimeout = defaults.CloseTimeout
+	}
+
+	var firstErr error
+	logErr := func(err error) {
+		if err == nil {
+			return
+		}
+		apierrors.HandleError(nil, err, apierrorkeys.ShutdownError, nil)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), opts.DrainTimeout)
+	for _, srv := range servers {
+		logErr(srv.Shutdown(drainCtx))
+	}
+	cancelDrain()
+
+	wsCtx, cancelWs := context.WithTimeout(context.Background(), opts.CloseTimeout)
+	logErr(websockets.Channel_CloseAllSockets(wsCtx, "server shutting down"))
+	cancelWs()
+
+	evCtx, cancelEv := context.WithTimeout(context.Background(), opts.CloseTimeout)
+	logErr(rs_ev_src.Shutdown(evCtx))
+	cancelEv()
+
+	traceCtx, cancelTrace := context.WithTimeout(context.Background(), opts.CloseTimeout)
+	logErr(tracing.Shutdown(traceCtx))
+	cancelTrace()
+
+	logErr(database.CloseDB())
+
+	return firstErr
+}
@@ -0,0 +1,329 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics
+/*
+
+	Counters, histograms and gauges written in the Prometheus text format, version 0.0.4, with no client library.
+
+	Counters and histograms are kept in memory and labelled by value, i.e.
+	  HTTPRequestsTotal.Inc("/v1/app/signIn", "POST", "200")
+	Gauges are read when scraped from a GaugeFunc, for values another package already keeps, i.e. sql.DBStats.
+
+	New* registers with Default, Handler_Metrics writes everything in Default sorted by name.
+	The metrics the server records itself are in standard.go.
+
+	This package imports nothing from the server so any package can record to it.
+
+*/
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets are the upper bounds in seconds of the histogram buckets used for latencies
+var DefBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Collector
+//   - a metric family that can write itself in the text format
+type Collector interface {
+	Name() string
+	WriteText(w io.Writer) error
+}
+
+// Registry: collectors written together, see Default
+type Registry struct {
+	mu         sync.RWMutex
+	collectors map[string]Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]Collector)}
+}
+
+// Default is the registry New* register with and Handler_Metrics writes
+var Default = NewRegistry()
+
+// Register adds c, replacing a collector of the same name
+func (reg *Registry) Register(c Collector) {
+	reg.mu.Lock()
+	reg.collectors[c.Name()] = c
+	reg.mu.Unlock()
+}
+
+// WriteText writes every collector sorted by name
+func (reg *Registry) WriteText(w io.Writer) error {
+	reg.mu.RLock()
+	collectors := make([]Collector, 0, len(reg.collectors))
+	for _, c := range reg.collectors {
+		collectors = append(collectors, c)
+	}
+	reg.mu.RUnlock()
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].Name() < collectors[j].Name() })
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		if err := c.WriteText(bw); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler_Metrics
+//   - writes Default in the Prometheus text format
+func Handler_Metrics(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	Default.WriteText(w)
+}
+
+// family holds what every metric type shares
+type family struct {
+	name       string
+	help       string
+	labelNames []string
+}
+
+func (f *family) Name() string {
+	return f.name
+}
+
+func (f *family) writeHeader(w io.Writer, metricType string) error {
+	_, err := io.WriteString(w, "# HELP "+f.name+" "+escapeHelp(f.help)+"\n# TYPE "+f.name+" "+metricType+"\n")
+	return err
+}
+
+// key joins label values to index a series, the values are checked against labelNames
+func (f *family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labelNames) {
+		panic("metrics: " + f.name + " wants " + strconv.Itoa(len(f.labelNames)) + " label values, got " + strconv.Itoa(len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// labels writes {name="value",...}, extra is appended as is i.e. le="0.5"
+func (f *family) labels(labelValues []string, extra string) string {
+	if len(labelValues) == 0 && extra == "" {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range f.labelNames {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name + `="` + escapeLabel(labelValues[i]) + `"`)
+	}
+	if extra != "" {
+		if len(labelValues) > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(extra)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// CounterVec: counters that only go up, one per set of label values
+type CounterVec struct {
+	family
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounterVec makes and registers a counter, by convention name ends in _total
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{family: family{name: name, help: help, labelNames: labelNames}, series: make(map[string]*counterSeries)}
+	Default.Register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: append([]string(nil), labelValues...)}
+		c.series[key] = s
+	}
+	s.value += v
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) WriteText(w io.Writer) error {
+	if err := c.writeHeader(w, "counter"); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	lines := make([]string, 0, len(c.series))
+	for _, s := range c.series {
+		lines = append(lines, c.name+c.labels(s.labelValues, "")+" "+formatFloat(s.value)+"\n")
+	}
+	c.mu.Unlock()
+	return writeSorted(w, lines)
+}
+
+// HistogramVec: observations counted into buckets, one histogram per set of label values
+type HistogramVec struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// NewHistogramVec makes and registers a histogram, nil buckets uses DefBuckets
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{family: family{name: name, help: help, labelNames: labelNames}, buckets: buckets, series: make(map[string]*histogramSeries)}
+	Default.Register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labelValues: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	// counts are per bucket here and made cumulative when written
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+	h.mu.Unlock()
+}
+
+func (h *HistogramVec) WriteText(w io.Writer) error {
+	if err := h.writeHeader(w, "histogram"); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	blocks := make([]string, 0, len(h.series))
+	for _, s := range h.series {
+		var sb strings.Builder
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			sb.WriteString(h.name + "_bucket" + h.labels(s.labelValues, `le="`+formatFloat(upper)+`"`) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		sb.WriteString(h.name + "_bucket" + h.labels(s.labelValues, `le="+Inf"`) + " " + strconv.FormatUint(s.count, 10) + "\n")
+		sb.WriteString(h.name + "_sum" + h.labels(s.labelValues, "") + " " + formatFloat(s.sum) + "\n")
+		sb.WriteString(h.name + "_count" + h.labels(s.labelValues, "") + " " + strconv.FormatUint(s.count, 10) + "\n")
+		blocks = append(blocks, sb.String())
+	}
+	h.mu.Unlock()
+	return writeSorted(w, blocks)
+}
+
+// Sample: one value of a GaugeFunc
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc: a gauge, or counter, read from collect when scraped
+type GaugeFunc struct {
+	family
+	metricType string
+	collect    func() []Sample
+}
+
+// NewGaugeFunc makes and registers a gauge read from collect, collect must be safe to call from any goroutine
+func NewGaugeFunc(name string, help string, collect func() []Sample, labelNames ...string) *GaugeFunc {
+	g := &GaugeFunc{family: family{name: name, help: help, labelNames: labelNames}, metricType: "gauge", collect: collect}
+	Default.Register(g)
+	return g
+}
+
+// NewCounterFunc is NewGaugeFunc for a value that only goes up, i.e. sql.DBStats.WaitCount
+func NewCounterFunc(name string, help string, collect func() []Sample, labelNames ...string) *GaugeFunc {
+	g := NewGaugeFunc(name, help, collect, labelNames...)
+	g.metricType = "counter"
+	return g
+}
+
+func (g *GaugeFunc) WriteText(w io.Writer) error {
+	samples := g.collect()
+	if err := g.writeHeader(w, g.metricType); err != nil {
+		return err
+	}
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		g.key(s.LabelValues)
+		lines = append(lines, g.name+g.labels(s.LabelValues, "")+" "+formatFloat(s.Value)+"\n")
+	}
+	return writeSorted(w, lines)
+}
+
+// Value is a collect func for a gauge without labels
+func Value(f func() float64) func() []Sample {
+	return func() []Sample {
+		return []Sample{{Value: f()}}
+	}
+}
+
+func writeSorted(w io.Writer, lines []string) error {
+	sort.Strings(lines)
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
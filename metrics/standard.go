@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// metrics the server records, database and websocket gauges are registered by observability.RegisterCollectors
+var (
+	// recorded by middleware for every routed request, route is the RouteDef RouteStr so path params do not add series
+	HTTPRequestsTotal   = NewCounterVec("rs_http_requests_total", "Requests served, by route, method and status.", "route", "method", "status")
+	HTTPRequestDuration = NewHistogramVec("rs_http_request_duration_seconds", "Time to serve a request, by route and method.", nil, "route", "method")
+
+	// recorded by authentication.VerifyRequest, mode is cookie, header, api_key, signature or token
+	AuthFailuresTotal = NewCounterVec("rs_auth_failures_total", "Requests that failed authentication, by auth mode.", "mode")
+
+	// recorded by rs_ev_src.DoEVEventActionContext, result is success or failure
+	EVActionsTotal = NewCounterVec("rs_ev_actions_total", "rs_ev_src event actions run, by action name and result.", "action", "result")
+
+	// recorded by mail and mailgun, transport is smtp or mailgun, result is success or failure
+	MailSendsTotal = NewCounterVec("rs_mail_sends_total", "Emails sent, by transport and result.", "transport", "result")
+)
+
+const (
+	RESULT_SUCCESS = "success"
+	RESULT_FAILURE = "failure"
+)
+
+// Result is RESULT_FAILURE for a non nil err, else RESULT_SUCCESS
+func Result(err error) string {
+	if err != nil {
+		return RESULT_FAILURE
+	}
+	return RESULT_SUCCESS
+}
+
+// runtime stats, MemStats is read at most once a second however often they are scraped
+var (
+	memStatsMu   sync.Mutex
+	memStats     runtime.MemStats
+	memStatsRead time.Time
+)
+
+func readMemStats() runtime.MemStats {
+	memStatsMu.Lock()
+	defer memStatsMu.Unlock()
+	if time.Since(memStatsRead) > time.Second {
+		runtime.ReadMemStats(&memStats)
+		memStatsRead = time.Now()
+	}
+	return memStats
+}
+
+func memStat(f func(ms runtime.MemStats) float64) func() []Sample {
+	return Value(func() float64 { return f(readMemStats()) })
+}
+
+var processStart = time.Now()
+
+func init() {
+	NewGaugeFunc("go_goroutines", "Goroutines that currently exist.", Value(func() float64 { return float64(runtime.NumGoroutine()) }))
+	NewGaugeFunc("go_sched_gomaxprocs_threads", "GOMAXPROCS, OS threads that can run Go code at once.", Value(func() float64 { return float64(runtime.GOMAXPROCS(0)) }))
+	NewGaugeFunc("go_info", "Go version.", func() []Sample { return []Sample{{LabelValues: []string{runtime.Version()}, Value: 1}} }, "version")
+	NewGaugeFunc("go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", memStat(func(ms runtime.MemStats) float64 { return float64(ms.HeapAlloc) }))
+	NewGaugeFunc("go_memstats_heap_inuse_bytes", "Bytes in in-use heap spans.", memStat(func(ms runtime.MemStats) float64 { return float64(ms.HeapInuse) }))
+	NewGaugeFunc("go_memstats_heap_objects", "Allocated heap objects.", memStat(func(ms runtime.MemStats) float64 { return float64(ms.HeapObjects) }))
+	NewGaugeFunc("go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", memStat(func(ms runtime.MemStats) float64 { return float64(ms.Sys) }))
+	NewCounterFunc("go_memstats_alloc_bytes_total", "Bytes allocated for heap objects, including freed.", memStat(func(ms runtime.MemStats) float64 { return float64(ms.TotalAlloc) }))
+	NewCounterFunc("go_gc_cycles_total", "Completed GC cycles.", memStat(func(ms runtime.MemStats) float64 { return float64(ms.NumGC) }))
+	NewCounterFunc("go_gc_pause_seconds_total", "Time spent in GC stop the world pauses.", memStat(func(ms runtime.MemStats) float64 { return float64(ms.PauseTotalNs) / 1e9 }))
+	NewGaugeFunc("process_start_time_seconds", "Start time of the process since the unix epoch.", Value(func() float64 { return float64(processStart.Unix()) }))
+}
@@ -0,0 +1,265 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/tracing"
+)
+
+// Route groups with composable, ordered middleware chains
+/*
+
+	A RouteGroup is a path prefix with a middleware stack, i.e.
+
+	admin := middleware.NewRouteGroup("/v1/admin").UseList(&middleware.RoleBaseReqVerifMiddleware)
+	admin.Route(middleware.RouteDef{RouteStr: "/users/{id}", HandlerFunc: adminusers.Handler_GetUser})
+	observe := admin.Group("/observe").Use(&SomeExtraMW)
+	observe.Route(middleware.RouteDef{RouteStr: "/goroutines", HandlerFunc: observability.Handler_LogGoroutineCount, Skip: []RequestMiddleware{&SomeExtraMW}})
+	err := admin.Register(mux, "admin")
+
+	The chain for a route is, in order:
+	  - the middleware of each group from the outermost in, in the order Use / UseList were called
+	  - the route's MiddlewareSli
+	  - the route's Use
+	  - minus anything in the route's Skip
+
+	Lists added with UseList, like the global ReqVerifMiddleware, are read when the routes are registered,
+	so the Set*Middleware funcs must run first. A list that was never set is a registration error.
+	Once registered the chain is a copy and later changes to the global lists do not affect it.
+
+*/
+
+// MiddlewareChain
+//   - an ordered, immutable list of RequestMiddleware built when a route is registered
+type MiddlewareChain struct {
+	mws []RequestMiddleware
+}
+
+// NewMiddlewareChain copies mws into a new chain
+func NewMiddlewareChain(mws ...RequestMiddleware) MiddlewareChain {
+	return MiddlewareChain{mws: append([]RequestMiddleware(nil), mws...)}
+}
+
+// Append returns a new chain with mws after the current ones
+func (c MiddlewareChain) Append(mws ...RequestMiddleware) MiddlewareChain {
+	out := make([]RequestMiddleware, 0, len(c.mws)+len(mws))
+	out = append(out, c.mws...)
+	out = append(out, mws...)
+	return MiddlewareChain{mws: out}
+}
+
+// Without returns a new chain with every occurrence of skip removed
+func (c MiddlewareChain) Without(skip ...RequestMiddleware) MiddlewareChain {
+	var out []RequestMiddleware
+	for _, mw := range c.mws {
+		skipped := false
+		for _, s := range skip {
+			if sameMiddleware(mw, s) {
+				skipped = true
+				break
+			}
+		}
+		if !skipped {
+			out = append(out, mw)
+		}
+	}
+	return MiddlewareChain{mws: out}
+}
+
+// Middleware returns a copy of the chain's middleware in order
+func (c MiddlewareChain) Middleware() []RequestMiddleware {
+	return append([]RequestMiddleware(nil), c.mws...)
+}
+
+func (c MiddlewareChain) Len() int {
+	return len(c.mws)
+}
+
+// Process runs each ProcessRequest in order, stopping at the first error, each in a span of its own
+func (c MiddlewareChain) Process(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	var err error
+	parent := tracing.SpanFromContext(ctx)
+	for _, mw := range c.mws {
+		mwCtx, span := tracing.StartChild(ctx, "middleware "+middlewareName(mw), tracing.KIND_INTERNAL)
+		ctx, err = mw.ProcessRequest(mwCtx, routeString, w, r)
+		span.RecordError(err)
+		span.End()
+		if err != nil {
+			return ctx, err
+		}
+		// the middleware's span is over, later middleware and the handler are children of the request span
+		ctx = tracing.ContextWithSpan(ctx, parent)
+	}
+	return ctx, nil
+}
+
+// middlewareName is the type name of mw without its package path
+func middlewareName(mw RequestMiddleware) string {
+	t := reflect.TypeOf(mw)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// sameMiddleware compares two middleware by identity, non comparable types never match
+func sameMiddleware(a RequestMiddleware, b RequestMiddleware) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	if ta != tb || !ta.Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// middlewareSource is either a single middleware or a global list read at registration
+type middlewareSource struct {
+	mw   RequestMiddleware
+	list *[]RequestMiddleware
+}
+
+// resolveSources builds the chain from sources, a list that was never set is an error
+func resolveSources(sources []middlewareSource, routeString string) (MiddlewareChain, error) {
+	var chain MiddlewareChain
+	for _, src := range sources {
+		if src.list == nil {
+			if src.mw == nil {
+				return chain, errors.New(apierrorkeys.MiddlewareError + ": nil middleware on route " + routeString)
+			}
+			chain = chain.Append(src.mw)
+			continue
+		}
+		if *src.list == nil {
+			return chain, errors.New(apierrorkeys.MiddlewareError + ": middleware list not set on route " + routeString + ", call its Set*Middleware func before registering routes")
+		}
+		for _, mw := range *src.list {
+			if mw == nil {
+				return chain, errors.New(apierrorkeys.MiddlewareError + ": nil middleware on route " + routeString)
+			}
+		}
+		chain = chain.Append(*src.list...)
+	}
+	return chain, nil
+}
+
+// buildChain builds the chain for a route from its group sources and its own MiddlewareSli, Use and Skip
+//   - a route outside any group must declare its MiddlewareSli, even if it is only BlankMiddleware
+func buildChain(groupSources []middlewareSource, inGroup bool, def RouteDef) (MiddlewareChain, error) {
+	sources := append([]middlewareSource(nil), groupSources...)
+	if def.MiddlewareSli != nil {
+		sources = append(sources, middlewareSource{list: def.MiddlewareSli})
+	} else if !inGroup {
+		return MiddlewareChain{}, errors.New(apierrorkeys.MiddlewareError + ": no MiddlewareSli on route " + def.RouteStr)
+	}
+	for _, mw := range def.Use {
+		sources = append(sources, middlewareSource{mw: mw})
+	}
+	chain, err := resolveSources(sources, def.RouteStr)
+	if err != nil {
+		return chain, err
+	}
+	return chain.Without(def.Skip...), nil
+}
+
+// RouteGroup
+//   - a path prefix with an ordered middleware stack, see the top of this file
+type RouteGroup struct {
+	prefix  string
+	parent  *RouteGroup
+	sources []middlewareSource
+	routes  []RouteDef
+	groups  []*RouteGroup
+}
+
+// NewRouteGroup makes a top level group, prefix i.e. "/v1/admin"
+func NewRouteGroup(prefix string) *RouteGroup {
+	return &RouteGroup{prefix: joinRoutePath("", prefix)}
+}
+
+// Prefix returns the full path prefix of the group
+func (g *RouteGroup) Prefix() string {
+	return g.prefix
+}
+
+// Use adds middleware to the group's stack, after any already added
+func (g *RouteGroup) Use(mws ...RequestMiddleware) *RouteGroup {
+	for _, mw := range mws {
+		g.sources = append(g.sources, middlewareSource{mw: mw})
+	}
+	return g
+}
+
+// UseList adds a global middleware list i.e. &middleware.ReqVerifMiddleware, read when the group is registered
+func (g *RouteGroup) UseList(lists ...*[]RequestMiddleware) *RouteGroup {
+	for _, list := range lists {
+		if list == nil {
+			// an unset list, so Register reports it instead of dropping it
+			list = new([]RequestMiddleware)
+		}
+		g.sources = append(g.sources, middlewareSource{list: list})
+	}
+	return g
+}
+
+// Group makes a nested group under this one, its routes run this group's stack first
+func (g *RouteGroup) Group(prefix string) *RouteGroup {
+	child := &RouteGroup{prefix: joinRoutePath(g.prefix, prefix), parent: g}
+	g.groups = append(g.groups, child)
+	return child
+}
+
+// stack returns the sources of every group from the outermost in
+func (g *RouteGroup) stack() []middlewareSource {
+	if g.parent == nil {
+		return append([]middlewareSource(nil), g.sources...)
+	}
+	return append(g.parent.stack(), g.sources...)
+}
+
+// Route adds routes to the group, RouteStr is relative to the group prefix
+func (g *RouteGroup) Route(defs ...RouteDef) *RouteGroup {
+	g.routes = append(g.routes, defs...)
+	return g
+}
+
+// Register
+//   - builds every route's chain and registers the group and its nested groups on the mux
+//   - ReqDefs are added to apimaster.ApiReqMap under listName
+//   - stops at the first error, i.e. a middleware list whose Set*Middleware func was not called
+func (g *RouteGroup) Register(mux *http.ServeMux, listName string) error {
+	groupSources := g.stack()
+	for _, def := range g.routes {
+		def.RouteStr = joinRoutePath(g.prefix, def.RouteStr)
+		registered, err := registerRoute(mux, def, groupSources, true)
+		if err != nil {
+			return err
+		}
+		registerReqDef(listName, registered)
+	}
+	for _, child := range g.groups {
+		err := child.Register(mux, listName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinRoutePath joins a prefix and a path, keeping a trailing slash on the path for subtree patterns
+func joinRoutePath(prefix string, path string) string {
+	prefix = strings.TrimRight(prefix, "/")
+	if path == "" || path == "/" {
+		if prefix == "" {
+			return "/"
+		}
+		return prefix + path
+	}
+	return prefix + "/" + strings.TrimLeft(path, "/")
+}
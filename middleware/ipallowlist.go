@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+// IP allowlist middleware
+/*
+
+	An *IPAllowList is a RequestMiddleware that rejects requests from addresses outside its networks with a 403
+	and apierrorkeys.IPNotAllowed, put it first in a chain so rejected requests never reach authentication, i.e.
+
+	allow, err := middleware.NewIPAllowList("10.0.0.0/8", "127.0.0.1")
+	admin := middleware.NewRouteGroup("/v1/admin").Use(allow).UseList(&middleware.RoleBaseReqVerifMiddleware)
+
+	The address is the connection's RemoteAddr, or with TrustProxyHeaders the one read from proxy headers, see clientAddr.
+
+*/
+
+// IPAllowList
+//   - a RequestMiddleware that only lets through requests from its networks, see the top of this file
+//   - build with NewIPAllowList, an IPAllowList with no networks lets no request through
+type IPAllowList struct {
+	TrustProxyHeaders bool
+	nets              []*net.IPNet
+}
+
+// NewIPAllowList
+//   - parses entries as CIDRs i.e. "10.0.0.0/8", or single addresses i.e. "127.0.0.1", "::1"
+//   - no entries, or only blank ones i.e. from an unset env var, is an error rather than an open list
+func NewIPAllowList(entries ...string) (*IPAllowList, error) {
+	al := &IPAllowList{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New(apierrorkeys.RouteDefError + ": invalid allowlist address " + entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			entry = entry + "/" + strconv.Itoa(bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.Wrap(err, apierrorkeys.RouteDefError+": invalid allowlist network "+entry)
+		}
+		al.nets = append(al.nets, ipNet)
+	}
+	if len(al.nets) == 0 {
+		return nil, errors.New(apierrorkeys.RouteDefError + ": an ip allowlist needs at least one address or network")
+	}
+	return al, nil
+}
+
+// Allows reports whether ip is in one of the networks, always false with no networks
+func (al *IPAllowList) Allows(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range al.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedProxyHops: how many proxies in front of the server append to X-Forwarded-For, read with TrustProxyHeaders
+var TrustedProxyHops = 1
+
+// clientAddr is the RemoteAddr of r without the port, or with trustProxyHeaders the address the outermost trusted proxy saw
+//   - that is the X-Forwarded-For entry TrustedProxyHops from the right, entries left of it are whatever the client sent,
+//     X-Real-Ip is only read without X-Forwarded-For, so only trust proxy headers behind proxies that set one of them
+//   - shared by IPAllowList and RateLimit
+func clientAddr(r *http.Request, trustProxyHeaders bool) string {
+	addr := r.RemoteAddr
+	if trustProxyHeaders {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(strings.Join(forwarded, ","), ",")
+			i := len(hops) - 1
+			if TrustedProxyHops > 1 {
+				i = len(hops) - TrustedProxyHops
+			}
+			if i < 0 {
+				i = 0
+			}
+			addr = hops[i]
+		} else if realIp := r.Header.Get("X-Real-Ip"); realIp != "" {
+			addr = realIp
+		}
+	}
+	addr = strings.TrimSpace(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return addr
+}
+
+// clientIP is the address from clientAddr
+func (al *IPAllowList) clientIP(r *http.Request) net.IP {
+	return net.ParseIP(clientAddr(r, al.TrustProxyHeaders))
+}
+
+func (al *IPAllowList) ProcessRequest(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	if !al.Allows(al.clientIP(r)) {
+		RejectWith(w, http.StatusForbidden)
+		return ctx, errors.New(apierrorkeys.IPNotAllowed)
+	}
+	return ctx, nil
+}
+
+func (al *IPAllowList) ErrorStatuses() []int {
+	return []int{http.StatusForbidden}
+}
@@ -3,7 +3,10 @@ package middleware
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"strconv"
+	"time"
 
 	"net/http"
 
@@ -12,7 +15,11 @@ import (
 	"github.com/rogue-syntax/rs-goapiserver/apicontext"
 	"github.com/rogue-syntax/rs-goapiserver/apierrors"
 	"github.com/rogue-syntax/rs-goapiserver/apimaster"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/metrics"
 	"github.com/rogue-syntax/rs-goapiserver/rs_go_requestlogger"
+	"github.com/rogue-syntax/rs-goapiserver/tracing"
 
 	"github.com/rogue-syntax/rs-goapiserver/authentication"
 )
@@ -65,63 +72,231 @@ type EventualHandler func(http.ResponseWriter, *http.Request, context.Context)
 //   - processes them though a slice of RequestMiddleware using its ProcessRequest function
 //   - passes a requestContext though these middleware functions, carryting a context object through to our requesthandlers
 //   - example : RouteHandler("/v1/someRoute", SomeFunction, [] )
+//   - registers on http.DefaultServeMux, use RouteHandlerOnMux to register on a specific server's mux
 func RouteHandler(routeString string, reqHandler EventualHandler, mwList *[]RequestMiddleware) {
-	http.HandleFunc(routeString, func(w http.ResponseWriter, r *http.Request) {
-		reqCtx := context.Background()
-		//LOG REQUEST HERE
-		var rSRequestLogger rs_go_requestlogger.RSRequestLogger
-		rSRequestLogger.Endpoint = routeString
-
-		rSRequestLogger.RequestVars.RequestURI = r.RequestURI
-		rSRequestLogger.RequestVars.Method = r.Method
-		rSRequestLogger.RequestVars.RemoteAddr = r.RemoteAddr
-		rSRequestLogger.RequestVars.UserAgent = r.UserAgent()
-		rSRequestLogger.RequestVars.Referer = r.Referer()
-		rSRequestLogger.RequestVars.Host = r.Host
-		rSRequestLogger.RequestVars.Header = r.Header
-
-		//GET FORM DATA
-		r.ParseForm()
-		rSRequestLogger.RequestVars.PostForm = r.PostForm
+	RouteHandlerOnMux(http.DefaultServeMux, routeString, reqHandler, mwList)
+}
 
-		//GET COOKIES
-		cookies := r.Cookies()
-		cookieMap := make(map[string]string)
-		for _, cookie := range cookies {
-			cookieMap[cookie.Name] = cookie.Value
+// RouteHandlerOnMux
+//   - same as RouteHandler, but registers the route on the given mux
+//   - example : RouteHandlerOnMux(adminServer.Mux, "/v1/someRoute", SomeFunction, &middleware.BlankMiddleware)
+func RouteHandlerOnMux(mux *http.ServeMux, routeString string, reqHandler EventualHandler, mwList *[]RequestMiddleware) {
+	err := RegisterRoute(mux, RouteDef{RouteStr: routeString, HandlerFunc: reqHandler, MiddlewareSli: mwList})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RegisterRoute
+//   - registers a RouteDef on the mux, RouteStr may be a path template i.e. "/v1/users/{id}/sessions"
+//   - the route only accepts def.Methods if any are declared, see router.go
+//   - the middleware chain is built now from MiddlewareSli, Use and Skip, see groups.go
+//   - returns an error for a bad template, an unknown method, an unset middleware list or a duplicate route
+func RegisterRoute(mux *http.ServeMux, def RouteDef) error {
+	_, err := registerRoute(mux, def, nil, false)
+	return err
+}
+
+// registerRoute registers def and returns it as registered, with its handler and chain resolved
+func registerRoute(mux *http.ServeMux, def RouteDef, groupSources []middlewareSource, inGroup bool) (RouteDef, error) {
+	if def.Typed != nil {
+		if def.HandlerFunc != nil {
+			return def, errors.New(apierrorkeys.RouteDefError + ": both HandlerFunc and Typed set on route " + def.RouteStr)
+		}
+		handler, err := def.Typed.handlerFor(def)
+		if err != nil {
+			return def, err
 		}
-		rSRequestLogger.RequestVars.Cookies = cookieMap
-		rSRequestLogger.RequestVars.URL = r.URL.String()
-
-		//GET BODY IN STRING FORM
-		bytedata, _ := io.ReadAll(r.Body)
-		reqBodyString := string(bytedata)
-		rSRequestLogger.RequestVars.Body = reqBodyString
-		r.Body = io.NopCloser(bytes.NewBuffer(bytedata))
-
-		reqID := uuid.New().String()
-		rSRequestLogger.Req_id = reqID
-		//STORE LOG IN CTX
-		reqCtx = rs_go_requestlogger.CtxWithRSLogger(reqCtx, &rSRequestLogger)
-
-		reqCtx = rs_go_requestlogger.CtxWithReqId(reqCtx, reqID)
-
-		r = r.WithContext(reqCtx)
-
-		var err error
-		for i := 0; i < len(*mwList); i++ {
-			reqCtx, err = (*mwList)[i].ProcessRequest(reqCtx, routeString, w, r)
-			if err != nil {
-				apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: err.Error(), W: &w})
-				return
+		def.HandlerFunc = handler
+	}
+	if def.HandlerFunc == nil {
+		return def, errors.New(apierrorkeys.RouteDefError + ": no HandlerFunc on route " + def.RouteStr)
+	}
+	methods, err := normalizeMethods(def.Methods)
+	if err != nil {
+		return def, err
+	}
+	def.Methods = methods
+	def.chain, err = buildChain(groupSources, inGroup, def)
+	if err != nil {
+		return def, err
+	}
+	def.validate, err = validatorFor(def)
+	if err != nil {
+		return def, err
+	}
+	entry := &routeEntry{routeStr: def.RouteStr, methods: methods}
+	pattern := def.RouteStr
+	if IsPathTemplate(def.RouteStr) {
+		tmpl, err := ParsePathTemplate(def.RouteStr)
+		if err != nil {
+			return def, err
+		}
+		entry.template = tmpl
+		pattern = tmpl.MuxPattern()
+	}
+	entry.serve = func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		serveRoute(def, w, r, params)
+	}
+	return def, routerFor(mux, pattern).add(entry)
+}
+
+// serveRoute runs a matched request through the route's middleware and on to its handler
+func serveRoute(def RouteDef, w http.ResponseWriter, r *http.Request, params map[string]string) {
+	routeString := def.RouteStr
+	reqHandler := def.HandlerFunc
+
+	//RECORD STATUS, SIZE AND DURATION OF THE RESPONSE
+	recorder := NewResponseRecorder(w)
+	recorder.SetResponseMode(apireturn.ModeForRequest(r))
+	w = recorder
+
+	//REQUEST CONTEXT: cancelled when the client goes away or the server shuts down, and after def.Timeout
+	reqCtx := r.Context()
+
+	//TRACE SPAN: a child of the caller's traceparent if sent, ended in the response phase
+	reqCtx = tracing.Extract(reqCtx, r.Header)
+	reqCtx, span := tracing.Start(reqCtx, r.Method+" "+routeString, tracing.KIND_SERVER)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("http.route", routeString)
+	span.SetAttribute("url.path", r.URL.Path)
+
+	if def.Timeout > 0 {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithTimeout(reqCtx, def.Timeout)
+		defer cancel()
+	}
+	//LOG REQUEST HERE
+	var rSRequestLogger rs_go_requestlogger.RSRequestLogger
+	rSRequestLogger.Time = time.Now().UTC()
+	rSRequestLogger.Endpoint = routeString
+
+	rSRequestLogger.RequestVars.RequestURI = r.RequestURI
+	rSRequestLogger.RequestVars.Method = r.Method
+	rSRequestLogger.RequestVars.RemoteAddr = r.RemoteAddr
+	rSRequestLogger.RequestVars.UserAgent = r.UserAgent()
+	rSRequestLogger.RequestVars.Referer = r.Referer()
+	rSRequestLogger.RequestVars.Host = r.Host
+	rSRequestLogger.RequestVars.Header = r.Header
+
+	//GET FORM DATA, KEEPING THE BODY OF A SIGNED REQUEST FOR authentication.VerifyWithSignature
+	//a signed body that can not be kept is refused below, before ParseForm reads unsigned values from it
+	bufErr := authentication.BufferSignedBody(r)
+	if bufErr == nil {
+		r.ParseForm()
+	}
+	rSRequestLogger.RequestVars.PostForm = r.PostForm
+
+	//GET COOKIES
+	cookies := r.Cookies()
+	cookieMap := make(map[string]string)
+	for _, cookie := range cookies {
+		cookieMap[cookie.Name] = cookie.Value
+	}
+	rSRequestLogger.RequestVars.Cookies = cookieMap
+	rSRequestLogger.RequestVars.URL = r.URL.String()
+
+	//GET BODY IN STRING FORM, UP TO THE REDACTION BODY LIMIT
+	redaction := rs_go_requestlogger.GlobalRedactionRules.Merge(def.Redaction)
+	bodyString, truncated := captureBody(r, redaction.BodyLimit())
+	rSRequestLogger.RequestVars.Body = bodyString
+
+	//MASK PASSWORDS, TOKENS AND KEYS BEFORE ANY RequestLogStreamer SEES THEM
+	redaction.Apply(&rSRequestLogger.RequestVars, r.Header.Get("Content-Type"), truncated)
+
+	reqID := uuid.New().String()
+	rSRequestLogger.Req_id = reqID
+	span.SetAttribute("req_id", reqID)
+	//STORE LOG IN CTX
+	reqCtx = rs_go_requestlogger.CtxWithRSLogger(reqCtx, &rSRequestLogger)
+
+	reqCtx = rs_go_requestlogger.CtxWithReqId(reqCtx, reqID)
+
+	//PATH PARAMS FROM THE ROUTE TEMPLATE
+	if params != nil {
+		reqCtx = apicontext.CtxWithPathParams(reqCtx, params)
+	}
+
+	r = r.WithContext(reqCtx)
+
+	//response phase and request logger on request finished, rejected or panicked
+	var mwErr error
+	defer func() {
+		panicVal := recover()
+		rec := recorder.Record()
+		rec.Err = mwErr
+		if panicVal != nil {
+			rec.Panic = panicVal
+			if !recorder.WroteHeader() {
+				rec.Status = http.StatusInternalServerError
 			}
 		}
-		//request logger on request finished
-		defer func() {
-			apierrors.HandleReqLog(r)
-		}()
-		reqHandler(w, r, reqCtx)
-	})
+		rSRequestLogger.ResponseVars = rs_go_requestlogger.ResponseVarsFrom(rec.Status, rec.Bytes, rec.Duration, panicVal)
+		if usr, err := apicontext.CtxGetUser(reqCtx); err == nil && usr != nil {
+			rSRequestLogger.User_id = usr.User_id
+		}
+		metrics.HTTPRequestsTotal.Inc(routeString, r.Method, strconv.Itoa(rec.Status))
+		span.SetAttribute("http.response.status_code", rec.Status)
+		if rSRequestLogger.User_id != 0 {
+			span.SetAttribute("enduser.id", rSRequestLogger.User_id)
+		}
+		if panicVal != nil {
+			span.SetStatus(tracing.STATUS_ERROR, fmt.Sprint(panicVal))
+		} else if rec.Status >= http.StatusInternalServerError {
+			span.SetStatus(tracing.STATUS_ERROR, http.StatusText(rec.Status))
+		}
+		span.End()
+		metrics.HTTPRequestDuration.Observe(rec.Duration.Seconds(), routeString, r.Method)
+		def.chain.processResponse(reqCtx, routeString, &rec, r)
+		apierrors.HandleReqLog(r)
+		if panicVal != nil {
+			panic(panicVal)
+		}
+	}()
+
+	if bufErr != nil {
+		mwErr = bufErr
+		if errors.Is(bufErr, authentication.ErrSignedBodyTooLarge) {
+			RejectWith(w, http.StatusRequestEntityTooLarge)
+		} else {
+			RejectWith(w, http.StatusBadRequest)
+		}
+	} else {
+		reqCtx, mwErr = def.chain.Process(reqCtx, routeString, w, r)
+	}
+	if mwErr != nil {
+		apierrors.HandleError(r, mwErr, mwErr.Error(), &apierrors.ReturnError{Msg: mwErr.Error(), Status: recorder.rejectStatus, W: &w})
+		return
+	}
+	if def.validate != nil {
+		err := def.validate(r, reqCtx)
+		if err != nil {
+			writeTypedError(w, r, err, apierrorkeys.InvalidAPIInput)
+			return
+		}
+	}
+	reqHandler(w, r, reqCtx)
+}
+
+// bodyReadCloser replays the captured start of a body before the rest of it
+type bodyReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// captureBody reads up to limit bytes of the body for the request log and puts them back in front of the rest
+//   - the handler still gets the whole body, only the log is capped
+//   - returns whether the body was longer than limit
+func captureBody(r *http.Request, limit int) (string, bool) {
+	if limit < 0 || r.Body == nil || r.Body == http.NoBody {
+		return "", false
+	}
+	bytedata, _ := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	r.Body = bodyReadCloser{Reader: io.MultiReader(bytes.NewReader(bytedata), r.Body), Closer: r.Body}
+	if len(bytedata) > limit {
+		return string(bytedata[:limit]), true
+	}
+	return string(bytedata), false
 }
 
 /*
@@ -130,12 +305,32 @@ RouteDef: A Struct for defining routes
   - HandlerFunc: The handling fucntion to contain the business logic of the route
   - MiddlewareSli: The slice collection of middleware obects implementing the RequestMiddleware interface,
     containing the ProcessRequest functions that contain the middlware logic
+  - Methods: The allowed http methods i.e. []string{http.MethodPost}, empty allows every method.
+    Also sets the Method and HTTPMethods of the ReqDef
+  - RouteStr may be a path template i.e. "/v1/users/{id}/sessions", read params with apicontext.CtxGetPathParam
+  - Use: middleware to run after the group stack and MiddlewareSli for this route only
+  - Skip: middleware to leave out of the group stack or MiddlewareSli for this route only
+  - Timeout: deadline for the request context handed to middleware and the handler, 0 for none.
+    Pass the handler's ctx on to database calls, util.HttpPostReqContext and rs_ev_src.DoEVEventActionContext
+  - Redaction: extra request log redaction rules for this route, added to rs_go_requestlogger.GlobalRedactionRules
+  - Typed: a handler made with Typed, in place of HandlerFunc, see typed.go
+  - Validate: check the request against ReqDef.InputType before HandlerFunc runs, see validate.go
 */
 type RouteDef struct {
 	RouteStr      string
 	HandlerFunc   EventualHandler
 	MiddlewareSli *[]RequestMiddleware
 	ReqDef        *apimaster.ApiReqDef
+	Methods       []string
+	Use           []RequestMiddleware
+	Skip          []RequestMiddleware
+	Timeout       time.Duration
+	Redaction     *rs_go_requestlogger.RedactionRules
+	Typed         *TypedHandler
+	Validate      bool
+
+	chain    MiddlewareChain
+	validate inputValidator
 }
 
 /*
@@ -147,6 +342,12 @@ SetRouteDefs:
 */
 
 func SetRouteDefs(defs *[]RouteDef, listName string) {
+	SetRouteDefsOnMux(http.DefaultServeMux, defs, listName)
+}
+
+// SetRouteDefsOnMux
+//   - same as SetRouteDefs, but registers the routes on the given mux
+func SetRouteDefsOnMux(mux *http.ServeMux, defs *[]RouteDef, listName string) {
 	//routeDef := RouteDef{RouteStr: "/v1/postSomething", }
 	//if the listName / category doesn't exist yet, create it
 	_, ok := apimaster.ApiReqMap[listName]
@@ -155,20 +356,101 @@ func SetRouteDefs(defs *[]RouteDef, listName string) {
 	}
 	for _, def := range *defs {
 		//register the route with the middleware
-		RouteHandler(def.RouteStr, def.HandlerFunc, def.MiddlewareSli)
-		//register the route with the apimaster api request map
-		if def.ReqDef != nil {
-			apimaster.ApiReqMap[listName][def.RouteStr] = *def.ReqDef
+		registered, err := registerRoute(mux, def, nil, false)
+		if err != nil {
+			panic(err)
 		}
+		//register the route with the apimaster api request map
+		registerReqDef(listName, registered)
 	}
 }
 
+// registerReqDef adds the route's ReqDef to apimaster.ApiReqMap under listName, keyed by apimaster.ReqMapKey
+//   - def is the registered route, its chain gives the Security and ErrorStatuses of the ReqDef
+func registerReqDef(listName string, def RouteDef) {
+	if def.Typed != nil {
+		def.ReqDef = def.Typed.reqDef(def)
+	}
+	if def.ReqDef == nil {
+		return
+	}
+	if _, ok := apimaster.ApiReqMap[listName]; !ok {
+		apimaster.ApiReqMap[listName] = make(map[string]apimaster.ApiReqDef)
+	}
+	reqDef := *def.ReqDef
+	reqDef.HTTPMethods, _ = normalizeMethods(def.Methods)
+	reqDef.Method = apimaster.MethodFromHTTPMethods(reqDef.HTTPMethods, reqDef.Method)
+	if IsPathTemplate(def.RouteStr) {
+		tmpl, _ := ParsePathTemplate(def.RouteStr)
+		reqDef.PathParams = tmpl.ParamNames()
+	}
+	reqDef.Security, reqDef.ErrorStatuses = def.chain.apiDoc(reqDef.HTTPMethods)
+	reqDef.Route = def.RouteStr
+	apimaster.ApiReqMap[listName][apimaster.ReqMapKey(def.RouteStr, reqDef.HTTPMethods)] = reqDef
+}
+
 // Request Middleware
 // - interface for all middleware handlers
 type RequestMiddleware interface {
 	ProcessRequest(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error)
 }
 
+// AuthMiddleware
+//   - optional, a RequestMiddleware that authenticates lists the apimaster.AUTH_SCHEME_* it accepts, for the api docs
+type AuthMiddleware interface {
+	AuthSchemes() []string
+}
+
+// ErrorStatusMiddleware
+//   - optional, the http statuses a RequestMiddleware may reject a request with, for the api docs
+type ErrorStatusMiddleware interface {
+	ErrorStatuses() []int
+}
+
+// apiDoc collects the auth schemes and rejection statuses of the chain, 405 is added for routes with declared methods
+func (c MiddlewareChain) apiDoc(methods []string) ([]string, []int) {
+	var schemes []string
+	var statuses []int
+	for _, mw := range c.mws {
+		if am, ok := mw.(AuthMiddleware); ok {
+			for _, scheme := range am.AuthSchemes() {
+				if !containsString(schemes, scheme) {
+					schemes = append(schemes, scheme)
+				}
+			}
+		}
+		if sm, ok := mw.(ErrorStatusMiddleware); ok {
+			for _, status := range sm.ErrorStatuses() {
+				if !containsInt(statuses, status) {
+					statuses = append(statuses, status)
+				}
+			}
+		}
+	}
+	if len(methods) > 0 {
+		statuses = append(statuses, http.StatusMethodNotAllowed)
+	}
+	return schemes, statuses
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
 // DEV MIDDLEWARE
 //   - 1. <ake a Middleware type i.e. type ExampleMiddlewareOneType struct
 //   - 2. Middleware declare an object of that type i.e. var ExampleMiddlewareOne ExampleMiddlewareOneType
@@ -234,15 +516,48 @@ var ReqVerif RequestVerifType
 var ReqVerifMiddleware []RequestMiddleware
 
 func SetReqVerifMiddleware() {
-	ReqVerifMiddleware = []RequestMiddleware{&ReqVerif}
+	ReqVerifMiddleware = []RequestMiddleware{&ReqVerif, &CSRF}
 }
 func (RequestVerifType) ProcessRequest(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	ctx, err := authentication.VerifyRequest(ctx, routeString, r.FormValue(AUTH_MODE_KEY), w, r)
+	rejectScopeDenied(w, err)
 	usr, _ := apicontext.CtxGetUser(ctx)
 	r = r.WithContext(apicontext.CtxWithUser(r.Context(), usr))
 	return ctx, err
 }
 
+// rejectScopeDenied answers an api key without a scope for the route with 403, the key itself was valid
+func rejectScopeDenied(w http.ResponseWriter, err error) {
+	if err != nil && apireturn.ErrorKeyOf(errors.Cause(err).Error()) == apierrorkeys.APIKeyScopeDenied {
+		RejectWith(w, http.StatusForbidden)
+	}
+}
+
+// //////////////////////
+// CSRF
+//   - rejects cookie authenticated, state changing requests without a matching X-CSRF-Token header, see authentication.VerifyCSRF
+//   - part of ReqVerifMiddleware and RoleBaseReqVerifMiddleware, add &middleware.CSRF with RouteDef.Use elsewhere
+type CSRFType struct {
+}
+
+var CSRF CSRFType
+
+func (CSRFType) ProcessRequest(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	err := authentication.VerifyCSRF(r)
+	if err != nil {
+		RejectWith(w, http.StatusForbidden)
+	}
+	return ctx, err
+}
+
+func (RequestVerifType) AuthSchemes() []string {
+	return []string{apimaster.AUTH_SCHEME_COOKIE, apimaster.AUTH_SCHEME_HEADER, apimaster.AUTH_SCHEME_API_KEY, apimaster.AUTH_SCHEME_SIGNED, apimaster.AUTH_SCHEME_TOKEN}
+}
+
+func (CSRFType) ErrorStatuses() []int {
+	return []int{http.StatusForbidden}
+}
+
 /*
 	Example operation to get user from authentication middleware context
 	usr, err := apicontext.CtxGetUser(ctx)
@@ -279,12 +594,17 @@ var RoleBaseReqVerif RoleBasedRequestVerifType
 var RoleBaseReqVerifMiddleware []RequestMiddleware
 
 func SetRoleBaseReqVerifMiddleware() {
-	RoleBaseReqVerifMiddleware = []RequestMiddleware{&RoleBaseReqVerif}
+	RoleBaseReqVerifMiddleware = []RequestMiddleware{&RoleBaseReqVerif, &CSRF}
+}
+
+func (RoleBasedRequestVerifType) AuthSchemes() []string {
+	return []string{apimaster.AUTH_SCHEME_COOKIE, apimaster.AUTH_SCHEME_HEADER, apimaster.AUTH_SCHEME_API_KEY, apimaster.AUTH_SCHEME_SIGNED, apimaster.AUTH_SCHEME_TOKEN}
 }
 
 func (RoleBasedRequestVerifType) ProcessRequest(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
 	ctx, err := authentication.VerifyRequest(ctx, routeString, r.FormValue(AUTH_MODE_KEY), w, r)
 	if err != nil {
+		rejectScopeDenied(w, err)
 		return ctx, err
 	}
 
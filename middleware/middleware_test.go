@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/authentication"
+	"github.com/rogue-syntax/rs-goapiserver/rs_go_requestlogger"
+)
+
+// quietLogs: request and error log streamers that drop everything, so serveRoute runs without a log setup
+type quietLogs struct{}
+
+func (quietLogs) Stream(rsLog *rs_go_requestlogger.RSRequestLogger, logStr string) string { return "" }
+func (quietLogs) Write(rsLog *rs_go_requestlogger.RSRequestLogger) string                 { return "" }
+
+type quietErrors struct{}
+
+func (quietErrors) Stream(err error, msg string, jsonError string, r *http.Request) string { return "" }
+func (quietErrors) Write(err error, msg string, r *http.Request) string                    { return "" }
+
+func TestServeRouteSignedFormBody(t *testing.T) {
+	prev := authentication.MaxSignedBodyBytes
+	authentication.MaxSignedBodyBytes = 8
+	defer func() { authentication.MaxSignedBodyBytes = prev }()
+	apierrors.InitAPIErrorHandlers(quietLogs{}, quietErrors{})
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCalled bool
+	}{
+		{"within the limit", "a=1&b=2", http.StatusOK, true},
+		{"over the limit", "a=1&b=2&c=3", http.StatusRequestEntityTooLarge, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			def := RouteDef{RouteStr: "/v1/signed", HandlerFunc: func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+				called = true
+				if r.PostForm.Get("a") != "1" {
+					t.Errorf("PostForm = %v", r.PostForm)
+				}
+				// the signed body is still there for VerifyWithSignature
+				rc, err := r.GetBody()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, _ := io.ReadAll(rc); string(body) != tt.body {
+					t.Errorf("GetBody = %q, want %q", body, tt.body)
+				}
+			}}
+			r := httptest.NewRequest("POST", "/v1/signed", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set(authentication.SIGNATURE_HEADER_KEY, "ab")
+			w := httptest.NewRecorder()
+			serveRoute(def, w, r, nil)
+			if called != tt.wantCalled || w.Code != tt.wantStatus {
+				t.Errorf("handler called %v, status %d, want %v and %d", called, w.Code, tt.wantCalled, tt.wantStatus)
+			}
+			if !tt.wantCalled && len(r.PostForm) != 0 {
+				t.Errorf("PostForm of a refused body = %v", r.PostForm)
+			}
+		})
+	}
+}
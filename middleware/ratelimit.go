@@ -0,0 +1,345 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apicontext"
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apikeys"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+// Rate limiting middleware
+/*
+
+	A *RateLimit is a RequestMiddleware, add it to a route with RouteDef.Use or to a group with RouteGroup.Use, i.e.
+
+	{RouteStr: "/v1/app/signIn", HandlerFunc: authentication.Handler_AppSignIn, MiddlewareSli: &middleware.BlankMiddleware, Use: []middleware.RequestMiddleware{&middleware.SignInRateLimit}}
+
+	var PerUserLimit = middleware.RateLimit{
+		Rule: middleware.RateLimitRule{Algorithm: middleware.RATELIMIT_TOKEN_BUCKET, Limit: 60, Window: time.Minute, Burst: 20},
+		Key:  middleware.RateLimitKeyByUser,
+	}
+
+	Requests over the limit get a 429 with a Retry-After header and apierrorkeys.RateLimited.
+	Every limited request gets X-RateLimit-Limit and X-RateLimit-Remaining headers.
+
+	Counters are kept per Name, or per route if Name is empty, and per key, so one RateLimit with a Name
+	shared by several routes gives them one shared budget.
+
+	Key picks who is limited, RateLimitKeyByIP, RateLimitKeyByUser, RateLimitKeyByApiKey or a custom RateLimitKeyFunc.
+	If Key is nil or returns "" the IP is used. RateLimitKeyByUser needs ReqVerif to run before the RateLimit in the chain.
+
+	The IP is the connection's RemoteAddr, or with TrustProxyHeaders the one read from proxy headers as for
+	IPAllowList, see clientAddr. i.e. behind one proxy
+
+	middleware.SignInRateLimit.TrustProxyHeaders = true
+
+	Counters live in DefaultRateLimitStore, an in-memory store, unless Store is set. Implement RateLimitStore
+	to share counters between instances i.e. in redis. If the store errors the request is let through and the error logged.
+
+*/
+
+// RateLimitAlgorithm
+type RateLimitAlgorithm int
+
+const (
+	// RATELIMIT_TOKEN_BUCKET: Limit requests per Window refilled continuously, with bursts up to Burst
+	RATELIMIT_TOKEN_BUCKET RateLimitAlgorithm = iota
+	// RATELIMIT_SLIDING_WINDOW: at most Limit requests in any Window, weighted across the previous and current window
+	RATELIMIT_SLIDING_WINDOW
+)
+
+/*
+RateLimitRule: how many requests are allowed
+  - Algorithm: RATELIMIT_TOKEN_BUCKET or RATELIMIT_SLIDING_WINDOW
+  - Limit: requests allowed per Window
+  - Window: the period Limit applies to
+  - Burst: token bucket only, the bucket size, defaults to Limit
+*/
+type RateLimitRule struct {
+	Algorithm RateLimitAlgorithm
+	Limit     int
+	Window    time.Duration
+	Burst     int
+}
+
+func (rule RateLimitRule) validate() error {
+	if rule.Limit <= 0 || rule.Window <= 0 || rule.Burst < 0 {
+		return errors.New(apierrorkeys.RateLimitError + ": Limit and Window must be more than 0")
+	}
+	if rule.Algorithm != RATELIMIT_TOKEN_BUCKET && rule.Algorithm != RATELIMIT_SLIDING_WINDOW {
+		return errors.New(apierrorkeys.RateLimitError + ": unknown algorithm " + strconv.Itoa(int(rule.Algorithm)))
+	}
+	return nil
+}
+
+func (rule RateLimitRule) burst() int {
+	if rule.Burst > 0 {
+		return rule.Burst
+	}
+	return rule.Limit
+}
+
+/*
+RateLimitResult: the outcome of taking one request from a key's budget
+  - Allowed: false if the request is over the limit
+  - Remaining: requests left right now
+  - RetryAfter: when a request would next be allowed, if not Allowed
+*/
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+// RateLimitStore
+//   - keeps the counters for each key, implement for a shared backend
+//   - Take counts one request against key under rule and must be safe for concurrent use
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, rule RateLimitRule, now time.Time) (RateLimitResult, error)
+}
+
+// RateLimitKeyFunc
+//   - returns who the request counts against, "" to fall back to the IP
+type RateLimitKeyFunc func(ctx context.Context, r *http.Request) (string, error)
+
+// RateLimitKeyByIP keys on the connection's RemoteAddr, without the port, proxy headers are not read
+func RateLimitKeyByIP(ctx context.Context, r *http.Request) (string, error) {
+	return "ip:" + clientAddr(r, false), nil
+}
+
+// RateLimitKeyByUser keys on the user set in the context by ReqVerif
+func RateLimitKeyByUser(ctx context.Context, r *http.Request) (string, error) {
+	usr, err := apicontext.CtxGetUser(ctx)
+	if err != nil || usr == nil {
+		return "", nil
+	}
+	return "user:" + strconv.Itoa(usr.User_id), nil
+}
+
+// RateLimitKeyByApiKey
+//   - keys on the key id of the named api key the request was verified with, sent in kbxa or signed with
+//   - needs ReqVerif to run before the RateLimit in the chain, an unverified request is keyed on its IP
+//     so a caller can not get a fresh budget by sending made up key ids
+func RateLimitKeyByApiKey(ctx context.Context, r *http.Request) (string, error) {
+	k, err := apikeys.CtxGetKey(ctx)
+	if err != nil {
+		return "", nil
+	}
+	return "apikey:" + k.Key_id, nil
+}
+
+// RateLimit
+//   - a RequestMiddleware that limits requests per key, see the top of this file
+//   - Name: shares one budget between every route using it, defaults to the route
+//   - Key: defaults to the client IP
+//   - TrustProxyHeaders: the client IP is read from proxy headers instead of RemoteAddr, see clientAddr
+//   - Store: defaults to DefaultRateLimitStore
+type RateLimit struct {
+	Name              string
+	Rule              RateLimitRule
+	Key               RateLimitKeyFunc
+	TrustProxyHeaders bool
+	Store             RateLimitStore
+}
+
+func (rl *RateLimit) ProcessRequest(ctx context.Context, routeString string, w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	err := rl.Rule.validate()
+	if err != nil {
+		return ctx, err
+	}
+	key := ""
+	if rl.Key != nil {
+		key, err = rl.Key(ctx, r)
+		if err != nil {
+			return ctx, errors.Wrap(err, apierrorkeys.RateLimitError)
+		}
+	}
+	if key == "" {
+		key = "ip:" + clientAddr(r, rl.TrustProxyHeaders)
+	}
+	scope := rl.Name
+	if scope == "" {
+		scope = routeString
+	}
+	store := rl.Store
+	if store == nil {
+		store = DefaultRateLimitStore
+	}
+
+	res, err := store.Take(ctx, scope+"|"+key, rl.Rule, time.Now())
+	if err != nil {
+		// fail open, a broken store should not take the api down
+		apierrors.HandleError(r, errors.Wrap(err, apierrorkeys.RateLimitError), apierrorkeys.RateLimitError, nil)
+		return ctx, nil
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(rl.Rule.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	if !res.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(math.Max(res.RetryAfter.Seconds(), 1)))))
+		RejectWith(w, http.StatusTooManyRequests)
+		return ctx, errors.New(apierrorkeys.RateLimited)
+	}
+	return ctx, nil
+}
+
+func (rl *RateLimit) ErrorStatuses() []int {
+	return []int{http.StatusTooManyRequests}
+}
+
+// MemoryRateLimitStore
+//   - an in-memory RateLimitStore for a single instance, idle keys are swept as it is used
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	windows map[string]*memoryWindow
+	takes   int
+}
+
+type memoryBucket struct {
+	tokens  float64
+	last    time.Time
+	expires time.Time
+}
+
+type memoryWindow struct {
+	start   time.Time
+	prev    int
+	curr    int
+	expires time.Time
+}
+
+// how many Takes between sweeps of idle keys
+const rateLimitSweepEvery = 1024
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		buckets: make(map[string]*memoryBucket),
+		windows: make(map[string]*memoryWindow),
+	}
+}
+
+// DefaultRateLimitStore is used by a RateLimit with no Store
+var DefaultRateLimitStore RateLimitStore = NewMemoryRateLimitStore()
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, rule RateLimitRule, now time.Time) (RateLimitResult, error) {
+	err := rule.validate()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.takes++
+	if s.takes%rateLimitSweepEvery == 0 {
+		s.sweep(now)
+	}
+	if rule.Algorithm == RATELIMIT_SLIDING_WINDOW {
+		return s.takeWindow(key, rule, now), nil
+	}
+	return s.takeBucket(key, rule, now), nil
+}
+
+func (s *MemoryRateLimitStore) takeBucket(key string, rule RateLimitRule, now time.Time) RateLimitResult {
+	capacity := float64(rule.burst())
+	perSecond := float64(rule.Limit) / rule.Window.Seconds()
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: capacity, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	var res RateLimitResult
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+		res.Remaining = int(b.tokens)
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	// idle until the bucket is full again
+	b.expires = now.Add(time.Duration((capacity - b.tokens) / perSecond * float64(time.Second)))
+	return res
+}
+
+func (s *MemoryRateLimitStore) takeWindow(key string, rule RateLimitRule, now time.Time) RateLimitResult {
+	start := now.Truncate(rule.Window)
+	win, ok := s.windows[key]
+	if !ok {
+		win = &memoryWindow{start: start}
+		s.windows[key] = win
+	}
+	if !win.start.Equal(start) {
+		if start.Sub(win.start) == rule.Window {
+			win.prev = win.curr
+		} else {
+			win.prev = 0
+		}
+		win.curr = 0
+		win.start = start
+	}
+	win.expires = start.Add(2 * rule.Window)
+
+	elapsed := now.Sub(start)
+	weight := 1 - float64(elapsed)/float64(rule.Window)
+	count := float64(win.prev)*weight + float64(win.curr)
+
+	var res RateLimitResult
+	if count+1 <= float64(rule.Limit) {
+		win.curr++
+		res.Allowed = true
+		res.Remaining = int(float64(rule.Limit) - count - 1)
+		return res
+	}
+	if win.prev == 0 || win.curr+1 > rule.Limit {
+		res.RetryAfter = start.Add(rule.Window).Sub(now)
+		return res
+	}
+	// wait until enough of the previous window has slid out
+	allowedAt := time.Duration(float64(rule.Window) * (1 - float64(rule.Limit-1-win.curr)/float64(win.prev)))
+	res.RetryAfter = allowedAt - elapsed
+	return res
+}
+
+// sweep drops keys that have been idle long enough to be back at a full budget
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.After(b.expires) {
+			delete(s.buckets, key)
+		}
+	}
+	for key, win := range s.windows {
+		if now.After(win.expires) {
+			delete(s.windows, key)
+		}
+	}
+}
+
+// //////////////////////////////
+// AUTH RATE LIMITS
+//   - sign in: 10 a minute per ip with bursts of 5
+//   - sign up and password reset send email, so 5 per 15 minutes per ip
+//   - token refresh: 30 a minute per ip with bursts of 10
+//   - the ip is the RemoteAddr, behind a proxy set TrustProxyHeaders on each
+var SignInRateLimit = RateLimit{
+	Name: "signIn",
+	Rule: RateLimitRule{Algorithm: RATELIMIT_TOKEN_BUCKET, Limit: 10, Window: time.Minute, Burst: 5},
+}
+
+var TokenRefreshRateLimit = RateLimit{
+	Name: "tokenRefresh",
+	Rule: RateLimitRule{Algorithm: RATELIMIT_TOKEN_BUCKET, Limit: 30, Window: time.Minute, Burst: 10},
+}
+
+var EmailRateLimit = RateLimit{
+	Name: "email",
+	Rule: RateLimitRule{Algorithm: RATELIMIT_SLIDING_WINDOW, Limit: 5, Window: 15 * time.Minute},
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rogue-syntax/rs-goapiserver/apikeys"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+type rateLimitStep struct {
+	at            time.Duration
+	key           string
+	wantAllowed   bool
+	wantRemaining int
+	wantRetry     time.Duration
+}
+
+func runRateLimitSteps(t *testing.T, rule RateLimitRule, steps []rateLimitStep) {
+	// a start of a minute, so sliding windows line up with the steps
+	t0 := time.Unix(1700000040, 0)
+	s := NewMemoryRateLimitStore()
+	for i, step := range steps {
+		key := step.key
+		if key == "" {
+			key = "k"
+		}
+		res, err := s.Take(context.Background(), key, rule, t0.Add(step.at))
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if res.Allowed != step.wantAllowed || res.Remaining != step.wantRemaining || res.RetryAfter != step.wantRetry {
+			t.Errorf("step %d at %v: Take = %+v, want allowed %v, remaining %d, retry after %v",
+				i, step.at, res, step.wantAllowed, step.wantRemaining, step.wantRetry)
+		}
+	}
+}
+
+func TestMemoryRateLimitStoreTokenBucket(t *testing.T) {
+	// 1 a second with bursts of 2
+	rule := RateLimitRule{Algorithm: RATELIMIT_TOKEN_BUCKET, Limit: 60, Window: time.Minute, Burst: 2}
+	runRateLimitSteps(t, rule, []rateLimitStep{
+		{0, "", true, 1, 0},
+		{0, "", true, 0, 0},
+		{0, "", false, 0, time.Second},
+		{0, "other", true, 1, 0},
+		{500 * time.Millisecond, "", false, 0, 500 * time.Millisecond},
+		{time.Second, "", true, 0, 0},
+		// idle refills up to Burst, not beyond
+		{time.Hour, "", true, 1, 0},
+		{time.Hour, "", true, 0, 0},
+		{time.Hour, "", false, 0, time.Second},
+	})
+}
+
+func TestMemoryRateLimitStoreSlidingWindow(t *testing.T) {
+	rule := RateLimitRule{Algorithm: RATELIMIT_SLIDING_WINDOW, Limit: 4, Window: time.Minute}
+	runRateLimitSteps(t, rule, []rateLimitStep{
+		{0, "", true, 3, 0},
+		{0, "", true, 2, 0},
+		{10 * time.Second, "", true, 1, 0},
+		{59 * time.Second, "", true, 0, 0},
+		// nothing in the previous window, wait for the next one
+		{59 * time.Second, "", false, 0, time.Second},
+		// all 4 still weigh fully at the start of the next window, a quarter slides out after 15s
+		{60 * time.Second, "", false, 0, 15 * time.Second},
+		{75 * time.Second, "", true, 0, 0},
+		// 3 weighted and 1 counted, the weighted 3 have to slide down to 2
+		{75 * time.Second, "", false, 0, 15 * time.Second},
+		// a window with nothing before it
+		{180 * time.Second, "", true, 3, 0},
+	})
+}
+
+func TestMemoryRateLimitStoreSweep(t *testing.T) {
+	rule := RateLimitRule{Algorithm: RATELIMIT_TOKEN_BUCKET, Limit: 60, Window: time.Minute}
+	window := RateLimitRule{Algorithm: RATELIMIT_SLIDING_WINDOW, Limit: 60, Window: time.Minute}
+	ctx := context.Background()
+	now := time.Unix(1700000040, 0)
+	s := NewMemoryRateLimitStore()
+	s.Take(ctx, "idle bucket", rule, now)
+	s.Take(ctx, "idle window", window, now)
+	for i := 2; i < rateLimitSweepEvery-1; i++ {
+		s.Take(ctx, "busy", rule, now)
+	}
+	// the sweep runs on this Take, an hour on every earlier key is back at a full budget
+	s.Take(ctx, "busy", rule, now.Add(time.Hour))
+	if len(s.buckets) != 1 || len(s.windows) != 0 {
+		t.Errorf("%d buckets and %d windows kept after the sweep, want 1 and 0", len(s.buckets), len(s.windows))
+	}
+}
+
+func TestRateLimitRuleValidate(t *testing.T) {
+	for _, rule := range []RateLimitRule{
+		{Limit: 0, Window: time.Minute},
+		{Limit: 1, Window: 0},
+		{Limit: 1, Window: time.Minute, Burst: -1},
+		{Algorithm: 7, Limit: 1, Window: time.Minute},
+	} {
+		if _, err := NewMemoryRateLimitStore().Take(context.Background(), "k", rule, time.Now()); err == nil {
+			t.Errorf("Take took rule %+v", rule)
+		}
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		hops       int // 0 does not trust proxy headers
+		want       string
+	}{
+		{"remote addr", "10.0.0.1:1234", nil, 0, "10.0.0.1"},
+		{"ipv6 remote addr", "[::1]:1234", nil, 0, "::1"},
+		{"headers ignored", "10.0.0.1:1234", map[string]string{"X-Real-Ip": "1.2.3.4", "X-Forwarded-For": "5.6.7.8"}, 0, "10.0.0.1"},
+		{"trusted x-forwarded-for, the proxy's entry", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 5.6.7.8"}, 1, "5.6.7.8"},
+		{"trusted x-forwarded-for with port", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "5.6.7.8:4321"}, 1, "5.6.7.8"},
+		{"two trusted proxies", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "6.6.6.6, 5.6.7.8, 10.0.0.2"}, 2, "5.6.7.8"},
+		{"fewer entries than proxies", "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "5.6.7.8"}, 2, "5.6.7.8"},
+		{"x-forwarded-for over x-real-ip", "10.0.0.1:1234", map[string]string{"X-Real-Ip": "6.6.6.6", "X-Forwarded-For": "5.6.7.8"}, 1, "5.6.7.8"},
+		{"trusted x-real-ip", "10.0.0.1:1234", map[string]string{"X-Real-Ip": "1.2.3.4"}, 1, "1.2.3.4"},
+		{"trusted without headers", "10.0.0.1:1234", nil, 1, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/a", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			prev := TrustedProxyHops
+			TrustedProxyHops = tt.hops
+			defer func() { TrustedProxyHops = prev }()
+			if got := clientAddr(r, tt.hops > 0); got != tt.want {
+				t.Errorf("clientAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	r := httptest.NewRequest("GET", "/v1/a", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	r.Header.Set("X-Kbx-Key-Id", "made up")
+	ctx := context.Background()
+
+	if key, _ := RateLimitKeyByIP(ctx, r); key != "ip:10.0.0.1" {
+		t.Errorf("RateLimitKeyByIP = %q, want the RemoteAddr", key)
+	}
+	if key, _ := RateLimitKeyByApiKey(ctx, r); key != "" {
+		t.Errorf("RateLimitKeyByApiKey of an unverified request = %q, want the IP fallback", key)
+	}
+	verified := apikeys.CtxWithKey(ctx, &apikeys.ApiKey{Key_id: "aaaaaaaaaaaaaaaa"})
+	if key, _ := RateLimitKeyByApiKey(verified, r); key != "apikey:aaaaaaaaaaaaaaaa" {
+		t.Errorf("RateLimitKeyByApiKey of a verified request = %q", key)
+	}
+}
+
+func TestRateLimitProcessRequest(t *testing.T) {
+	rule := RateLimitRule{Algorithm: RATELIMIT_TOKEN_BUCKET, Limit: 1, Window: time.Minute}
+	request := func(rl *RateLimit, forwardedFor string) (*httptest.ResponseRecorder, error) {
+		r := httptest.NewRequest("GET", "/v1/a", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		_, err := rl.ProcessRequest(context.Background(), "/v1/a", w, r)
+		return w, err
+	}
+
+	rl := &RateLimit{Rule: rule, Store: NewMemoryRateLimitStore()}
+	if _, err := request(rl, "1.1.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	// a new proxy header is not a new budget
+	w, err := request(rl, "2.2.2.2")
+	if err == nil || !strings.HasPrefix(err.Error(), apierrorkeys.RateLimited) {
+		t.Fatalf("second request error = %v, want %s", err, apierrorkeys.RateLimited)
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("second request = %d, headers %v", w.Code, w.Header())
+	}
+
+	trusting := &RateLimit{Rule: rule, TrustProxyHeaders: true, Store: NewMemoryRateLimitStore()}
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		if _, err := request(trusting, ip); err != nil {
+			t.Errorf("request from %s behind a trusted proxy: %v", ip, err)
+		}
+	}
+	// the proxy appends the address it saw, what the client put before it is not a new budget
+	if _, err := request(trusting, "9.9.9.9, 1.1.1.1"); err == nil {
+		t.Error("a made up X-Forwarded-For entry got a fresh budget behind a trusted proxy")
+	}
+}
@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+)
+
+// Post handler middleware and response capture
+/*
+
+	RouteHandler wraps the http.ResponseWriter in a ResponseRecorder before any middleware runs,
+	so the status, bytes written and duration of every request are known once the handler returns.
+
+	A RequestMiddleware can optionally also implement ResponseMiddleware. After the handler returns,
+	or after a ProcessRequest rejects the request, or after the handler panics,
+	ProcessResponse is called on every middleware in the route's chain that implements it, in reverse order.
+
+	The ResponseRecord is also copied into the RSRequestLogger's ResponseVars before the request log is written.
+
+	The ResponseRecorder also carries the apireturn.ResponseMode of its request, so apireturn.ApiJSONReturn answers
+	with a plain envelope, a status, or a problem response as the request asked. A RequestMiddleware rejecting a
+	request with a particular status calls RejectWith, the status is sent with the error response.
+
+*/
+
+// ResponseMiddleware
+//   - optional second phase for a RequestMiddleware, see the top of this file
+type ResponseMiddleware interface {
+	ProcessResponse(ctx context.Context, routeString string, rec *ResponseRecord, r *http.Request)
+}
+
+/*
+ResponseRecord: the outcome of a request
+  - Status: the status code written, 200 if the handler wrote nothing, 101 if the connection was hijacked i.e. websockets
+  - Bytes: body bytes written
+  - Duration: time from RouteHandler receiving the request to the handler returning
+  - Panic: the recovered panic value if the handler panicked, the panic is re raised after the response phase
+  - Err: the error from the ProcessRequest that rejected the request, if any
+*/
+type ResponseRecord struct {
+	Status   int
+	Bytes    int64
+	Duration time.Duration
+	Panic    interface{}
+	Err      error
+}
+
+// ResponseRecorder
+//   - an http.ResponseWriter that records the status and size of the response
+//   - passes Flush and Hijack through to the wrapped writer so websocket upgrades keep working
+//   - implements apireturn.ResponseModer, the mode is apireturn.DefaultResponseMode until SetResponseMode
+type ResponseRecorder struct {
+	http.ResponseWriter
+	status       int
+	bytes        int64
+	wroteHeader  bool
+	hijacked     bool
+	start        time.Time
+	mode         apireturn.ResponseMode
+	rejectStatus int
+}
+
+func NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w, start: time.Now(), mode: apireturn.DefaultResponseMode}
+}
+
+// SetResponseMode sets the apireturn.ResponseMode responses are written in
+func (rw *ResponseRecorder) SetResponseMode(mode apireturn.ResponseMode) {
+	rw.mode = mode
+}
+
+func (rw *ResponseRecorder) ResponseMode() apireturn.ResponseMode {
+	return rw.mode
+}
+
+// RejectWith
+//   - sets the status a RequestMiddleware rejects the request with, i.e. 429, sent with the error response
+//   - writes the status at once if w is not a ResponseRecorder
+func RejectWith(w http.ResponseWriter, status int) {
+	if rec, ok := w.(*ResponseRecorder); ok && !rec.WroteHeader() {
+		rec.rejectStatus = status
+		return
+	}
+	w.WriteHeader(status)
+}
+
+func (rw *ResponseRecorder) WriteHeader(status int) {
+	if !rw.wroteHeader {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *ResponseRecorder) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.status = http.StatusOK
+		rw.wroteHeader = true
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+func (rw *ResponseRecorder) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		if !rw.wroteHeader {
+			rw.status = http.StatusOK
+			rw.wroteHeader = true
+		}
+		f.Flush()
+	}
+}
+
+func (rw *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("ResponseRecorder: wrapped ResponseWriter does not implement http.Hijacker")
+	}
+	conn, brw, err := h.Hijack()
+	if err == nil {
+		rw.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer
+func (rw *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// WroteHeader reports whether a status has been sent
+func (rw *ResponseRecorder) WroteHeader() bool {
+	return rw.wroteHeader || rw.hijacked
+}
+
+// Record returns the outcome so far
+func (rw *ResponseRecorder) Record() ResponseRecord {
+	rec := ResponseRecord{Status: rw.status, Bytes: rw.bytes, Duration: time.Since(rw.start)}
+	if rw.hijacked {
+		rec.Status = http.StatusSwitchingProtocols
+	} else if !rw.wroteHeader {
+		rec.Status = http.StatusOK
+	}
+	return rec
+}
+
+// processResponse runs ProcessResponse on every middleware that implements it, last first
+func (c MiddlewareChain) processResponse(ctx context.Context, routeString string, rec *ResponseRecord, r *http.Request) {
+	for i := len(c.mws) - 1; i >= 0; i-- {
+		if rm, ok := c.mws[i].(ResponseMiddleware); ok {
+			rm.ProcessResponse(ctx, routeString, rec, r)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+// A method and path parameter aware router on top of http.ServeMux
+/*
+
+	A RouteDef.RouteStr may be a plain mux pattern i.e. "/v1/app/signIn", or a path template with
+	named parameters i.e. "/v1/users/{id}/sessions".
+
+	A template is registered on the mux under its static prefix, "/v1/users/", and every route sharing
+	that prefix is dispatched by one muxRouter, so "/v1/users/{id}" and "/v1/users/{id}/sessions" can live side by side.
+
+	A route that declares RouteDef.Methods only accepts those methods (HEAD is implied by GET).
+	A request whose path matches but whose method does not gets a 405 with an Allow header.
+
+	Extracted parameters are read in the handler with apicontext.CtxGetPathParam(ctx, "id")
+
+*/
+
+// PathTemplate
+//   - a parsed RouteStr with {name} segments
+type PathTemplate struct {
+	Raw      string
+	segments []templateSegment
+	literals int
+}
+
+type templateSegment struct {
+	value   string
+	isParam bool
+}
+
+// IsPathTemplate reports whether the route string contains {name} parameters
+func IsPathTemplate(routeString string) bool {
+	return strings.Contains(routeString, "{")
+}
+
+// ParsePathTemplate
+//   - parses a template like "/v1/users/{id}/sessions"
+//   - a parameter must be a whole segment and names must be unique
+func ParsePathTemplate(routeString string) (*PathTemplate, error) {
+	if !strings.HasPrefix(routeString, "/") {
+		return nil, errors.New(apierrorkeys.RouteDefError + ": route must start with / : " + routeString)
+	}
+	t := PathTemplate{Raw: routeString}
+	seen := make(map[string]bool)
+	for _, seg := range strings.Split(strings.Trim(routeString, "/"), "/") {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			name := seg[1 : len(seg)-1]
+			if name == "" || strings.ContainsAny(name, "{}") {
+				return nil, errors.New(apierrorkeys.RouteDefError + ": bad parameter " + seg + " in " + routeString)
+			}
+			if seen[name] {
+				return nil, errors.New(apierrorkeys.RouteDefError + ": duplicate parameter " + name + " in " + routeString)
+			}
+			seen[name] = true
+			t.segments = append(t.segments, templateSegment{value: name, isParam: true})
+			continue
+		}
+		if strings.ContainsAny(seg, "{}") {
+			return nil, errors.New(apierrorkeys.RouteDefError + ": parameter must be a whole segment in " + routeString)
+		}
+		t.segments = append(t.segments, templateSegment{value: seg})
+		t.literals++
+	}
+	return &t, nil
+}
+
+// MuxPattern is the static prefix the template is registered under on the mux
+func (t *PathTemplate) MuxPattern() string {
+	pattern := "/"
+	for _, seg := range t.segments {
+		if seg.isParam {
+			break
+		}
+		pattern += seg.value + "/"
+	}
+	return pattern
+}
+
+// ParamNames returns the template's parameter names in order
+func (t *PathTemplate) ParamNames() []string {
+	var names []string
+	for _, seg := range t.segments {
+		if seg.isParam {
+			names = append(names, seg.value)
+		}
+	}
+	return names
+}
+
+// Match
+//   - matches an escaped url path against the template, returning the unescaped parameters
+func (t *PathTemplate) Match(escapedPath string) (map[string]string, bool) {
+	parts := strings.Split(strings.Trim(escapedPath, "/"), "/")
+	if len(parts) != len(t.segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, seg := range t.segments {
+		if seg.isParam {
+			val, err := url.PathUnescape(parts[i])
+			if err != nil || val == "" {
+				return nil, false
+			}
+			params[seg.value] = val
+			continue
+		}
+		if parts[i] != seg.value {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// routeEntry is one registered route in a muxRouter
+type routeEntry struct {
+	routeStr string
+	template *PathTemplate
+	methods  []string
+	serve    func(w http.ResponseWriter, r *http.Request, params map[string]string)
+}
+
+func (e *routeEntry) match(r *http.Request) (map[string]string, bool) {
+	if e.template == nil {
+		// plain patterns were already matched by the mux
+		return nil, true
+	}
+	return e.template.Match(r.URL.EscapedPath())
+}
+
+func (e *routeEntry) allowsMethod(method string) bool {
+	if len(e.methods) == 0 {
+		return true
+	}
+	for _, m := range e.methods {
+		if m == method || (m == http.MethodGet && method == http.MethodHead) {
+			return true
+		}
+	}
+	return false
+}
+
+// muxRouter dispatches every route registered under one mux pattern
+type muxRouter struct {
+	mu      sync.RWMutex
+	entries []*routeEntry
+}
+
+func (mr *muxRouter) add(e *routeEntry) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	for _, existing := range mr.entries {
+		if existing.routeStr == e.routeStr && methodsOverlap(existing.methods, e.methods) {
+			return errors.New(apierrorkeys.RouteDefError + ": route registered twice: " + e.routeStr)
+		}
+	}
+	mr.entries = append(mr.entries, e)
+	// templates before plain patterns, most literal segments first
+	sort.SliceStable(mr.entries, func(i, j int) bool {
+		a, b := mr.entries[i].template, mr.entries[j].template
+		if a == nil || b == nil {
+			return b == nil && a != nil
+		}
+		return a.literals > b.literals
+	})
+	return nil
+}
+
+// methodsOverlap reports whether two method lists can serve the same request, an empty list allows every method
+func methodsOverlap(a []string, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return true
+	}
+	for _, m := range a {
+		for _, n := range b {
+			if m == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (mr *muxRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mr.mu.RLock()
+	entries := mr.entries
+	mr.mu.RUnlock()
+
+	var allowed []string
+	for _, e := range entries {
+		params, ok := e.match(r)
+		if !ok {
+			continue
+		}
+		if !e.allowsMethod(r.Method) {
+			allowed = append(allowed, e.methods...)
+			continue
+		}
+		e.serve(w, r, params)
+		return
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", allowHeader(allowed))
+		recorder := NewResponseRecorder(w)
+		recorder.SetResponseMode(apireturn.ModeForRequest(r))
+		w = recorder
+		apireturn.ApiJSONReturnStatus(nil, apierrorkeys.MethodNotAllowed, http.StatusMethodNotAllowed, &w)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func allowHeader(methods []string) string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, m := range methods {
+		if !seen[m] {
+			seen[m] = true
+			out = append(out, m)
+		}
+		if m == http.MethodGet && !seen[http.MethodHead] {
+			seen[http.MethodHead] = true
+			out = append(out, http.MethodHead)
+		}
+	}
+	return strings.Join(out, ", ")
+}
+
+var routersMutex sync.Mutex
+var routers = map[*http.ServeMux]map[string]*muxRouter{}
+
+// routerFor returns the muxRouter for a pattern on a mux, registering it with the mux on first use
+func routerFor(mux *http.ServeMux, pattern string) *muxRouter {
+	routersMutex.Lock()
+	defer routersMutex.Unlock()
+	byPattern, ok := routers[mux]
+	if !ok {
+		byPattern = make(map[string]*muxRouter)
+		routers[mux] = byPattern
+	}
+	mr, ok := byPattern[pattern]
+	if !ok {
+		mr = &muxRouter{}
+		byPattern[pattern] = mr
+		mux.Handle(pattern, mr)
+	}
+	return mr
+}
+
+// normalizeMethods upper cases and validates declared methods
+func normalizeMethods(methods []string) ([]string, error) {
+	var out []string
+	for _, m := range methods {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		switch m {
+		case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+			http.MethodDelete, http.MethodOptions, http.MethodConnect, http.MethodTrace:
+			out = append(out, m)
+		default:
+			return nil, errors.New(apierrorkeys.RouteDefError + ": unknown method " + m)
+		}
+	}
+	return out, nil
+}
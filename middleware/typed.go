@@ -0,0 +1,446 @@
+package middleware
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apicontext"
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apimaster"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/apivalidate"
+)
+
+// Typed handlers
+/*
+
+	Typed turns a func(ctx, In) (Out, error) into a route handler that decodes In, validates it, calls the func
+	and returns Out in an apireturn.JsonReturn, i.e.
+
+	func PWVerify(ctx context.Context, in PWSubmission) (PWValidationResponse, error)
+
+	{RouteStr: "/v1/app/newPWVerificationEP", Typed: middleware.Typed(signup.PWVerify).Describe("Password Verification Endpoint"), MiddlewareSli: &middleware.BlankMiddleware, Methods: []string{http.MethodPost}}
+
+	In is decoded from the route's RouteParamSource, taken from Typed.From, else the ReqDef Method, else the route's Methods:
+	  - POSTREQ: a JSON body, or a form / multipart body by Content-Type
+	  - MULTIPART_FORM: multipart form values, and files into *multipart.FileHeader or []*multipart.FileHeader fields
+	  - GETREQ, URIREQ: the url query
+	Path template params i.e. {id} are always set on the matching field last. Form, query and path values match
+	fields by json name, case insensitively, and may fill string, bool, number, encoding.TextUnmarshaler, pointer and slice fields.
+
+	In is then checked against its `validate` tags, see apivalidate. Bad input returns apierrorkeys.InvalidAPIInput with
+	the []apivalidate.FieldViolation as Data.
+
+	An error from the func returns apierrorkeys.APIReqError, or the Key and Data of an apierrors.KeyedError.
+
+	Unless the RouteDef has a ReqDef, one is built from In and Out for apimaster.ApiReqMap.
+
+*/
+
+const DEFAULT_MAX_MULTIPART_MB = 32
+
+// TypedHandler
+//   - made by Typed, set as RouteDef.Typed instead of a HandlerFunc
+//   - Source: where In is decoded from, see the top of this file
+//   - Desc: the ApiReqDef description
+//   - MaxMultipartMB: memory limit for multipart forms, DEFAULT_MAX_MULTIPART_MB if 0
+type TypedHandler struct {
+	Source         apimaster.RouteParamSource
+	Desc           string
+	MaxMultipartMB int64
+
+	inType  reflect.Type
+	outType reflect.Type
+	serve   func(source apimaster.RouteParamSource, w http.ResponseWriter, r *http.Request, ctx context.Context)
+}
+
+// Typed makes a TypedHandler from fn, In must be a struct, use apimaster.ApiNilDescriptor for no input
+func Typed[In any, Out any](fn func(ctx context.Context, in In) (Out, error)) *TypedHandler {
+	t := &TypedHandler{
+		inType:  reflect.TypeOf((*In)(nil)).Elem(),
+		outType: reflect.TypeOf((*Out)(nil)).Elem(),
+	}
+	t.serve = func(source apimaster.RouteParamSource, w http.ResponseWriter, r *http.Request, ctx context.Context) {
+		var in In
+		err := decodeAndValidate(&in, source, t.maxMultipartBytes(), r, ctx)
+		if err != nil {
+			writeTypedError(w, r, err, apierrorkeys.InvalidAPIInput)
+			return
+		}
+		out, err := fn(ctx, in)
+		if err != nil {
+			writeTypedError(w, r, err, apierrorkeys.APIReqError)
+			return
+		}
+		apireturn.ApiJSONReturn(out, apierrorkeys.NOError, &w)
+	}
+	return t
+}
+
+// From sets the source In is decoded from
+func (t *TypedHandler) From(source apimaster.RouteParamSource) *TypedHandler {
+	t.Source = source
+	return t
+}
+
+// Describe sets the ApiReqDef description
+func (t *TypedHandler) Describe(desc string) *TypedHandler {
+	t.Desc = desc
+	return t
+}
+
+func (t *TypedHandler) maxMultipartBytes() int64 {
+	if t.MaxMultipartMB > 0 {
+		return t.MaxMultipartMB * 1024 * 1024
+	}
+	return DEFAULT_MAX_MULTIPART_MB * 1024 * 1024
+}
+
+// InputType and OutputType are the reflect types of In and Out
+func (t *TypedHandler) InputType() reflect.Type {
+	return t.inType
+}
+
+func (t *TypedHandler) OutputType() reflect.Type {
+	return t.outType
+}
+
+// sourceFor picks the RouteParamSource for a route, see the top of this file
+func (t *TypedHandler) sourceFor(def RouteDef) apimaster.RouteParamSource {
+	if t.Source != "" {
+		return t.Source
+	}
+	return routeSource(def)
+}
+
+// handlerFor checks In and returns the EventualHandler for the route
+func (t *TypedHandler) handlerFor(def RouteDef) (EventualHandler, error) {
+	if t.serve == nil {
+		return nil, errors.New(apierrorkeys.RouteDefError + ": TypedHandler not made with Typed on route " + def.RouteStr)
+	}
+	if t.inType.Kind() != reflect.Struct {
+		return nil, errors.New(apierrorkeys.RouteDefError + ": Typed input must be a struct on route " + def.RouteStr)
+	}
+	source := t.sourceFor(def)
+	return func(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+		t.serve(source, w, r, ctx)
+	}, nil
+}
+
+// reqDef fills in the route's ApiReqDef from In and Out
+func (t *TypedHandler) reqDef(def RouteDef) *apimaster.ApiReqDef {
+	reqDef := apimaster.ApiReqDef{API: def.RouteStr}
+	if def.ReqDef != nil {
+		reqDef = *def.ReqDef
+	}
+	if reqDef.Method == "" {
+		reqDef.Method = t.sourceFor(def)
+	}
+	if reqDef.Desc == "" {
+		reqDef.Desc = t.Desc
+	}
+	if reqDef.Input == nil {
+		reqDef.Input = apimaster.MakeTypeDescriptorMap(t.inType)
+	}
+	if reqDef.OutputData == nil {
+		reqDef.OutputData = apimaster.MakeTypeDescriptorMap(t.outType)
+	}
+	if reqDef.InputType == nil {
+		reqDef.InputType = t.inType
+	}
+	if reqDef.OutputType == nil {
+		reqDef.OutputType = t.outType
+	}
+	if reqDef.OutputWrapper == nil {
+		reqDef.OutputWrapper = apimaster.MakeStructDescriptorMap(new(apireturn.JsonReturn))
+	}
+	return &reqDef
+}
+
+// writeTypedError returns a KeyedError's key and data, a ValidationError's violations, or defaultKey
+func writeTypedError(w http.ResponseWriter, r *http.Request, err error, defaultKey string) {
+	var keyed *apierrors.KeyedError
+	if errors.As(err, &keyed) {
+		apierrors.HandleError(r, err, keyed.Key, &apierrors.ReturnError{Msg: keyed.Key, Data: keyed.Data, W: &w})
+		return
+	}
+	var invalid *apivalidate.ValidationError
+	if errors.As(err, &invalid) {
+		apierrors.HandleError(r, err, apierrorkeys.InvalidAPIInput, &apierrors.ReturnError{Msg: apierrorkeys.InvalidAPIInput, Data: invalid.Violations, W: &w})
+		return
+	}
+	apierrors.HandleError(r, err, defaultKey, &apierrors.ReturnError{Msg: defaultKey, W: &w})
+}
+
+// decodeInput fills in, a pointer to a struct, from the request
+func decodeInput(in interface{}, source apimaster.RouteParamSource, maxMultipart int64, r *http.Request, ctx context.Context) error {
+	v := reflect.ValueOf(in).Elem()
+	var violations []apivalidate.FieldViolation
+	switch source {
+	case apimaster.GETREQ, apimaster.URIREQ:
+		setFromValues(v, r.URL.Query(), &violations)
+	case apimaster.MULTIPART_FORM:
+		err := decodeMultipart(v, maxMultipart, r, &violations)
+		if err != nil {
+			return err
+		}
+	default:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "multipart/form-data":
+			err := decodeMultipart(v, maxMultipart, r, &violations)
+			if err != nil {
+				return err
+			}
+		case "application/x-www-form-urlencoded":
+			err := r.ParseForm()
+			if err != nil {
+				return apierrors.NewKeyedError(apierrorkeys.CantDecode, nil, err)
+			}
+			setFromValues(v, r.PostForm, &violations)
+		default:
+			var raw json.RawMessage
+			err := json.NewDecoder(r.Body).Decode(&raw)
+			if err != nil && err != io.EOF {
+				return apierrors.NewKeyedError(apierrorkeys.JSONDecodeError, nil, err)
+			}
+			if err == nil {
+				err = json.Unmarshal(raw, in)
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(err, &typeErr) {
+					violations = append(violations, jsonTypeViolations(v.Type(), raw, typeErr)...)
+				} else if err != nil {
+					return apierrors.NewKeyedError(apierrorkeys.JSONDecodeError, nil, err)
+				}
+			}
+		}
+	}
+	if params, err := apicontext.CtxGetPathParams(ctx); err == nil {
+		values := make(map[string][]string, len(params))
+		for name, val := range params {
+			values[name] = []string{val}
+		}
+		setFromValues(v, values, &violations)
+	}
+	if len(violations) > 0 {
+		return &apivalidate.ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+// decodeAndValidate decodes in and checks its validate tags, a *apivalidate.ValidationError holds the violations of both
+func decodeAndValidate(in interface{}, source apimaster.RouteParamSource, maxMultipart int64, r *http.Request, ctx context.Context) error {
+	var violations []apivalidate.FieldViolation
+	err := decodeInput(in, source, maxMultipart, r, ctx)
+	var invalid *apivalidate.ValidationError
+	if errors.As(err, &invalid) {
+		violations = invalid.Violations
+	} else if err != nil {
+		return err
+	}
+	err = apivalidate.Struct(in)
+	if errors.As(err, &invalid) {
+		// a field that failed to decode is not reported again for the zero value it was left with
+		for _, violation := range invalid.Violations {
+			if !hasViolation(violations, violation.Field) {
+				violations = append(violations, violation)
+			}
+		}
+	} else if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return &apivalidate.ValidationError{Violations: violations}
+	}
+	return nil
+}
+
+func hasViolation(violations []apivalidate.FieldViolation, field string) bool {
+	for _, violation := range violations {
+		if violation.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeViolations lists every top level field of a JSON object that does not fit its type,
+// encoding/json only reports the first
+func jsonTypeViolations(t reflect.Type, raw json.RawMessage, first *json.UnmarshalTypeError) []apivalidate.FieldViolation {
+	typeViolation := func(prefix string, typeErr *json.UnmarshalTypeError) apivalidate.FieldViolation {
+		field := typeErr.Field
+		if prefix != "" && field != "" {
+			field = prefix + "." + field
+		} else if prefix != "" {
+			field = prefix
+		}
+		return apivalidate.FieldViolation{Field: field, Rule: "type", Msg: "must be " + typeErr.Type.String()}
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(raw, &fields) != nil {
+		return []apivalidate.FieldViolation{typeViolation("", first)}
+	}
+	var violations []apivalidate.FieldViolation
+	for i := 0; i < t.NumField(); i++ {
+		name := apivalidate.JSONName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		fieldRaw, ok := lookupFold(fields, name)
+		if !ok {
+			continue
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(json.Unmarshal(fieldRaw, reflect.New(t.Field(i).Type).Interface()), &typeErr) {
+			violations = append(violations, typeViolation(name, typeErr))
+		}
+	}
+	if len(violations) == 0 {
+		return []apivalidate.FieldViolation{typeViolation("", first)}
+	}
+	return violations
+}
+
+func decodeMultipart(v reflect.Value, maxMultipart int64, r *http.Request, violations *[]apivalidate.FieldViolation) error {
+	err := r.ParseMultipartForm(maxMultipart)
+	if err != nil {
+		return apierrors.NewKeyedError(apierrorkeys.CantDecode, nil, err)
+	}
+	setFromValues(v, r.MultipartForm.Value, violations)
+	setFiles(v, r.MultipartForm.File)
+	return nil
+}
+
+// lookupFold finds a key in values case insensitively
+func lookupFold[T any](values map[string]T, name string) (T, bool) {
+	if val, ok := values[name]; ok {
+		return val, true
+	}
+	for key, val := range values {
+		if strings.EqualFold(key, name) {
+			return val, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+// setFromValues sets struct fields from form, query or path values
+func setFromValues(v reflect.Value, values map[string][]string, violations *[]apivalidate.FieldViolation) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := apivalidate.JSONName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		vals, ok := lookupFold(values, name)
+		if !ok || len(vals) == 0 {
+			continue
+		}
+		err := setField(v.Field(i), vals)
+		if err != nil {
+			*violations = append(*violations, apivalidate.FieldViolation{Field: name, Rule: "type", Msg: err.Error()})
+		}
+	}
+}
+
+var fileHeaderType = reflect.TypeOf((*multipart.FileHeader)(nil))
+
+// setFiles sets *multipart.FileHeader and []*multipart.FileHeader fields from a multipart form
+func setFiles(v reflect.Value, files map[string][]*multipart.FileHeader) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := apivalidate.JSONName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		headers, ok := lookupFold(files, name)
+		if !ok || len(headers) == 0 {
+			continue
+		}
+		field := v.Field(i)
+		switch {
+		case field.Type() == fileHeaderType:
+			field.Set(reflect.ValueOf(headers[0]))
+		case field.Kind() == reflect.Slice && field.Type().Elem() == fileHeaderType:
+			field.Set(reflect.ValueOf(headers))
+		}
+	}
+}
+
+func setField(field reflect.Value, vals []string) error {
+	if field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.Uint8 {
+		slice := reflect.MakeSlice(field.Type(), len(vals), len(vals))
+		for i, val := range vals {
+			err := setScalar(slice.Index(i), val)
+			if err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+		return nil
+	}
+	return setScalar(field, vals[0])
+}
+
+func setScalar(field reflect.Value, val string) error {
+	if field.Kind() == reflect.Pointer {
+		elem := reflect.New(field.Type().Elem())
+		err := setScalar(elem.Elem(), val)
+		if err != nil {
+			return err
+		}
+		field.Set(elem)
+		return nil
+	}
+	if field.CanAddr() {
+		if tu, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			err := tu.UnmarshalText([]byte(val))
+			if err != nil {
+				return errors.New("must be a valid " + field.Type().String())
+			}
+			return nil
+		}
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(val, 10, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be a positive integer")
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(val, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		field.SetFloat(n)
+	default:
+		return errors.New("can not be set from a form value")
+	}
+	return nil
+}
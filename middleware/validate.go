@@ -0,0 +1,96 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apimaster"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/apivalidate"
+)
+
+// Request validation for HandlerFunc routes
+/*
+
+	A RouteDef with Validate set checks the request against its ReqDef.InputType before the handler runs, i.e.
+
+	type PWSubmission struct {
+		NewPw   string `validate:"required"`
+		PwToken string `validate:"required"`
+	}
+
+	{RouteStr: "/v1/app/newPWVerificationEP", HandlerFunc: signup.PWVerifEP_handler, ReqDef: &signup.PWVerifEP_handler_ApiReq, Validate: true, ...}
+
+	The input is decoded like a Typed handler's, see typed.go, from the ReqDef Method or the route's Methods: the url query
+	for GETREQ and URIREQ, the JSON, form or multipart body otherwise. Values that do not fit a field's type, and the
+	`validate` rules of apivalidate, are violations. Any violation returns apierrorkeys.InvalidAPIInput with every
+	[]apivalidate.FieldViolation as Data, and the handler is not called.
+
+	Validation runs after the middleware chain, so unauthenticated requests are rejected first.
+	The handler still reads the request as before, a JSON body is buffered and replayed to it.
+
+	Typed routes always validate, Validate changes nothing for them.
+
+*/
+
+// inputValidator checks a request before the handler runs
+type inputValidator func(r *http.Request, ctx context.Context) error
+
+// validatorFor returns the route's inputValidator, nil if it does not validate
+func validatorFor(def RouteDef) (inputValidator, error) {
+	if !def.Validate || def.Typed != nil {
+		return nil, nil
+	}
+	if def.ReqDef == nil || def.ReqDef.InputType == nil {
+		return nil, errors.New(apierrorkeys.RouteDefError + ": Validate needs a ReqDef with an InputType on route " + def.RouteStr)
+	}
+	inType := def.ReqDef.InputType
+	if inType.Kind() != reflect.Struct {
+		return nil, errors.New(apierrorkeys.RouteDefError + ": ReqDef InputType must be a struct on route " + def.RouteStr)
+	}
+	// a malformed validate tag fails now rather than on the first request
+	err := apivalidate.Struct(reflect.New(inType).Interface())
+	var invalid *apivalidate.ValidationError
+	if err != nil && !errors.As(err, &invalid) {
+		return nil, errors.Wrap(err, "route "+def.RouteStr)
+	}
+	source := routeSource(def)
+	return func(r *http.Request, ctx context.Context) error {
+		return decodeReplayable(reflect.New(inType).Interface(), source, r, ctx)
+	}, nil
+}
+
+// routeSource is where a route's input is read from, the ReqDef Method, else derived from the route's Methods
+func routeSource(def RouteDef) apimaster.RouteParamSource {
+	if def.ReqDef != nil && def.ReqDef.Method != "" {
+		return def.ReqDef.Method
+	}
+	methods, _ := normalizeMethods(def.Methods)
+	return apimaster.MethodFromHTTPMethods(methods, apimaster.POSTREQ)
+}
+
+// decodeReplayable decodes and validates the input like a Typed handler, leaving a JSON body for the handler to read again
+func decodeReplayable(in interface{}, source apimaster.RouteParamSource, r *http.Request, ctx context.Context) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	replay := source != apimaster.GETREQ && source != apimaster.URIREQ && source != apimaster.MULTIPART_FORM &&
+		mediaType != "multipart/form-data" && mediaType != "application/x-www-form-urlencoded" &&
+		r.Body != nil && r.Body != http.NoBody
+	if !replay {
+		// the query is not consumed, and forms are parsed once and kept on the request
+		return decodeAndValidate(in, source, DEFAULT_MAX_MULTIPART_MB*1024*1024, r, ctx)
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return errors.Wrap(err, apierrorkeys.CantDecode)
+	}
+	closer := r.Body
+	r.Body = bodyReadCloser{Reader: bytes.NewReader(body), Closer: closer}
+	err = decodeAndValidate(in, source, DEFAULT_MAX_MULTIPART_MB*1024*1024, r, ctx)
+	r.Body = bodyReadCloser{Reader: bytes.NewReader(body), Closer: closer}
+	return err
+}
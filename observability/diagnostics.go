@@ -0,0 +1,395 @@
+package observability
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apicontext"
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn"
+	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+)
+
+// Runtime diagnostics
+/*
+
+	pprof profiles, goroutine dumps grouped by stack, heap and GC stats and a runtime summary, for an admin listener.
+	The health check detail, health.Handler_HealthDetail, is mounted with them at DIAGNOSTICS_PREFIX/health.
+	Routes are registered by adminroutes.SetDiagnosticsRoutes, behind an optional middleware.IPAllowList and role permissions.
+
+	Profiles are written with runtime/pprof rather than net/http/pprof, whose init registers unguarded
+	/debug/pprof/ routes on http.DefaultServeMux. The pprof routes take the same query params as net/http/pprof,
+	so go tool pprof works against them with the auth headers, i.e.
+
+	go tool pprof -http=:8081 "https://admin.internal/v1/admin/debug/pprof/heap"
+
+*/
+
+const (
+	DIAGNOSTICS_PREFIX = "/v1/admin/debug"
+
+	// CPU profiles and execution traces are capped at MaxProfileSeconds
+	DefaultProfileSeconds = 30
+	DefaultTraceSeconds   = 1
+	MaxProfileSeconds     = 300
+
+	// a goroutine dump larger than this is cut short
+	MaxGoroutineDumpBytes = 64 << 20
+)
+
+var startedAt = time.Now()
+
+// ProfileInfo: a profile listed by Handler_PprofIndex
+type ProfileInfo struct {
+	Name  string
+	Count int
+	Href  string
+}
+
+// Handler_PprofIndex
+//   - the profiles Handler_Pprof serves with their current counts, plus the profile (cpu) and trace pseudo profiles
+func Handler_PprofIndex(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	profiles := pprof.Profiles()
+	infos := make([]ProfileInfo, 0, len(profiles)+2)
+	for _, p := range profiles {
+		infos = append(infos, ProfileInfo{Name: p.Name(), Count: p.Count(), Href: DIAGNOSTICS_PREFIX + "/pprof/" + p.Name()})
+	}
+	infos = append(infos,
+		ProfileInfo{Name: "profile", Href: DIAGNOSTICS_PREFIX + "/pprof/profile?seconds=" + strconv.Itoa(DefaultProfileSeconds)},
+		ProfileInfo{Name: "trace", Href: DIAGNOSTICS_PREFIX + "/pprof/trace?seconds=" + strconv.Itoa(DefaultTraceSeconds)},
+	)
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	apireturn.ApiJSONReturn(infos, apierrorkeys.NOError, &w)
+}
+
+// Handler_Pprof
+//   - serves the profile named by the {name} path param, like net/http/pprof
+//   - profile: a CPU profile of ?seconds=, trace: an execution trace of ?seconds=
+//   - any other runtime/pprof profile i.e. heap, goroutine, allocs, block, mutex, threadcreate, with ?debug=N for text and ?gc=1 to GC first
+func Handler_Pprof(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	name, err := apicontext.CtxGetPathParam(ctx, "name")
+	if err != nil {
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.RequestError, W: &w})
+		return
+	}
+	switch name {
+	case "profile":
+		serveTimed(w, r, ctx, name, DefaultProfileSeconds, func(buf *bytes.Buffer) (func(), error) {
+			if err := pprof.StartCPUProfile(buf); err != nil {
+				return nil, err
+			}
+			return pprof.StopCPUProfile, nil
+		})
+	case "trace":
+		serveTimed(w, r, ctx, name, DefaultTraceSeconds, func(buf *bytes.Buffer) (func(), error) {
+			if err := trace.Start(buf); err != nil {
+				return nil, err
+			}
+			return trace.Stop, nil
+		})
+	default:
+		p := pprof.Lookup(name)
+		if p == nil {
+			err := errors.New(apierrorkeys.RequestError + ": unknown profile " + name)
+			apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: err.Error(), Status: http.StatusNotFound, W: &w})
+			return
+		}
+		debugLevel, _ := strconv.Atoi(r.FormValue("debug"))
+		if name == "heap" && r.FormValue("gc") != "" {
+			runtime.GC()
+		}
+		setProfileHeaders(w, name, debugLevel > 0)
+		p.WriteTo(w, debugLevel)
+	}
+}
+
+// serveTimed runs the profile begun by start for ?seconds=, or until the client goes away, then writes it
+func serveTimed(w http.ResponseWriter, r *http.Request, ctx context.Context, name string, defaultSeconds int, start func(buf *bytes.Buffer) (func(), error)) {
+	seconds, err := strconv.Atoi(r.FormValue("seconds"))
+	if err != nil || seconds <= 0 {
+		seconds = defaultSeconds
+	}
+	if seconds > MaxProfileSeconds {
+		seconds = MaxProfileSeconds
+	}
+	// buffered so a failure to start can still be reported as json
+	var buf bytes.Buffer
+	stop, err := start(&buf)
+	if err != nil {
+		err = errors.Wrap(err, apierrorkeys.APIReqError)
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: err.Error(), Status: http.StatusConflict, W: &w})
+		return
+	}
+	timer := time.NewTimer(time.Duration(seconds) * time.Second)
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		timer.Stop()
+	}
+	stop()
+	if ctx.Err() != nil {
+		return
+	}
+	setProfileHeaders(w, name, false)
+	w.Write(buf.Bytes())
+}
+
+func setProfileHeaders(w http.ResponseWriter, name string, text bool) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if text {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+}
+
+// GoroutineGroup: goroutines in the same state with the same stack
+//   - Stack: function and file lines, call arguments and goroutine ids removed so identical stacks group
+type GoroutineGroup struct {
+	Count int
+	State string
+	Stack []string
+}
+
+// GoroutineDump: every goroutine grouped by state and stack, the largest groups first
+type GoroutineDump struct {
+	Total     int
+	Groups    []GoroutineGroup
+	Truncated bool
+}
+
+// Handler_Goroutines
+//   - a GoroutineDump, the first thing to read when the goroutine count climbs
+//   - ?min=N leaves out groups with fewer than N goroutines
+func Handler_Goroutines(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	minCount, _ := strconv.Atoi(r.FormValue("min"))
+	stacks, truncated := goroutineStacks()
+	dump := GroupGoroutines(stacks)
+	dump.Truncated = dump.Truncated || truncated
+	if minCount > 1 {
+		groups := dump.Groups[:0]
+		for _, g := range dump.Groups {
+			if g.Count >= minCount {
+				groups = append(groups, g)
+			}
+		}
+		dump.Groups = groups
+	}
+	apireturn.ApiJSONReturn(dump, apierrorkeys.NOError, &w)
+}
+
+// goroutineStacks is runtime.Stack of every goroutine, growing the buffer up to MaxGoroutineDumpBytes
+func goroutineStacks() ([]byte, bool) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n], false
+		}
+		if len(buf) >= MaxGoroutineDumpBytes {
+			return buf[:n], true
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// GroupGoroutines groups a runtime.Stack dump of every goroutine by state and stack
+func GroupGoroutines(stacks []byte) GoroutineDump {
+	var dump GoroutineDump
+	index := make(map[string]int)
+	for _, block := range strings.Split(strings.TrimSpace(string(stacks)), "\n\n") {
+		lines := strings.Split(block, "\n")
+		// goroutine 18 [chan receive, 2 minutes]:
+		header := lines[0]
+		stateStart, stateEnd := strings.Index(header, "["), strings.LastIndex(header, "]")
+		if !strings.HasPrefix(header, "goroutine ") || stateStart < 0 || stateEnd < stateStart {
+			// not a goroutine, i.e. a dump cut short by the buffer
+			dump.Truncated = true
+			continue
+		}
+		state, _, _ := strings.Cut(header[stateStart+1:stateEnd], ",")
+		stack := make([]string, 0, len(lines)-1)
+		for _, line := range lines[1:] {
+			stack = append(stack, normalizeFrame(line))
+		}
+		key := state + "\n" + strings.Join(stack, "\n")
+		i, ok := index[key]
+		if !ok {
+			i = len(dump.Groups)
+			index[key] = i
+			dump.Groups = append(dump.Groups, GoroutineGroup{State: state, Stack: stack})
+		}
+		dump.Groups[i].Count++
+		dump.Total++
+	}
+	sort.SliceStable(dump.Groups, func(i, j int) bool { return dump.Groups[i].Count > dump.Groups[j].Count })
+	return dump
+}
+
+// normalizeFrame drops what differs between goroutines sharing a stack, the call arguments and creator goroutine id
+func normalizeFrame(line string) string {
+	if strings.HasPrefix(line, "\t") {
+		return strings.TrimSpace(line)
+	}
+	if strings.HasPrefix(line, "created by ") {
+		line, _, _ = strings.Cut(line, " in goroutine ")
+		return line
+	}
+	if strings.HasSuffix(line, ")") {
+		if i := strings.LastIndex(line, "("); i > 0 {
+			return line[:i] + "(...)"
+		}
+	}
+	return line
+}
+
+// HeapStats: the heap fields of runtime.MemStats, in bytes unless a count
+type HeapStats struct {
+	HeapAlloc    uint64
+	HeapSys      uint64
+	HeapIdle     uint64
+	HeapInuse    uint64
+	HeapReleased uint64
+	HeapObjects  uint64
+	StackInuse   uint64
+	StackSys     uint64
+	TotalAlloc   uint64
+	Mallocs      uint64
+	Frees        uint64
+	Sys          uint64
+	NextGC       uint64
+}
+
+// Handler_HeapStats
+//   - HeapStats read now, a heap profile is at DIAGNOSTICS_PREFIX/pprof/heap
+func Handler_HeapStats(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	apireturn.ApiJSONReturn(HeapStats{
+		HeapAlloc:    ms.HeapAlloc,
+		HeapSys:      ms.HeapSys,
+		HeapIdle:     ms.HeapIdle,
+		HeapInuse:    ms.HeapInuse,
+		HeapReleased: ms.HeapReleased,
+		HeapObjects:  ms.HeapObjects,
+		StackInuse:   ms.StackInuse,
+		StackSys:     ms.StackSys,
+		TotalAlloc:   ms.TotalAlloc,
+		Mallocs:      ms.Mallocs,
+		Frees:        ms.Frees,
+		Sys:          ms.Sys,
+		NextGC:       ms.NextGC,
+	}, apierrorkeys.NOError, &w)
+}
+
+// GCStats
+//   - Pauses_ms: the most recent pauses, newest first, up to 32
+//   - PauseQuantiles_ms: min, 25%, 50%, 75% and max of the recorded pauses
+//   - GOGC, GOMEMLIMIT: the environment settings, empty when defaulted
+type GCStats struct {
+	NumGC             int64
+	LastGC            time.Time
+	PauseTotal_ms     float64
+	Pauses_ms         []float64
+	PauseQuantiles_ms []float64
+	GCCPUFraction     float64
+	NextGC            uint64
+	GOGC              string
+	GOMEMLIMIT        string
+}
+
+// Handler_GCStats
+//   - GCStats from debug.ReadGCStats and runtime.MemStats
+func Handler_GCStats(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	gcs := debug.GCStats{PauseQuantiles: make([]time.Duration, 5)}
+	debug.ReadGCStats(&gcs)
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stats := GCStats{
+		NumGC:         gcs.NumGC,
+		LastGC:        gcs.LastGC,
+		PauseTotal_ms: toMs(gcs.PauseTotal),
+		GCCPUFraction: ms.GCCPUFraction,
+		NextGC:        ms.NextGC,
+		GOGC:          os.Getenv("GOGC"),
+		GOMEMLIMIT:    os.Getenv("GOMEMLIMIT"),
+	}
+	for i, p := range gcs.Pause {
+		if i == 32 {
+			break
+		}
+		stats.Pauses_ms = append(stats.Pauses_ms, toMs(p))
+	}
+	if gcs.NumGC > 0 {
+		for _, q := range gcs.PauseQuantiles {
+			stats.PauseQuantiles_ms = append(stats.PauseQuantiles_ms, toMs(q))
+		}
+	}
+	apireturn.ApiJSONReturn(stats, apierrorkeys.NOError, &w)
+}
+
+func toMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// RuntimeSummary: what the process is and how it is doing, at a glance
+type RuntimeSummary struct {
+	Go_version  string
+	GOOS        string
+	GOARCH      string
+	NumCPU      int
+	GOMAXPROCS  int
+	Goroutines  int
+	CgoCalls    int64
+	Started_at  time.Time
+	Uptime_s    float64
+	HeapAlloc   uint64
+	Sys         uint64
+	NumGC       uint32
+	Module      string
+	Version     string
+	VCSRevision string
+}
+
+// Handler_RuntimeSummary
+//   - a RuntimeSummary read now, with the module version and vcs revision from the build info
+func Handler_RuntimeSummary(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	summary := RuntimeSummary{
+		Go_version: runtime.Version(),
+		GOOS:       runtime.GOOS,
+		GOARCH:     runtime.GOARCH,
+		NumCPU:     runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		CgoCalls:   runtime.NumCgoCall(),
+		Started_at: startedAt,
+		Uptime_s:   time.Since(startedAt).Seconds(),
+		HeapAlloc:  ms.HeapAlloc,
+		Sys:        ms.Sys,
+		NumGC:      ms.NumGC,
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		summary.Module = info.Main.Path
+		summary.Version = info.Main.Version
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				summary.VCSRevision = setting.Value
+			}
+		}
+	}
+	apireturn.ApiJSONReturn(summary, apierrorkeys.NOError, &w)
+}
@@ -2,11 +2,17 @@ package observability
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"runtime"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/rogue-syntax/rs-goapiserver/database"
+	"github.com/rogue-syntax/rs-goapiserver/metrics"
 	"github.com/rogue-syntax/rs-goapiserver/websockets"
 )
 
@@ -37,3 +43,55 @@ func Handler_GetUserSockets(w http.ResponseWriter, r *http.Request, ctx context.
 	infoSliceJson, _ := json.Marshal(infoSlice)
 	fmt.Fprintf(w, string(infoSliceJson))
 }
+
+// how long a scrape waits on the websocket manager for socket counts
+const SocketCountTimeout = 2 * time.Second
+
+var registerOnce sync.Once
+
+// RegisterCollectors
+//   - adds the database pool and websocket gauges to metrics.Default, safe to call more than once
+//   - the request, auth, event, mail and runtime metrics are always registered, see metrics/standard.go
+func RegisterCollectors() {
+	registerOnce.Do(func() {
+		dbStat := func(f func(st sql.DBStats) float64) func() []metrics.Sample {
+			return func() []metrics.Sample {
+				if database.DB == nil {
+					return nil
+				}
+				return []metrics.Sample{{Value: f(database.DB.Stats())}}
+			}
+		}
+		metrics.NewGaugeFunc("rs_db_max_open_connections", "Maximum open connections to the database.", dbStat(func(st sql.DBStats) float64 { return float64(st.MaxOpenConnections) }))
+		metrics.NewGaugeFunc("rs_db_open_connections", "Open connections, in use and idle.", dbStat(func(st sql.DBStats) float64 { return float64(st.OpenConnections) }))
+		metrics.NewGaugeFunc("rs_db_in_use_connections", "Connections in use.", dbStat(func(st sql.DBStats) float64 { return float64(st.InUse) }))
+		metrics.NewGaugeFunc("rs_db_idle_connections", "Idle connections.", dbStat(func(st sql.DBStats) float64 { return float64(st.Idle) }))
+		metrics.NewCounterFunc("rs_db_wait_count_total", "Times a connection was waited for.", dbStat(func(st sql.DBStats) float64 { return float64(st.WaitCount) }))
+		metrics.NewCounterFunc("rs_db_wait_duration_seconds_total", "Time spent waiting for connections.", dbStat(func(st sql.DBStats) float64 { return st.WaitDuration.Seconds() }))
+		metrics.NewCounterFunc("rs_db_max_idle_closed_total", "Connections closed by SetMaxIdleConns.", dbStat(func(st sql.DBStats) float64 { return float64(st.MaxIdleClosed) }))
+		metrics.NewCounterFunc("rs_db_max_idle_time_closed_total", "Connections closed by SetConnMaxIdleTime.", dbStat(func(st sql.DBStats) float64 { return float64(st.MaxIdleTimeClosed) }))
+		metrics.NewCounterFunc("rs_db_max_lifetime_closed_total", "Connections closed by SetConnMaxLifetime.", dbStat(func(st sql.DBStats) float64 { return float64(st.MaxLifetimeClosed) }))
+
+		metrics.NewGaugeFunc("rs_websocket_connections", "Open websocket connections, by user.", func() []metrics.Sample {
+			ctx, cancel := context.WithTimeout(context.Background(), SocketCountTimeout)
+			defer cancel()
+			counts, err := websockets.Channel_GetSocketCounts(ctx)
+			if err != nil {
+				return nil
+			}
+			samples := make([]metrics.Sample, 0, len(counts))
+			for user_id, count := range counts {
+				samples = append(samples, metrics.Sample{LabelValues: []string{strconv.Itoa(user_id)}, Value: float64(count)})
+			}
+			return samples
+		}, "user_id")
+	})
+}
+
+// Handler_Metrics
+//   - the Prometheus text format of metrics.Default, with the collectors of RegisterCollectors
+//   - behind RoleBaseReqVerifMiddleware, scrape with an api key in the kbxa and user-id headers and auth-mode=a
+func Handler_Metrics(w http.ResponseWriter, r *http.Request, ctx context.Context) {
+	RegisterCollectors()
+	metrics.Handler_Metrics(w, r, ctx)
+}
@@ -17,8 +17,21 @@ var RouteRoles = map[string][]int{
 	"/v1/test/testRoleAuthentication": {1},
 	"/v1/api":                         {1},
 	"/v1/api-data":                    {1},
+	"/v1/openapi.json":                {1},
+	"/v1/logs/query":                  {1},
+	"/v1/logs/timeline":               {1},
+	"/v1/errors/errLog":               {1},
+	"/v1/errors/reqLog":               {1},
 	"/v1/observe/logGoroutineCount":   {1},
 	"/v1/observe/getUserSockets":      {1},
+	"/v1/observe/metrics":             {1},
+	"/v1/admin/debug/pprof":           {1},
+	"/v1/admin/debug/pprof/{name}":    {1},
+	"/v1/admin/debug/goroutines":      {1},
+	"/v1/admin/debug/heap":            {1},
+	"/v1/admin/debug/gc":              {1},
+	"/v1/admin/debug/runtime":         {1},
+	"/v1/admin/debug/health":          {1},
 }
 
 func TestRoleAuth(w http.ResponseWriter, r *http.Request, ctx context.Context) {
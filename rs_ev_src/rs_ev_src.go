@@ -1,6 +1,7 @@
 package rs_ev_src
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
@@ -13,6 +14,9 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/metrics"
+	"github.com/rogue-syntax/rs-goapiserver/rs_go_requestlogger"
+	"github.com/rogue-syntax/rs-goapiserver/tracing"
 )
 
 // need to differentiate propagated error to application callers
@@ -27,6 +31,7 @@ const (
 	ERRORFLAG_STREAM_EVENT_1 = "STREAM_1"
 	ERRORFLAG_STREAM_EVENT_2 = "STREAM_2"
 	ERRORFLAG_STORE_TO_SQL   = "STORE_TO_SQL"
+	ERRORFLAG_SHUTDOWN       = "SHUTDOWN"
 )
 
 var InjectedStreamer EVEventStreamer
@@ -132,6 +137,12 @@ type ISerializableEvent interface {
 type IEVAction[T any, R any] interface {
 	Do(data T) (R, error)
 }
+
+// IEVActionContext
+//   - optional, an action that also implements DoContext is run with the caller's context by DoEVEventActionContext
+type IEVActionContext[T any, R any] interface {
+	DoContext(ctx context.Context, data T) (R, error)
+}
 type UnixTimeMilliseconds int64
 
 // The action event class
@@ -259,16 +270,49 @@ type EVEventExecError struct {
 //   - StreamError: error from streaming the event : check for nil to see if the event was streamed successfully
 //   - StoreError: error from storing the event to the database : check for nil to see if the event was stored successfully
 func DoEVEventAction[DATATYPE any, CONTEXTTYPE any, RETURNTYPE any](e *EVEvent[DATATYPE, CONTEXTTYPE, RETURNTYPE]) (res RETURNTYPE, evError EVEventExecError) {
+	return DoEVEventActionContext(context.Background(), e)
+}
+
+// DoEVEventActionContext
+//   - DoEVEventAction bound to ctx, i.e. the request context handed to a handler
+//   - if ctx is already done the action is not run and ActionError wraps ctx.Err()
+//   - the action gets ctx if it implements IEVActionContext, otherwise Do is called
+//   - streaming and storing the event are not cancelled by ctx so the outcome is always recorded
+//   - an event set with NO_REQUEST_ID takes the Req_id of ctx, and ActionError carries the event's Req_id,
+//     see apierrors.ReqIder
+func DoEVEventActionContext[DATATYPE any, CONTEXTTYPE any, RETURNTYPE any](ctx context.Context, e *EVEvent[DATATYPE, CONTEXTTYPE, RETURNTYPE]) (res RETURNTYPE, evError EVEventExecError) {
+	if e.Req_id == NO_REQUEST_ID {
+		e.Req_id, _ = rs_go_requestlogger.CtxGetReqId(ctx)
+	}
+	if ctx.Err() != nil {
+		evError.ActionError = withReqId(errors.Wrap(ctx.Err(), ERRORFLAG_ACTION), e.Req_id)
+		return res, evError
+	}
+	if !beginEVEvent() {
+		evError.ActionError = withReqId(errors.New(ERRORFLAG_SHUTDOWN), e.Req_id)
+		return res, evError
+	}
+	defer inFlightEvents.Done()
+	ctx, span := tracing.Start(ctx, "event "+e.Action_name, tracing.KIND_INTERNAL)
+	defer span.End()
+	span.SetAttribute("ev_id", e.Ev_id.String())
+	span.SetAttribute("req_id", e.Req_id)
 	var err error = nil
 	e.Timestamp = time.Now()
 	e.Date_time = e.Timestamp.Format(DATEFORMAT)
 	//take action
-	res, err = e.Action.Do(e.Data)
+	if ctxAction, ok := e.Action.(IEVActionContext[DATATYPE, RETURNTYPE]); ok {
+		res, err = ctxAction.DoContext(ctx, e.Data)
+	} else {
+		res, err = e.Action.Do(e.Data)
+	}
+	metrics.EVActionsTotal.Inc(e.Action_name, metrics.Result(err))
+	span.RecordError(err)
 	//action is not successful?
 	if err != nil {
 		e.Success = false
 		e.ErrMsg = err.Error()
-		evError.ActionError = errors.Wrap(err, ERRORFLAG_ACTION)
+		evError.ActionError = withReqId(errors.Wrap(err, ERRORFLAG_ACTION), e.Req_id)
 	} else {
 		//action was succesful!
 		e.Success = true
@@ -300,14 +344,33 @@ func DoEVEventAction[DATATYPE any, CONTEXTTYPE any, RETURNTYPE any](e *EVEvent[D
 		err2 := errors.Wrap(err, ERRORFLAG_STREAM_EVENT_1)
 		evError.StreamError = err2
 	}
-	err = StoreEV(eInterface)
+	// not cancelled by ctx, but stored under the event's span
+	err = StoreEVContext(tracing.ContextWithSpan(context.Background(), span), eInterface)
 	if err != nil {
 		err2 := errors.Wrap(err, ERRORFLAG_STORE_TO_SQL)
 		evError.StoreError = err2
 	}
+	span.SetAttribute("success", e.Success)
 	return res, evError
 }
 
+// reqIdError is an action error with the Req_id of its event, it satisfies apierrors.ReqIder
+type reqIdError struct {
+	error
+	req_id string
+}
+
+func (re reqIdError) Unwrap() error { return re.error }
+func (re reqIdError) Cause() error  { return re.error }
+func (re reqIdError) ReqId() string { return re.req_id }
+
+func withReqId(err error, req_id string) error {
+	if req_id == NO_REQUEST_ID {
+		return err
+	}
+	return reqIdError{error: err, req_id: req_id}
+}
+
 // MAP OF ACTION NAMES TO ACTION HANDLERS
 // HANDLERS ARE : ANONYMOUS FUNCTIONS THAT WRAP DoEVEventAction
 // DoEVEventAction TAKES THE ARGUMENT TYPE AND THE EVEvent WHICH CONTAIN THE ACTION AND ITS DATA
@@ -449,6 +512,11 @@ func LoadFromJSONFile() ([]EVEventSerial, error) {
 }
 
 func StoreEV(e *SerializableEvent) error {
+	return StoreEVContext(context.Background(), e)
+}
+
+// StoreEVContext is StoreEV with the insert traced under the span in ctx
+func StoreEVContext(ctx context.Context, e *SerializableEvent) error {
 	dataJson, err := json.Marshal(&e.Data)
 	if err != nil {
 		return err
@@ -459,7 +527,7 @@ func StoreEV(e *SerializableEvent) error {
 		return err
 	}
 
-	_, err = DBCONN.Exec(`
+	_, err = DBCONN.ExecContext(ctx, `
 			INSERT INTO EVEvents (Ev_id, Ev_type, Action_name, Data, MetaData, CalledAt, Timestamp, Date_time, Success, Version, ErrMsg, Req_id, Attempt, Schedule_type)
 			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?,?)`,
 		e.Ev_id,
@@ -481,6 +549,32 @@ func StoreEV(e *SerializableEvent) error {
 	return err
 }
 
+// LoadByReqIdContext
+//   - the stored events with a Req_id, oldest first, i.e. the events a request produced
+//   - nil if the package was not INIT with a database
+func LoadByReqIdContext(ctx context.Context, req_id string) ([]EVEventSerial, error) {
+	if DBCONN == nil {
+		return nil, nil
+	}
+	rows, err := DBCONN.QueryContext(ctx, `
+			SELECT Ev_id, Ev_type, Action_name, Data, MetaData, CalledAt, Timestamp, Date_time, Success, Version, ErrMsg, Req_id, Attempt, Schedule_type
+			FROM EVEvents WHERE Req_id = ? ORDER BY CalledAt`, req_id)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var events []EVEventSerial
+	for rows.Next() {
+		var ev EVEventSerial
+		err = rows.Scan(&ev.Ev_id, &ev.Ev_type, &ev.Action_name, &ev.Data, &ev.MetaData, &ev.CalledAt, &ev.Timestamp, &ev.Date_time, &ev.Success, &ev.Version, &ev.ErrMsg, &ev.Req_id, &ev.Attempt, &ev.Schedule_type)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		events = append(events, ev)
+	}
+	return events, errors.WithStack(rows.Err())
+}
+
 func streamEVEvent(ev EVEvent[interface{}, interface{}, interface{}]) error {
 
 	return nil
@@ -503,7 +597,8 @@ CREATE TABLE EVEvents (
 	Req_id char(36),
 	Attempt TINYINT DEFAULT 0,
 	Schedule_type tinyint(4) NOT NULL DEFAULT 0,
-  PRIMARY KEY (Ev_id, Date_time)
+  PRIMARY KEY (Ev_id, Date_time),
+  KEY Req_id (Req_id)
 ) ENGINE = INNODB,
   CHARACTER SET utf8mb4,
   COLLATE utf8mb4_general_ci
@@ -520,6 +615,64 @@ type EVEventStreamer interface {
 	StreamEV(ev *SerializableEvent) error
 }
 
+// EVEventStreamCloser
+//
+// an injected EVEventStreamer that buffers events can also implement EVEventStreamCloser,
+// Shutdown will call Close on it after all in flight events have finished streaming
+type EVEventStreamCloser interface {
+	Close() error
+}
+
+var drainMutex sync.Mutex
+var draining bool
+var inFlightEvents sync.WaitGroup
+
+// beginEVEvent registers an in flight event, returns false once Shutdown has started
+func beginEVEvent() bool {
+	drainMutex.Lock()
+	defer drainMutex.Unlock()
+	if draining {
+		return false
+	}
+	inFlightEvents.Add(1)
+	return true
+}
+
+// Shutdown
+//
+// stops accepting new events, DoEVEventAction returns an ERRORFLAG_SHUTDOWN ActionError from here on
+//
+// waits for in flight events to finish their action, stream and store, or for ctx to be done
+//
+// then closes the InjectedStreamer if it implements EVEventStreamCloser
+func Shutdown(ctx context.Context) error {
+	drainMutex.Lock()
+	draining = true
+	drainMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		inFlightEvents.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), ERRORFLAG_SHUTDOWN)
+	}
+
+	// no event is mid write once the file lock is held
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+	if closer, ok := InjectedStreamer.(EVEventStreamCloser); ok {
+		err := closer.Close()
+		if err != nil {
+			return errors.Wrap(err, ERRORFLAG_SHUTDOWN)
+		}
+	}
+	return nil
+}
+
 type EVEventSubscription interface {
 	Subscriber(ev *SerializableEvent) error
 }
@@ -11,7 +11,8 @@ CREATE TABLE EVEvents (
 	Version DECIMAL(5,3),
 	ErrMsg CHAR(255),
 	Req_Id char(36),
-  PRIMARY KEY (Ev_id, Date_time)
+  PRIMARY KEY (Ev_id, Date_time),
+  KEY Req_id (Req_id)
 ) ENGINE = INNODB,
   CHARACTER SET utf8mb4,
   COLLATE utf8mb4_general_ci
@@ -0,0 +1,230 @@
+package rs_go_requestlogger
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Redaction of sensitive request values before they are logged
+/*
+
+	RouteHandler copies the request into RSRequestLogger.RequestVars, GlobalRedactionRules (merged with the
+	route's RouteDef.Redaction) is applied to that copy before the log is handed to any RequestLogStreamer.
+	The request itself is never changed.
+
+	  - Headers: header names, case insensitive, the whole value is masked
+	  - Cookies: cookie names
+	  - FormKeys: keys in PostForm, in the query of URL and RequestURI, and in a form encoded body
+	  - JSONPaths: dot separated paths into a JSON body i.e. "user.password", "*" matches any key or array index,
+	    keys match case insensitively like encoding/json does
+	  - MaxBodyBytes: how much of the body is captured, 0 for DEFAULT_MAX_BODY_BYTES, REDACT_NO_BODY to capture none
+
+	A JSON body cut off at MaxBodyBytes can not be parsed, so it is replaced by a note instead of being logged.
+	Multipart bodies are never logged.
+
+	Change GlobalRedactionRules before serving, i.e.
+	rs_go_requestlogger.GlobalRedactionRules = rs_go_requestlogger.DefaultRedactionRules().Merge(&rs_go_requestlogger.RedactionRules{FormKeys: []string{"ssn"}})
+
+*/
+
+const (
+	REDACTED               = "REDACTED"
+	DEFAULT_MAX_BODY_BYTES = 64 * 1024
+	REDACT_NO_BODY         = -1
+)
+
+/*
+RedactionRules: what to mask in a request log, see the top of this file
+*/
+type RedactionRules struct {
+	Headers      []string
+	Cookies      []string
+	FormKeys     []string
+	JSONPaths    []string
+	MaxBodyBytes int
+}
+
+// DefaultRedactionRules
+//   - session, api key and csrf credentials, the password and token fields of the signin and signup endpoints,
+//     and the refresh_token of /v1/app/token/refresh, names match case insensitively so it covers Refresh_token
+func DefaultRedactionRules() RedactionRules {
+	return RedactionRules{
+		Headers:   []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "kbxa", "kbxb", "X-CSRF-Token"},
+		Cookies:   []string{"kbxs", "kbxc"},
+		FormKeys:  []string{"pw", "password", "NewPw", "PwToken", "Token", "refresh_token"},
+		JSONPaths: []string{"pw", "password", "NewPw", "PwToken", "Token", "refresh_token"},
+	}
+}
+
+// GlobalRedactionRules apply to every route, a RouteDef.Redaction adds to them
+var GlobalRedactionRules = DefaultRedactionRules()
+
+// Merge returns the rules plus those in override, a non zero override MaxBodyBytes replaces the limit
+func (rules RedactionRules) Merge(override *RedactionRules) RedactionRules {
+	if override == nil {
+		return rules
+	}
+	merged := RedactionRules{
+		Headers:      append(append([]string(nil), rules.Headers...), override.Headers...),
+		Cookies:      append(append([]string(nil), rules.Cookies...), override.Cookies...),
+		FormKeys:     append(append([]string(nil), rules.FormKeys...), override.FormKeys...),
+		JSONPaths:    append(append([]string(nil), rules.JSONPaths...), override.JSONPaths...),
+		MaxBodyBytes: rules.MaxBodyBytes,
+	}
+	if override.MaxBodyBytes != 0 {
+		merged.MaxBodyBytes = override.MaxBodyBytes
+	}
+	return merged
+}
+
+// BodyLimit is the number of body bytes to capture, -1 for none
+func (rules RedactionRules) BodyLimit() int {
+	if rules.MaxBodyBytes == 0 {
+		return DEFAULT_MAX_BODY_BYTES
+	}
+	if rules.MaxBodyBytes < 0 {
+		return REDACT_NO_BODY
+	}
+	return rules.MaxBodyBytes
+}
+
+// Apply
+//   - masks rv in place, Header and PostForm are copied first so the request's own maps are not touched
+//   - contentType is the request's Content-Type, truncated is true if the body was cut off at BodyLimit
+func (rules RedactionRules) Apply(rv *RequestVars, contentType string, truncated bool) {
+	if rv.Header != nil {
+		rv.Header = rv.Header.Clone()
+		for name := range rv.Header {
+			if containsFold(rules.Headers, name) {
+				rv.Header[name] = []string{REDACTED}
+			}
+		}
+	}
+	for name := range rv.Cookies {
+		if containsFold(rules.Cookies, name) {
+			rv.Cookies[name] = REDACTED
+		}
+	}
+	if rv.PostForm != nil {
+		rv.PostForm = redactValues(rv.PostForm, rules.FormKeys)
+	}
+	rv.URL = redactQuery(rv.URL, rules.FormKeys)
+	rv.RequestURI = redactQuery(rv.RequestURI, rules.FormKeys)
+	rv.Body = rules.redactBody(rv.Body, contentType, truncated)
+}
+
+func (rules RedactionRules) redactBody(body string, contentType string, truncated bool) string {
+	if body == "" {
+		return body
+	}
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		return "[multipart body not logged]"
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(body)
+		if err != nil {
+			return "[form body not logged: " + err.Error() + "]"
+		}
+		return redactValues(values, rules.FormKeys).Encode()
+	case strings.Contains(mediaType, "json") || looksLikeJSON(body):
+		if truncated {
+			return "[json body over " + strconv.Itoa(rules.BodyLimit()) + " bytes not logged]"
+		}
+		return redactJSON(body, rules.JSONPaths)
+	}
+	return body
+}
+
+func looksLikeJSON(body string) bool {
+	trimmed := strings.TrimSpace(body)
+	return strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")
+}
+
+// redactJSON masks paths in a JSON document, a body that is not valid JSON is returned as is
+func redactJSON(body string, paths []string) string {
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return body
+	}
+	for _, path := range paths {
+		doc = redactPath(doc, strings.Split(path, "."))
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return body
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
+
+func redactPath(node interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return REDACTED
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, child := range n {
+			if path[0] == "*" || strings.EqualFold(path[0], key) {
+				n[key] = redactPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range n {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				n[i] = redactPath(child, path[1:])
+			}
+		}
+	}
+	return node
+}
+
+func redactValues(values url.Values, keys []string) url.Values {
+	out := make(url.Values, len(values))
+	for key, vals := range values {
+		if containsFold(keys, key) {
+			out[key] = []string{REDACTED}
+			continue
+		}
+		out[key] = append([]string(nil), vals...)
+	}
+	return out
+}
+
+// redactQuery masks keys in the query of a url or request uri, it is returned as is if nothing matches
+func redactQuery(rawURL string, keys []string) string {
+	i := strings.Index(rawURL, "?")
+	if i < 0 {
+		return rawURL
+	}
+	values, err := url.ParseQuery(rawURL[i+1:])
+	if err != nil {
+		return rawURL[:i] + "?[query not logged]"
+	}
+	matched := false
+	for key := range values {
+		if containsFold(keys, key) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return rawURL
+	}
+	return rawURL[:i] + "?" + redactValues(values, keys).Encode()
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
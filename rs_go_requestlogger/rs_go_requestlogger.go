@@ -2,8 +2,10 @@ package rs_go_requestlogger
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -25,11 +27,36 @@ type RequestVars struct {
 	Body       string
 }
 
+// ResponseVars: the outcome of the request, filled in by RouteHandler once the handler returns
+type ResponseVars struct {
+	Status      int
+	Bytes       int64
+	Duration_ms float64
+	Panic       string
+}
+
+func ResponseVarsFrom(status int, bytes int64, duration time.Duration, panicVal interface{}) ResponseVars {
+	rv := ResponseVars{
+		Status:      status,
+		Bytes:       bytes,
+		Duration_ms: float64(duration) / float64(time.Millisecond),
+	}
+	if panicVal != nil {
+		rv.Panic = fmt.Sprint(panicVal)
+	}
+	return rv
+}
+
+// RSRequestLogger: the request log entry
+//   - Time: when the request arrived, User_id: the authenticated user, 0 if none
 type RSRequestLogger struct {
-	Endpoint    string
-	RequestVars RequestVars
-	ErrorLogs   []string
-	Req_id      string
+	Time         time.Time
+	User_id      int
+	Endpoint     string
+	RequestVars  RequestVars
+	ResponseVars ResponseVars
+	ErrorLogs    []string
+	Req_id       string
 }
 
 type keyType string
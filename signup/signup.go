@@ -62,8 +62,8 @@ type TokenValidationResponse struct {
 }
 
 type PWSubmission struct {
-	NewPw   string
-	PwToken string
+	NewPw   string `validate:"required"`
+	PwToken string `validate:"required"`
 	NewUser bool
 }
 
@@ -107,8 +107,12 @@ func verifyEmail(emailString *string) bool {
 }
 
 func CheckEmailUnique(email_value string) (bool, error) {
+	return CheckEmailUniqueContext(context.Background(), email_value)
+}
+
+func CheckEmailUniqueContext(ctx context.Context, email_value string) (bool, error) {
 	var count *int
-	err := database.DB.Get(&count, "SELECT COUNT(*) FROM user_base WHERE user_email = ?", email_value)
+	err := database.DB.GetContext(ctx, &count, "SELECT COUNT(*) FROM user_base WHERE user_email = ?", email_value)
 	if err != nil {
 		return false, err
 	}
@@ -147,6 +151,8 @@ var PWVerifEP_handler_ApiReq apimaster.ApiReqDef = apimaster.ApiReqDef{
 	Input:         apimaster.MakeStructDescriptorMap(new(PWSubmission)),
 	OutputData:    apimaster.MakeStructDescriptorMap(new(PWValidationResponse)),
 	OutputWrapper: apimaster.MakeStructDescriptorMap(new(apireturn.JsonReturn)),
+	InputType:     apimaster.TypeOf[PWSubmission](),
+	OutputType:    apimaster.TypeOf[PWValidationResponse](),
 }
 
 func PWVerifEP_handler(w http.ResponseWriter, r *http.Request, ctx context.Context) {
@@ -168,7 +174,7 @@ func PWVerifEP_handler(w http.ResponseWriter, r *http.Request, ctx context.Conte
 	currentTime := time.Now()
 	currentTimeUnix := currentTime.Unix()
 	//Clear expired PW Verifications
-	_, err = database.DB.Exec("call clearExpiredPWVerification(?)", currentTimeUnix)
+	_, err = database.DB.ExecContext(ctx, "call clearExpiredPWVerification(?)", currentTimeUnix)
 	if err != nil {
 		pwValidationResponse.Trace = 1
 		pwValidationResponse.ErrorMsg = err.Error()
@@ -178,7 +184,7 @@ func PWVerifEP_handler(w http.ResponseWriter, r *http.Request, ctx context.Conte
 	}
 	//check to see if PW Verificatiopn record with supplied token exists and is not expired
 	var passwordReset PasswordReset
-	err = database.DB.Get(&passwordReset, "SELECT * FROM password_reset WHERE password_reset_token = ? AND password_reset_expires > ?;", pwSubmission.PwToken, currentTimeUnix)
+	err = database.DB.GetContext(ctx, &passwordReset, "SELECT * FROM password_reset WHERE password_reset_token = ? AND password_reset_expires > ?;", pwSubmission.PwToken, currentTimeUnix)
 	//err = database.DB.Get(&passwordReset, "SELECT * FROM main.password_reset WHERE password_reset_token = ? ;", pwSubmission.PwToken)
 	if err != nil {
 		pwValidationResponse.Trace = 2
@@ -213,7 +219,7 @@ func PWVerifEP_handler(w http.ResponseWriter, r *http.Request, ctx context.Conte
 		return
 	}
 	//set pw for user in db
-	_, err = database.DB.Exec("INSERT INTO user_auth (user_id, user_pw) VALUES (?, ?) ON DUPLICATE KEY UPDATE user_pw = ?;", *passwordReset.User_id, pwHash, pwHash)
+	_, err = database.DB.ExecContext(ctx, "INSERT INTO user_auth (user_id, user_pw) VALUES (?, ?) ON DUPLICATE KEY UPDATE user_pw = ?;", *passwordReset.User_id, pwHash, pwHash)
 
 	if err != nil {
 		pwValidationResponse.Trace = 6
@@ -258,7 +264,7 @@ func EmailVerifEP_handler(w http.ResponseWriter, r *http.Request, ctx context.Co
 	currentTimeUnix := currentTime.Unix()
 	pwExpTimeUnix := pwExpTime.Unix()
 
-	_, err = database.DB.Exec("call clearExpiredEMailVerification(?)", currentTimeUnix)
+	_, err = database.DB.ExecContext(ctx, "call clearExpiredEMailVerification(?)", currentTimeUnix)
 	if err != nil {
 		validationResp.Trace = 1
 		validationResp.ErrorMsg = err.Error()
@@ -267,7 +273,7 @@ func EmailVerifEP_handler(w http.ResponseWriter, r *http.Request, ctx context.Co
 	}
 
 	var emailVerification []EmailVerification
-	err = database.DB.Select(&emailVerification, "SELECT * FROM email_verification WHERE email_verif_token = ? && email_verif_expires > ? ", tokenValidation.Token, currentTimeUnix)
+	err = database.DB.SelectContext(ctx, &emailVerification, "SELECT * FROM email_verification WHERE email_verif_token = ? && email_verif_expires > ? ", tokenValidation.Token, currentTimeUnix)
 
 	if err != nil {
 		validationResp.Trace = 2
@@ -291,7 +297,7 @@ func EmailVerifEP_handler(w http.ResponseWriter, r *http.Request, ctx context.Co
 
 	emailVerif := emailVerification[0]
 	//createNewUserFromEmail : email:string, pwRequestTokem:string, time exp: int )
-	_, err = database.DB.Exec("call createNewUserFromEmail(?,?,?)", emailVerif.Email_address, pwToken, pwExpTimeUnix)
+	_, err = database.DB.ExecContext(ctx, "call createNewUserFromEmail(?,?,?)", emailVerif.Email_address, pwToken, pwExpTimeUnix)
 	if err != nil {
 		validationResp.Trace = 5
 		apireturn.ApiJSONReturn(err.Error(), apierrorkeys.APIReqError, &w)
@@ -315,16 +321,16 @@ func Handler_AppSignUp(w http.ResponseWriter, r *http.Request, ctx context.Conte
 
 	err := decoder.Decode(&emailSubmission)
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.SystemError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.SystemError, W: &w})
 		return
 	}
 
 	// verify email syntax and sanitize
 	// check email unique
 	//checkEmailUnique
-	isUnique, err := CheckEmailUnique(emailSubmission.EmailAddress)
+	isUnique, err := CheckEmailUniqueContext(ctx, emailSubmission.EmailAddress)
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.EmailTaken, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.EmailTaken, W: &w})
 		return
 	}
 
@@ -348,7 +354,7 @@ func Handler_AppSignUp(w http.ResponseWriter, r *http.Request, ctx context.Conte
 		expTime := time.Now().Add(15 * time.Minute)
 		expTimeUnix := expTime.Unix()
 		// log email verif record to db
-		_, err = database.DB.Exec("INSERT INTO email_verification ( email_address, email_verif_token, email_verif_expires) VALUES ( ?,?,? );", emailSubmission.EmailAddress, token, expTimeUnix)
+		_, err = database.DB.ExecContext(ctx, "INSERT INTO email_verification ( email_address, email_verif_token, email_verif_expires) VALUES ( ?,?,? );", emailSubmission.EmailAddress, token, expTimeUnix)
 		if err != nil {
 			isAvailable.Trace = 3
 			isAvailable.ErrorMsg = err.Error()
@@ -365,7 +371,7 @@ func Handler_AppSignUp(w http.ResponseWriter, r *http.Request, ctx context.Conte
 			return
 		}
 
-		err = mail.SendMailSingle(emailSubmission.EmailAddress, emailBody, global.EnvVars.ServiceName+" Support", global.EnvVars.SMTPSupportUserName, global.EnvVars.ServiceName+" email verification")
+		err = mail.SendMailSingleContext(ctx, emailSubmission.EmailAddress, emailBody, global.EnvVars.ServiceName+" Support", global.EnvVars.SMTPSupportUserName, global.EnvVars.ServiceName+" email verification")
 		// send verification email
 		if err != nil {
 			isAvailable.Trace = 5
@@ -386,16 +392,16 @@ func Handler_RequestPasswordReset(w http.ResponseWriter, r *http.Request, ctx co
 
 	err := decoder.Decode(&emailSubmission)
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.SystemError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.SystemError, W: &w})
 		return
 	}
 
 	// verify email syntax and sanitize
 	// check email unique
 	//checkEmailUnique
-	isUnique, err := CheckEmailUnique(emailSubmission.EmailAddress)
+	isUnique, err := CheckEmailUniqueContext(ctx, emailSubmission.EmailAddress)
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.EmailTaken, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.EmailTaken, W: &w})
 		return
 	}
 
@@ -419,7 +425,7 @@ func Handler_RequestPasswordReset(w http.ResponseWriter, r *http.Request, ctx co
 		expTime := time.Now().Add(15 * time.Minute)
 		expTimeUnix := expTime.Unix()
 		// log email verif record to db
-		_, err = database.DB.Exec("INSERT INTO main.email_verification ( email_address, email_verif_token, email_verif_expires) VALUES ( ?,?,? );", emailSubmission.EmailAddress, token, expTimeUnix)
+		_, err = database.DB.ExecContext(ctx, "INSERT INTO main.email_verification ( email_address, email_verif_token, email_verif_expires) VALUES ( ?,?,? );", emailSubmission.EmailAddress, token, expTimeUnix)
 		if err != nil {
 			isAvailable.Trace = 3
 			isAvailable.ErrorMsg = err.Error()
@@ -436,7 +442,7 @@ func Handler_RequestPasswordReset(w http.ResponseWriter, r *http.Request, ctx co
 			apireturn.ApiJSONReturn(isAvailable, apierrorkeys.APIReqError, &w)
 			return
 		}
-		err = mail.SendMailSingle(emailSubmission.EmailAddress, emailBody, "KIBANX Support", global.EnvVars.SMTPSupportUserName, "KIBANX email verification")
+		err = mail.SendMailSingleContext(ctx, emailSubmission.EmailAddress, emailBody, "KIBANX Support", global.EnvVars.SMTPSupportUserName, "KIBANX email verification")
 		// send verification email
 		if err != nil {
 			isAvailable.Trace = 5
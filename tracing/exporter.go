@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// Exporter
+//   - receives every span as it ends, must be safe to call from any goroutine and should not block for long
+//   - an Exporter that also implements io.Closer is closed by Shutdown, i.e. to flush a batch to a collector
+type Exporter interface {
+	ExportSpan(span SpanData)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// SetExporter turns tracing on, nil turns it off
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	exporter = e
+	exporterMu.Unlock()
+}
+
+func getExporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+	return exporter
+}
+
+// Shutdown turns tracing off and closes the exporter if it is an io.Closer, ctx bounds the close
+func Shutdown(ctx context.Context) error {
+	exporterMu.Lock()
+	e := exporter
+	exporter = nil
+	exporterMu.Unlock()
+	closer, ok := e.(io.Closer)
+	if !ok {
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() { done <- closer.Close() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WriterExporter writes each span as a line of JSON, for local use
+type WriterExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	c   io.Closer
+}
+
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{enc: json.NewEncoder(w)}
+}
+
+// NewStdoutExporter writes spans to stdout
+func NewStdoutExporter() *WriterExporter {
+	return NewWriterExporter(os.Stdout)
+}
+
+// NewFileExporter appends spans to the file at path, Close closes the file
+func NewFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := NewWriterExporter(f)
+	e.c = f
+	return e, nil
+}
+
+func (e *WriterExporter) ExportSpan(span SpanData) {
+	e.mu.Lock()
+	e.enc.Encode(span)
+	e.mu.Unlock()
+}
+
+func (e *WriterExporter) Close() error {
+	if e.c == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.c.Close()
+}
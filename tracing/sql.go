@@ -0,0 +1,199 @@
+package tracing
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MaxStatementLength caps the db.statement attribute, statements hold placeholders not values
+var MaxStatementLength = 1024
+
+// WrapConnector
+//   - traces the queries and execs of c's connections made with a context that holds a span,
+//     i.e. sqlx.NewDb(sql.OpenDB(tracing.WrapConnector(connector, "mysql")), "mysql")
+//   - calls without a context, or outside a request, are not traced
+func WrapConnector(c driver.Connector, system string) driver.Connector {
+	return &tracedConnector{Connector: c, system: system}
+}
+
+type tracedConnector struct {
+	driver.Connector
+	system string
+}
+
+func (tc *tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := tc.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{Conn: conn, system: tc.system}, nil
+}
+
+// startQuery starts a db span, the caller ends it unless the driver skipped the call
+func startQuery(ctx context.Context, system string, query string) *Span {
+	op := strings.ToUpper(strings.SplitN(strings.TrimSpace(query), " ", 2)[0])
+	_, span := StartChild(ctx, "db "+op, KIND_CLIENT)
+	if span != nil {
+		statement := query
+		if len(statement) > MaxStatementLength {
+			statement = statement[:MaxStatementLength]
+		}
+		span.SetAttribute("db.system", system)
+		span.SetAttribute("db.operation", op)
+		span.SetAttribute("db.statement", statement)
+	}
+	return span
+}
+
+// endQuery ends span, a driver.ErrSkip means database/sql retries another way so nothing happened
+func endQuery(span *Span, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	span.RecordError(err)
+	span.End()
+}
+
+// tracedConn passes every optional driver interface on to the wrapped conn
+type tracedConn struct {
+	driver.Conn
+	system string
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{Stmt: stmt, query: query, system: c.system}, nil
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startQuery(ctx, c.system, query)
+	rows, err := qc.QueryContext(ctx, query, args)
+	endQuery(span, err)
+	return rows, err
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	span := startQuery(ctx, c.system, query)
+	res, err := ec.ExecContext(ctx, query, args)
+	endQuery(span, err)
+	return res, err
+}
+
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bt, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bt.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if rs, ok := c.Conn.(driver.SessionResetter); ok {
+		return rs.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *tracedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type tracedStmt struct {
+	driver.Stmt
+	query  string
+	system string
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	span := startQuery(ctx, s.system, s.query)
+	var rows driver.Rows
+	var err error
+	if sq, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = sq.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedToValues(args); err == nil {
+			rows, err = s.Stmt.Query(values)
+		}
+	}
+	endQuery(span, err)
+	return rows, err
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	span := startQuery(ctx, s.system, s.query)
+	var res driver.Result
+	var err error
+	if se, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = se.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedToValues(args); err == nil {
+			res, err = s.Stmt.Exec(values)
+		}
+	}
+	endQuery(span, err)
+	return res, err
+}
+
+func (s *tracedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (s *tracedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if cc, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return cc.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// namedToValues is what database/sql does for a driver without the context interfaces
+func namedToValues(named []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = nv.Value
+	}
+	return values, nil
+}
@@ -0,0 +1,322 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing
+/*
+
+	Spans in the OpenTelemetry model, propagated with the W3C traceparent header, with no client library.
+
+	Nothing is recorded until SetExporter is called, Start then returns a nil *Span whose methods do nothing,
+	so instrumented code never checks whether tracing is on.
+
+	Start makes a child of the span in ctx, or of a remote parent put in ctx by Extract, or a new trace.
+	A remote parent that is not sampled is propagated but not recorded.
+	Inject writes the traceparent of the span in ctx to outgoing headers.
+
+	Spans are exported as they End, see Exporter and the stdout / file WriterExporter in exporter.go.
+	database/sql calls are traced with WrapConnector, see sql.go.
+
+*/
+
+const (
+	TRACEPARENT_HEADER = "traceparent"
+	TRACESTATE_HEADER  = "tracestate"
+)
+
+type SpanKind string
+
+const (
+	KIND_INTERNAL SpanKind = "internal"
+	KIND_SERVER   SpanKind = "server"
+	KIND_CLIENT   SpanKind = "client"
+)
+
+type StatusCode string
+
+const (
+	STATUS_UNSET StatusCode = "unset"
+	STATUS_OK    StatusCode = "ok"
+	STATUS_ERROR StatusCode = "error"
+)
+
+const flagSampled byte = 0x01
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+func (s SpanID) IsValid() bool   { return s != SpanID{} }
+
+// SpanContext: what is propagated between services
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+	Remote     bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&flagSampled != 0
+}
+
+// Traceparent formats sc as a version 00 traceparent header
+func (sc SpanContext) Traceparent() string {
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+// ParseTraceparent reads a traceparent header, ok is false for a malformed or all zero header
+func ParseTraceparent(h string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	// version 00 has exactly four fields, later versions may add more
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Flags = flags[0]
+	sc.Remote = true
+	return sc, sc.IsValid()
+}
+
+// SpanEvent: something that happened during a span, i.e. an error
+type SpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes map[string]interface{}
+}
+
+// Span: a timed operation, nil when tracing is off or the trace is not sampled, every method accepts nil
+type Span struct {
+	mu         sync.Mutex
+	name       string
+	kind       SpanKind
+	sc         SpanContext
+	parent     SpanID
+	start      time.Time
+	attributes map[string]interface{}
+	events     []SpanEvent
+	status     StatusCode
+	statusMsg  string
+	ended      bool
+}
+
+// SpanData: an ended span as handed to the Exporter
+type SpanData struct {
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         SpanKind               `json:"kind"`
+	StartTime    time.Time              `json:"startTime"`
+	EndTime      time.Time              `json:"endTime"`
+	DurationMs   float64                `json:"durationMs"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Events       []SpanEvent            `json:"events,omitempty"`
+	Status       StatusCode             `json:"status"`
+	StatusMsg    string                 `json:"statusMessage,omitempty"`
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// Start begins a span named name as a child of the span, or remote parent, in ctx
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if getExporter() == nil {
+		return ctx, nil
+	}
+	var parent SpanContext
+	if ps := SpanFromContext(ctx); ps != nil {
+		parent = ps.sc
+	} else if rc, ok := ctx.Value(remoteKey{}).(SpanContext); ok {
+		parent = rc
+		if !rc.IsSampled() {
+			return ctx, nil
+		}
+	}
+	s := &Span{name: name, kind: kind, start: time.Now(), status: STATUS_UNSET}
+	s.sc.Flags = flagSampled
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.TraceState = parent.TraceState
+		s.parent = parent.SpanID
+	} else {
+		rand.Read(s.sc.TraceID[:])
+	}
+	rand.Read(s.sc.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// StartChild is Start only when ctx already holds a span, for calls that would be noise as a trace of their own
+func StartChild(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if SpanFromContext(ctx) == nil {
+		return ctx, nil
+	}
+	return Start(ctx, name, kind)
+}
+
+// SpanFromContext is the span started in ctx, nil if none
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWithSpan makes s the span in ctx, nil s leaves ctx as is
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// Extract puts the remote parent of the traceparent and tracestate headers in ctx for the next Start
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, ok := ParseTraceparent(h.Get(TRACEPARENT_HEADER))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = h.Get(TRACESTATE_HEADER)
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// Inject writes the traceparent of the span, or remote parent, in ctx to h
+func Inject(ctx context.Context, h http.Header) {
+	sc, ok := spanContextOf(ctx)
+	if !ok {
+		return
+	}
+	h.Set(TRACEPARENT_HEADER, sc.Traceparent())
+	if sc.TraceState != "" {
+		h.Set(TRACESTATE_HEADER, sc.TraceState)
+	}
+}
+
+func spanContextOf(ctx context.Context) (SpanContext, bool) {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc, true
+	}
+	sc, ok := ctx.Value(remoteKey{}).(SpanContext)
+	return sc, ok
+}
+
+// SpanContext is the propagated identity of s
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttribute adds a key value, use the OpenTelemetry semantic names where one exists i.e. http.route
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.attributes == nil {
+		s.attributes = make(map[string]interface{})
+	}
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+func (s *Span) AddEvent(name string, attributes map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.events = append(s.events, SpanEvent{Name: name, Time: time.Now(), Attributes: attributes})
+	s.mu.Unlock()
+}
+
+// RecordError adds an exception event and sets the status to error, nil err does nothing
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.AddEvent("exception", map[string]interface{}{"exception.message": err.Error()})
+	s.SetStatus(STATUS_ERROR, err.Error())
+}
+
+func (s *Span) SetStatus(code StatusCode, msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.status = code
+	s.statusMsg = msg
+	s.mu.Unlock()
+}
+
+// End records the span with the Exporter, later calls do nothing
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	end := time.Now()
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	data := SpanData{
+		TraceID:    s.sc.TraceID.String(),
+		SpanID:     s.sc.SpanID.String(),
+		Name:       s.name,
+		Kind:       s.kind,
+		StartTime:  s.start,
+		EndTime:    end,
+		DurationMs: float64(end.Sub(s.start)) / float64(time.Millisecond),
+		Attributes: s.attributes,
+		Events:     s.events,
+		Status:     s.status,
+		StatusMsg:  s.statusMsg,
+	}
+	if s.parent.IsValid() {
+		data.ParentSpanID = s.parent.String()
+	}
+	s.mu.Unlock()
+	if e := getExporter(); e != nil {
+		e.ExportSpan(data)
+	}
+}
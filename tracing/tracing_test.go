@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name        string
+		header      string
+		wantOk      bool
+		wantSampled bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"surrounding space", " 00-" + traceID + "-" + spanID + "-01 ", true, true},
+		{"later version with more fields", "01-" + traceID + "-" + spanID + "-01-extra", true, true},
+		{"version 00 with more fields", "00-" + traceID + "-" + spanID + "-01-extra", false, false},
+		{"version ff", "ff-" + traceID + "-" + spanID + "-01", false, false},
+		{"empty", "", false, false},
+		{"too few fields", "00-" + traceID + "-" + spanID, false, false},
+		{"short trace id", "00-" + traceID[:30] + "-" + spanID + "-01", false, false},
+		{"short span id", "00-" + traceID + "-" + spanID[:14] + "-01", false, false},
+		{"trace id not hex", "00-" + "zz" + traceID[2:] + "-" + spanID + "-01", false, false},
+		{"span id not hex", "00-" + traceID + "-" + "zz" + spanID[2:] + "-01", false, false},
+		{"flags not hex", "00-" + traceID + "-" + spanID + "-zz", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"zero span id", "00-" + traceID + "-0000000000000000-01", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.header)
+			if ok != tt.wantOk {
+				t.Fatalf("ParseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if sc.TraceID.String() != traceID || sc.SpanID.String() != spanID || !sc.Remote || sc.IsSampled() != tt.wantSampled {
+				t.Errorf("ParseTraceparent(%q) = %+v", tt.header, sc)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceparent(header)
+	if !ok {
+		t.Fatal("ParseTraceparent refused a valid header")
+	}
+	if got := sc.Traceparent(); got != header {
+		t.Errorf("Traceparent = %q, want %q", got, header)
+	}
+
+	in := http.Header{}
+	in.Set(TRACEPARENT_HEADER, header)
+	in.Set(TRACESTATE_HEADER, "vendor=value")
+	out := http.Header{}
+	Inject(Extract(context.Background(), in), out)
+	if out.Get(TRACEPARENT_HEADER) != header || out.Get(TRACESTATE_HEADER) != "vendor=value" {
+		t.Errorf("Inject of an extracted parent = %v", out)
+	}
+}
@@ -7,9 +7,11 @@ import (
 	"net/http"
 
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/rogue-syntax/rs-goapiserver/apicontext"
 	"github.com/rogue-syntax/rs-goapiserver/apierrors"
 	"github.com/rogue-syntax/rs-goapiserver/apireturn/apierrorkeys"
+	"github.com/rogue-syntax/rs-goapiserver/rs_go_requestlogger"
 
 	"github.com/gorilla/websocket"
 )
@@ -37,10 +39,19 @@ type SocketEvent struct {
 	Data      interface{}
 }
 
+// IncomingSocketEvent
+//   - Req_id: the Req_id of the request that opened the socket, pass Context() on to
+//     rs_ev_src.DoEVEventActionContext, or wrap errors with apierrors.WithReqId, to correlate them with it
 type IncomingSocketEvent struct {
 	User_id     int
 	SocketEvent SocketEvent
 	Conn_id     uuid.UUID
+	Req_id      string
+}
+
+// Context is a background context carrying the event's Req_id
+func (ise *IncomingSocketEvent) Context() context.Context {
+	return rs_go_requestlogger.CtxWithReqId(context.Background(), ise.Req_id)
 }
 
 type ProgressEvent struct {
@@ -54,7 +65,7 @@ type ProgressEvent struct {
 func TestWS(w http.ResponseWriter, r *http.Request, ctx context.Context) {
 	usr, err := apicontext.CtxGetUser(ctx)
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
 		return
 	}
 	msg := GenericEventsMap[TEST]
@@ -66,7 +77,7 @@ func TestWS(w http.ResponseWriter, r *http.Request, ctx context.Context) {
 func WsEndpoint(w http.ResponseWriter, r *http.Request, ctx context.Context) {
 	usr, err := apicontext.CtxGetUser(ctx)
 	if err != nil {
-		apierrors.HandleError(nil, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
+		apierrors.HandleError(r, err, err.Error(), &apierrors.ReturnError{Msg: apierrorkeys.AuthorizationError, W: &w})
 		return
 	}
 
@@ -74,7 +85,7 @@ func WsEndpoint(w http.ResponseWriter, r *http.Request, ctx context.Context) {
 	wsChannel <- req
 	resp := <-req.Response
 	if resp.Err != nil {
-		apierrors.HandleError(nil, resp.Err, apierrorkeys.WebSocketError, &apierrors.ReturnError{Msg: apierrorkeys.WebSocketError, W: &w})
+		apierrors.HandleError(r, resp.Err, apierrorkeys.WebSocketError, &apierrors.ReturnError{Msg: apierrorkeys.WebSocketError, W: &w})
 		return
 	}
 }
@@ -127,6 +138,71 @@ func Channel_GetUserSockets() (map[int][]*RSSocketConnection, error) {
 	return returnMap, nil
 }
 
+// Channel_GetSocketCounts
+//   - the number of open sockets of each user with one open, for metrics
+//   - returns ctx.Err() if the manager does not answer before ctx is done, nil if websockets were never initialized
+func Channel_GetSocketCounts(ctx context.Context) (map[int]int, error) {
+	if wsChannel == nil {
+		return nil, nil
+	}
+	req := WebSocketChanReq{Type: CountSockets, Response: make(chan WebSocketChanResp, 1)}
+	select {
+	case wsChannel <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case resp := <-req.Response:
+		counts, _ := resp.Msg.(map[int]int)
+		return counts, resp.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Channel_CloseAllSockets
+//   - asks ManageWebSockets to send close frames to every socket it holds and close them
+//   - returns ctx.Err() if the manager does not answer before ctx is done
+//   - a no-op if websockets were never initialized
+func Channel_CloseAllSockets(ctx context.Context, reason string) error {
+	if wsChannel == nil {
+		return nil
+	}
+	req := WebSocketChanReq{Type: CloseAll, User_ids: nil, Msg: reason, Response: make(chan WebSocketChanResp, 1)}
+	select {
+	case wsChannel <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case resp := <-req.Response:
+		return resp.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Channel_Heartbeat
+//   - checks ManageWebSockets is receiving on its channel, for the health checks
+//   - returns ctx.Err() if the manager does not answer before ctx is done, an error if websockets were never initialized
+func Channel_Heartbeat(ctx context.Context) error {
+	if wsChannel == nil {
+		return errors.New(apierrorkeys.WebSocketError + ": websockets not initialized")
+	}
+	req := WebSocketChanReq{Type: Heartbeat, Response: make(chan WebSocketChanResp, 1)}
+	select {
+	case wsChannel <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case resp := <-req.Response:
+		return resp.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func ExampleOfProgressUpdate(userSock *websocket.Conn) {
 	var progEV ProgressEvent
 	progEV.EventName = "propSearchProgEv"
@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
+	"github.com/rogue-syntax/rs-goapiserver/apierrors"
+	"github.com/rogue-syntax/rs-goapiserver/rs_go_requestlogger"
 )
 
 func IntiWebsockets(ch chan WebSocketChanReq, incoming chan IncomingSocketEvent, logProvider LogEventProvider, disconnectCallback func(*RSSocketConnection)) {
@@ -56,6 +59,9 @@ const (
 	SocketEventUnmarshal WSChannelErrorKeys = "Socket Event Unmarshal Error"
 )
 
+// how long writing the close frames may take during shutdown, one deadline shared by every socket
+var CloseFrameTimeout = 2 * time.Second
+
 // the UserSocket channel to manage the websockets
 var wsChannel chan WebSocketChanReq
 
@@ -109,6 +115,9 @@ const (
 	SendMsg
 	GetAllSockets
 	UpdateUrl
+	CloseAll
+	CountSockets
+	Heartbeat
 )
 
 type WebSocketChanResp struct {
@@ -134,10 +143,12 @@ type WebSocketChanReq struct {
 	Sockets  chan map[int][]RSSocketConnection
 }
 
+// RSSocketConnection: Req_id is the Req_id of the request that opened the socket
 type RSSocketConnection struct {
 	Conn    *websocket.Conn
 	User_id int
 	Conn_id uuid.UUID
+	Req_id  string
 }
 
 // The managing goroutine function
@@ -187,6 +198,26 @@ func ManageWebSockets(requestChannel chan WebSocketChanReq, incomingMsgChannel c
 			resp := WebSocketChanResp{Err: nil, Msg: UserSockets, Type: SuccessMsg}
 			req.Response <- resp
 			close(req.Response)
+		case CountSockets:
+			userSocketsMutex.Lock()
+			counts := make(map[int]int, len(UserSockets))
+			for user_id, socketSlice := range UserSockets {
+				if len(socketSlice) > 0 {
+					counts[user_id] = len(socketSlice)
+				}
+			}
+			userSocketsMutex.Unlock()
+			req.Response <- WebSocketChanResp{Err: nil, Msg: counts, Type: SuccessMsg}
+			close(req.Response)
+		case Heartbeat:
+			req.Response <- WebSocketChanResp{Err: nil, Msg: "success", Type: SuccessMsg}
+			close(req.Response)
+		case CloseAll:
+			userSocketsMutex.Lock()
+			resp := CloseAllSockets(UserSockets, req.Msg)
+			userSocketsMutex.Unlock()
+			req.Response <- resp
+			close(req.Response)
 
 		}
 
@@ -204,13 +235,13 @@ func listenOnWebSocket(conn *RSSocketConnection, usr_id int, incomingMsgChannel
 		var socketEvent SocketEvent
 		err = json.Unmarshal(msg, &socketEvent)
 		if err != nil {
-			logEventProvider.LogMessage(err, string(SocketEventUnmarshal), nil)
+			logEventProvider.LogMessage(apierrors.WithReqId(err, conn.Req_id), string(SocketEventUnmarshal), nil)
 			continue
 		}
 		fmt.Println("Incoming Messgage")
 		if cbFunc, ok := WSCallbacks[socketEvent.EventName]; ok {
 			fmt.Println("Handling Incoming Message")
-			cbFunc(&IncomingSocketEvent{User_id: usr_id, SocketEvent: socketEvent, Conn_id: conn.Conn_id})
+			cbFunc(&IncomingSocketEvent{User_id: usr_id, SocketEvent: socketEvent, Conn_id: conn.Conn_id, Req_id: conn.Req_id})
 		}
 		//incomingMsgChannel <- IncomingSocketEvent{User_id: usr_id, SocketEvent: socketEvent}
 	}
@@ -241,6 +272,7 @@ func RegisterConn(UserSockets UserSocketType, r *http.Request, w http.ResponseWr
 	}
 	wsu.Conn_id = uuid.New()
 	wsu.User_id = usr_id
+	wsu.Req_id, _ = rs_go_requestlogger.CtxGetReqId(r.Context())
 	UserSockets[usr_id] = append(socketList, &wsu)
 	msgBytes, _ := json.Marshal(SocketEvent{EventKey: GenericEventsMap[CONNECTED].EventKey, EventName: GenericEventsMap[CONNECTED].EventName, Data: "Client Connected"})
 	msg := string(msgBytes)
@@ -290,6 +322,41 @@ func MsgUsers(UserSockets UserSocketType, user_ids []int, msg *string) WebSocket
 	return resp
 }
 
+// CloseAllSockets
+//   - sends a going away close frame with the reason to every socket at once, then closes it
+//   - every frame shares one CloseFrameTimeout deadline, so slow peers can not add up past the shutdown's CloseTimeout
+//   - empties UserSockets, called by ManageWebSockets on a CloseAll request during shutdown
+func CloseAllSockets(UserSockets UserSocketType, reason string) WebSocketChanResp {
+	var firstErr error
+	var errMu sync.Mutex
+	setErr := func(err error) {
+		errMu.Lock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		errMu.Unlock()
+	}
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	deadline := time.Now().Add(CloseFrameTimeout)
+	var wg sync.WaitGroup
+	for user_id, socketSlice := range UserSockets {
+		for _, ws := range socketSlice {
+			wg.Add(1)
+			go func(ws *RSSocketConnection) {
+				defer wg.Done()
+				setErr(ws.Conn.WriteControl(websocket.CloseMessage, closeMsg, deadline))
+				setErr(ws.Conn.Close())
+			}(ws)
+		}
+		delete(UserSockets, user_id)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return WebSocketChanResp{Err: firstErr, Msg: WebSocketError, Type: ErrorKey}
+	}
+	return WebSocketChanResp{Err: nil, Msg: "success", Type: SuccessMsg}
+}
+
 func HandleIncomingWebSockets(incomingMsgChannel chan IncomingSocketEvent) {
 
 	defer func() {
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,6 +16,12 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+// lumberjack log files, rotated backups sit beside them, see the logquery package
+const (
+	ERROR_LOG_FILE   = "/var/logs/apiserver.log"
+	REQUEST_LOG_FILE = "/var/logs/requestLogger.log"
+)
+
 var once sync.Once
 
 var error_logger zerolog.Logger
@@ -54,7 +61,7 @@ func GetErrorLogger() zerolog.Logger {
 
 		//if os.Getenv("APP_ENV") != "development" {
 		fileLogger := &lumberjack.Logger{
-			Filename:   "/var/logs/apiserver.log",
+			Filename:   ERROR_LOG_FILE,
 			MaxSize:    5, //
 			MaxBackups: 10,
 			MaxAge:     14,
@@ -71,6 +78,7 @@ func GetErrorLogger() zerolog.Logger {
 	return error_logger
 }
 
+// LogError logs err with the Req_id of r, if r is not nil
 func LogError(err *error, msg string, r *http.Request) string {
 	if r != nil {
 		log_id, _ := rs_go_requestlogger.CtxGetReqId(r.Context())
@@ -81,8 +89,24 @@ func LogError(err *error, msg string, r *http.Request) string {
 	return logStr
 }
 
+// LogErrorReqId logs err with a Req_id, i.e. from an rs_ev_src event or websocket callback, empty for none
+func LogErrorReqId(err *error, msg string, req_id string) string {
+	if req_id != "" {
+		logStr := error_logger.Error().CallingFunc().Stack().Err(*err).Str("Req_id", req_id).Msg(msg)
+		return logStr
+	}
+	logStr := error_logger.Error().CallingFunc().Stack().Err(*err).Msg(msg)
+	return logStr
+}
+
+// LogEvent logs a lifecycle message i.e. shutdown starting, with no level so the error logger's level does not drop it
+func LogEvent(msg string) string {
+	logger := GetErrorLogger()
+	return logger.Log().Msg(msg)
+}
+
 var ReqLogger = &lumberjack.Logger{
-	Filename:   "/var/logs/requestLogger.log",
+	Filename:   REQUEST_LOG_FILE,
 	MaxSize:    5, //
 	MaxBackups: 10,
 	MaxAge:     14,
@@ -119,6 +143,10 @@ func GetReqLogger() zerolog.Logger {
 func LogRequest(msg string) string {
 	//log := req_logger.Log().Str("req", msg).Msg(msg)
 	msgStr := msg
+	// one entry per line
+	if !strings.HasSuffix(msgStr, "\n") {
+		msgStr += "\n"
+	}
 	ReqLogger.Write([]byte(msgStr))
 	return msg
 }